@@ -38,6 +38,10 @@ var (
 	testType string // Provided by --type
 	testCryogenicFlag bool // Provided by --cryogenic
 	testPolarimeter int // Provided by --polarimeter
+	testCampaign string // Provided by --campaign
+	testParameters []string // Provided by --param
+	testDuplicates string // Provided by --duplicates
+	testCheckData bool // Provided by --check-data
 )
 
 // testInfoInteractive fills the variables named "test*" (see above)
@@ -122,7 +126,23 @@ argument must be one of the following words:
    * cryo: the test was done at cryogenic temperatures.
 
 Any other argument is assumed to specify attachments to be associated
-with the test.`,
+with the test.
+
+If a campaign is open (see "stdb campaign"), the test is associated
+with it, unless --campaign is used.
+
+Parameters of the test (bias voltages, RF power, etc.) can be specified
+using --param once for each of them, e.g.:
+
+   stdb add --param vdrain=0.8V --param rf_power=-30dBm --param lna=on ...
+
+Parameters can be used with "stdb search".
+
+If the file has already been imported, the test is rejected. This can
+be changed using --duplicates, or setting the property
+"duplicate_policy" (see "stdb property"). The flag --check-data
+compares the samples as well, in order to detect the same data
+exported in different files.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) < 2 {
 			log.Fatal("you must specify the full path of the file containing the data" +
@@ -145,10 +165,15 @@ with the test.`,
 			log.Fatal(err)
 		}
 
-		dbpath := cmd.Flag("dbpath").Value.String()
+		dbpath := singleDatabasePath(cmd)
 		username := cmd.Flag("username").Value.String()
 
-		conn := db.Connection{}
+		conn := db.Connection{
+			DuplicatePolicy: db.DuplicatePolicy(testDuplicates),
+		}
+		if cmd.Flags().Changed("check-data") {
+			conn.CheckDataDuplicates = &testCheckData
+		}
 		if err := conn.Connect(dbpath); err != nil {
 			log.Fatal(err)
 		}
@@ -162,12 +187,36 @@ with the test.`,
 			CryogenicFlag: testCryogenicFlag,
 			Polarimeter: testPolarimeter,
 		}
+		for _, curParam := range testParameters {
+			param, err := db.ParseParameter(curParam)
+			if err != nil {
+				log.Fatal(err)
+			}
+			newTest.Parameters = append(newTest.Parameters, param)
+		}
+		if testCampaign != "" {
+			var campaign db.Campaign
+			if err := conn.GetCampaignByName(testCampaign, &campaign); err != nil {
+				log.Fatal(err)
+			}
+			newTest.CampaignID = campaign.ID
+		}
 		testID, err := conn.AddTest(&newTest, username, testFile)
 		if err != nil {
 			log.Fatalf("unable to add file \"%s\": %v", testFile, err)
 		}
 
-		log.Printf("new test with ID %d has been created", testID)
+		log.Printf("new test with ID %d (UUID %s) has been created", testID, newTest.UUID)
+		if len(newTest.DuplicateOf) > 0 {
+			log.Printf("warning: the same data are contained in test(s) %v", newTest.DuplicateOf)
+		}
+
+		for _, curAttachment := range args[2:] {
+			if _, err := conn.AddAttachment(testID, curAttachment, username); err != nil {
+				log.Fatalf("unable to attach file \"%s\": %v", curAttachment, err)
+			}
+			log.Printf("file \"%s\" has been attached to the test", curAttachment)
+		}
 	},
 }
 
@@ -177,6 +226,10 @@ func init() {
 	addCmd.Flags().StringVar(&testShortName, "shortname", "", "Short name of the test")
 	addCmd.Flags().StringVar(&testDescription, "description", "", "Long description of the test")
 	addCmd.Flags().StringVar(&testUsername, "username", "", "Name of the user which is uploading the test")
-	addCmd.Flags().StringVar(&testType, "type", "", "Type of the test (refer to the test plan report)")
-	addCmd.Flags().IntVar(&testPolarimeter, "polarimeter", 0, "Number of the polarimeter being tested")
+	addCmd.Flags().StringVar(&testType, "type", "", "Type of the test (refer to the test plan report, or run \"stdb testtype list\")")
+	addCmd.Flags().StringVar(&testCampaign, "campaign", "", "Name of the campaign the test belongs to (default is the open one)")
+	addCmd.Flags().StringArrayVar(&testParameters, "param", []string{}, "Parameter of the test, in the form name=value[unit] (can be repeated)")
+	addCmd.Flags().StringVar(&testDuplicates, "duplicates", "", "What to do if the data have already been imported (reject, warn, link)")
+	addCmd.Flags().BoolVar(&testCheckData, "check-data", false, "Compare the samples too when looking for duplicates")
+	addCmd.Flags().IntVar(&testPolarimeter, "polarimeter", 0, "Number of the polarimeter being tested (see \"stdb polarimeter\")")
 }
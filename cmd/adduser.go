@@ -75,7 +75,7 @@ This command requires a working tty terminal.`,
 			log.Printf("unexpected arguments %v", args)
 		}
 
-		dbpath := cmd.Flag("dbpath").Value.String()
+		dbpath := singleDatabasePath(cmd)
 		username := cmd.Flag("username").Value.String()
 		email := cmd.Flag("email").Value.String()
 		fullname := cmd.Flag("fullname").Value.String()
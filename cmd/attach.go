@@ -0,0 +1,57 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+// attachCmd represents the attach command
+var attachCmd = &cobra.Command{
+	Use:   "attach TEST_ID FILE...",
+	Short: "Attach one or more files to an existing test",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 2 {
+			log.Fatal("you must specify the ID of the test and at least one file")
+		}
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+		testID := parseTestID(conn, args)
+
+		for _, curFile := range args[1:] {
+			id, err := conn.AddAttachment(testID, curFile, username)
+			if err != nil {
+				log.Fatalf("unable to attach file \"%s\": %v", curFile, err)
+			}
+			log.Printf("file \"%s\" has been attached to test %d with ID %d", curFile, testID, id)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(attachCmd)
+
+	attachCmd.Flags().String("username", "", "Name of the user performing the operation")
+}
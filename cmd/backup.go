@@ -0,0 +1,105 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"log"
+
+	"github.com/lspestrip/stdb/db"
+	"github.com/spf13/cobra"
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup ARCHIVE",
+	Short: "Save a copy of the database and of its files",
+	Long: `Save a consistent copy of the database, of the FITS files and of the
+attachments in a single archive (a .tar.gz file), which contains a
+manifest with the checksum of each file. The backup can be done while
+the database is being used.
+
+If --since is used, the backup is incremental: only the files that are
+not in the specified archive are saved. Use "stdb restore" to recreate
+the database.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("you must specify the name of the archive to create")
+		}
+		since := cmd.Flag("since").Value.String()
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		manifest, err := conn.Backup(args[0], since, username)
+		if err != nil {
+			log.Fatalf("unable to save the backup: %v", err)
+		}
+		log.Printf("backup %s saved in \"%s\" (%d files, %d objects in the database)",
+			manifest.ID, args[0], len(manifest.Files), len(manifest.Blobs))
+	},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore ARCHIVE...",
+	Short: "Recreate a database from one or more backups",
+	Long: `Recreate the database in the folder specified by --dbpath (which must
+not exist) from the archives produced by "stdb backup". The first
+archive must be a full backup, followed by the chain of incremental
+backups based on it, in the order they were made. All the archives are
+verified before the database is created.
+
+If --check is used, the archives are only verified.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.Fatal("you must specify at least one archive")
+		}
+
+		if check, _ := cmd.Flags().GetBool("check"); check {
+			for _, curName := range args {
+				manifest, err := db.VerifyBackup(curName)
+				if err != nil {
+					log.Fatalf("archive \"%s\" is not valid: %v", curName, err)
+				}
+				log.Printf("archive \"%s\" (backup %s, %s) is valid",
+					curName, manifest.ID, manifest.CreationDate.Format("2006-01-02 15:04:05"))
+			}
+			return
+		}
+
+		dbpath := singleDatabasePath(cmd)
+		manifest, err := db.RestoreBackup(dbpath, args)
+		if err != nil {
+			log.Fatalf("unable to restore the database: %v", err)
+		}
+		log.Printf("database restored in \"%s\" from backup %s", dbpath, manifest.ID)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(backupCmd)
+	RootCmd.AddCommand(restoreCmd)
+
+	backupCmd.Flags().String("since", "", "Make an incremental backup based on this archive")
+	backupCmd.Flags().String("username", "", "Name of the user performing the operation")
+	restoreCmd.Flags().Bool("check", false, "Only verify the archives")
+}
@@ -0,0 +1,222 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
+)
+
+var (
+	campaignCryostat string // Provided by --cryostat
+	campaignOperator string // Provided by --operator
+	campaignNotes    string // Provided by --notes
+	campaignDate     string // Provided by --date
+)
+
+// parseCampaignDate interprets the value of the --date flag. An empty
+// string means "now".
+func parseCampaignDate(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if date, err := time.Parse(layout, s); err == nil {
+			return date.UTC()
+		}
+	}
+
+	log.Fatalf("invalid date \"%s\", use the format YYYY-MM-DD[THH:MM:SS]", s)
+	return time.Time{}
+}
+
+// formatCampaignDate prints the date of a campaign, or "open" if the date
+// is not set
+func formatCampaignDate(date time.Time) string {
+	if date.IsZero() {
+		return "open"
+	}
+	return date.Format("2006-01-02 15:04")
+}
+
+// campaignCmd represents the campaign command
+var campaignCmd = &cobra.Command{
+	Use:   "campaign",
+	Short: "Manage test campaigns and cryogenic cooldowns",
+	Long: `Open, close and list the campaigns used to group tests.
+
+While a campaign is open, every test added to the database
+using the "add" command is automatically associated with it.
+Only one campaign can be open at any time.`,
+}
+
+var campaignOpenCmd = &cobra.Command{
+	Use:   "open NAME",
+	Short: "Start a new campaign",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("you must specify the name of the campaign")
+		}
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		campaign := db.Campaign{
+			Name:      args[0],
+			StartDate: parseCampaignDate(campaignDate),
+			Cryostat:  campaignCryostat,
+			Operator:  campaignOperator,
+			Notes:     campaignNotes,
+		}
+		id, err := conn.OpenCampaign(&campaign, username)
+		if err != nil {
+			log.Fatalf("unable to open campaign \"%s\": %v", args[0], err)
+		}
+
+		log.Printf("campaign \"%s\" has been opened with ID %d", args[0], id)
+	},
+}
+
+var campaignCloseCmd = &cobra.Command{
+	Use:   "close [NAME]",
+	Short: "Close a campaign (by default, the one currently open)",
+	Run: func(cmd *cobra.Command, args []string) {
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		var campaign db.Campaign
+		switch len(args) {
+		case 0:
+			isOpen, err := conn.GetOpenCampaign(&campaign)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !isOpen {
+				log.Fatal("no campaign is open")
+			}
+		case 1:
+			if err := conn.GetCampaignByName(args[0], &campaign); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatalf("unexpected arguments %v", args[1:])
+		}
+
+		if err := conn.CloseCampaign(campaign.ID, parseCampaignDate(campaignDate), username); err != nil {
+			log.Fatalf("unable to close campaign \"%s\": %v", campaign.Name, err)
+		}
+
+		log.Printf("campaign \"%s\" has been closed", campaign.Name)
+	},
+}
+
+var campaignListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Print the list of campaigns",
+	Run: func(cmd *cobra.Command, args []string) {
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		campaigns, err := conn.GetListOfCampaigns(username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("%-4s %-24s %-16s %-16s %-12s %s\n",
+			"ID", "Name", "Start", "End", "Cryostat", "Operator")
+		for _, curCampaign := range campaigns {
+			fmt.Printf("%-4d %-24s %-16s %-16s %-12s %s\n",
+				curCampaign.ID, curCampaign.Name,
+				formatCampaignDate(curCampaign.StartDate), formatCampaignDate(curCampaign.EndDate),
+				curCampaign.Cryostat, curCampaign.Operator)
+		}
+	},
+}
+
+var campaignShowCmd = &cobra.Command{
+	Use:   "show NAME",
+	Short: "Print a summary of the tests done during a campaign",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("you must specify the name of the campaign")
+		}
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		var campaign db.Campaign
+		if err := conn.GetCampaignByName(args[0], &campaign); err != nil {
+			log.Fatal(err)
+		}
+
+		summary, err := conn.GetCampaignSummary(campaign.ID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Campaign:     %s (ID %d)\n", campaign.Name, campaign.ID)
+		fmt.Printf("Start:        %s\n", formatCampaignDate(campaign.StartDate))
+		fmt.Printf("End:          %s\n", formatCampaignDate(campaign.EndDate))
+		fmt.Printf("Cryostat:     %s\n", campaign.Cryostat)
+		fmt.Printf("Operator:     %s\n", campaign.Operator)
+		fmt.Printf("Notes:        %s\n", campaign.Notes)
+		fmt.Printf("Tests:        %d (%d cryogenic)\n", summary.NumOfTests, summary.CryogenicTests)
+		fmt.Printf("Polarimeters: %v\n", summary.Polarimeters)
+
+		testTypes := make([]string, 0, len(summary.TestTypes))
+		for curType := range summary.TestTypes {
+			testTypes = append(testTypes, curType)
+		}
+		sort.Strings(testTypes)
+		for _, curType := range testTypes {
+			fmt.Printf("  %-10s %d\n", curType, summary.TestTypes[curType])
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(campaignCmd)
+	campaignCmd.AddCommand(campaignOpenCmd)
+	campaignCmd.AddCommand(campaignCloseCmd)
+	campaignCmd.AddCommand(campaignListCmd)
+	campaignCmd.AddCommand(campaignShowCmd)
+
+	campaignCmd.PersistentFlags().String("username", "", "Name of the user performing the operation")
+
+	campaignOpenCmd.Flags().StringVar(&campaignCryostat, "cryostat", "", "Cryostat used during the campaign")
+	campaignOpenCmd.Flags().StringVar(&campaignOperator, "operator", "", "Person in charge of the campaign")
+	campaignOpenCmd.Flags().StringVar(&campaignNotes, "notes", "", "Free-form notes")
+	for _, curCmd := range []*cobra.Command{campaignOpenCmd, campaignCloseCmd} {
+		curCmd.Flags().StringVar(&campaignDate, "date", "", "Date of the event (default is now)")
+	}
+}
@@ -21,19 +21,92 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
 )
 
+// printProblems prints the problems found in the database, and returns
+// the number of errors that have not been fixed
+func printProblems(problems []db.Problem) int {
+	numOfErrors := 0
+	for _, curProblem := range problems {
+		status := ""
+		if curProblem.Fixed {
+			status = " [fixed]"
+		} else if curProblem.Fixable {
+			status = " [use --fix to fix it]"
+		}
+		fmt.Printf("%-7s  %s: %s%s\n", curProblem.Severity, curProblem.Object,
+			curProblem.Message, status)
+
+		if curProblem.Severity == db.SeverityError && !curProblem.Fixed {
+			numOfErrors++
+		}
+	}
+	return numOfErrors
+}
+
 // checkdbCmd represents the checkdb command
 var checkdbCmd = &cobra.Command{
 	Use:   "checkdb",
 	Short: "Perform a consistency check on the database",
-	Long: `Analyze the database and look for inconsistencies or
-weird settings (e.g., missing attachments, no active users, etc.).`,
+	Long: `Analyze the database and look for inconsistencies: tests without
+FITS files, files not used by any test, files whose checksum does not
+match, data whose column statistics have not been computed (e.g.,
+because they were imported by an older version of stdb), attachments
+associated with missing tests, users with no password, dates that
+cannot be parsed, and a schema version different from the one used by
+this program.
+
+Each problem is printed together with its severity (info, warning or
+error). If --fix is specified, the database is upgraded to the current
+version of the schema, and the problems that can be fixed without
+losing data are fixed: missing checksums and column statistics are
+computed (this requires to read the FITS files), dangling rows
+are removed, users with no password are disabled, and unused previews
+are deleted. Unused data files and attachments are only reported, as
+they might be the only copy of something missing from the index. The
+program exits with a non-zero status if some errors have not been
+fixed.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		log.Print("check called")
+		fix, _ := cmd.Flags().GetBool("fix")
+		quick, _ := cmd.Flags().GetBool("quick")
+		username := cmd.Flag("username").Value.String()
+
+		// Without --fix, the database must not be upgraded to the current
+		// version of the schema, so that a mismatch can be reported
+		var conn *db.Connection
+		if fix {
+			conn = connectToDatabase(cmd)
+		} else {
+			conn = &db.Connection{}
+			if err := conn.ConnectForCheck(singleDatabasePath(cmd)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		defer conn.Disconnect()
+
+		report, err := conn.Check(db.CheckOptions{Fix: fix, SkipChecksums: quick}, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		numOfErrors := printProblems(report.Problems)
+
+		log.Printf("%d errors, %d warnings, %d notes",
+			report.Count(db.SeverityError),
+			report.Count(db.SeverityWarning),
+			report.Count(db.SeverityInfo))
+
+		if numOfErrors > 0 {
+			conn.Disconnect()
+			os.Exit(1)
+		}
 	},
 }
 
@@ -41,4 +114,6 @@ func init() {
 	RootCmd.AddCommand(checkdbCmd)
 
 	checkdbCmd.Flags().Bool("fix", false, "Automatically fix as many errors as possible")
+	checkdbCmd.Flags().Bool("quick", false, "Do not verify the checksums of the files")
+	checkdbCmd.Flags().String("username", "", "Name of the user performing the operation")
 }
@@ -0,0 +1,149 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
+)
+
+var (
+	commentReplyTo int    // Provided by --reply-to
+	commentFile    string // Provided by --file
+)
+
+// parseTestID interprets the first argument of a command as the ID or the
+// UUID of a test
+func parseTestID(conn *db.Connection, args []string) int {
+	if len(args) < 1 {
+		log.Fatal("you must specify the ID of the test")
+	}
+
+	testID, err := conn.ResolveTestID(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return testID
+}
+
+// commentCmd represents the comment command
+var commentCmd = &cobra.Command{
+	Use:   "comment",
+	Short: "Read and write comments about tests",
+	Long: `Add comments to a test and print the discussion threads
+associated with it. Comments are written using Markdown.`,
+}
+
+var commentAddCmd = &cobra.Command{
+	Use:   "add TEST_ID [TEXT...]",
+	Short: "Add a comment to a test",
+	Long: `Add a comment to the test with ID TEST_ID. The text of the
+comment is either given on the command line or read from the
+file specified by --file ("-" means the standard input). The
+flag --username is mandatory, as it specifies the author.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.Fatal("you must specify the ID of the test")
+		}
+		username := cmd.Flag("username").Value.String()
+		if username == "" {
+			log.Fatal("you must specify the author of the comment using --username")
+		}
+
+		body := strings.Join(args[1:], " ")
+		if commentFile != "" {
+			var (
+				contents []byte
+				err      error
+			)
+			if commentFile == "-" {
+				contents, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				contents, err = ioutil.ReadFile(commentFile)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			body = string(contents)
+		}
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+		testID := parseTestID(conn, args)
+
+		comment := db.Comment{
+			TestID:   testID,
+			Username: username,
+			Body:     body,
+			ReplyTo:  commentReplyTo,
+		}
+		id, err := conn.AddComment(&comment)
+		if err != nil {
+			log.Fatalf("unable to add the comment: %v", err)
+		}
+
+		log.Printf("comment %d has been added to test %d", id, testID)
+	},
+}
+
+var commentListCmd = &cobra.Command{
+	Use:   "list TEST_ID",
+	Short: "Print the comments of a test",
+	Run: func(cmd *cobra.Command, args []string) {
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+		testID := parseTestID(conn, args)
+
+		comments, err := conn.GetComments(testID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, curComment := range comments {
+			indent := strings.Repeat("    ", curComment.Depth)
+			fmt.Printf("%s[%d] %s, %s\n", indent, curComment.ID, curComment.Username,
+				curComment.CreationDate.Format("2006-01-02 15:04"))
+			for _, curLine := range strings.Split(curComment.Body, "\n") {
+				fmt.Printf("%s  %s\n", indent, curLine)
+			}
+			fmt.Println()
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(commentCmd)
+	commentCmd.AddCommand(commentAddCmd)
+	commentCmd.AddCommand(commentListCmd)
+
+	commentCmd.PersistentFlags().String("username", "", "Name of the user performing the operation")
+
+	commentAddCmd.Flags().IntVar(&commentReplyTo, "reply-to", 0, "ID of the comment this is a reply to")
+	commentAddCmd.Flags().StringVar(&commentFile, "file", "", "Read the text of the comment from a file (\"-\" for the standard input)")
+}
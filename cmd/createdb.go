@@ -34,7 +34,7 @@ another one.)`,
 			log.Fatalf("unexpected arguments in the command line: %v", args)
 		}
 		
-		dbpath := cmd.Flag("dbpath").Value.String()
+		dbpath := singleDatabasePath(cmd)
 
 		var overwriteMode db.CreationMode
 		if overwriteFlag {
@@ -0,0 +1,60 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+// duplicatesCmd represents the duplicates command
+var duplicatesCmd = &cobra.Command{
+	Use:   "duplicates",
+	Short: "Print the tests whose data have been imported more than once",
+	Long: `Look for tests that have been created from the same input file
+("source"), or whose samples are the same ("data"). Tests imported
+with versions of stdb older than 0.9.0 are not considered.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		groups, err := conn.FindDuplicateTests()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(groups) == 0 {
+			fmt.Println("No duplicates found")
+			return
+		}
+
+		fmt.Printf("%-8s %-18s %s\n", "Kind", "Checksum", "Tests")
+		for _, curGroup := range groups {
+			fmt.Printf("%-8s %-18s %v\n", curGroup.Kind, curGroup.Checksum[:16], curGroup.TestIDs)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(duplicatesCmd)
+}
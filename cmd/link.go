@@ -0,0 +1,96 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"log"
+	"strings"
+
+	"github.com/lspestrip/stdb/db"
+	"github.com/spf13/cobra"
+)
+
+// parseLinkArgs interprets the arguments of the "link" and "unlink" commands
+func parseLinkArgs(conn *db.Connection, args []string) (int, string, int) {
+	if len(args) != 3 {
+		log.Fatal("you must specify the source test, the relationship and the target test")
+	}
+
+	sourceID := parseTestID(conn, args[0:1])
+	targetID := parseTestID(conn, args[2:3])
+
+	return sourceID, strings.ToLower(args[1]), targetID
+}
+
+// linkCmd represents the link command
+var linkCmd = &cobra.Command{
+	Use:   "link SOURCE RELATION TARGET",
+	Short: "Create a relationship between two tests",
+	Long: `Record that the test with ID SOURCE is related to the test
+with ID TARGET. RELATION must be one of the following:
+
+   * repeats: SOURCE is a repetition of TARGET;
+   * supersedes: SOURCE replaces TARGET, which should not be used;
+   * reference-for: SOURCE is the baseline used to analyze TARGET;
+   * same-setup-as: the two tests share the same setup;
+   * duplicate-of: SOURCE contains the same data as TARGET.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+		sourceID, relation, targetID := parseLinkArgs(conn, args)
+
+		if err := conn.LinkTests(sourceID, relation, targetID, username); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("test %d %s test %d", sourceID, relation, targetID)
+	},
+}
+
+// unlinkCmd represents the unlink command
+var unlinkCmd = &cobra.Command{
+	Use:   "unlink SOURCE RELATION TARGET",
+	Short: "Remove a relationship between two tests",
+	Run: func(cmd *cobra.Command, args []string) {
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+		sourceID, relation, targetID := parseLinkArgs(conn, args)
+
+		if err := conn.UnlinkTests(sourceID, relation, targetID, username); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("relationship between tests %d and %d has been removed", sourceID, targetID)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(linkCmd)
+	RootCmd.AddCommand(unlinkCmd)
+
+	for _, curCmd := range []*cobra.Command{linkCmd, unlinkCmd} {
+		curCmd.Flags().String("username", "", "Name of the user performing the operation")
+	}
+}
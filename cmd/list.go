@@ -0,0 +1,118 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
+)
+
+var (
+	listOptions  db.ListOptions // Filled by the flags of the command
+	listCampaign string         // Provided by --campaign
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Print a page of the list of tests",
+	Long: `Print the tests in the database, sorted by the key specified by
+--sort ("id", "date", "polarimeter", "type", or "name"). Long lists
+can be split in pages using --limit: the command prints a cursor
+at the end of each page, which can be passed to --after to get the
+next one. Listing tests does not add entries to the log.
+
+If more than one database is passed to --dbpath, the tests of all of
+them are listed together; in this case, use --offset instead of
+--after to get the following pages.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listOptions.CampaignName = listCampaign
+
+		var (
+			entries []db.FederatedEntry
+			total   int
+			cursor  string
+		)
+		if len(databasePaths(cmd)) == 1 {
+			conn := connectToDatabase(cmd)
+			defer conn.Disconnect()
+
+			page, err := conn.ListTests(listOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, curEntry := range page.Tests {
+				entries = append(entries, db.FederatedEntry{TestEntry: curEntry})
+			}
+			total, cursor = page.Total, page.NextCursor
+		} else {
+			fed := openFederation(cmd)
+			defer fed.Close()
+
+			page, err := fed.ListTests(listOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+			entries, total = page.Tests, page.Total
+		}
+
+		printTestEntries(entries)
+		fmt.Printf("\n%d tests shown out of %d\n", len(entries), total)
+		if cursor != "" {
+			fmt.Printf("Next page: --after %s\n", cursor)
+		}
+	},
+}
+
+// printTestEntries prints a table with the tests in "entries". The
+// database containing each test is printed only if it is known.
+func printTestEntries(entries []db.FederatedEntry) {
+	federated := len(entries) > 0 && entries[0].Database != ""
+
+	if federated {
+		fmt.Printf("%-24s ", "Database")
+	}
+	fmt.Printf("%-6s %-12s %-8s %-24s %s\n", "ID", "Date", "Pol", "Type", "Name")
+	for _, curEntry := range entries {
+		if federated {
+			fmt.Printf("%-24s ", curEntry.Database)
+		}
+		fmt.Printf("%-6d %-12s %-8d %-24s %s\n",
+			curEntry.ID, curEntry.Test.CreationDate.Format("2006-01-02"),
+			curEntry.Test.Polarimeter, curEntry.Test.TestType, curEntry.Test.ShortName)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().StringVar(&listOptions.Sort, "sort", db.SortByID, "Key used to sort the tests")
+	listCmd.Flags().BoolVar(&listOptions.Descending, "desc", false, "Sort the tests in descending order")
+	listCmd.Flags().IntVar(&listOptions.Limit, "limit", 20, "Maximum number of tests to print (zero means no limit)")
+	listCmd.Flags().IntVar(&listOptions.Offset, "offset", 0, "Number of tests to skip")
+	listCmd.Flags().StringVar(&listOptions.After, "after", "", "Cursor printed at the end of the previous page")
+	listCmd.Flags().StringVar(&listCampaign, "campaign", "", "Name of the campaign")
+	listCmd.Flags().IntVar(&listOptions.Polarimeter, "polarimeter", 0, "Number of the polarimeter")
+}
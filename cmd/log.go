@@ -0,0 +1,171 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
+)
+
+var (
+	logFilter db.LogFilter // Filled by the flags of "stdb log"
+	logSince  string       // Provided by --since
+	logUntil  string       // Provided by --until
+)
+
+// parseLogTime interprets "s" either as a date ("2017-05-18"), as a date
+// and time in RFC 3339 format ("2017-05-18T10:38:25Z"), or as a time in
+// the past relative to now ("12h", "30d"). An empty string is the zero time.
+func parseLogTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	}
+	if duration, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return date, nil
+	}
+	if date, err := time.Parse(time.RFC3339, s); err == nil {
+		return date, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time \"%s\"", s)
+}
+
+// logCmd represents the log command
+var logCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Print the entries of the log",
+	Long: `Print the entries of the log matching all the conditions specified
+through the flags, from the most recent to the oldest. Times passed to
+--since and --until can be dates ("2017-05-18"), dates and times in
+RFC 3339 format ("2017-05-18T10:38:25Z"), or intervals before now
+("12h", "30d"). Actions are "read", "create", "update", "delete",
+"login", "logout", and "message".`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		if logFilter.Since, err = parseLogTime(logSince); err != nil {
+			log.Fatal(err)
+		}
+		if logFilter.Until, err = parseLogTime(logUntil); err != nil {
+			log.Fatal(err)
+		}
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		entries, err := conn.QueryLog(logFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, curEntry := range entries {
+			object := curEntry.ObjectType
+			if curEntry.ObjectID != "" {
+				object += " " + curEntry.ObjectID
+			}
+			client := curEntry.ClientAddress
+			if client == "" {
+				client = "-"
+			}
+			fmt.Printf("%s  %-12s %-15s %-8s %-7s %-20s %s\n",
+				curEntry.Date.Local().Format("2006-01-02 15:04:05"), curEntry.Username, client,
+				curEntry.Action, curEntry.Outcome, object, curEntry.Message)
+		}
+	},
+}
+
+// logPruneCmd represents the "log prune" command
+var logPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove old \"read\" entries from the log",
+	Long: `Remove the entries of the log recording read accesses that are older
+than the number of days specified by --days. If --days is not used,
+the value of the property "log_read_retention_days" is used (90 days,
+if the property is not set). If --archive is used, the entries are
+appended to the specified file as JSON objects, one per line, before
+being removed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		username := cmd.Flag("username").Value.String()
+		archiveName := cmd.Flag("archive").Value.String()
+		days, _ := cmd.Flags().GetInt("days")
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		if days <= 0 {
+			var err error
+			if days, err = conn.ReadLogRetention(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		var archive io.Writer
+		if archiveName != "" {
+			f, err := os.OpenFile(archiveName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			archive = f
+		}
+
+		count, err := conn.PruneLog(time.Now().AddDate(0, 0, -days), archive, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%d entries older than %d days have been removed from the log", count, days)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(logCmd)
+	logCmd.AddCommand(logPruneCmd)
+
+	logCmd.Flags().StringVar(&logSince, "since", "", "Only print entries written after this time")
+	logCmd.Flags().StringVar(&logUntil, "until", "", "Only print entries written before this time")
+	logCmd.Flags().StringVar(&logFilter.Username, "user", "", "Only print the actions of this user")
+	logCmd.Flags().StringVar(&logFilter.Action, "action", "", "Only print this kind of action")
+	logCmd.Flags().StringVar(&logFilter.ObjectType, "object", "", "Only print actions on this kind of object (\"test\", \"user\", ...)")
+	logCmd.Flags().StringVar(&logFilter.ObjectID, "id", "", "Only print actions on the object with this ID")
+	logCmd.Flags().StringVar(&logFilter.Outcome, "outcome", "", "Only print actions with this outcome (\"success\" or \"failure\")")
+	logCmd.Flags().IntVar(&logFilter.Limit, "limit", 100, "Maximum number of entries to print (zero means no limit)")
+
+	logPruneCmd.Flags().Int("days", 0, "Remove the entries older than this number of days")
+	logPruneCmd.Flags().String("archive", "", "Append the removed entries to this file")
+	logPruneCmd.Flags().String("username", "", "Name of the user performing the operation")
+}
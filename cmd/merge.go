@@ -0,0 +1,113 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lspestrip/stdb/db"
+	"github.com/spf13/cobra"
+)
+
+// mergeCmd represents the merge command
+var mergeCmd = &cobra.Command{
+	Use:   "merge",
+	Short: "Import the contents of another database",
+	Long: `Import the tests, users, attachments and log messages of the
+database specified by --from into the database specified by --dbpath.
+Merged tests get new IDs; the ID of the source database and the
+original ID of each test are recorded. Merging the same database again
+only imports the tests added since the previous merge.
+
+Users with the same name in both databases must have the same email
+address. If they do not, use --map-user OLD=NEW to rename users of the
+source database (NEW can be an existing user). Tests whose data are
+already in the database are handled according to --duplicates.
+
+The database specified by --from is never modified. If it was created
+by an older version of stdb, upgrade it first (e.g., with "stdb checkdb
+--fix").`,
+	Run: func(cmd *cobra.Command, args []string) {
+		from := cmd.Flag("from").Value.String()
+		if from == "" {
+			log.Fatal("you must specify the database to merge using --from")
+		}
+		username := cmd.Flag("username").Value.String()
+
+		options := db.MergeOptions{UserMap: make(map[string]string)}
+		userMap, _ := cmd.Flags().GetStringArray("map-user")
+		for _, curPair := range userMap {
+			parts := strings.SplitN(curPair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				log.Fatalf("invalid user mapping \"%s\", it must be in the form OLD=NEW", curPair)
+			}
+			options.UserMap[parts[0]] = parts[1]
+		}
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+		conn.DuplicatePolicy = db.DuplicatePolicy(cmd.Flag("duplicates").Value.String())
+
+		report, err := conn.MergeFrom(from, options, username)
+		if err != nil {
+			log.Fatalf("unable to merge \"%s\": %v", from, err)
+		}
+
+		oldIDs := make([]int, 0, len(report.TestIDs))
+		for oldID := range report.TestIDs {
+			oldIDs = append(oldIDs, oldID)
+		}
+		sort.Ints(oldIDs)
+		for _, oldID := range oldIDs {
+			fmt.Printf("%d -> %d\n", oldID, report.TestIDs[oldID])
+		}
+
+		log.Printf("%d tests merged from database %s, %d already present, %d log messages copied",
+			len(report.TestIDs)-len(report.AlreadyMerged), report.SourceID,
+			len(report.AlreadyMerged), report.LogEntries)
+		if len(report.NewUsers) > 0 {
+			log.Printf("new users: %s", strings.Join(report.NewUsers, ", "))
+		}
+		for newID, duplicates := range report.Duplicates {
+			log.Printf("warning, the data of test %d are the same as in test(s) %v", newID, duplicates)
+		}
+		if len(report.Rejected) > 0 {
+			log.Printf("tests %v were not merged, as their data are already in the database", report.Rejected)
+		}
+		if len(report.MissingFiles) > 0 {
+			log.Printf("warning, %d files are missing in the source database: %s",
+				len(report.MissingFiles), strings.Join(report.MissingFiles, ", "))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mergeCmd)
+
+	mergeCmd.Flags().String("from", "", "Path to the database to merge")
+	mergeCmd.Flags().StringArray("map-user", nil, "Rename a user of the source database (OLD=NEW)")
+	mergeCmd.Flags().String("duplicates", "",
+		"What to do with tests whose data are already in the database (reject, warn, link)")
+	mergeCmd.Flags().String("username", "", "Name of the user performing the operation")
+}
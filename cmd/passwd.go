@@ -43,7 +43,7 @@ This command requires a working tty terminal.`,
 			log.Printf("unexpected arguments %v", args)
 		}
 
-		dbpath := cmd.Flag("dbpath").Value.String()
+		dbpath := singleDatabasePath(cmd)
 
 		rl, err := readline.New("")
 		if err != nil {
@@ -0,0 +1,270 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
+)
+
+var (
+	polSerialNumber string // Provided by --serial
+	polModule       string // Provided by --module
+	polBoard        string // Provided by --board
+	polBand         string // Provided by --band
+	polStatus       string // Provided by --status
+	polNotes        string // Provided by --notes
+)
+
+// parsePolarimeterNumber interprets the first command-line argument as the
+// number of a polarimeter
+func parsePolarimeterNumber(args []string) int {
+	if len(args) != 1 {
+		log.Fatal("you must specify the number of the polarimeter")
+	}
+
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.Fatalf("invalid polarimeter number \"%s\"", args[0])
+	}
+
+	return number
+}
+
+// databasePaths returns the paths specified by the --dbpath flag, which
+// can contain more than one path separated by os.PathListSeparator (":" on
+// Unix systems, ";" on Windows)
+func databasePaths(cmd *cobra.Command) []string {
+	paths := filepath.SplitList(cmd.Flag("dbpath").Value.String())
+	if len(paths) == 0 {
+		return []string{"."}
+	}
+	return paths
+}
+
+// singleDatabasePath returns the path specified by the --dbpath flag, and
+// quits the program if more than one path has been specified
+func singleDatabasePath(cmd *cobra.Command) string {
+	paths := databasePaths(cmd)
+	if len(paths) != 1 {
+		log.Fatalf("command \"%s\" can only work on one database", cmd.CommandPath())
+	}
+	return paths[0]
+}
+
+// connectToDatabase opens the database specified by the --dbpath flag and
+// quits the program if this is not possible
+func connectToDatabase(cmd *cobra.Command) *db.Connection {
+	dbpath := singleDatabasePath(cmd)
+
+	conn := db.Connection{}
+	if err := conn.Connect(dbpath); err != nil {
+		log.Fatal(err)
+	}
+
+	return &conn
+}
+
+// openFederation opens all the databases specified by the --dbpath flag in
+// read-only mode, and quits the program if this is not possible
+func openFederation(cmd *cobra.Command) *db.Federation {
+	fed, err := db.OpenFederation(databasePaths(cmd))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return fed
+}
+
+// polarimeterCmd represents the polarimeter command
+var polarimeterCmd = &cobra.Command{
+	Use:   "polarimeter",
+	Short: "Manage the registry of polarimeters",
+	Long: `Add, modify and list the polarimeters known to the database.
+
+Each test must refer to a polarimeter which has already been
+registered using "stdb polarimeter add". Valid statuses are
+` + strings.Join(db.PolarimeterStatuses, ", ") + `.`,
+}
+
+var polarimeterAddCmd = &cobra.Command{
+	Use:   "add NUMBER",
+	Short: "Register a new polarimeter",
+	Run: func(cmd *cobra.Command, args []string) {
+		number := parsePolarimeterNumber(args)
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		pol := db.Polarimeter{
+			Number:       number,
+			SerialNumber: polSerialNumber,
+			Module:       polModule,
+			Board:        polBoard,
+			Band:         polBand,
+			Status:       polStatus,
+			Notes:        polNotes,
+		}
+		if err := conn.AddPolarimeter(&pol, username); err != nil {
+			log.Fatalf("unable to register polarimeter %d: %v", number, err)
+		}
+
+		log.Printf("polarimeter %d has been registered", number)
+	},
+}
+
+var polarimeterSetCmd = &cobra.Command{
+	Use:   "set NUMBER",
+	Short: "Modify the information about a polarimeter",
+	Long: `Change the fields of a polarimeter that has already been
+registered. Only the fields specified through the flags are modified.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		number := parsePolarimeterNumber(args)
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		var pol db.Polarimeter
+		if err := conn.GetPolarimeter(number, username, &pol); err != nil {
+			log.Fatal(err)
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("serial") {
+			pol.SerialNumber = polSerialNumber
+		}
+		if flags.Changed("module") {
+			pol.Module = polModule
+		}
+		if flags.Changed("board") {
+			pol.Board = polBoard
+		}
+		if flags.Changed("band") {
+			pol.Band = polBand
+		}
+		if flags.Changed("status") {
+			pol.Status = polStatus
+		}
+		if flags.Changed("notes") {
+			pol.Notes = polNotes
+		}
+
+		if err := conn.UpdatePolarimeter(&pol, username); err != nil {
+			log.Fatalf("unable to update polarimeter %d: %v", number, err)
+		}
+
+		log.Printf("polarimeter %d has been updated", number)
+	},
+}
+
+var polarimeterListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Print the list of registered polarimeters",
+	Run: func(cmd *cobra.Command, args []string) {
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		pols, err := conn.GetListOfPolarimeters(username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("%-6s %-16s %-8s %-8s %-4s %-12s\n",
+			"Number", "Serial", "Module", "Board", "Band", "Status")
+		for _, curPol := range pols {
+			fmt.Printf("%-6d %-16s %-8s %-8s %-4s %-12s\n",
+				curPol.Number, curPol.SerialNumber, curPol.Module, curPol.Board,
+				curPol.Band, curPol.Status)
+		}
+	},
+}
+
+var polarimeterShowCmd = &cobra.Command{
+	Use:   "show NUMBER",
+	Short: "Print the details of a polarimeter and the list of its tests",
+	Run: func(cmd *cobra.Command, args []string) {
+		number := parsePolarimeterNumber(args)
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		var pol db.Polarimeter
+		if err := conn.GetPolarimeter(number, username, &pol); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Polarimeter:   %d\n", pol.Number)
+		fmt.Printf("Serial number: %s\n", pol.SerialNumber)
+		fmt.Printf("Module:        %s\n", pol.Module)
+		fmt.Printf("Board:         %s\n", pol.Board)
+		fmt.Printf("Band:          %s\n", pol.Band)
+		fmt.Printf("Status:        %s\n", pol.Status)
+		fmt.Printf("Notes:         %s\n", pol.Notes)
+
+		page, err := conn.ListTests(db.ListOptions{
+			Sort:        db.SortByDate,
+			Descending:  true,
+			Polarimeter: number,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("\n%d tests:\n", page.Total)
+		for _, curEntry := range page.Tests {
+			fmt.Printf("%6d  %s  %-10s  %s\n", curEntry.ID,
+				curEntry.Test.CreationDate.Format("2006-01-02 15:04:05"),
+				curEntry.Test.TestType, curEntry.Test.ShortName)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(polarimeterCmd)
+	polarimeterCmd.AddCommand(polarimeterAddCmd)
+	polarimeterCmd.AddCommand(polarimeterSetCmd)
+	polarimeterCmd.AddCommand(polarimeterListCmd)
+	polarimeterCmd.AddCommand(polarimeterShowCmd)
+
+	polarimeterCmd.PersistentFlags().String("username", "", "Name of the user performing the operation")
+
+	for _, curCmd := range []*cobra.Command{polarimeterAddCmd, polarimeterSetCmd} {
+		curCmd.Flags().StringVar(&polSerialNumber, "serial", "", "Serial number of the hardware")
+		curCmd.Flags().StringVar(&polModule, "module", "", "Position of the polarimeter in the focal plane module")
+		curCmd.Flags().StringVar(&polBoard, "board", "", "Bias board driving the polarimeter")
+		curCmd.Flags().StringVar(&polBand, "band", "", "Frequency band (Q or W)")
+		curCmd.Flags().StringVar(&polNotes, "notes", "", "Free-form notes")
+	}
+	polarimeterAddCmd.Flags().StringVar(&polStatus, "status", db.PolarimeterAvailable, "Current status of the polarimeter")
+	polarimeterSetCmd.Flags().StringVar(&polStatus, "status", "", "Current status of the polarimeter")
+}
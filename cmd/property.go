@@ -0,0 +1,89 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// propertyCmd represents the property command
+var propertyCmd = &cobra.Command{
+	Use:   "property [KEY [VALUE]]",
+	Short: "Print or modify the properties of the database",
+	Long: `Without arguments, print all the properties of the database.
+With KEY, print the value of that property; with KEY and VALUE,
+set it. The following properties are used by stdb:
+
+   * duplicate_policy: what to do when importing data that are
+     already in the database ("reject", "warn", "link");
+   * duplicate_check_data: compare the samples too when looking
+     for duplicates ("true" or "false");
+   * blob_store: where FITS files and attachments are saved ("file"
+     for the database folder, "s3" for a S3-compatible service);
+   * s3_endpoint, s3_bucket, s3_region, s3_prefix: configuration of
+     the S3 service. Credentials are read from the environment
+     variables STDB_S3_ACCESS_KEY and STDB_S3_SECRET_KEY.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		switch len(args) {
+		case 0:
+			props, err := conn.GetProperties()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			keys := make([]string, 0, len(props))
+			for key := range props {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Printf("%s = %s\n", key, props[key])
+			}
+		case 1:
+			value, err := conn.GetProperty(args[0], "")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(value)
+		case 2:
+			if err := conn.SetProperty(args[0], args[1], username); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatalf("unexpected arguments %v", args[2:])
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(propertyCmd)
+
+	propertyCmd.Flags().String("username", "", "Name of the user performing the operation")
+}
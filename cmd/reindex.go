@@ -0,0 +1,98 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
+)
+
+// reindexCmd represents the reindex command
+var reindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild index.db from the headers of the FITS files",
+	Long: `Scan the FITS files in the database folder and create a new
+index.db using the information saved in their headers (short name,
+date, uploader, test type, cryogenic flag, polarimeter, UUID, version
+of the data, and parameters). This is useful if index.db has been lost
+or corrupted; the file must not exist, so move a corrupted one away
+before running the command.
+
+Descriptions, campaigns, comments, relations between tests and the
+associations of attachments are saved only in index.db, so they cannot
+be recovered. Users are recreated from the FITS files without a
+password, and they are disabled. Files that cannot be reconciled are
+listed in the output. FITS files written before UUIDs were introduced
+do not contain the UUID of their test: the files with the same
+polarimeter, test type, short name and date are considered versions of
+one test, which gets a new UUID.
+
+If --backup is specified, the users (with their passwords), the
+attachments and the UUIDs of the tests whose files have none are
+recovered from the index saved in the archive, which should be the
+most recent backup of the database.
+
+If --check is specified, the existing index.db is compared with the
+FITS files and nothing is modified; files without a UUID are matched
+with the index using their checksum. The program exits with a non-zero
+status if some errors have been found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		check, _ := cmd.Flags().GetBool("check")
+		backup, _ := cmd.Flags().GetString("backup")
+		username := cmd.Flag("username").Value.String()
+		dbpath := singleDatabasePath(cmd)
+
+		report, err := db.Reindex(dbpath, db.ReindexOptions{Check: check, Backup: backup}, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		numOfErrors := printProblems(report.Problems)
+
+		if check {
+			log.Printf("%d FITS files of %d tests compared with the index", report.NumOfFiles, report.NumOfTests)
+		} else {
+			log.Printf("index rebuilt from %d FITS files, %d tests, %d users and %d attachments recovered",
+				report.NumOfFiles, report.NumOfTests, len(report.NewUsers)+len(report.RecoveredUsers),
+				report.NumOfAttachments)
+		}
+		log.Printf("%d errors, %d warnings, %d notes",
+			report.Count(db.SeverityError),
+			report.Count(db.SeverityWarning),
+			report.Count(db.SeverityInfo))
+
+		if numOfErrors > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reindexCmd)
+
+	reindexCmd.Flags().Bool("check", false, "Compare the existing index with the FITS files without modifying it")
+	reindexCmd.Flags().String("backup", "", "Backup archive used to recover users, attachments and UUIDs")
+	reindexCmd.Flags().String("username", "", "Name of the user performing the operation")
+}
@@ -0,0 +1,93 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var replaceReason string // Provided by --reason
+
+// replaceCmd represents the replace command
+var replaceCmd = &cobra.Command{
+	Use:   "replace TEST_ID FILE",
+	Short: "Re-import the data of a test from a corrected file",
+	Long: `Convert FILE into a new version of the data of the test with
+ID TEST_ID. The test keeps its ID and metadata, and older
+versions of the data are kept in the database: use "stdb versions"
+to list them. The flag --reason is mandatory.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatal("you must specify the ID of the test and the file containing the new data")
+		}
+		username := cmd.Flag("username").Value.String()
+		if replaceReason == "" {
+			log.Fatal("you must explain why the data are being replaced using --reason")
+		}
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+		testID := parseTestID(conn, args)
+
+		version, err := conn.ReplaceTestData(testID, args[1], replaceReason, username)
+		if err != nil {
+			log.Fatalf("unable to replace the data of test %d: %v", testID, err)
+		}
+
+		log.Printf("file \"%s\" is now version %d of the data of test %d", args[1], version, testID)
+	},
+}
+
+// versionsCmd represents the versions command
+var versionsCmd = &cobra.Command{
+	Use:   "versions TEST_ID",
+	Short: "List the versions of the data of a test",
+	Run: func(cmd *cobra.Command, args []string) {
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+		testID := parseTestID(conn, args)
+
+		versions, err := conn.GetTestDataVersions(testID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("%-4s %-17s %-12s %-64s %s\n", "Ver", "Date", "User", "Checksum", "Reason")
+		for _, curVersion := range versions {
+			fmt.Printf("%-4d %-17s %-12s %-64s %s\n", curVersion.Version,
+				curVersion.CreationDate.Format("2006-01-02 15:04"), curVersion.Username,
+				curVersion.Checksum, curVersion.Reason)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(replaceCmd)
+	RootCmd.AddCommand(versionsCmd)
+
+	replaceCmd.Flags().StringVar(&replaceReason, "reason", "", "Why the data are being replaced")
+	for _, curCmd := range []*cobra.Command{replaceCmd, versionsCmd} {
+		curCmd.Flags().String("username", "", "Name of the user performing the operation")
+	}
+}
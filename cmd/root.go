@@ -22,6 +22,7 @@ package cmd
 
 import (
 	"log"
+	"path/filepath"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
@@ -55,7 +56,9 @@ func init() {
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", 
 	                                    "config file (default is $HOME/.stdb.yaml)")
-	RootCmd.PersistentFlags().String("dbpath", ".", "Path to the database")
+	RootCmd.PersistentFlags().String("dbpath", ".",
+		"Path to the database (commands that only read it accept several paths separated by \""+
+			string(filepath.ListSeparator)+"\")")
 
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
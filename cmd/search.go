@@ -0,0 +1,149 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
+)
+
+var (
+	searchText        string   // Provided by --text
+	searchType        string   // Provided by --type
+	searchPolarimeter int      // Provided by --polarimeter
+	searchCampaign    string   // Provided by --campaign
+	searchParameters  []string // Provided by --param
+	searchColumns     []string // Provided by --column
+	searchMaxNum      int      // Provided by --max
+)
+
+// searchCmd represents the search command
+var searchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "Look for tests matching some criteria",
+	Long: `Print the list of tests matching all the conditions specified
+through the flags. Conditions on parameters (see "stdb add --param")
+are in the form "name OP value[unit]", where OP is one of the
+operators =, !=, <, <=, >, >=. For instance:
+
+   stdb search --param "vdrain>=0.5V" --param lna=on
+
+If a unit is specified, only parameters with the same unit match;
+SI prefixes are taken into account, so "vdrain>=500mV" matches a
+parameter equal to 0.8V. If no unit is specified, only parameters
+without a unit match.
+Remember to quote conditions using < and >, as they are special
+characters for the shell.
+
+Conditions on the data are in the form "column.statistic OP
+value[unit]", where statistic is one of ` + strings.Join(db.ColumnStatistics(), ", ") + `.
+Statistics are computed when the data are imported (use "stdb
+checkdb --fix" to compute them for data imported by older versions of
+stdb), and only the latest version of the data of each test is
+considered. Units are compared like for parameters. For instance:
+
+   stdb search --column "BaseV.max>700mV" --column "PWR2.mean<-60000"
+
+If more than one database is passed to --dbpath, all of them are
+searched, and the tests are sorted by acquisition date.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		username := cmd.Flag("username").Value.String()
+
+		query := db.SearchQuery{
+			Text:         searchText,
+			TestType:     searchType,
+			Polarimeter:  searchPolarimeter,
+			CampaignName: searchCampaign,
+		}
+		for _, curCondition := range searchParameters {
+			cond, err := db.ParseParameterCondition(curCondition)
+			if err != nil {
+				log.Fatal(err)
+			}
+			query.Parameters = append(query.Parameters, cond)
+		}
+		for _, curCondition := range searchColumns {
+			cond, err := db.ParseColumnCondition(curCondition)
+			if err != nil {
+				log.Fatal(err)
+			}
+			query.Columns = append(query.Columns, cond)
+		}
+
+		if len(databasePaths(cmd)) > 1 {
+			fed := openFederation(cmd)
+			defer fed.Close()
+
+			entries, err := fed.SearchTests(query, searchMaxNum)
+			if err != nil {
+				log.Fatal(err)
+			}
+			printTestEntries(entries)
+			return
+		}
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		testIDs, err := conn.SearchTests(query, username, searchMaxNum)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		page, err := conn.ListTests(db.ListOptions{Sort: db.SortByID, Descending: true, TestIDs: testIDs})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Print the tests in the same order as SearchTests returned them
+		position := make(map[int]int, len(testIDs))
+		for idx, curID := range testIDs {
+			position[curID] = idx
+		}
+		sort.SliceStable(page.Tests, func(i, j int) bool {
+			return position[page.Tests[i].ID] < position[page.Tests[j].ID]
+		})
+
+		entries := make([]db.FederatedEntry, len(page.Tests))
+		for idx, curEntry := range page.Tests {
+			entries[idx].TestEntry = curEntry
+		}
+		printTestEntries(entries)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(searchCmd)
+
+	searchCmd.Flags().StringVar(&searchText, "text", "", "Text to look for in the name, description and comments of the test")
+	searchCmd.Flags().StringVar(&searchType, "type", "", "Type of the test")
+	searchCmd.Flags().IntVar(&searchPolarimeter, "polarimeter", 0, "Number of the polarimeter")
+	searchCmd.Flags().StringVar(&searchCampaign, "campaign", "", "Name of the campaign")
+	searchCmd.Flags().StringArrayVar(&searchParameters, "param", []string{}, "Condition on a parameter, e.g., \"vdrain>0.5V\" (can be repeated)")
+	searchCmd.Flags().StringArrayVar(&searchColumns, "column", []string{}, "Condition on the data, e.g., \"BaseV.max>0.7V\" (can be repeated)")
+	searchCmd.Flags().IntVar(&searchMaxNum, "max", -1, "Maximum number of tests to print (negative means no limit)")
+	searchCmd.Flags().String("username", "", "Name of the user performing the operation")
+}
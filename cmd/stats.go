@@ -0,0 +1,105 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// humanSize returns a string representing a number of bytes using the
+// most appropriate unit
+func humanSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	value := float64(bytes) / unit
+	for _, curUnit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if value < unit || curUnit == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, curUnit)
+		}
+		value /= unit
+	}
+	return ""
+}
+
+// printCounts prints the number of tests for each key of "counts", sorted
+// by key
+func printCounts(title string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for curKey := range counts {
+		keys = append(keys, curKey)
+	}
+	sort.Strings(keys)
+
+	fmt.Printf("\n%s:\n", title)
+	for _, curKey := range keys {
+		fmt.Printf("  %-24s %6d\n", curKey, counts[curKey])
+	}
+}
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Print statistics about the tests in the database",
+	Long: `Print the number of tests grouped by polarimeter, test type,
+uploader and month of acquisition, the total number of samples and
+hours of acquisition, and the space used by FITS files and attachments.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		stats, err := conn.Stats()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Number of tests:    %d (%d cryogenic, %d warm)\n",
+			stats.NumOfTests, stats.CryogenicTests, stats.WarmTests)
+		fmt.Printf("Number of samples:  %d\n", stats.TotalSamples)
+		fmt.Printf("Acquisition time:   %.1f hours\n", stats.TotalHours)
+		fmt.Printf("FITS files:         %d (%s)\n", stats.FitsFiles.NumOfFiles, humanSize(stats.FitsFiles.Bytes))
+		fmt.Printf("Attachments:        %d (%s)\n", stats.Attachments.NumOfFiles, humanSize(stats.Attachments.Bytes))
+
+		polarimeters := make([]int, 0, len(stats.ByPolarimeter))
+		for curPol := range stats.ByPolarimeter {
+			polarimeters = append(polarimeters, curPol)
+		}
+		sort.Ints(polarimeters)
+
+		fmt.Printf("\nTests per polarimeter:\n")
+		for _, curPol := range polarimeters {
+			fmt.Printf("  %-24d %6d\n", curPol, stats.ByPolarimeter[curPol])
+		}
+		printCounts("Tests per type", stats.ByTestType)
+		printCounts("Tests per uploader", stats.ByUploader)
+		printCounts("Tests per month", stats.ByMonth)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statsCmd)
+}
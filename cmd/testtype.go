@@ -0,0 +1,142 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lspestrip/stdb/db"
+)
+
+var (
+	testTypeRef         string   // Provided by --ref
+	testTypeDescription string   // Provided by --description
+	testTypeFormat      string   // Provided by --format
+	testTypeRequired    []string // Provided by --require
+)
+
+// testtypeCmd represents the testtype command
+var testtypeCmd = &cobra.Command{
+	Use:   "testtype",
+	Short: "Manage the vocabulary of test types",
+	Long: `List and extend the types of test accepted by the database.
+
+Each type has a short code, which refers to some test described in
+the Test Plan, and any number of aliases, which are alternative
+spellings accepted by the "add" command.`,
+}
+
+var testtypeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Print the list of test types and their aliases",
+	Run: func(cmd *cobra.Command, args []string) {
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		testTypes, aliases, err := conn.GetListOfTestTypes()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, curType := range testTypes {
+			fmt.Printf("%-10s %s\n", curType.Code, curType.Description)
+			if curType.TestPlanRef != "" {
+				fmt.Printf("%-10s Test Plan: %s\n", "", curType.TestPlanRef)
+			}
+			if curType.FileFormat != "" {
+				fmt.Printf("%-10s File format: %s\n", "", curType.FileFormat)
+			}
+			if len(curType.RequiredMetadata) > 0 {
+				fmt.Printf("%-10s Required fields: %s\n", "",
+					strings.Join(curType.RequiredMetadata, ", "))
+			}
+			if len(aliases[curType.Code]) > 0 {
+				fmt.Printf("%-10s Aliases: %s\n", "", strings.Join(aliases[curType.Code], ", "))
+			}
+		}
+	},
+}
+
+var testtypeAddCmd = &cobra.Command{
+	Use:   "add CODE",
+	Short: "Add a new test type",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("you must specify the code of the new test type")
+		}
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		testType := db.TestType{
+			Code:             args[0],
+			TestPlanRef:      testTypeRef,
+			Description:      testTypeDescription,
+			FileFormat:       testTypeFormat,
+			RequiredMetadata: testTypeRequired,
+		}
+		if err := conn.AddTestType(&testType, username); err != nil {
+			log.Fatalf("unable to add test type \"%s\": %v", args[0], err)
+		}
+
+		log.Printf("test type \"%s\" has been added", testType.Code)
+	},
+}
+
+var testtypeAliasCmd = &cobra.Command{
+	Use:   "alias ALIAS CODE",
+	Short: "Make ALIAS an alternative spelling for the test type CODE",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatal("you must specify the alias and the code of the test type")
+		}
+		username := cmd.Flag("username").Value.String()
+
+		conn := connectToDatabase(cmd)
+		defer conn.Disconnect()
+
+		if err := conn.AddTestTypeAlias(args[0], args[1], username); err != nil {
+			log.Fatalf("unable to add alias \"%s\": %v", args[0], err)
+		}
+
+		log.Printf("\"%s\" is now an alias for \"%s\"", args[0], args[1])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(testtypeCmd)
+	testtypeCmd.AddCommand(testtypeListCmd)
+	testtypeCmd.AddCommand(testtypeAddCmd)
+	testtypeCmd.AddCommand(testtypeAliasCmd)
+
+	testtypeCmd.PersistentFlags().String("username", "", "Name of the user performing the operation")
+
+	testtypeAddCmd.Flags().StringVar(&testTypeRef, "ref", "", "Section of the Test Plan describing the test")
+	testtypeAddCmd.Flags().StringVar(&testTypeDescription, "description", "", "Description of the test")
+	testtypeAddCmd.Flags().StringVar(&testTypeFormat, "format", "", "Required format of the input file (e.g., \"keithley\")")
+	testtypeAddCmd.Flags().StringSliceVar(&testTypeRequired, "require", []string{},
+		"Fields that must be provided for this kind of test (\"shortname\", \"description\")")
+}
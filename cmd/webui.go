@@ -14,10 +14,14 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
@@ -30,26 +34,119 @@ import (
 
 const (
 	maxNumOfTestsToDisplay = 15
+	maxNumOfSamplesToSend = 100000
+	previewPlotWidth = 600
+	previewPlotHeight = 150
 	sessionCookieName = "session_cookie"
 )
 
-type dbEntry struct {
-	ID int
-	Test db.Test
+// relatedEntry is a test related to the one shown in a page
+type relatedEntry struct {
+	Description string // Description of the relationship (e.g., "repeated by")
+	db.TestEntry
+}
+
+// previewPlot contains the SVG coordinates used to draw a quick-look plot
+// of a column of data in testinfo.html
+type previewPlot struct {
+	Name string
+	Unit string
+	MinValue float64
+	MaxValue float64
+	Envelope string // Points of the polygon enclosing the min/max values
+	Mean string     // Points of the line connecting the mean values
+}
+
+// makePreviewPlot computes the coordinates of the plot of one level of a
+// column preview
+func makePreviewPlot(col *db.ColumnPreview, level db.PreviewLevel) previewPlot {
+	plot := previewPlot{Name: col.Name, Unit: col.Unit}
+	numOfBins := len(level.Min)
+	if numOfBins == 0 {
+		return plot
+	}
+
+	plot.MinValue, plot.MaxValue = level.Min[0], level.Max[0]
+	for idx := range level.Min {
+		plot.MinValue = math.Min(plot.MinValue, level.Min[idx])
+		plot.MaxValue = math.Max(plot.MaxValue, level.Max[idx])
+	}
+
+	x := func(bin int) float64 {
+		if numOfBins == 1 {
+			return previewPlotWidth / 2
+		}
+		return float64(bin) * previewPlotWidth / float64(numOfBins-1)
+	}
+	y := func(value float64) float64 {
+		if plot.MaxValue == plot.MinValue {
+			return previewPlotHeight / 2
+		}
+		return previewPlotHeight * (plot.MaxValue - value) / (plot.MaxValue - plot.MinValue)
+	}
+
+	var envelope, mean strings.Builder
+	for bin := 0; bin < numOfBins; bin++ {
+		fmt.Fprintf(&envelope, "%.1f,%.1f ", x(bin), y(level.Max[bin]))
+		fmt.Fprintf(&mean, "%.1f,%.1f ", x(bin), y(level.Mean[bin]))
+	}
+	for bin := numOfBins - 1; bin >= 0; bin-- {
+		fmt.Fprintf(&envelope, "%.1f,%.1f ", x(bin), y(level.Min[bin]))
+	}
+	plot.Envelope = strings.TrimSpace(envelope.String())
+	plot.Mean = strings.TrimSpace(mean.String())
+	return plot
 }
 
 var (
 	dbConn db.Connection
+	// Read-only connection used by the pages that do not require the user
+	// to be logged in
+	publicConn db.Connection
 	username string
+
+	// Test IDs and versions whose preview is being computed by computePreview
+	previewsMutex sync.Mutex
+	previewsInProgress = make(map[[2]int]bool)
 )
 
+// computePreview computes and saves the preview of version "version" of
+// the data of a test in the background (zero means the latest one), unless
+// this is already being done
+func computePreview(testID int, version int) {
+	previewsMutex.Lock()
+	defer previewsMutex.Unlock()
+	key := [2]int{testID, version}
+	if previewsInProgress[key] {
+		return
+	}
+	previewsInProgress[key] = true
+
+	go func() {
+		if _, err := dbConn.GetTestPreview(testID, version); err != nil {
+			log.Printf("unable to compute the preview of test %d: %v", testID, err)
+		}
+
+		previewsMutex.Lock()
+		delete(previewsInProgress, key)
+		previewsMutex.Unlock()
+	}()
+}
+
 func authenticate(c *gin.Context) {
 	formUsername := c.PostForm("username")
 	formPassword := []byte(c.PostForm("password"))
 
-	password, err := dbConn.GetUserPassword(formUsername)
+	password, err := dbConn.GetUserPasswordContext(c.Request.Context(), formUsername)
 	if err != nil || bcrypt.CompareHashAndPassword(password, formPassword) != nil {
-		dbConn.Log("failed authentication", formUsername)
+		dbConn.LogEventContext(c.Request.Context(), db.LogEntry{
+			Username:   formUsername,
+			Action:     db.ActionLogin,
+			ObjectType: db.ObjectUser,
+			ObjectID:   formUsername,
+			Outcome:    db.OutcomeFailure,
+			Message:    "failed authentication",
+		})
 		c.HTML(http.StatusUnauthorized, "error.html", gin.H{
 			"errorMessage": fmt.Sprintf("access denied (%v)", err),
 		})
@@ -57,6 +154,13 @@ func authenticate(c *gin.Context) {
 	}
 	
 	session, _ := web.CreateSession(formUsername)
+	dbConn.LogEventContext(c.Request.Context(), db.LogEntry{
+		Username:   formUsername,
+		Action:     db.ActionLogin,
+		ObjectType: db.ObjectUser,
+		ObjectID:   formUsername,
+		Message:    "user has logged in",
+	})
 	c.SetCookie(sessionCookieName, session.UUID.String(), 0, "", "", false, true)
 	c.Redirect(http.StatusMovedPermanently, "/")
 }
@@ -88,10 +192,17 @@ func protect(h gin.HandlerFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		valid, session, err := isCookieValid(c)
 		if valid {
-			dbConn.Log(fmt.Sprintf("granting permission to page"), session.Username)
+			// Record the user in the log entries written by the handler
+			c.Request = c.Request.WithContext(db.WithUsername(c.Request.Context(), session.Username))
 			h(c) // Chain
 		} else {
-			dbConn.Log(fmt.Sprintf("in protect: error %v", err), "")
+			dbConn.LogEventContext(c.Request.Context(), db.LogEntry{
+				Action:     db.ActionRead,
+				ObjectType: db.ObjectPage,
+				ObjectID:   c.Request.URL.Path,
+				Outcome:    db.OutcomeFailure,
+				Message:    fmt.Sprintf("access denied: %v", err),
+			})
 			c.HTML(http.StatusServiceUnavailable, "error.html", gin.H{
 				"errorMessage": "Access denied",
 			})
@@ -112,53 +223,393 @@ func logout(c *gin.Context) {
 	// Delete this cookie
 	c.SetCookie(sessionCookieName, "", -1, "", "", false, true)
 	c.Redirect(http.StatusMovedPermanently, "/")
-	dbConn.Log(fmt.Sprintf("user has logged out"), session.Username)
+	dbConn.LogEventContext(c.Request.Context(), db.LogEntry{
+		Username:   session.Username,
+		Action:     db.ActionLogout,
+		ObjectType: db.ObjectUser,
+		ObjectID:   session.Username,
+		Message:    "user has logged out",
+	})
 }
 
-// Show the main web page (template: mainpage.html)
-func mainPage(c *gin.Context) {
-	ids, _ := dbConn.GetListOfTestIDs(username, -1)
-	overallNumOfTests := len(ids)
+// recordClientAddress makes the log entries written while handling a
+// request include the address of the client
+func recordClientAddress(c *gin.Context) {
+	c.Request = c.Request.WithContext(db.WithClientAddress(c.Request.Context(), c.ClientIP()))
+	c.Next()
+}
 
-	var numOfTests = overallNumOfTests
-	if overallNumOfTests > maxNumOfTestsToDisplay {
-		numOfTests = maxNumOfTestsToDisplay
+// errorStatus returns the HTTP status code to send for an error returned by
+// the database
+func errorStatus(err error) int {
+	if errors.Is(err, db.ErrNotFound) {
+		return http.StatusNotFound
 	}
+	if errors.Is(err, db.ErrInvalidRange) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
 
-	entries := make([]dbEntry, numOfTests)
-	ids, _ = dbConn.GetListOfTestIDs(username, numOfTests)
-
-	for idx, curID := range ids {
-		entries[idx].ID = curID
-		dbConn.GetTest(curID, username, &entries[idx].Test)
+// Show the main web page (template: mainpage.html). The optional
+// parameter "campaign" restricts the list to the tests of one campaign,
+// and "after" is the cursor of the page to show.
+func mainPage(c *gin.Context) {
+	campaignID, _ := strconv.Atoi(c.Query("campaign"))
+
+	page, err := publicConn.ListTestsContext(c.Request.Context(), db.ListOptions{
+		Sort:       db.SortByID,
+		Descending: true,
+		After:      c.Query("after"),
+		Limit:      maxNumOfTestsToDisplay,
+		CampaignID: campaignID,
+	})
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
 	}
 
+	campaigns, _ := publicConn.GetListOfCampaignsContext(c.Request.Context(), username)
+
 	loggedIn, session, _ := isCookieValid(c)
 	c.HTML(http.StatusOK, "mainpage.html", gin.H{
 		"databaseSchemaVersion": db.DatabaseSchemaVersion,
-		"overallNumOfTests": overallNumOfTests,
-		"entries": entries,
+		"overallNumOfTests": page.Total,
+		"entries": page.Tests,
+		"nextCursor": page.NextCursor,
+		"campaigns": campaigns,
+		"campaignID": campaignID,
 		"loggedIn": loggedIn,
 		"username": session.Username,
 	})
 }
 
+// Show the list of campaigns (template: campaigns.html)
+func campaignList(c *gin.Context) {
+	campaigns, err := dbConn.GetListOfCampaignsContext(c.Request.Context(), username)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	c.HTML(http.StatusOK, "campaigns.html", gin.H{
+		"campaigns": campaigns,
+	})
+}
+
+// Show a summary of the tests done during a campaign (template: campaign.html)
+func campaignInformation(c *gin.Context) {
+	campaignID, err := strconv.Atoi(c.Param("campaignID"))
+	if err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	var campaign db.Campaign
+	if err := dbConn.GetCampaignContext(c.Request.Context(), campaignID, username, &campaign); err != nil {
+		c.HTML(errorStatus(err), "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	summary, err := dbConn.GetCampaignSummaryContext(c.Request.Context(), campaignID)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	c.HTML(http.StatusOK, "campaign.html", gin.H{
+		"campaign": campaign,
+		"summary": summary,
+	})
+}
+
 // Show a page containing information for a test (template: testinfo.html)
 func testInformation(c *gin.Context) {
-	testID, err := strconv.Atoi(c.Param("testID"))
+	testID, err := dbConn.ResolveTestIDContext(c.Request.Context(), c.Param("testID"))
 	if err != nil {
-		c.HTML(http.StatusNotFound, "error.html", gin.H{
+		c.HTML(errorStatus(err), "error.html", gin.H{
 			"errorMessage": fmt.Sprintf("%v", err),
 		})
 		return
 	}
 
 	var test db.Test
-	dbConn.GetTest(testID, username, &test)
+	dbConn.GetTestContext(c.Request.Context(), testID, username, &test)
+
+	relations, _ := dbConn.GetTestRelationsContext(c.Request.Context(), testID)
+	relatedIDs := make([]int, len(relations))
+	for idx, curRelation := range relations {
+		relatedIDs[idx] = curRelation.OtherTest(testID)
+	}
+	relatedTests := make(map[int]db.Test)
+	if page, err := dbConn.ListTestsContext(c.Request.Context(), db.ListOptions{TestIDs: relatedIDs}); err == nil {
+		for _, curEntry := range page.Tests {
+			relatedTests[curEntry.ID] = curEntry.Test
+		}
+	}
+
+	related := make([]relatedEntry, len(relations))
+	for idx, curRelation := range relations {
+		related[idx].Description = curRelation.Describe(testID)
+		related[idx].ID = relatedIDs[idx]
+		related[idx].Test = relatedTests[relatedIDs[idx]]
+	}
+
+	comments, _ := dbConn.GetCommentsContext(c.Request.Context(), testID)
+	versions, _ := dbConn.GetTestDataVersionsContext(c.Request.Context(), testID)
+	attachments, _ := dbConn.GetAttachmentsContext(c.Request.Context(), testID)
+
+	// Missing previews are computed in the background, as this requires
+	// to read the whole FITS file: the page is shown without the plots
+	var plots []previewPlot
+	previewPending := false
+	if preview, ok, err := dbConn.GetSavedTestPreviewContext(c.Request.Context(), testID, 0); err == nil && ok {
+		for idx := range preview.Columns {
+			col := &preview.Columns[idx]
+			plots = append(plots, makePreviewPlot(col, col.Level(previewPlotWidth)))
+		}
+	} else if err == nil {
+		computePreview(testID, 0)
+		previewPending = true
+	}
+
+	columnStats, _ := dbConn.GetColumnStatsContext(c.Request.Context(), testID, 0)
 
 	c.HTML(http.StatusOK, "testinfo.html", gin.H{
 		"testID": testID,
 		"test": test,
+		"related": related,
+		"comments": comments,
+		"versions": versions,
+		"attachments": attachments,
+		"plots": plots,
+		"previewPending": previewPending,
+		"columnStats": columnStats,
+	})
+}
+
+// Send the FITS file containing the data of a test. The optional
+// parameter "version" selects an older version of the data; by
+// default, the latest one is sent.
+func downloadTest(c *gin.Context) {
+	testID, err := dbConn.ResolveTestIDContext(c.Request.Context(), c.Param("testID"))
+	if err != nil {
+		c.HTML(errorStatus(err), "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	version, _ := strconv.Atoi(c.Query("version"))
+	r, dataVersion, err := dbConn.OpenTestDataContext(c.Request.Context(), testID, version)
+	if err != nil {
+		c.HTML(errorStatus(err), "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+	defer r.Close()
+
+	fileName := fmt.Sprintf("test_%06d_v%d.fits.gz", testID, dataVersion.Version)
+	c.DataFromReader(http.StatusOK, -1, "application/gzip", r, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s\"", fileName),
+	})
+}
+
+// Send some columns of the data of a test as a JSON object. The optional
+// parameters are "columns" (comma-separated list of names, by default all
+// the columns are sent), "start" and "end" (range of rows). No more than
+// maxNumOfSamplesToSend rows are sent: the field "end" of the result tells
+// where the next request should start.
+func testDataColumns(c *gin.Context) {
+	testID, err := dbConn.ResolveTestIDContext(c.Request.Context(), c.Param("testID"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	var columns []string
+	if value := c.Query("columns"); value != "" {
+		columns = strings.Split(value, ",")
+	}
+	start, err := strconv.Atoi(c.DefaultQuery("start", "0"))
+	if err == nil && start < 0 {
+		err = fmt.Errorf("negative row number")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid start row: %v", err)})
+		return
+	}
+	end, err := strconv.Atoi(c.DefaultQuery("end", "-1"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid end row: %v", err)})
+		return
+	}
+	if end < 0 || end-start > maxNumOfSamplesToSend {
+		end = start + maxNumOfSamplesToSend
+	}
+
+	data, err := dbConn.ReadTestColumnsContext(c.Request.Context(), testID, columns, start, end)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	numOfRows := 0
+	if len(data) > 0 {
+		numOfRows = data[0].Len()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"test_id": testID,
+		"start": start,
+		"end": start + numOfRows,
+		"columns": data,
+	})
+}
+
+// Send the preview of the data of a test as a JSON object (see
+// db.DataPreview). The optional parameter "points" selects, for each
+// column, the finest resolution with no more than the given number of
+// bins; by default, all the resolutions are sent. The parameter "version"
+// works as in downloadTest. If the preview has not been computed yet, the
+// status is 202 and the object is {"pending": true}.
+func testDataPreview(c *gin.Context) {
+	testID, err := dbConn.ResolveTestIDContext(c.Request.Context(), c.Param("testID"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// Like in testInformation, missing previews are computed in the
+	// background: the client must ask again later
+	version, _ := strconv.Atoi(c.Query("version"))
+	preview, ok, err := dbConn.GetSavedTestPreviewContext(c.Request.Context(), testID, version)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		computePreview(testID, version)
+		c.JSON(http.StatusAccepted, gin.H{"pending": true})
+		return
+	}
+
+	if points, err := strconv.Atoi(c.Query("points")); err == nil && points > 0 {
+		for idx := range preview.Columns {
+			col := &preview.Columns[idx]
+			col.Levels = []db.PreviewLevel{col.Level(points)}
+		}
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// Send the contents of an attachment
+func downloadAttachment(c *gin.Context) {
+	attachmentID, err := strconv.Atoi(c.Param("attachmentID"))
+	if err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	r, att, err := dbConn.OpenAttachmentContext(c.Request.Context(), attachmentID)
+	if err != nil {
+		c.HTML(errorStatus(err), "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+	defer r.Close()
+
+	c.DataFromReader(http.StatusOK, -1, att.MimeType, r, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s\"", att.FileName),
+	})
+}
+
+// Add a comment to a test, written by the user who is logged in
+func addComment(c *gin.Context) {
+	testID, err := dbConn.ResolveTestIDContext(c.Request.Context(), c.Param("testID"))
+	if err != nil {
+		c.HTML(errorStatus(err), "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	_, session, _ := isCookieValid(c)
+	replyTo, _ := strconv.Atoi(c.PostForm("reply_to"))
+	comment := db.Comment{
+		TestID: testID,
+		Username: session.Username,
+		Body: c.PostForm("body"),
+		ReplyTo: replyTo,
+	}
+	if _, err := dbConn.AddCommentContext(c.Request.Context(), &comment); err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("unable to add the comment: %v", err),
+		})
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/tests/%d", testID))
+}
+
+// Show a page containing the details of a polarimeter and the list of
+// the tests done on it (template: polarimeter.html)
+func polarimeterInformation(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("number"))
+	if err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	var pol db.Polarimeter
+	if err := dbConn.GetPolarimeterContext(c.Request.Context(), number, username, &pol); err != nil {
+		c.HTML(errorStatus(err), "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	page, _ := dbConn.ListTestsContext(c.Request.Context(), db.ListOptions{
+		Sort:        db.SortByDate,
+		Descending:  true,
+		Polarimeter: number,
+	})
+
+	c.HTML(http.StatusOK, "polarimeter.html", gin.H{
+		"polarimeter": pol,
+		"entries": page.Tests,
+	})
+}
+
+// Show statistics about the tests in the database (template: stats.html)
+func statistics(c *gin.Context) {
+	stats, err := dbConn.StatsContext(c.Request.Context())
+	if err != nil {
+		c.HTML(errorStatus(err), "error.html", gin.H{
+			"errorMessage": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	c.HTML(http.StatusOK, "stats.html", gin.H{
+		"stats": stats,
+		"fitsSize": humanSize(stats.FitsFiles.Bytes),
+		"attachmentsSize": humanSize(stats.Attachments.Bytes),
 	})
 }
 
@@ -170,7 +621,7 @@ var webuiCmd = &cobra.Command{
 the current host.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		port, err := strconv.Atoi(cmd.Flag("port").Value.String())
-		dbpath := cmd.Flag("dbpath").Value.String()
+		dbpath := singleDatabasePath(cmd)
 
 		log.Printf("webui called, connecting to database at \"%s\"", dbpath)
 
@@ -181,17 +632,31 @@ the current host.`,
 		if err := dbConn.Connect(dbpath); err != nil {
 			log.Fatal(err)
 		}
+		if err := publicConn.ConnectReadOnly(dbpath); err != nil {
+			log.Fatal(err)
+		}
 
 		router := gin.Default()
+		router.Use(recordClientAddress)
 		router.LoadHTMLGlob("templates/*.html")
 
 		router.GET("/", mainPage)
 		router.GET("/tests/:testID", protect(testInformation))
+		router.POST("/tests/:testID/comments", protect(addComment))
+		router.GET("/tests/:testID/download", protect(downloadTest))
+		router.GET("/tests/:testID/data", protect(testDataColumns))
+		router.GET("/tests/:testID/preview", protect(testDataPreview))
+		router.GET("/attachments/:attachmentID", protect(downloadAttachment))
+		router.GET("/polarimeters/:number", protect(polarimeterInformation))
+		router.GET("/stats", protect(statistics))
+		router.GET("/campaigns", protect(campaignList))
+		router.GET("/campaigns/:campaignID", protect(campaignInformation))
 		router.POST("/authenticate", authenticate)
 		router.GET("/logout", protect(logout))
 
 		router.Run(fmt.Sprintf(":%d", port))
 
+		publicConn.Disconnect()
 		dbConn.Disconnect()
 	},
 }
@@ -22,6 +22,9 @@ package convert
 
 import (
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math"
@@ -59,6 +62,21 @@ type metadata struct {
 	Interlock string
 }
 
+// checksum computes a SHA-256 hash of the names and values of the columns.
+// Values are hashed with the same precision used in the FITS file, so that
+// two files containing the same data produce the same checksum.
+func (table *dataTable) checksum() string {
+	hash := sha256.New()
+	for _, curCol := range table.Columns {
+		hash.Write([]byte(curCol.name))
+		for _, curValue := range curCol.values {
+			binary.Write(hash, binary.LittleEndian, float32(curValue))
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 func fillColumnData(sheet *xls.WorkSheet, colNum int, data []float64) {
 	numOfRows := int(sheet.MaxRow)
 	for i := 1; i <= numOfRows; i++ {
@@ -281,6 +299,7 @@ func KeithleyXlsToFits(inputpath string,
 	} else {
 		result.NumOfSamples = 0
 	}
+	result.DataChecksum = table.checksum()
 	result.CreationDate = meta.LastExecuted
 	result.TimeSpanSec = float32(meta.ExecutionTimeSec)
 
@@ -229,4 +229,9 @@ func TestKeithleyConversion(t *testing.T) {
 	if testFile.InputFileName != sourceFilePath {
 		t.Errorf("Wrong InputFileName field: \"%s\"", testFile.InputFileName)
 	}
-}
\ No newline at end of file
+
+	// The checksum of the data must not depend on the file format
+	if checksum := dataFromFits.table.checksum(); testFile.DataChecksum != checksum {
+		t.Errorf("Wrong DataChecksum field: \"%s\" != \"%s\"", testFile.DataChecksum, checksum)
+	}
+}
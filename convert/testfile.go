@@ -35,12 +35,17 @@ type TestFile struct {
 	InputFileName string // Name of the file used to produce the FITS file
 
 	FitsChecksum string // Checksum of the FITS file
+	DataChecksum string // Checksum of the samples, independent of the file format
 	CreationDate time.Time // Time  when the acquisition of the data stopped
 
 	TimeSpanSec float32 // Length of the test, in seconds
 	NumOfSamples int // Number of samples acquired during the test
 }
 
+// FileTypes lists the values returned by FileType for the files that can
+// be converted
+var FileTypes = []string{"keithley"}
+
 // FileType returns a string identifiying the type of the file. It is used
 // to determine how to read a file containing the data acquired during a
 // test.
@@ -21,12 +21,15 @@
 package db
 
 import (
+	"context"
+	"fmt"
 	"path"
 
 	"database/sql"
 	// Driver for accessing the Sqlite3 database file
 	_ "github.com/mattn/go-sqlite3"
 	"os"
+	"sync"
 )
 
 // Connection is a connection to some existing database
@@ -34,10 +37,134 @@ type Connection struct {
 	Active bool
 	BasePath string
 	Connection *sql.DB
+
+	// How to handle data that have already been imported. If empty, the
+	// "duplicate_policy" property is used (default: DuplicateReject)
+	DuplicatePolicy DuplicatePolicy
+	// Whether to compare the samples as well as the input files when looking
+	// for duplicates. If nil, the "duplicate_check_data" property is used
+	// (default: false)
+	CheckDataDuplicates *bool
+
+	// Where the FITS files and the attachments are saved. If nil, Connect
+	// creates it according to the "blob_store" property
+	Blobs BlobStore
+
+	// True if the connection has been established by ConnectReadOnly
+	ReadOnly bool
+
+	writer       *writerLock
+	uncompressed uncompressedCache // FITS files read by OpenTestRows
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
 const MsgInactiveConnection = "connection to the database has not been established yet"
 
+// indexDSN returns the string used to open "index.db". The WAL journal lets
+// readers (e.g., the web server) work while a command is writing, and the
+// busy timeout makes concurrent writers wait instead of failing with
+// "database is locked". Transactions take the write lock when they begin,
+// so that two of them never deadlock trying to upgrade a read lock.
+func indexDSN(fileName string) string {
+	return fileName + "?_journal_mode=WAL&_busy_timeout=10000&_foreign_keys=on&_txlock=immediate"
+}
+
+// contextDB runs the queries of a *sql.DB within a context. It implements
+// both queryRower and queryer, so it can be passed to the helper functions.
+type contextDB struct {
+	ctx context.Context
+	db  *sql.DB
+}
+
+func (c contextDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c contextDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
+
+// withContext returns an object running queries on the database within "ctx"
+func (conn *Connection) withContext(ctx context.Context) contextDB {
+	return contextDB{ctx: ctx, db: conn.Connection}
+}
+
+// checkWritable returns an error if the connection cannot be used to
+// modify the database
+func (conn *Connection) checkWritable() error {
+	if !conn.Active {
+		return ErrInactive
+	}
+	if conn.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// beginWrite starts a transaction that modifies the database, holding the
+// writer lock (see writerLock). The function returned together with the
+// transaction releases the lock: it must be called once the transaction
+// has been committed or rolled back, typically using "defer". If "ctx" is
+// cancelled, the transaction is rolled back.
+func (conn *Connection) beginWrite(ctx context.Context) (*sql.Tx, func(), error) {
+	unlock, err := conn.lockWriter()
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	tx, err := conn.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		unlock()
+		return nil, func() {}, err
+	}
+
+	return tx, unlock, nil
+}
+
+// lockWriter acquires the writer lock (see writerLock) and returns the
+// function that releases it. The function can be called more than once, so
+// that the lock can be released as soon as the transaction is committed
+// (e.g., before writing in the log) while a deferred call remains in place
+// for the error paths.
+func (conn *Connection) lockWriter() (func(), error) {
+	if conn.ReadOnly {
+		return func() {}, ErrReadOnly
+	}
+
+	if err := conn.writer.Lock(); err != nil {
+		return func() {}, err
+	}
+
+	var once sync.Once
+	return func() { once.Do(conn.writer.Unlock) }, nil
+}
+
+// execWrite runs a statement that modifies the database outside of a
+// transaction. Like beginWrite, it holds the writer lock.
+func (conn *Connection) execWrite(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	unlock, err := conn.lockWriter()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return conn.Connection.ExecContext(ctx, query, args...)
+}
+
 // Connect establishes a connection to some local database.
 // After having called this function successfully, you should
 // defer the execution of "Disconnect".
@@ -52,11 +179,111 @@ func (conn *Connection) Connect(basepath string) error {
 		return err
 	}
 	var err error
-	conn.Connection, err = sql.Open("sqlite3", indexFileName)
+	conn.Connection, err = sql.Open("sqlite3", indexDSN(indexFileName))
+	if err != nil {
+		return err
+	}
+
+	if conn.writer, err = openWriterLock(basepath); err != nil {
+		conn.Connection.Close()
+		return err
+	}
+
+	// Databases created by older versions of stdb are upgraded on the fly
+	if err := conn.upgradeSchema(); err != nil {
+		conn.writer.Close()
+		conn.Connection.Close()
+		return err
+	}
+
+	if conn.Blobs == nil {
+		if conn.Blobs, err = openBlobStore(conn.Connection, basepath); err != nil {
+			conn.writer.Close()
+			conn.Connection.Close()
+			return err
+		}
+	}
+
+	conn.Active = true
+	return nil
+}
+
+// readOnlyDSN returns the string used to open "index.db" in read-only
+// mode. SQLite still takes shared locks, so the database can be updated
+// by other processes while it is being read.
+func readOnlyDSN(fileName string) string {
+	return "file:" + fileName + "?mode=ro&_busy_timeout=10000&_query_only=true"
+}
+
+// ConnectReadOnly establishes a connection to some local database that
+// cannot be used to modify it: the methods that would change the database
+// return ErrReadOnly, and no entries are written in the log. Unlike
+// Connect, it does not upgrade databases created by older versions of
+// stdb. After having called this function successfully, you should defer
+// the execution of "Disconnect".
+func (conn *Connection) ConnectReadOnly(basepath string) error {
+	return conn.connectReadOnly(basepath, readOnlyDSN, false)
+}
+
+// ConnectForCheck is like ConnectReadOnly, but it accepts databases using
+// any version of the schema, so that Check can report a mismatch instead
+// of the database being upgraded. Apart from Check, no method should be
+// called on such a connection.
+func (conn *Connection) ConnectForCheck(basepath string) error {
+	return conn.connectReadOnly(basepath, readOnlyDSN, true)
+}
+
+// connectUntouched is like ConnectForCheck, but it does not create any
+// file in the folder of the database. SQLite creates the "-wal" and "-shm"
+// files even when a database is opened in read-only mode, unless it is
+// opened as immutable; this is safe only if no other process is using the
+// database, i.e., if there is no "-wal" file.
+func (conn *Connection) connectUntouched(basepath string) error {
+	indexFileName := path.Join(basepath, IndexFileName)
+	if _, err := os.Stat(indexFileName + "-wal"); err == nil {
+		return conn.connectReadOnly(basepath, readOnlyDSN, true)
+	}
+	return conn.connectReadOnly(basepath, immutableDSN, true)
+}
+
+// immutableDSN returns the string used to open "index.db" when no other
+// process is using it (see connectUntouched)
+func immutableDSN(fileName string) string {
+	return "file:" + fileName + "?mode=ro&immutable=1&_query_only=true"
+}
+
+func (conn *Connection) connectReadOnly(basepath string, dsn func(string) string, anyVersion bool) error {
+	conn.BasePath = basepath
+	conn.ReadOnly = true
+
+	indexFileName := path.Join(basepath, IndexFileName)
+	if _, err := os.Stat(indexFileName); err != nil {
+		return err
+	}
+	var err error
+	conn.Connection, err = sql.Open("sqlite3", dsn(indexFileName))
 	if err != nil {
 		return err
 	}
 
+	version, err := getSchemaVersion(conn.Connection)
+	if err != nil {
+		conn.Connection.Close()
+		return fmt.Errorf("unable to determine the version of the database schema: %v", err)
+	}
+	if version != DatabaseSchemaVersion && !anyVersion {
+		conn.Connection.Close()
+		return fmt.Errorf("the database uses version %s of the schema instead of %s, connect to it in read-write mode to upgrade it",
+			version, DatabaseSchemaVersion)
+	}
+
+	if conn.Blobs == nil {
+		if conn.Blobs, err = openBlobStore(conn.Connection, basepath); err != nil {
+			conn.Connection.Close()
+			return err
+		}
+	}
+
 	conn.Active = true
 	return nil
 }
@@ -64,7 +291,11 @@ func (conn *Connection) Connect(basepath string) error {
 // Disconnect closes the connection with the database
 func (conn *Connection) Disconnect() error {
 	if conn.Active {
+		conn.uncompressed.clear()
 		result := conn.Connection.Close()
+		if conn.writer != nil {
+			conn.writer.Close()
+		}
 		conn.Active = false
 		return result
 	}
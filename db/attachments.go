@@ -0,0 +1,211 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+)
+
+// Attachment is a file associated with a test, e.g., a photo of the setup
+// or the log of the acquisition software
+type Attachment struct {
+	ID       int    // Unique ID of the attachment
+	TestID   int    // ID of the test
+	FileName string // Name of the file (without directories)
+	MimeType string // MIME type of the file
+	Checksum string // SHA-256 checksum of the file
+}
+
+// attachmentStoragePath returns the key of the attachment with the given
+// checksum
+func attachmentStoragePath(checksum string) string {
+	return blobStoragePath(attachmentsFolderName, checksum, "")
+}
+
+// Key returns the key of the attachment in the BlobStore of the database
+func (att *Attachment) Key() string {
+	return attachmentStoragePath(att.Checksum)
+}
+
+// AddAttachment copies the file "fileName" in the database and associates
+// it with the test with ID "testID". The return value is the ID of the new
+// attachment. The parameter "username" is used only for logging purposes.
+func (conn *Connection) AddAttachment(testID int, fileName string, username string) (int, error) {
+	return conn.AddAttachmentContext(context.Background(), testID, fileName, username)
+}
+
+// AddAttachmentContext is like AddAttachment, but it accepts a context to cancel the operation
+func (conn *Connection) AddAttachmentContext(ctx context.Context, testID int, fileName string, username string) (int, error) {
+	if err := conn.checkWritable(); err != nil {
+		return -1, err
+	}
+
+	if err := checkTestExists(conn.withContext(ctx), testID); err != nil {
+		return -1, err
+	}
+
+	inFile, err := os.Open(fileName)
+	if err != nil {
+		return -1, err
+	}
+	defer inFile.Close()
+
+	mimeType := mime.TypeByExtension(filepath.Ext(fileName))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	// The file is saved holding the writer lock, so that another writer
+	// cannot remove an identical object while it is being referenced
+	tx, unlock, err := conn.beginWrite(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer unlock()
+
+	_, checksum, removeFile, err := writeBlob(conn.Blobs, attachmentStoragePath, func(w io.Writer) error {
+		_, err := io.Copy(w, inFile)
+		return err
+	})
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	result, err := tx.Exec(`
+insert into attachments (test_id, file_name, mime_type, checksum) values (?, ?, ?, ?)`,
+		testID, filepath.Base(fileName), mimeType, checksum)
+	if err != nil {
+		tx.Rollback()
+		removeFile()
+		return -1, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		removeFile()
+		return -1, err
+	}
+
+	if _, err := tx.Exec(`
+insert into test_attachment_assoc (test_id, attachment_id) values (?, ?)`,
+		testID, id); err != nil {
+		tx.Rollback()
+		removeFile()
+		return -1, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		removeFile()
+		return -1, err
+	}
+	unlock()
+
+	conn.logAction(ctx, username, ActionCreate, ObjectAttachment, id,
+		fmt.Sprintf("file \"%s\" has been attached to test %d", filepath.Base(fileName), testID))
+	return int(id), nil
+}
+
+// scanAttachment reads one row of the "attachments" table
+func scanAttachment(row rowScanner, att *Attachment) error {
+	var (
+		mimeType sql.NullString
+		checksum sql.NullString
+	)
+	if err := row.Scan(&att.ID, &att.TestID, &att.FileName, &mimeType, &checksum); err != nil {
+		return err
+	}
+
+	att.MimeType = mimeType.String
+	att.Checksum = checksum.String
+	return nil
+}
+
+// GetAttachments returns the attachments of a test, in the order they
+// were added
+func (conn *Connection) GetAttachments(testID int) ([]Attachment, error) {
+	return conn.GetAttachmentsContext(context.Background(), testID)
+}
+
+// GetAttachmentsContext is like GetAttachments, but it accepts a context to cancel the operation
+func (conn *Connection) GetAttachmentsContext(ctx context.Context, testID int) ([]Attachment, error) {
+	if !conn.Active {
+		return []Attachment{}, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select a.attachment_id, ta.test_id, a.file_name, a.mime_type, a.checksum
+from attachments a join test_attachment_assoc ta on a.attachment_id = ta.attachment_id
+where ta.test_id = ? order by a.attachment_id`,
+		testID)
+	if err != nil {
+		return []Attachment{}, err
+	}
+	defer rows.Close()
+
+	result := make([]Attachment, 0)
+	for rows.Next() {
+		var curAttachment Attachment
+		if err := scanAttachment(rows, &curAttachment); err != nil {
+			return []Attachment{}, err
+		}
+		result = append(result, curAttachment)
+	}
+
+	return result, rows.Err()
+}
+
+// OpenAttachment returns a reader for the contents of an attachment, together
+// with the information about it. The caller must close the reader.
+func (conn *Connection) OpenAttachment(attachmentID int) (io.ReadCloser, Attachment, error) {
+	return conn.OpenAttachmentContext(context.Background(), attachmentID)
+}
+
+// OpenAttachmentContext is like OpenAttachment, but it accepts a context to cancel the operation
+func (conn *Connection) OpenAttachmentContext(ctx context.Context, attachmentID int) (io.ReadCloser, Attachment, error) {
+	var att Attachment
+	if !conn.Active {
+		return nil, att, ErrInactive
+	}
+
+	err := scanAttachment(conn.withContext(ctx).QueryRow(`
+select attachment_id, test_id, file_name, mime_type, checksum
+from attachments where attachment_id = ?`,
+		attachmentID), &att)
+	if err == sql.ErrNoRows {
+		return nil, att, errNotFound("no attachment with ID=%d", attachmentID)
+	} else if err != nil {
+		return nil, att, err
+	}
+
+	r, err := conn.Blobs.Get(att.Key())
+	if err == ErrBlobNotFound {
+		return nil, att, fmt.Errorf("the file of attachment %d is missing from the storage", attachmentID)
+	}
+	return r, att, err
+}
@@ -0,0 +1,517 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	backupFormatVersion  = 1
+	backupManifestName   = "manifest.json"
+	backupIndexName      = "index.db"
+	backupBlobFolderName = "blobs"
+)
+
+// BackupFile describes one of the files contained in a backup archive
+type BackupFile struct {
+	Name     string // Name of the file within the archive
+	Size     int64  // Size of the file, in bytes
+	Checksum string // SHA-256 checksum of the file
+}
+
+// BackupBlob describes one of the objects in the BlobStore of the database
+type BackupBlob struct {
+	Key       string // Key of the object in the BlobStore
+	Checksum  string // SHA-256 checksum of the object
+	ArchiveID string // ID of the archive containing the object
+}
+
+// BackupManifest describes the contents of a backup archive. It is saved as
+// the last file of the archive. Incremental backups only contain the objects
+// that are not in the archive they are based on, but the manifest lists all
+// the objects needed to restore the database.
+type BackupManifest struct {
+	FormatVersion int          // Version of the archive format
+	ID            string       // Unique ID of the archive
+	BaseID        string       // ID of the archive this one is based on (empty for full backups)
+	CreationDate  time.Time    // When the backup was made
+	SchemaVersion string       // Version of the database schema
+	Files         []BackupFile // Files contained in this archive
+	Blobs         []BackupBlob // All the objects of the database
+}
+
+// IsIncremental returns true if the archive depends on another one
+func (manifest *BackupManifest) IsIncremental() bool {
+	return manifest.BaseID != ""
+}
+
+// snapshotIndex copies the database into a new file using the online backup
+// API of SQLite, which produces a consistent copy even if other processes
+// are writing to the database
+func (conn *Connection) snapshotIndex(ctx context.Context, destFileName string) error {
+	srcConn, err := conn.Connection.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	destDb, err := sql.Open("sqlite3", destFileName)
+	if err != nil {
+		return err
+	}
+	defer destDb.Close()
+
+	destConn, err := destDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := destDriverConn.(*sqlite3.SQLiteConn).Backup("main",
+				srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			// Copy a few pages at a time, so that writers are not blocked
+			for {
+				if err := ctx.Err(); err != nil {
+					backup.Finish()
+					return err
+				}
+				done, err := backup.Step(256)
+				if err != nil {
+					backup.Finish()
+					return err
+				}
+				if done {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			return backup.Finish()
+		})
+	})
+}
+
+// backupWriter adds files to a tar archive, keeping track of their checksums
+type backupWriter struct {
+	tw       *tar.Writer
+	manifest *BackupManifest
+}
+
+func (bw *backupWriter) add(name string, size int64, r io.Reader) (string, error) {
+	if err := bw.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: bw.manifest.CreationDate,
+	}); err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(bw.tw, io.TeeReader(r, hash)); err != nil {
+		return "", err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	bw.manifest.Files = append(bw.manifest.Files, BackupFile{Name: name, Size: size, Checksum: checksum})
+	return checksum, nil
+}
+
+func (bw *backupWriter) addFile(name string, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = bw.add(name, info.Size(), f)
+	return err
+}
+
+func (bw *backupWriter) addBlob(store BlobStore, info BlobInfo) (string, error) {
+	r, err := store.Get(info.Key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	return bw.add(path.Join(backupBlobFolderName, info.Key), info.Size, r)
+}
+
+// Backup saves a consistent copy of the database and of all its files in the
+// archive "archiveName" (a gzipped tar file), which is verified once it has
+// been written. If "baseArchiveName" is not empty, the backup is incremental:
+// only the objects that are not in that archive are saved. The parameter
+// "username" is used only for logging purposes.
+func (conn *Connection) Backup(archiveName string, baseArchiveName string, username string) (BackupManifest, error) {
+	return conn.BackupContext(context.Background(), archiveName, baseArchiveName, username)
+}
+
+// BackupContext is like Backup, but it accepts a context to cancel the operation
+func (conn *Connection) BackupContext(ctx context.Context, archiveName string, baseArchiveName string, username string) (BackupManifest, error) {
+	manifest := BackupManifest{
+		FormatVersion: backupFormatVersion,
+		ID:            uuid.NewV4().String(),
+		CreationDate:  time.Now().UTC().Truncate(time.Second),
+	}
+	if !conn.Active {
+		return manifest, ErrInactive
+	}
+
+	var err error
+	if manifest.SchemaVersion, err = getSchemaVersion(conn.withContext(ctx)); err != nil {
+		return manifest, err
+	}
+
+	// Objects are content-addressed, so an object with the same key as one
+	// in the base archive has the same contents
+	baseBlobs := make(map[string]BackupBlob)
+	if baseArchiveName != "" {
+		baseManifest, err := VerifyBackup(baseArchiveName)
+		if err != nil {
+			return manifest, fmt.Errorf("invalid base archive \"%s\": %v", baseArchiveName, err)
+		}
+		manifest.BaseID = baseManifest.ID
+		for _, curBlob := range baseManifest.Blobs {
+			baseBlobs[curBlob.Key] = curBlob
+		}
+	}
+
+	snapshotFile, err := ioutil.TempFile("", "stdb-backup-")
+	if err != nil {
+		return manifest, err
+	}
+	snapshotFile.Close()
+	defer os.Remove(snapshotFile.Name())
+
+	// The snapshot is taken before the list of objects is read: objects added
+	// in the meantime are not referenced by the snapshot
+	if err := conn.snapshotIndex(ctx, snapshotFile.Name()); err != nil {
+		return manifest, fmt.Errorf("unable to copy the database: %v", err)
+	}
+
+	out, err := os.Create(archiveName)
+	if err != nil {
+		return manifest, err
+	}
+	err = conn.writeBackupArchive(ctx, out, snapshotFile.Name(), baseBlobs, &manifest)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		_, err = VerifyBackup(archiveName)
+	}
+	if err != nil {
+		os.Remove(archiveName)
+		return manifest, err
+	}
+
+	conn.logAction(ctx, username, ActionRead, ObjectDatabase, manifest.ID,
+		fmt.Sprintf("backup %s saved in \"%s\" (%d files)", manifest.ID, archiveName, len(manifest.Files)))
+	return manifest, nil
+}
+
+func (conn *Connection) writeBackupArchive(ctx context.Context, w io.Writer, snapshotFileName string,
+	baseBlobs map[string]BackupBlob, manifest *BackupManifest) error {
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	bw := backupWriter{tw: tw, manifest: manifest}
+
+	if err := bw.addFile(backupIndexName, snapshotFileName); err != nil {
+		return err
+	}
+
+	for _, curFolder := range blobFolders {
+		blobs, err := conn.Blobs.List(curFolder)
+		if err != nil {
+			return err
+		}
+
+		for _, curBlob := range blobs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if baseBlob, ok := baseBlobs[curBlob.Key]; ok {
+				manifest.Blobs = append(manifest.Blobs, baseBlob)
+				continue
+			}
+
+			checksum, err := bw.addBlob(conn.Blobs, curBlob)
+			if err != nil {
+				return fmt.Errorf("unable to save \"%s\": %v", curBlob.Key, err)
+			}
+			manifest.Blobs = append(manifest.Blobs, BackupBlob{
+				Key:       curBlob.Key,
+				Checksum:  checksum,
+				ArchiveID: manifest.ID,
+			})
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0644,
+		Size:    int64(len(manifestData)),
+		ModTime: manifest.CreationDate,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestData); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// walkBackupArchive calls "fn" for each file in the archive but the
+// manifest, then checks that the files match the manifest, which is
+// returned. The function "fn" must consume the reader.
+func walkBackupArchive(archiveName string, fn func(name string, r io.Reader) error) (BackupManifest, error) {
+	var manifest BackupManifest
+
+	f, err := os.Open(archiveName)
+	if err != nil {
+		return manifest, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return manifest, err
+	}
+	defer zr.Close()
+
+	checksums := make(map[string]string)
+	foundManifest := false
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, err
+		}
+
+		if header.Name == backupManifestName {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, fmt.Errorf("invalid manifest: %v", err)
+			}
+			foundManifest = true
+			continue
+		}
+
+		hash := sha256.New()
+		if err := fn(header.Name, io.TeeReader(tr, hash)); err != nil {
+			return manifest, err
+		}
+		// Make sure that the checksum covers the whole file
+		if _, err := io.Copy(hash, tr); err != nil {
+			return manifest, err
+		}
+		checksums[header.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+	// Read the rest of the stream, so that gzip verifies its checksum
+	if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+		return manifest, err
+	}
+
+	if !foundManifest {
+		return manifest, fmt.Errorf("no manifest found in \"%s\"", archiveName)
+	}
+	if manifest.FormatVersion != backupFormatVersion {
+		return manifest, fmt.Errorf("unsupported archive format %d", manifest.FormatVersion)
+	}
+
+	for _, curFile := range manifest.Files {
+		checksum, ok := checksums[curFile.Name]
+		if !ok {
+			return manifest, fmt.Errorf("file \"%s\" is missing from the archive", curFile.Name)
+		}
+		if checksum != curFile.Checksum {
+			return manifest, fmt.Errorf("file \"%s\" is corrupted (wrong checksum)", curFile.Name)
+		}
+		delete(checksums, curFile.Name)
+	}
+	for name := range checksums {
+		return manifest, fmt.Errorf("file \"%s\" is not listed in the manifest", name)
+	}
+
+	return manifest, nil
+}
+
+// VerifyBackup reads the archive "archiveName" and checks that its contents
+// match the manifest, which is returned.
+func VerifyBackup(archiveName string) (BackupManifest, error) {
+	return walkBackupArchive(archiveName, func(name string, r io.Reader) error {
+		return nil
+	})
+}
+
+// RestoreBackup creates a new database in the folder "dbpath" using the
+// archives in "archiveNames". The first archive must be a full backup, and
+// each of the others must be an incremental backup based on the previous
+// one; the database is restored in the state saved by the last one. All the
+// archives are verified before the folder is created. Objects are restored
+// in the database folder, so the "blob_store" property is reset to "file".
+// The database is restored in a temporary folder, which is renamed into
+// "dbpath" only if no error occurs.
+func RestoreBackup(dbpath string, archiveNames []string) (BackupManifest, error) {
+	var manifest BackupManifest
+	if len(archiveNames) == 0 {
+		return manifest, fmt.Errorf("no archive specified")
+	}
+	if _, err := os.Stat(dbpath); err == nil {
+		return manifest, fmt.Errorf("\"%s\" already exists", dbpath)
+	} else if !os.IsNotExist(err) {
+		return manifest, err
+	}
+
+	archiveIDs := make(map[string]bool)
+	for idx, curName := range archiveNames {
+		curManifest, err := VerifyBackup(curName)
+		if err != nil {
+			return manifest, fmt.Errorf("archive \"%s\" is not valid: %v", curName, err)
+		}
+
+		if idx == 0 && curManifest.IsIncremental() {
+			return manifest, fmt.Errorf("archive \"%s\" is incremental, a full backup must come first", curName)
+		}
+		if idx > 0 && curManifest.BaseID != manifest.ID {
+			return manifest, fmt.Errorf("archive \"%s\" is not based on \"%s\"", curName, archiveNames[idx-1])
+		}
+
+		manifest = curManifest
+		archiveIDs[curManifest.ID] = true
+	}
+
+	// The objects needed to restore the database must be in the archives
+	blobKeys := make(map[string]string)
+	for _, curBlob := range manifest.Blobs {
+		if !archiveIDs[curBlob.ArchiveID] {
+			return manifest, fmt.Errorf("object \"%s\" is contained in archive %s, which was not provided",
+				curBlob.Key, curBlob.ArchiveID)
+		}
+		blobKeys[path.Join(backupBlobFolderName, curBlob.Key)] = curBlob.Key
+	}
+
+	// The temporary folder is created next to "dbpath", so that it can be
+	// renamed without copying the files
+	cleanPath := filepath.Clean(dbpath)
+	tempPath, err := ioutil.TempDir(filepath.Dir(cleanPath), "."+filepath.Base(cleanPath)+".restore")
+	if err != nil {
+		return manifest, err
+	}
+	defer os.RemoveAll(tempPath)
+	if err := os.Chmod(tempPath, 0755); err != nil {
+		return manifest, err
+	}
+
+	if err := restoreArchives(tempPath, archiveNames, blobKeys); err != nil {
+		return manifest, err
+	}
+
+	return manifest, os.Rename(tempPath, dbpath)
+}
+
+// restoreArchives extracts the index and the objects listed in "blobKeys"
+// from the archives into the folder "dbpath"
+func restoreArchives(dbpath string, archiveNames []string, blobKeys map[string]string) error {
+	store := NewFileBlobStore(dbpath)
+	for idx, curName := range archiveNames {
+		isLast := idx == len(archiveNames)-1
+		if _, err := walkBackupArchive(curName, func(name string, r io.Reader) error {
+			if key, ok := blobKeys[name]; ok {
+				delete(blobKeys, name)
+				return store.Put(key, r)
+			}
+			if isLast && name == backupIndexName {
+				return writeFile(path.Join(dbpath, IndexFileName), r)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("unable to restore \"%s\": %v", curName, err)
+		}
+	}
+
+	for _, key := range blobKeys {
+		return fmt.Errorf("object \"%s\" is missing from the archives", key)
+	}
+
+	db, err := sql.Open("sqlite3", path.Join(dbpath, IndexFileName))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`insert or replace into properties (key, value) values ('blob_store', 'file')`)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeFile(fileName string, r io.Reader) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	conn := createTestDatabase(t, "backup")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 5}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	testID, err := conn.AddTest(&Test{TestType: "sweep", Polarimeter: 5}, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	fullArchive := path.Join(targetPath, "backup_full.tar.gz")
+	full, err := conn.Backup(fullArchive, "", "testuser")
+	if err != nil {
+		t.Fatalf("unable to make a full backup: %v", err)
+	}
+	// The database, the FITS file and its preview
+	if full.IsIncremental() || len(full.Blobs) != 2 || len(full.Files) != 3 {
+		t.Errorf("wrong manifest for a full backup: %v", full)
+	}
+
+	if _, err := conn.AddAttachment(testID, inputFilePath, "testuser"); err != nil {
+		t.Fatalf("unable to add an attachment: %v", err)
+	}
+
+	incrArchive := path.Join(targetPath, "backup_incr.tar.gz")
+	incr, err := conn.Backup(incrArchive, fullArchive, "testuser")
+	if err != nil {
+		t.Fatalf("unable to make an incremental backup: %v", err)
+	}
+	// Only the database and the attachment are saved in the new archive
+	if incr.BaseID != full.ID || len(incr.Blobs) != 3 || len(incr.Files) != 2 {
+		t.Errorf("wrong manifest for an incremental backup: %v", incr)
+	}
+
+	if _, err := RestoreBackup(path.Join(targetPath, "restore_bad"), []string{incrArchive}); err == nil {
+		t.Error("an incremental backup was restored without its base")
+	}
+
+	restorePath := path.Join(targetPath, "restore")
+	if _, err := RestoreBackup(restorePath, []string{fullArchive, incrArchive}); err != nil {
+		t.Fatalf("unable to restore a backup: %v", err)
+	}
+
+	var restored Connection
+	if err := restored.Connect(restorePath); err != nil {
+		t.Fatalf("unable to connect to the restored database: %v", err)
+	}
+	defer restored.Disconnect()
+
+	r, _, err := restored.OpenTestData(testID, 0)
+	if err != nil {
+		t.Fatalf("the data of test %d were not restored: %v", testID, err)
+	}
+	r.Close()
+
+	attachments, err := restored.GetAttachments(testID)
+	if err != nil || len(attachments) != 1 {
+		t.Fatalf("attachments were not restored: %v (%v)", attachments, err)
+	}
+	r, _, err = restored.OpenAttachment(attachments[0].ID)
+	if err != nil {
+		t.Fatalf("unable to open a restored attachment: %v", err)
+	}
+	r.Close()
+
+	// Flip one byte of the first file in the archive. This is done on the
+	// uncompressed stream, as some bytes of a deflate stream do not change
+	// its output.
+	f, err := os.Open(fullArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(zr)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[1024] ^= 0xff
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(contents)
+	zw.Close()
+	corruptedArchive := path.Join(targetPath, "backup_corrupted.tar.gz")
+	if err := ioutil.WriteFile(corruptedArchive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyBackup(corruptedArchive); err == nil {
+		t.Error("a corrupted archive was not detected")
+	}
+	if _, err := RestoreBackup(path.Join(targetPath, "restore_corrupted"), []string{corruptedArchive}); err == nil {
+		t.Error("a corrupted archive was restored")
+	} else if _, err := os.Stat(path.Join(targetPath, "restore_corrupted")); !os.IsNotExist(err) {
+		t.Error("the database folder was created for a corrupted archive")
+	}
+	if leftovers, _ := filepath.Glob(path.Join(targetPath, ".restore_corrupted*")); len(leftovers) != 0 {
+		t.Errorf("temporary folders were not removed: %v", leftovers)
+	}
+
+	if _, err := RestoreBackup(restorePath, []string{fullArchive}); err == nil {
+		t.Error("a backup was restored over an existing database")
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBlobNotFound is returned by the methods of a BlobStore when the key
+// does not exist
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes an object saved in a BlobStore
+type BlobInfo struct {
+	Key     string    // Key of the object
+	Size    int64     // Size of the object, in bytes
+	ModTime time.Time // When the object was last modified
+}
+
+// BlobStore is a place where the data of tests and attachments are saved.
+// Keys are slash-separated paths like "data/3f/a1/3fa1….fits.gz".
+type BlobStore interface {
+	// Put saves the contents of "r" under "key", overwriting any existing
+	// object with the same key
+	Put(key string, r io.Reader) error
+	// Get returns a reader for the object; the caller must close it
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns information about the object
+	Stat(key string) (BlobInfo, error)
+	// Delete removes the object
+	Delete(key string) error
+	// List returns all the objects whose key begins with "prefix", sorted
+	// by key
+	List(prefix string) ([]BlobInfo, error)
+}
+
+// validateBlobKey checks that a key cannot be used to escape the store
+func validateBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key ||
+		strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid blob key \"%s\"", key)
+	}
+	return nil
+}
+
+// FileBlobStore keeps objects in a folder of the local filesystem, using
+// the key as the relative path of the file
+type FileBlobStore struct {
+	Root string // Folder containing the objects
+}
+
+// NewFileBlobStore creates a BlobStore using the folder "root"
+func NewFileBlobStore(root string) *FileBlobStore {
+	return &FileBlobStore{Root: root}
+}
+
+func (store *FileBlobStore) fullPath(key string) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(store.Root, filepath.FromSlash(key)), nil
+}
+
+// Put implements BlobStore. The object is first written in a temporary file,
+// so that readers never see partial contents.
+func (store *FileBlobStore) Put(key string, r io.Reader) error {
+	fullPath, err := store.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fullPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), fullPath); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return nil
+}
+
+// Get implements BlobStore
+func (store *FileBlobStore) Get(key string) (io.ReadCloser, error) {
+	fullPath, err := store.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fullPath)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+// Stat implements BlobStore
+func (store *FileBlobStore) Stat(key string) (BlobInfo, error) {
+	fullPath, err := store.fullPath(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+
+	return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete implements BlobStore
+func (store *FileBlobStore) Delete(key string) error {
+	fullPath, err := store.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(fullPath)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// List implements BlobStore. Temporary files created by Put are skipped.
+func (store *FileBlobStore) List(prefix string) ([]BlobInfo, error) {
+	result := make([]BlobInfo, 0)
+	err := filepath.Walk(store.Root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(store.Root, fullPath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, err
+}
+
+// MemoryBlobStore keeps objects in memory. It is meant to be used in tests.
+type MemoryBlobStore struct {
+	mutex   sync.Mutex
+	objects map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	contents []byte
+	modTime  time.Time
+}
+
+// NewMemoryBlobStore creates an empty BlobStore that keeps objects in memory
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{objects: make(map[string]memoryBlob)}
+}
+
+// Put implements BlobStore
+func (store *MemoryBlobStore) Put(key string, r io.Reader) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.objects[key] = memoryBlob{contents: contents, modTime: time.Now()}
+	return nil
+}
+
+// Get implements BlobStore
+func (store *MemoryBlobStore) Get(key string) (io.ReadCloser, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	blob, ok := store.objects[key]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob.contents)), nil
+}
+
+// Stat implements BlobStore
+func (store *MemoryBlobStore) Stat(key string) (BlobInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	blob, ok := store.objects[key]
+	if !ok {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	return BlobInfo{Key: key, Size: int64(len(blob.contents)), ModTime: blob.modTime}, nil
+}
+
+// Delete implements BlobStore
+func (store *MemoryBlobStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.objects[key]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(store.objects, key)
+	return nil
+}
+
+// List implements BlobStore
+func (store *MemoryBlobStore) List(prefix string) ([]BlobInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	result := make([]BlobInfo, 0)
+	for key, blob := range store.objects {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, BlobInfo{Key: key, Size: int64(len(blob.contents)), ModTime: blob.modTime})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+// Kinds of BlobStore that can be specified in the "blob_store" property
+var blobStoreKinds = []string{"file", "s3"}
+
+func validateBlobStoreKind(value string) error {
+	for _, curKind := range blobStoreKinds {
+		if value == curKind {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown blob store \"%s\" (valid values are %s)",
+		value, strings.Join(blobStoreKinds, ", "))
+}
+
+// openBlobStore creates the BlobStore specified by the properties of the
+// database. If "blob_store" is "file" (the default), objects are saved in
+// the database folder. If it is "s3", the properties "s3_endpoint",
+// "s3_bucket", "s3_region", and "s3_prefix" are used; credentials are read
+// from the environment variables STDB_S3_ACCESS_KEY and STDB_S3_SECRET_KEY
+// (or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY), so that they are not
+// saved in the database.
+func openBlobStore(q queryRower, basePath string) (BlobStore, error) {
+	props := map[string]string{
+		"blob_store":  "file",
+		"s3_endpoint": "",
+		"s3_bucket":   "",
+		"s3_region":   "",
+		"s3_prefix":   "",
+	}
+	for key, defaultValue := range props {
+		value, err := getProperty(q, key, defaultValue)
+		if err != nil {
+			return nil, err
+		}
+		props[key] = value
+	}
+
+	switch props["blob_store"] {
+	case "file":
+		return NewFileBlobStore(basePath), nil
+	case "s3":
+		if props["s3_endpoint"] == "" || props["s3_bucket"] == "" {
+			return nil, fmt.Errorf("properties \"s3_endpoint\" and \"s3_bucket\" must be set")
+		}
+
+		store := NewS3BlobStore(props["s3_endpoint"], props["s3_bucket"], props["s3_region"],
+			firstNonEmpty(os.Getenv("STDB_S3_ACCESS_KEY"), os.Getenv("AWS_ACCESS_KEY_ID")),
+			firstNonEmpty(os.Getenv("STDB_S3_SECRET_KEY"), os.Getenv("AWS_SECRET_ACCESS_KEY")))
+		store.Prefix = props["s3_prefix"]
+		return store, nil
+	}
+
+	return nil, validateBlobStoreKind(props["blob_store"])
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, curValue := range values {
+		if curValue != "" {
+			return curValue
+		}
+	}
+	return ""
+}
@@ -0,0 +1,462 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Campaign is a group of tests done in the same test campaign or
+// cryogenic cooldown. At most one campaign can be open at any time:
+// new tests are automatically associated with it.
+type Campaign struct {
+	ID        int       // Unique ID of the campaign
+	Name      string    // Name of the campaign (must be unique)
+	StartDate time.Time // When the campaign started
+	EndDate   time.Time // When the campaign ended (zero if still open)
+	Cryostat  string    // Cryostat used during the campaign
+	Operator  string    // Person in charge of the campaign
+	Notes     string    // Free-form notes
+}
+
+// IsOpen returns true if the campaign has not been closed yet
+func (c *Campaign) IsOpen() bool {
+	return c.EndDate.IsZero()
+}
+
+// CampaignSummary contains aggregated information about the tests
+// belonging to a campaign
+type CampaignSummary struct {
+	NumOfTests     int            // Number of tests in the campaign
+	Polarimeters   []int          // Polarimeters tested during the campaign
+	TestTypes      map[string]int // Number of tests for each test type
+	FirstTestDate  time.Time      // Acquisition date of the first test
+	LastTestDate   time.Time      // Acquisition date of the last test
+	TotalTimeSpan  float64        // Sum of the length of all the tests, in seconds
+	CryogenicTests int            // Number of tests done at cryogenic temperatures
+}
+
+// scanCampaign reads one row of the "campaigns" table. The columns must be
+// in the same order as in the "campaigns" table.
+func scanCampaign(row rowScanner, campaign *Campaign) error {
+	var (
+		startDate string
+		endDate   sql.NullString
+		cryostat  sql.NullString
+		operator  sql.NullString
+		notes     sql.NullString
+	)
+	if err := row.Scan(&campaign.ID, &campaign.Name, &startDate, &endDate,
+		&cryostat, &operator, &notes); err != nil {
+		return err
+	}
+
+	var err error
+	if campaign.StartDate, err = time.Parse(time.RFC3339, startDate); err != nil {
+		return err
+	}
+	campaign.EndDate = time.Time{}
+	if endDate.Valid {
+		if campaign.EndDate, err = time.Parse(time.RFC3339, endDate.String); err != nil {
+			return err
+		}
+	}
+
+	campaign.Cryostat = cryostat.String
+	campaign.Operator = operator.String
+	campaign.Notes = notes.String
+	return nil
+}
+
+// getOpenCampaignID returns the ID of the campaign that is currently open,
+// or zero if no campaign is open
+func getOpenCampaignID(q queryRower) (int, error) {
+	var id int
+	err := q.QueryRow(`select campaign_id from campaigns where end_date is null`).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return id, err
+}
+
+// OpenCampaign creates a new campaign and makes it the current one, so that
+// tests added later are associated with it. If the StartDate field of
+// "campaign" is zero, the current time is used. It is not possible to open
+// a campaign while another one is still open. The return value contains the
+// unique ID of the campaign. The parameter "username" is used only for
+// logging purposes.
+func (conn *Connection) OpenCampaign(campaign *Campaign, username string) (int, error) {
+	return conn.OpenCampaignContext(context.Background(), campaign, username)
+}
+
+// OpenCampaignContext is like OpenCampaign, but it accepts a context to cancel the operation
+func (conn *Connection) OpenCampaignContext(ctx context.Context, campaign *Campaign, username string) (int, error) {
+	if err := conn.checkWritable(); err != nil {
+		return -1, err
+	}
+
+	if campaign.Name == "" {
+		return -1, fmt.Errorf("the name of a campaign cannot be empty")
+	}
+	if campaign.StartDate.IsZero() {
+		campaign.StartDate = time.Now().UTC()
+	}
+	campaign.EndDate = time.Time{}
+
+	tx, unlock, err := conn.beginWrite(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer unlock()
+
+	openID, err := getOpenCampaignID(tx)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	if openID != 0 {
+		tx.Rollback()
+		return -1, fmt.Errorf("campaign %d is still open, close it first", openID)
+	}
+
+	result, err := tx.Exec(`
+insert into campaigns (name, start_date, cryostat, operator, notes) values (?, ?, ?, ?, ?)`,
+		campaign.Name,
+		campaign.StartDate.Format(time.RFC3339),
+		campaign.Cryostat,
+		campaign.Operator,
+		campaign.Notes)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return -1, err
+	}
+	unlock()
+
+	campaign.ID = int(id)
+	conn.logAction(ctx, username, ActionCreate, ObjectCampaign, id,
+		fmt.Sprintf("campaign \"%s\" (ID=%d) has been opened", campaign.Name, id))
+	return int(id), nil
+}
+
+// CloseCampaign marks the campaign with the given ID as closed. If "endDate"
+// is zero, the current time is used. The parameter "username" is used only
+// for logging purposes.
+func (conn *Connection) CloseCampaign(campaignID int, endDate time.Time, username string) error {
+	return conn.CloseCampaignContext(context.Background(), campaignID, endDate, username)
+}
+
+// CloseCampaignContext is like CloseCampaign, but it accepts a context to cancel the operation
+func (conn *Connection) CloseCampaignContext(ctx context.Context, campaignID int, endDate time.Time, username string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	if endDate.IsZero() {
+		endDate = time.Now().UTC()
+	}
+
+	result, err := conn.execWrite(ctx, `
+update campaigns set end_date = ? where campaign_id = ? and end_date is null`,
+		endDate.Format(time.RFC3339), campaignID)
+	if err != nil {
+		return err
+	}
+
+	if numOfRows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if numOfRows == 0 {
+		return fmt.Errorf("there is no open campaign with ID=%d", campaignID)
+	}
+
+	conn.logAction(ctx, username, ActionUpdate, ObjectCampaign, campaignID,
+		fmt.Sprintf("campaign with ID=%d has been closed", campaignID))
+	return nil
+}
+
+// GetOpenCampaign fills "campaign" with the campaign that is currently open.
+// The boolean is false if no campaign is open.
+func (conn *Connection) GetOpenCampaign(campaign *Campaign) (bool, error) {
+	return conn.GetOpenCampaignContext(context.Background(), campaign)
+}
+
+// GetOpenCampaignContext is like GetOpenCampaign, but it accepts a context to cancel the operation
+func (conn *Connection) GetOpenCampaignContext(ctx context.Context, campaign *Campaign) (bool, error) {
+	if !conn.Active {
+		return false, ErrInactive
+	}
+
+	err := scanCampaign(conn.withContext(ctx).QueryRow(`
+select campaign_id, name, start_date, end_date, cryostat, operator, notes
+from campaigns where end_date is null`), campaign)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetCampaign searches for a campaign with the given ID and saves it in
+// "campaign". The parameter "username" is used only for logging purposes,
+// and it can be empty.
+func (conn *Connection) GetCampaign(campaignID int, username string, campaign *Campaign) error {
+	return conn.GetCampaignContext(context.Background(), campaignID, username, campaign)
+}
+
+// GetCampaignContext is like GetCampaign, but it accepts a context to cancel the operation
+func (conn *Connection) GetCampaignContext(ctx context.Context, campaignID int, username string, campaign *Campaign) error {
+	if !conn.Active {
+		return ErrInactive
+	}
+
+	err := scanCampaign(conn.withContext(ctx).QueryRow(`
+select campaign_id, name, start_date, end_date, cryostat, operator, notes
+from campaigns where campaign_id = ?`, campaignID), campaign)
+	if err == sql.ErrNoRows {
+		return errNotFound("no campaign with ID=%d", campaignID)
+	} else if err != nil {
+		return err
+	}
+
+	conn.logAction(ctx, username, ActionRead, ObjectCampaign, campaignID,
+		fmt.Sprintf("request for campaign with ID=%d has been satisfied", campaignID))
+	return nil
+}
+
+// GetCampaignByName searches for a campaign with the given name and saves
+// it in "campaign".
+func (conn *Connection) GetCampaignByName(name string, campaign *Campaign) error {
+	return conn.GetCampaignByNameContext(context.Background(), name, campaign)
+}
+
+// GetCampaignByNameContext is like GetCampaignByName, but it accepts a context to cancel the operation
+func (conn *Connection) GetCampaignByNameContext(ctx context.Context, name string, campaign *Campaign) error {
+	if !conn.Active {
+		return ErrInactive
+	}
+
+	err := scanCampaign(conn.withContext(ctx).QueryRow(`
+select campaign_id, name, start_date, end_date, cryostat, operator, notes
+from campaigns where name = ?`, name), campaign)
+	if err == sql.ErrNoRows {
+		return errNotFound("no campaign named \"%s\"", name)
+	}
+
+	return err
+}
+
+// GetListOfCampaigns returns all the campaigns in the database, from the
+// most recent to the most ancient one. The parameter "username" is used
+// only for logging purposes.
+func (conn *Connection) GetListOfCampaigns(username string) ([]Campaign, error) {
+	return conn.GetListOfCampaignsContext(context.Background(), username)
+}
+
+// GetListOfCampaignsContext is like GetListOfCampaigns, but it accepts a context to cancel the operation
+func (conn *Connection) GetListOfCampaignsContext(ctx context.Context, username string) ([]Campaign, error) {
+	if !conn.Active {
+		return []Campaign{}, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select campaign_id, name, start_date, end_date, cryostat, operator, notes
+from campaigns order by start_date desc, campaign_id desc`)
+	if err != nil {
+		return []Campaign{}, err
+	}
+	defer rows.Close()
+
+	result := make([]Campaign, 0)
+	for rows.Next() {
+		var curCampaign Campaign
+		if err := scanCampaign(rows, &curCampaign); err != nil {
+			return []Campaign{}, err
+		}
+		result = append(result, curCampaign)
+	}
+	if err := rows.Err(); err != nil {
+		return []Campaign{}, err
+	}
+
+	conn.logAction(ctx, username, ActionRead, ObjectCampaign, "",
+		fmt.Sprintf("querying the list of campaigns, %d results returned", len(result)))
+	return result, nil
+}
+
+// GetListOfTestIDsForCampaign returns the IDs of all the tests belonging to
+// a campaign, from the most recent to the most ancient one. If maxNum is
+// positive, it specifies the maximum number of IDs to retrieve. The
+// parameter "username" is used only for logging purposes.
+func (conn *Connection) GetListOfTestIDsForCampaign(campaignID int, username string, maxNum int) ([]int, error) {
+	return conn.GetListOfTestIDsForCampaignContext(context.Background(), campaignID, username, maxNum)
+}
+
+// GetListOfTestIDsForCampaignContext is like GetListOfTestIDsForCampaign, but it accepts a context to cancel the operation
+func (conn *Connection) GetListOfTestIDsForCampaignContext(ctx context.Context, campaignID int, username string, maxNum int) ([]int, error) {
+	if !conn.Active {
+		return []int{}, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select test_id from tests where campaign_id = ? order by test_id desc limit ?`,
+		campaignID, maxNum)
+	if err != nil {
+		return []int{}, err
+	}
+	defer rows.Close()
+
+	result := make([]int, 0)
+	for rows.Next() {
+		var curID int64
+		if err := rows.Scan(&curID); err != nil {
+			return []int{}, err
+		}
+		result = append(result, int(curID))
+	}
+	if err := rows.Err(); err != nil {
+		return []int{}, err
+	}
+
+	conn.logAction(ctx, username, ActionRead, ObjectCampaign, campaignID,
+		fmt.Sprintf("querying the tests of campaign %d, %d results returned (maxNum=%d)",
+			campaignID, len(result), maxNum))
+	return result, nil
+}
+
+// GetCampaignSummary computes aggregated information about the tests
+// belonging to the campaign with the given ID
+func (conn *Connection) GetCampaignSummary(campaignID int) (CampaignSummary, error) {
+	return conn.GetCampaignSummaryContext(context.Background(), campaignID)
+}
+
+// GetCampaignSummaryContext is like GetCampaignSummary, but it accepts a context to cancel the operation
+func (conn *Connection) GetCampaignSummaryContext(ctx context.Context, campaignID int) (CampaignSummary, error) {
+	summary := CampaignSummary{
+		Polarimeters: []int{},
+		TestTypes:    make(map[string]int),
+	}
+
+	if !conn.Active {
+		return summary, ErrInactive
+	}
+
+	var (
+		firstDate     sql.NullString
+		lastDate      sql.NullString
+		totalTimeSpan sql.NullFloat64
+		cryoTests     sql.NullInt64
+	)
+	err := conn.withContext(ctx).QueryRow(`
+select count(*), min(creation_date), max(creation_date), sum(time_span_sec), sum(is_cryogenic)
+from tests where campaign_id = ?`,
+		campaignID).Scan(&summary.NumOfTests, &firstDate, &lastDate, &totalTimeSpan, &cryoTests)
+	if err != nil {
+		return summary, err
+	}
+
+	if firstDate.Valid {
+		if summary.FirstTestDate, err = time.Parse(time.RFC3339Nano, firstDate.String); err != nil {
+			return summary, err
+		}
+	}
+	if lastDate.Valid {
+		if summary.LastTestDate, err = time.Parse(time.RFC3339Nano, lastDate.String); err != nil {
+			return summary, err
+		}
+	}
+	summary.TotalTimeSpan = totalTimeSpan.Float64
+	summary.CryogenicTests = int(cryoTests.Int64)
+
+	polRows, err := conn.withContext(ctx).Query(`
+select distinct polarimeter from tests where campaign_id = ? order by polarimeter`,
+		campaignID)
+	if err != nil {
+		return summary, err
+	}
+	defer polRows.Close()
+
+	for polRows.Next() {
+		var curPol int
+		if err := polRows.Scan(&curPol); err != nil {
+			return summary, err
+		}
+		summary.Polarimeters = append(summary.Polarimeters, curPol)
+	}
+	if err := polRows.Err(); err != nil {
+		return summary, err
+	}
+
+	typeRows, err := conn.withContext(ctx).Query(`
+select type, count(*) from tests where campaign_id = ? group by type`,
+		campaignID)
+	if err != nil {
+		return summary, err
+	}
+	defer typeRows.Close()
+
+	for typeRows.Next() {
+		var (
+			curType  string
+			curCount int
+		)
+		if err := typeRows.Scan(&curType, &curCount); err != nil {
+			return summary, err
+		}
+		summary.TestTypes[curType] = curCount
+	}
+
+	return summary, typeRows.Err()
+}
+
+// checkCampaign returns the ID of the campaign a new test should be
+// associated with. If "campaignID" is zero, the campaign currently open is
+// used (if any); otherwise, the function checks that the campaign exists.
+// The value returned is NULL if the test does not belong to any campaign.
+func checkCampaign(tx *sql.Tx, campaignID int) (sql.NullInt64, error) {
+	if campaignID == 0 {
+		openID, err := getOpenCampaignID(tx)
+		return sql.NullInt64{Int64: int64(openID), Valid: openID != 0}, err
+	}
+
+	var id int
+	err := tx.QueryRow(`select campaign_id from campaigns where campaign_id = ?`,
+		campaignID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return sql.NullInt64{}, errNotFound("no campaign with ID=%d", campaignID)
+	}
+
+	return sql.NullInt64{Int64: int64(id), Valid: err == nil}, err
+}
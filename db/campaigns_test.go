@@ -0,0 +1,96 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCampaigns(t *testing.T) {
+	conn := createTestDatabase(t, "campaigns")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 2}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	startDate := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	campaignID, err := conn.OpenCampaign(&Campaign{
+		Name:      "cooldown-1",
+		StartDate: startDate,
+		Cryostat:  "Bicocca",
+	}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to open a campaign: %v", err)
+	}
+
+	if _, err := conn.OpenCampaign(&Campaign{Name: "cooldown-2"}, "testuser"); err == nil {
+		t.Error("two campaigns were opened at the same time")
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	test := Test{TestType: "sweep", Polarimeter: 2, CryogenicFlag: true}
+	testID, err := conn.AddTest(&test, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	if test.CampaignID != campaignID {
+		t.Errorf("test was not associated with the open campaign (%d != %d)",
+			test.CampaignID, campaignID)
+	}
+
+	if err := conn.CloseCampaign(campaignID, time.Time{}, "testuser"); err != nil {
+		t.Errorf("unable to close a campaign: %v", err)
+	}
+
+	var campaign Campaign
+	if err := conn.GetCampaign(campaignID, "testuser", &campaign); err != nil {
+		t.Errorf("unable to retrieve a campaign: %v", err)
+	}
+	if campaign.IsOpen() || !campaign.StartDate.Equal(startDate) || campaign.Cryostat != "Bicocca" {
+		t.Errorf("wrong campaign returned by GetCampaign: %v", campaign)
+	}
+
+	// Now that no campaign is open, new tests are not associated with any
+	test = Test{TestType: "sweep", Polarimeter: 2}
+	if _, err := conn.AddTest(&test, "testuser", inputFilePath); err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	if test.CampaignID != 0 {
+		t.Errorf("test was associated with a closed campaign")
+	}
+
+	ids, err := conn.GetListOfTestIDsForCampaign(campaignID, "testuser", -1)
+	if err != nil || len(ids) != 1 || ids[0] != testID {
+		t.Errorf("unexpected result from GetListOfTestIDsForCampaign: %v (%v)", ids, err)
+	}
+
+	summary, err := conn.GetCampaignSummary(campaignID)
+	if err != nil {
+		t.Fatalf("unable to compute the summary of a campaign: %v", err)
+	}
+	if summary.NumOfTests != 1 || summary.CryogenicTests != 1 || summary.TestTypes["sweep"] != 1 ||
+		len(summary.Polarimeters) != 1 || summary.Polarimeters[0] != 2 {
+		t.Errorf("wrong summary for campaign %d: %v", campaignID, summary)
+	}
+}
@@ -0,0 +1,547 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Severity of the problems found by Check
+const (
+	SeverityInfo    = "info"    // Nothing is wrong, but something can be improved
+	SeverityWarning = "warning" // Something is wrong, but no data are lost
+	SeverityError   = "error"   // Some data are missing or corrupted
+)
+
+// Problem is an inconsistency found by Check
+type Problem struct {
+	Severity string // One of the Severity* constants
+	Object   string // What is affected, e.g., "test 12" or the key of a file
+	Message  string // Description of the problem
+	Fixable  bool   // Can Check fix the problem without losing data?
+	Fixed    bool   // Has Check fixed the problem?
+
+	fix func(tx *sql.Tx) error // Changes to the database needed to fix the problem
+	key string                 // Object to remove from the BlobStore to fix the problem
+}
+
+// CheckOptions specifies what Check should do
+type CheckOptions struct {
+	Fix           bool // Fix the problems that can be fixed safely
+	SkipChecksums bool // Do not read the files to verify their checksums (faster)
+}
+
+// CheckReport is the result of Check
+type CheckReport struct {
+	Problems []Problem
+}
+
+// Count returns the number of problems with the given severity
+func (report *CheckReport) Count(severity string) int {
+	result := 0
+	for _, curProblem := range report.Problems {
+		if curProblem.Severity == severity {
+			result++
+		}
+	}
+	return result
+}
+
+// orphanGracePeriod is how old an object in the BlobStore must be before
+// Check considers it an orphan: objects are saved before the rows that
+// refer to them, so recent ones might belong to an import in progress.
+const orphanGracePeriod = time.Hour
+
+// checker holds the state of a consistency check
+type checker struct {
+	ctx     context.Context
+	conn    *Connection
+	q       contextDB
+	options CheckOptions
+	report  CheckReport
+}
+
+func (c *checker) add(problem Problem) {
+	c.report.Problems = append(c.report.Problems, problem)
+}
+
+// blobChecksum returns the SHA-256 checksum of an object of the BlobStore
+func blobChecksum(store BlobStore, key string) (string, error) {
+	r, err := store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkSchemaVersion verifies that the schema is the one this program uses
+func (c *checker) checkSchemaVersion() error {
+	version, err := getSchemaVersion(c.q)
+	if err != nil {
+		return err
+	}
+	if version != DatabaseSchemaVersion {
+		c.add(Problem{
+			Severity: SeverityError,
+			Object:   "schema",
+			Message: fmt.Sprintf("the database uses version %s of the schema, but this program expects %s",
+				version, DatabaseSchemaVersion),
+		})
+	}
+	return nil
+}
+
+// checkDataFiles verifies that the FITS file of each version of the data
+// is present, that the statistics of its columns have been computed and,
+// unless SkipChecksums is set, that it is not corrupted. It returns the
+// keys of the FITS files and of their previews.
+func (c *checker) checkDataFiles() (map[string]bool, error) {
+	type dataFile struct {
+		testID   int
+		version  int
+		key      string
+		checksum sql.NullString
+	}
+	var files []dataFile
+	if err := forEachRow(c.q, `
+select test_id, version, file_name, fits_checksum from test_data_versions order by test_id, version`,
+		func(values []interface{}) error {
+			curFile := dataFile{
+				testID:  int(values[0].(int64)),
+				version: int(values[1].(int64)),
+			}
+			curFile.key, _ = values[2].(string)
+			curFile.checksum.String, curFile.checksum.Valid = values[3].(string)
+			files = append(files, curFile)
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+
+	withStats := make(map[[2]int]bool)
+	if err := forEachRow(c.q, `select distinct test_id, version from column_stats`,
+		func(values []interface{}) error {
+			withStats[[2]int{int(values[0].(int64)), int(values[1].(int64))}] = true
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+
+	usedKeys := make(map[string]bool)
+	for _, curFile := range files {
+		if err := c.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		usedKeys[curFile.key] = true
+		if curFile.checksum.Valid && curFile.checksum.String != "" {
+			usedKeys[previewStoragePath(curFile.checksum.String)] = true
+		}
+		object := fmt.Sprintf("test %d (version %d)", curFile.testID, curFile.version)
+		if _, err := c.conn.Blobs.Stat(curFile.key); err == ErrBlobNotFound {
+			c.add(Problem{
+				Severity: SeverityError,
+				Object:   object,
+				Message:  fmt.Sprintf("FITS file \"%s\" is missing", curFile.key),
+			})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		testID, version := curFile.testID, curFile.version
+		if !c.options.SkipChecksums {
+			checksum, err := blobChecksum(c.conn.Blobs, curFile.key)
+			if err != nil {
+				return nil, err
+			}
+			if !curFile.checksum.Valid || curFile.checksum.String == "" {
+				c.add(Problem{
+					Severity: SeverityInfo,
+					Object:   object,
+					Message:  "the checksum of the FITS file is not recorded",
+					Fixable:  true,
+					fix: func(tx *sql.Tx) error {
+						_, err := tx.Exec(`
+update test_data_versions set fits_checksum = ? where test_id = ? and version = ?`,
+							checksum, testID, version)
+						return err
+					},
+				})
+			} else if checksum != curFile.checksum.String {
+				c.add(Problem{
+					Severity: SeverityError,
+					Object:   object,
+					Message: fmt.Sprintf("FITS file \"%s\" is corrupted (checksum %s instead of %s)",
+						curFile.key, checksum, curFile.checksum.String),
+				})
+				continue
+			}
+		}
+
+		// Data imported by older versions of stdb have no statistics, which
+		// are computed here and not while upgrading the schema, as this
+		// requires to read every FITS file. They are computed before
+		// applyFixes takes the writer lock, so that other processes are
+		// not blocked while the files are read.
+		if !withStats[[2]int{testID, version}] {
+			problem := Problem{
+				Severity: SeverityInfo,
+				Object:   object,
+				Message:  "the statistics of the columns are missing, so searches on columns ignore this test",
+				Fixable:  true,
+			}
+			if c.options.Fix {
+				if _, stats, err := summarizeBlob(c.conn.Blobs, curFile.key); err != nil {
+					problem.Severity = SeverityWarning
+					problem.Message = fmt.Sprintf("the statistics of the columns are missing and cannot be computed: %v", err)
+					problem.Fixable = false
+				} else {
+					problem.fix = func(tx *sql.Tx) error {
+						return saveColumnStats(tx, int64(testID), version, stats)
+					}
+				}
+			}
+			c.add(problem)
+		}
+	}
+
+	// Tests must have at least one version of the data
+	if err := forEachRow(c.q, `
+select test_id from tests t
+where not exists (select 1 from test_data_versions v where v.test_id = t.test_id)
+order by test_id`,
+		func(values []interface{}) error {
+			c.add(Problem{
+				Severity: SeverityError,
+				Object:   fmt.Sprintf("test %d", values[0].(int64)),
+				Message:  "the test has no FITS file",
+			})
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+
+	return usedKeys, nil
+}
+
+// checkAttachments verifies that the file of each attachment is present
+// and not corrupted, and that associations refer to existing rows
+func (c *checker) checkAttachments() (map[string]bool, error) {
+	type attachment struct {
+		id       int
+		checksum string
+	}
+	var attachments []attachment
+	if err := forEachRow(c.q, `select attachment_id, checksum from attachments order by attachment_id`,
+		func(values []interface{}) error {
+			curAttachment := attachment{id: int(values[0].(int64))}
+			curAttachment.checksum, _ = values[1].(string)
+			attachments = append(attachments, curAttachment)
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+
+	usedKeys := make(map[string]bool)
+	for _, curAttachment := range attachments {
+		if err := c.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		object := fmt.Sprintf("attachment %d", curAttachment.id)
+		if curAttachment.checksum == "" {
+			c.add(Problem{
+				Severity: SeverityError,
+				Object:   object,
+				Message:  "the attachment has no checksum, so its file cannot be found",
+			})
+			continue
+		}
+
+		key := attachmentStoragePath(curAttachment.checksum)
+		usedKeys[key] = true
+		if _, err := c.conn.Blobs.Stat(key); err == ErrBlobNotFound {
+			c.add(Problem{
+				Severity: SeverityError,
+				Object:   object,
+				Message:  fmt.Sprintf("file \"%s\" is missing", key),
+			})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if c.options.SkipChecksums {
+			continue
+		}
+		if checksum, err := blobChecksum(c.conn.Blobs, key); err != nil {
+			return nil, err
+		} else if checksum != curAttachment.checksum {
+			c.add(Problem{
+				Severity: SeverityError,
+				Object:   object,
+				Message:  fmt.Sprintf("file \"%s\" is corrupted (checksum %s)", key, checksum),
+			})
+		}
+	}
+
+	if err := forEachRow(c.q, `
+select rowid, test_id, attachment_id from test_attachment_assoc ta
+where not exists (select 1 from tests t where t.test_id = ta.test_id)
+   or not exists (select 1 from attachments a where a.attachment_id = ta.attachment_id)`,
+		func(values []interface{}) error {
+			rowID := values[0].(int64)
+			c.add(Problem{
+				Severity: SeverityWarning,
+				Object:   fmt.Sprintf("test %d, attachment %d", values[1], values[2]),
+				Message:  "the association between a test and an attachment refers to a missing row",
+				Fixable:  true,
+				fix: func(tx *sql.Tx) error {
+					_, err := tx.Exec(`delete from test_attachment_assoc where rowid = ?`, rowID)
+					return err
+				},
+			})
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+
+	return usedKeys, nil
+}
+
+// checkOrphanBlobs looks for objects in "folder" that are not used by any
+// row of the database. Only previews can be removed safely, as they are
+// computed again when needed: data files and attachments might be the
+// only copy of something that the index has lost (e.g., after a reindex).
+func (c *checker) checkOrphanBlobs(folder string, usedKeys map[string]bool) error {
+	blobs, err := c.conn.Blobs.List(folder + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, curBlob := range blobs {
+		if usedKeys[curBlob.Key] || time.Since(curBlob.ModTime) < orphanGracePeriod {
+			continue
+		}
+		c.add(Problem{
+			Severity: SeverityWarning,
+			Object:   curBlob.Key,
+			Message:  fmt.Sprintf("the file is not used by any test (%d bytes)", curBlob.Size),
+			Fixable:  folder == previewsFolderName,
+			key:      curBlob.Key,
+		})
+	}
+	return nil
+}
+
+// checkUsers looks for users that have no password
+func (c *checker) checkUsers() error {
+	return forEachRow(c.q, `
+select user_id, is_enabled from users where password_hash is null or password_hash = '' order by user_id`,
+		func(values []interface{}) error {
+			user, _ := values[0].(string)
+			enabled, _ := values[1].(int64)
+			problem := Problem{
+				Severity: SeverityWarning,
+				Object:   fmt.Sprintf("user %s", user),
+				Message:  "the user has an empty password hash",
+			}
+			if enabled != 0 {
+				problem.Message += " and should be disabled"
+				problem.Fixable = true
+				problem.fix = func(tx *sql.Tx) error {
+					_, err := tx.Exec(`update users set is_enabled = 0 where user_id = ?`, user)
+					return err
+				}
+			}
+			c.add(problem)
+			return nil
+		})
+}
+
+// dateColumns lists the columns containing dates in RFC 3339 format
+var dateColumns = []struct {
+	table    string
+	column   string
+	severity string
+}{
+	{"tests", "creation_date", SeverityError},
+	{"test_data_versions", "creation_date", SeverityWarning},
+	{"campaigns", "start_date", SeverityError},
+	{"campaigns", "end_date", SeverityError},
+	{"test_relations", "creation_date", SeverityWarning},
+	{"test_comments", "creation_date", SeverityWarning},
+	{"users", "creation_date", SeverityWarning},
+	{"log", "date", SeverityInfo},
+}
+
+// checkDates looks for dates that cannot be parsed
+func (c *checker) checkDates() error {
+	for _, cur := range dateColumns {
+		severity := cur.severity
+		table := cur.table
+		if err := forEachRow(c.q, fmt.Sprintf(`
+select rowid, %s from %s where %[1]s is not null`, cur.column, cur.table),
+			func(values []interface{}) error {
+				date, _ := values[1].(string)
+				if _, err := time.Parse(time.RFC3339Nano, date); err != nil {
+					c.add(Problem{
+						Severity: severity,
+						Object:   fmt.Sprintf("row %d of table \"%s\"", values[0], table),
+						Message:  fmt.Sprintf("invalid date \"%s\"", date),
+					})
+				}
+				return nil
+			}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyFixes fixes the problems in the report that can be fixed
+func (c *checker) applyFixes() (int, error) {
+	tx, unlock, err := c.conn.beginWrite(c.ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	for _, curProblem := range c.report.Problems {
+		if curProblem.fix == nil {
+			continue
+		}
+		if err := curProblem.fix(tx); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	numOfFixes := 0
+	for idx := range c.report.Problems {
+		curProblem := &c.report.Problems[idx]
+		if !curProblem.Fixable {
+			continue
+		}
+		if curProblem.key != "" {
+			if err := c.conn.Blobs.Delete(curProblem.key); err != nil {
+				log.Printf("unable to remove \"%s\": %v", curProblem.key, err)
+				continue
+			}
+		}
+		curProblem.Fixed = true
+		numOfFixes++
+	}
+
+	return numOfFixes, nil
+}
+
+// Check looks for inconsistencies in the database: missing or corrupted
+// files, files not used by any test, missing statistics of the columns,
+// rows referring to missing rows, users without passwords, invalid dates,
+// and a schema version different from DatabaseSchemaVersion. If
+// options.Fix is true, the problems that can be fixed without losing data
+// are fixed (see Problem.Fixable). The parameter "username" is used only
+// for logging purposes.
+func (conn *Connection) Check(options CheckOptions, username string) (CheckReport, error) {
+	return conn.CheckContext(context.Background(), options, username)
+}
+
+// CheckContext is like Check, but it accepts a context to cancel the operation
+func (conn *Connection) CheckContext(ctx context.Context, options CheckOptions, username string) (CheckReport, error) {
+	if options.Fix {
+		if err := conn.checkWritable(); err != nil {
+			return CheckReport{}, err
+		}
+	} else if !conn.Active {
+		return CheckReport{}, ErrInactive
+	}
+
+	c := checker{
+		ctx:     ctx,
+		conn:    conn,
+		q:       conn.withContext(ctx),
+		options: options,
+		report:  CheckReport{Problems: []Problem{}},
+	}
+
+	if err := c.checkSchemaVersion(); err != nil {
+		return c.report, err
+	}
+	if len(c.report.Problems) > 0 {
+		// The other checks rely on the current version of the schema
+		return c.report, nil
+	}
+	dataKeys, err := c.checkDataFiles()
+	if err != nil {
+		return c.report, err
+	}
+	attachmentKeys, err := c.checkAttachments()
+	if err != nil {
+		return c.report, err
+	}
+	if err := c.checkOrphanBlobs(dataFolderName, dataKeys); err != nil {
+		return c.report, err
+	}
+	if err := c.checkOrphanBlobs(attachmentsFolderName, attachmentKeys); err != nil {
+		return c.report, err
+	}
+	if err := c.checkOrphanBlobs(previewsFolderName, dataKeys); err != nil {
+		return c.report, err
+	}
+	if err := c.checkUsers(); err != nil {
+		return c.report, err
+	}
+	if err := c.checkDates(); err != nil {
+		return c.report, err
+	}
+
+	if !options.Fix {
+		return c.report, nil
+	}
+
+	numOfFixes, err := c.applyFixes()
+	if err != nil {
+		return c.report, err
+	}
+	if numOfFixes > 0 {
+		conn.logAction(ctx, username, ActionUpdate, ObjectDatabase, "",
+			fmt.Sprintf("%d problems have been fixed by the consistency check", numOfFixes))
+	}
+	return c.report, nil
+}
@@ -0,0 +1,214 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// findProblem returns the first problem in the report whose object and
+// message contain the given strings
+func findProblem(report CheckReport, object string, message string) *Problem {
+	for idx, curProblem := range report.Problems {
+		if strings.Contains(curProblem.Object, object) && strings.Contains(curProblem.Message, message) {
+			return &report.Problems[idx]
+		}
+	}
+	return nil
+}
+
+func TestCheck(t *testing.T) {
+	conn := createTestDatabase(t, "check")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 6}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	firstID, err := conn.AddTest(&Test{ShortName: "first", TestType: "sweep", Polarimeter: 6}, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	secondID, err := conn.AddTest(&Test{ShortName: "second", TestType: "sweep", Polarimeter: 6}, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	report, err := conn.Check(CheckOptions{}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to check the database: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("problems found in a consistent database: %v", report.Problems)
+	}
+
+	// Break the database in a few ways
+	var key string
+	if err := conn.Connection.QueryRow(`select file_name from test_data_versions where test_id = ?`,
+		secondID).Scan(&key); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Blobs.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		`update test_data_versions set fits_checksum = null where test_id = ` + strconv.Itoa(firstID),
+		`update tests set creation_date = 'yesterday' where test_id = ` + strconv.Itoa(firstID),
+		`insert into users (user_id, password_hash, is_enabled) values ('nopass', '', 1)`,
+	} {
+		if _, err := conn.Connection.Exec(query); err != nil {
+			t.Fatalf("unable to run \"%s\": %v", query, err)
+		}
+	}
+
+	orphanKey := dataStoragePath(strings.Repeat("ab", 32))
+	if err := conn.Blobs.Put(orphanKey, strings.NewReader("unused")); err != nil {
+		t.Fatal(err)
+	}
+	orphanPreviewKey := previewStoragePath(strings.Repeat("ef", 32))
+	if err := conn.Blobs.Put(orphanPreviewKey, strings.NewReader("unused preview")); err != nil {
+		t.Fatal(err)
+	}
+	recentKey := dataStoragePath(strings.Repeat("cd", 32))
+	if err := conn.Blobs.Put(recentKey, strings.NewReader("being imported")); err != nil {
+		t.Fatal(err)
+	}
+	oldTime := time.Now().Add(-2 * orphanGracePeriod)
+	for _, key := range []string{orphanKey, orphanPreviewKey} {
+		if err := os.Chtimes(filepath.Join(conn.BasePath, filepath.FromSlash(key)), oldTime, oldTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err = conn.Check(CheckOptions{}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to check the database: %v", err)
+	}
+
+	expected := []struct {
+		object   string
+		message  string
+		severity string
+		fixable  bool
+	}{
+		{"test " + strconv.Itoa(secondID), "is missing", SeverityError, false},
+		{"test " + strconv.Itoa(firstID), "checksum of the FITS file is not recorded", SeverityInfo, true},
+		{"table \"tests\"", "invalid date \"yesterday\"", SeverityError, false},
+		{"user nopass", "empty password hash", SeverityWarning, true},
+		{orphanKey, "not used by any test", SeverityWarning, false},
+		{orphanPreviewKey, "not used by any test", SeverityWarning, true},
+	}
+	for _, cur := range expected {
+		problem := findProblem(report, cur.object, cur.message)
+		if problem == nil {
+			t.Errorf("problem \"%s: %s\" not found in %v", cur.object, cur.message, report.Problems)
+			continue
+		}
+		if problem.Severity != cur.severity || problem.Fixable != cur.fixable || problem.Fixed {
+			t.Errorf("wrong problem found: %v", *problem)
+		}
+	}
+	if len(report.Problems) != len(expected) {
+		t.Errorf("%d problems expected, got %v", len(expected), report.Problems)
+	}
+	if findProblem(report, recentKey, "") != nil {
+		t.Errorf("a file being imported has been reported as unused")
+	}
+
+	report, err = conn.Check(CheckOptions{Fix: true}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to fix the database: %v", err)
+	}
+	for _, curProblem := range report.Problems {
+		if curProblem.Fixed != curProblem.Fixable {
+			t.Errorf("problem not fixed: %v", curProblem)
+		}
+	}
+
+	if _, err := conn.Blobs.Stat(orphanKey); err != nil {
+		t.Errorf("unused data file has been removed: %v", err)
+	}
+	if _, err := conn.Blobs.Stat(orphanPreviewKey); err != ErrBlobNotFound {
+		t.Errorf("unused preview has not been removed: %v", err)
+	}
+	if _, err := conn.Blobs.Stat(recentKey); err != nil {
+		t.Errorf("file being imported has been removed: %v", err)
+	}
+	var enabled int
+	if err := conn.Connection.QueryRow(`select is_enabled from users where user_id = 'nopass'`).Scan(&enabled); err != nil || enabled != 0 {
+		t.Errorf("user with no password has not been disabled (%d, %v)", enabled, err)
+	}
+
+	report, err = conn.Check(CheckOptions{}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to check the database: %v", err)
+	}
+	if len(report.Problems) != 4 || report.Count(SeverityError) != 2 {
+		t.Errorf("wrong problems after the fix: %v", report.Problems)
+	}
+
+	// Fixing is not allowed through read-only connections
+	var roConn Connection
+	if err := roConn.ConnectReadOnly(conn.BasePath); err != nil {
+		t.Fatalf("unable to connect in read-only mode: %v", err)
+	}
+	defer roConn.Disconnect()
+	if _, err := roConn.Check(CheckOptions{}, "reader"); err != nil {
+		t.Errorf("unable to check the database in read-only mode: %v", err)
+	}
+	if _, err := roConn.Check(CheckOptions{Fix: true}, "reader"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("wrong error when fixing the database in read-only mode: %v", err)
+	}
+}
+
+func TestCheckOldSchema(t *testing.T) {
+	dbPath := createLegacyDatabase(t, "check_legacy", []Test{{ShortName: "a", TestType: "dc", Polarimeter: 1}})
+
+	var conn Connection
+	if err := conn.ConnectForCheck(dbPath); err != nil {
+		t.Fatalf("unable to open a legacy database: %v", err)
+	}
+	defer conn.Disconnect()
+
+	report, err := conn.Check(CheckOptions{}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to check a legacy database: %v", err)
+	}
+	if len(report.Problems) != 1 || findProblem(report, "schema", "version "+baseSchemaVersion) == nil {
+		t.Errorf("the old schema has not been reported: %v", report.Problems)
+	}
+	if version, err := getSchemaVersion(conn.Connection); err != nil || version != baseSchemaVersion {
+		t.Errorf("the database has been upgraded by the check: \"%s\" (%v)", version, err)
+	}
+
+	var roConn Connection
+	if err := roConn.ConnectReadOnly(dbPath); err == nil {
+		roConn.Disconnect()
+		t.Error("a legacy database has been opened in read-only mode")
+	}
+}
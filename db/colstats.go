@@ -0,0 +1,421 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// ColumnStats contains the summary statistics of one column of the data of
+// a test. They are computed when the data are imported, so that tests can
+// be searched by the values of their samples (see ColumnCondition).
+// Statistics that cannot be computed (e.g., the mean of a column containing
+// only NaNs) are NaN.
+type ColumnStats struct {
+	Name         string
+	Unit         string
+	NumOfSamples int
+	NaNFraction  float64 // Fraction of the samples that are NaN or infinite
+	Mean         float64 // The following statistics ignore NaNs and infinities
+	Std          float64
+	Min          float64
+	Max          float64
+	Median       float64 // Approximated for long columns (see maxMedianSamples)
+	First        float64 // First sample of the column, possibly NaN
+	Last         float64 // Last sample of the column, possibly NaN
+}
+
+// Statistics that can be used in a ColumnCondition, together with the
+// name of the column in the "column_stats" table
+var columnStatistics = map[string]string{
+	"samples":      "num_of_samples",
+	"nan_fraction": "nan_fraction",
+	"mean":         "mean",
+	"std":          "std_dev",
+	"min":          "min_value",
+	"max":          "max_value",
+	"median":       "median",
+	"first":        "first_value",
+	"last":         "last_value",
+}
+
+// ColumnStatistics returns the names of the statistics that can be used in
+// a ColumnCondition, in alphabetical order
+func ColumnStatistics() []string {
+	result := make([]string, 0, len(columnStatistics))
+	for name := range columnStatistics {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// maxMedianSamples is the maximum number of samples of a column kept in
+// memory to compute its median (see statsAccumulator)
+const maxMedianSamples = 1 << 16
+
+// statsAccumulator computes the ColumnStats of a column while the samples
+// are read. The mean and the standard deviation use Welford's algorithm.
+// The median is exact for columns with no more than maxMedianSamples valid
+// samples; for longer columns, it is the median of a regular subsample
+// (one sample every "stride"), which is an approximation whose accuracy
+// depends on how fast the samples vary with respect to the stride.
+type statsAccumulator struct {
+	stats     ColumnStats
+	numValid  int
+	subsample []float64 // One valid sample every "stride"
+	stride    int
+	m2        float64
+}
+
+func newStatsAccumulator(name string, unit string, numOfSamples int) *statsAccumulator {
+	if numOfSamples > maxMedianSamples {
+		numOfSamples = maxMedianSamples
+	}
+	return &statsAccumulator{
+		stats:     ColumnStats{Name: name, Unit: unit, First: math.NaN(), Last: math.NaN()},
+		subsample: make([]float64, 0, numOfSamples),
+		stride:    1,
+	}
+}
+
+func (acc *statsAccumulator) add(value float64) {
+	if acc.stats.NumOfSamples == 0 {
+		acc.stats.First = value
+	}
+	acc.stats.Last = value
+	acc.stats.NumOfSamples++
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+
+	if acc.numValid == 0 {
+		acc.stats.Min, acc.stats.Max = value, value
+	} else {
+		acc.stats.Min = math.Min(acc.stats.Min, value)
+		acc.stats.Max = math.Max(acc.stats.Max, value)
+	}
+
+	if acc.numValid%acc.stride == 0 {
+		acc.subsample = append(acc.subsample, value)
+		if len(acc.subsample) == maxMedianSamples {
+			// Keep every other sample, so that the memory used is bounded
+			for idx := 0; idx < maxMedianSamples/2; idx++ {
+				acc.subsample[idx] = acc.subsample[2*idx]
+			}
+			acc.subsample = acc.subsample[:maxMedianSamples/2]
+			acc.stride *= 2
+		}
+	}
+	acc.numValid++
+
+	delta := value - acc.stats.Mean
+	acc.stats.Mean += delta / float64(acc.numValid)
+	acc.m2 += delta * (value - acc.stats.Mean)
+}
+
+func (acc *statsAccumulator) finish() ColumnStats {
+	result := acc.stats
+	n := acc.numValid
+	if result.NumOfSamples > 0 {
+		result.NaNFraction = float64(result.NumOfSamples-n) / float64(result.NumOfSamples)
+	}
+	if n == 0 {
+		nan := math.NaN()
+		result.Mean, result.Std, result.Min, result.Max, result.Median = nan, nan, nan, nan, nan
+		return result
+	}
+
+	result.Std = math.Sqrt(acc.m2 / float64(n))
+	values := acc.subsample
+	sort.Float64s(values)
+	if len(values)%2 == 1 {
+		result.Median = values[len(values)/2]
+	} else {
+		result.Median = (values[len(values)/2-1] + values[len(values)/2]) / 2
+	}
+	return result
+}
+
+// nullIfNaN converts NaNs into NULL values, as SQLite does not store them
+func nullIfNaN(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return value
+}
+
+// saveColumnStats writes the statistics of version "version" of the data
+// of a test in the "column_stats" table
+func saveColumnStats(tx *sql.Tx, testID int64, version int, stats []ColumnStats) error {
+	for _, curStats := range stats {
+		if _, err := tx.Exec(`
+insert or replace into column_stats (test_id, version, column_name, unit, num_of_samples,
+                                     nan_fraction, mean, std_dev, min_value, max_value,
+                                     median, first_value, last_value)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			testID,
+			version,
+			curStats.Name,
+			nullIfEmpty(curStats.Unit),
+			curStats.NumOfSamples,
+			nullIfNaN(curStats.NaNFraction),
+			nullIfNaN(curStats.Mean),
+			nullIfNaN(curStats.Std),
+			nullIfNaN(curStats.Min),
+			nullIfNaN(curStats.Max),
+			nullIfNaN(curStats.Median),
+			nullIfNaN(curStats.First),
+			nullIfNaN(curStats.Last)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillColumnStats computes the statistics of the versions of the data
+// that have none, e.g., because they were imported by an older version of
+// stdb. Files that cannot be read are skipped with a warning, as they are
+// reported by "stdb checkdb".
+func fillColumnStats(tx *sql.Tx, store BlobStore) error {
+	type dataFile struct {
+		testID  int64
+		version int
+		key     string
+	}
+	var files []dataFile
+	if err := forEachRow(tx, `
+select test_id, version, file_name from test_data_versions v
+where not exists (select 1 from column_stats s where s.test_id = v.test_id and s.version = v.version)
+order by test_id, version`,
+		func(values []interface{}) error {
+			files = append(files, dataFile{
+				testID:  values[0].(int64),
+				version: int(values[1].(int64)),
+				key:     values[2].(string),
+			})
+			return nil
+		}); err != nil {
+		return err
+	}
+
+	for _, curFile := range files {
+		_, stats, err := summarizeBlob(store, curFile.key)
+		if err != nil {
+			log.Printf("warning, unable to compute the statistics of test %d (version %d): %v",
+				curFile.testID, curFile.version, err)
+			continue
+		}
+		if err := saveColumnStats(tx, curFile.testID, curFile.version, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetColumnStats returns the summary statistics of the columns of version
+// "version" of the data of a test (zero means the latest one). The result
+// is empty if the statistics could not be computed when the data were
+// imported, or if the data were imported by an older version of stdb: in
+// this case, they are computed by GetTestPreview together with a missing
+// preview, and by Check when it fixes problems.
+func (conn *Connection) GetColumnStats(testID int, version int) ([]ColumnStats, error) {
+	return conn.GetColumnStatsContext(context.Background(), testID, version)
+}
+
+// GetColumnStatsContext is like GetColumnStats, but it accepts a context to cancel the operation
+func (conn *Connection) GetColumnStatsContext(ctx context.Context, testID int, version int) ([]ColumnStats, error) {
+	if !conn.Active {
+		return nil, ErrInactive
+	}
+
+	q := conn.withContext(ctx)
+	var dataVersion DataVersion
+	if err := resolveTestData(q, testID, version, &dataVersion); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`
+select column_name, coalesce(unit, ''), num_of_samples, nan_fraction, mean, std_dev,
+       min_value, max_value, median, first_value, last_value
+from column_stats where test_id = ? and version = ? order by rowid`,
+		testID, dataVersion.Version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]ColumnStats, 0)
+	for rows.Next() {
+		var (
+			curStats ColumnStats
+			values   [8]sql.NullFloat64
+		)
+		if err := rows.Scan(&curStats.Name, &curStats.Unit, &curStats.NumOfSamples,
+			&values[0], &values[1], &values[2], &values[3], &values[4], &values[5],
+			&values[6], &values[7]); err != nil {
+			return nil, err
+		}
+
+		targets := []*float64{&curStats.NaNFraction, &curStats.Mean, &curStats.Std,
+			&curStats.Min, &curStats.Max, &curStats.Median, &curStats.First, &curStats.Last}
+		for idx, curValue := range values {
+			if curValue.Valid {
+				*targets[idx] = curValue.Float64
+			} else {
+				*targets[idx] = math.NaN()
+			}
+		}
+		result = append(result, curStats)
+	}
+
+	return result, rows.Err()
+}
+
+// ColumnCondition is a condition on a summary statistic of a column of the
+// data, e.g., "the maximum of BaseV is greater than 0.7 V". Only the latest
+// version of the data of each test is considered. If Unit is empty, only
+// columns without a unit match, unless the statistic is "samples" or
+// "nan_fraction".
+type ColumnCondition struct {
+	Column    string  // Name of the column (case-insensitive)
+	Statistic string  // One of the names returned by ColumnStatistics
+	Operator  string  // One among "=", "!=", "<", "<=", ">", ">="
+	Value     float64 // Value to compare with
+	Unit      string  // If not empty, it must match the unit of the column, regardless of SI prefixes
+}
+
+// ParseColumnCondition interprets a string like "BaseV.max>0.7V" or
+// "PWR2.mean<-60000" as a condition on the statistics of a column
+func ParseColumnCondition(s string) (ColumnCondition, error) {
+	var cond ColumnCondition
+
+	for _, curOp := range comparisonOperators {
+		idx := strings.Index(s, curOp)
+		if idx < 0 {
+			continue
+		}
+
+		lhs := strings.TrimSpace(s[:idx])
+		dot := strings.LastIndex(lhs, ".")
+		if dot <= 0 {
+			return cond, fmt.Errorf("\"%s\" is not in the form COLUMN.STATISTIC", lhs)
+		}
+		cond.Column = lhs[:dot]
+		cond.Statistic = strings.ToLower(lhs[dot+1:])
+		if _, ok := columnStatistics[cond.Statistic]; !ok {
+			return cond, fmt.Errorf("unknown statistic \"%s\" in \"%s\" (valid choices are %s)",
+				cond.Statistic, s, strings.Join(ColumnStatistics(), ", "))
+		}
+
+		cond.Operator = curOp
+		if cond.Operator == "==" {
+			cond.Operator = "="
+		}
+
+		var reference TestParameter
+		parseParameterValue(s[idx+len(curOp):], &reference)
+		if reference.Kind != ParameterNumber {
+			return cond, fmt.Errorf("the value in \"%s\" must be a number", s)
+		}
+		cond.Value = reference.Number
+		cond.Unit = reference.Unit
+
+		return cond, nil
+	}
+
+	return cond, fmt.Errorf("no comparison operator found in \"%s\"", s)
+}
+
+// dimensionlessStatistics lists the statistics that are not measured in
+// the unit of the column
+var dimensionlessStatistics = map[string]bool{"samples": true, "nan_fraction": true}
+
+// prefixedUnit is a unit together with the exponent of its SI prefix
+type prefixedUnit struct {
+	name     string
+	exponent int
+}
+
+// prefixedUnits returns "base" and the units obtained by adding a SI
+// prefix to it (e.g., "mV", "kV", and so on for "V")
+func prefixedUnits(base string) []prefixedUnit {
+	result := []prefixedUnit{{base, 0}}
+	if !siBaseUnits[base] {
+		return result
+	}
+
+	for prefix, exponent := range siPrefixes {
+		result = append(result, prefixedUnit{prefix + base, exponent})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+// sqlCondition returns a SQL expression that can be used in the "where"
+// clause of a query on the "tests" table, together with its arguments
+func (cond *ColumnCondition) sqlCondition() (string, []interface{}, error) {
+	column, ok := columnStatistics[cond.Statistic]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown statistic \"%s\"", cond.Statistic)
+	}
+	if !isComparisonOperator(cond.Operator) {
+		return "", nil, fmt.Errorf("unknown operator \"%s\"", cond.Operator)
+	}
+
+	args := []interface{}{cond.Column}
+	expr := fmt.Sprintf(`exists (select 1 from column_stats s
+where s.test_id = tests.test_id
+  and s.version = (select max(version) from test_data_versions v where v.test_id = tests.test_id)
+  and s.column_name = ? collate nocase and s.%s %s `, column, cond.Operator)
+	if cond.Unit == "" {
+		expr += "?"
+		args = append(args, cond.Value)
+		if !dimensionlessStatistics[cond.Statistic] {
+			// Values measured in some unit cannot be compared with a pure number
+			expr += " and s.unit is null"
+		}
+	} else {
+		// Units are compared without SI prefixes, so that "BaseV.max>0.5V"
+		// matches a column measured in mV: the value is converted into
+		// each unit that the column might use
+		base, exponent := splitUnitPrefix(cond.Unit)
+		expr += "case s.unit"
+		for _, curUnit := range prefixedUnits(base) {
+			value := cond.Value
+			if !dimensionlessStatistics[cond.Statistic] {
+				value = scaleByPowerOf10(value, exponent-curUnit.exponent)
+			}
+			expr += " when ? then ?"
+			args = append(args, curUnit.name, value)
+		}
+		expr += " end"
+	}
+
+	return expr + ")", args, nil
+}
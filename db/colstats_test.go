@@ -0,0 +1,214 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseColumnCondition(t *testing.T) {
+	for _, cur := range []struct {
+		s    string
+		cond ColumnCondition
+	}{
+		{"BaseV.max>0.7V", ColumnCondition{"BaseV", "max", ">", 0.7, "V"}},
+		{"PWR2.mean<-60000", ColumnCondition{"PWR2", "mean", "<", -60000, ""}},
+		{"EmitterI.NaN_Fraction == 0", ColumnCondition{"EmitterI", "nan_fraction", "=", 0, ""}},
+	} {
+		cond, err := ParseColumnCondition(cur.s)
+		if err != nil {
+			t.Errorf("unable to parse \"%s\": %v", cur.s, err)
+		} else if cond != cur.cond {
+			t.Errorf("wrong condition for \"%s\": %v", cur.s, cond)
+		}
+	}
+
+	for _, s := range []string{"BaseV>0.7", "BaseV.average>0.7", "BaseV.max>high", ".max>1"} {
+		if _, err := ParseColumnCondition(s); err == nil {
+			t.Errorf("condition \"%s\" was accepted", s)
+		}
+	}
+}
+
+func TestColumnStats(t *testing.T) {
+	conn := createTestDatabase(t, "colstats")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 10}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	test := Test{TestType: "sweep", Polarimeter: 10}
+	testID, err := conn.AddTest(&test, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	stats, err := conn.GetColumnStats(testID, 0)
+	if err != nil {
+		t.Fatalf("unable to read the statistics of test %d: %v", testID, err)
+	}
+	if len(stats) != 4 {
+		t.Fatalf("wrong number of columns: %d", len(stats))
+	}
+
+	var baseV *ColumnStats
+	for idx := range stats {
+		if stats[idx].Name == "BaseV" {
+			baseV = &stats[idx]
+		}
+	}
+	if baseV == nil || baseV.Unit != "V" || baseV.NumOfSamples != test.NumOfSamples {
+		t.Fatalf("wrong statistics for column \"BaseV\": %v", baseV)
+	}
+
+	data, err := conn.ReadTestColumns(testID, []string{"BaseV"}, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := data[0].Float64s()
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	if math.Abs(baseV.Mean-mean) > 1e-9 || baseV.Min != sorted[0] || baseV.Max != sorted[len(sorted)-1] ||
+		baseV.First != values[0] || baseV.Last != values[len(values)-1] || baseV.NaNFraction != 0 {
+		t.Errorf("wrong statistics for column \"BaseV\": %v", *baseV)
+	}
+
+	for _, cur := range []struct {
+		condition string
+		found     bool
+	}{
+		{fmt.Sprintf("BaseV.max>=%gV", baseV.Max), true},
+		{fmt.Sprintf("basev.max>%gV", baseV.Max), false},
+		{fmt.Sprintf("BaseV.max>=%gA", baseV.Max), false},
+		{fmt.Sprintf("BaseV.max>%gmV", (baseV.Max-0.001)*1000), true},
+		{fmt.Sprintf("BaseV.max>%gmV", (baseV.Max+0.001)*1000), false},
+		{fmt.Sprintf("BaseV.min<%gkV", (baseV.Min+0.001)/1000), true},
+		{"BaseV.max>0mA", false},
+		{fmt.Sprintf("BaseV.max>=%g", baseV.Max), false},
+		{fmt.Sprintf("BaseV.samples=%dV", test.NumOfSamples), true},
+		{"BaseV.samples>0", true},
+	} {
+		cond, err := ParseColumnCondition(cur.condition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := conn.SearchTests(SearchQuery{Columns: []ColumnCondition{cond}}, "testuser", -1)
+		if err != nil || (len(result) == 1) != cur.found {
+			t.Errorf("wrong result from SearchTests for \"%s\": %v (%v)", cur.condition, result, err)
+		}
+	}
+
+	// Missing statistics are computed again together with a missing
+	// preview, e.g., after an upgrade
+	if _, err := conn.Connection.Exec(`delete from column_stats`); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Blobs.Delete(previewStoragePath(test.FitsChecksum)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.GetTestPreview(testID, 0); err != nil {
+		t.Fatalf("unable to compute the preview of test %d: %v", testID, err)
+	}
+	if recomputed, err := conn.GetColumnStats(testID, 0); err != nil || !reflect.DeepEqual(recomputed, stats) {
+		t.Errorf("the statistics computed with the preview are different: %v (%v)", recomputed, err)
+	}
+
+	// Check reports missing statistics, and it computes them if asked to.
+	// Files that cannot be read do not prevent the other fixes.
+	brokenTest := Test{TestType: "sweep", Polarimeter: 10}
+	brokenID, err := conn.AddTest(&brokenTest, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	var brokenKey string
+	if err := conn.Connection.QueryRow(`select file_name from test_data_versions where test_id = ?`,
+		brokenID).Scan(&brokenKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Blobs.Put(brokenKey, strings.NewReader("not a FITS file")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Connection.Exec(`delete from column_stats`); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := conn.Check(CheckOptions{SkipChecksums: true}, "testuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem := findProblem(report, fmt.Sprintf("test %d (version 1)", testID), "statistics"); problem == nil || !problem.Fixable {
+		t.Fatalf("missing statistics not reported by Check: %v", report.Problems)
+	}
+
+	report, err = conn.Check(CheckOptions{Fix: true, SkipChecksums: true}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to compute the missing statistics: %v", err)
+	}
+	if problem := findProblem(report, fmt.Sprintf("test %d (version 1)", testID), "statistics"); problem == nil || !problem.Fixed {
+		t.Errorf("missing statistics not fixed by Check: %v", report.Problems)
+	}
+	if problem := findProblem(report, fmt.Sprintf("test %d (version 1)", brokenID), "cannot be computed"); problem == nil || problem.Fixable {
+		t.Errorf("unreadable file not reported by Check: %v", report.Problems)
+	}
+	if recomputed, err := conn.GetColumnStats(testID, 0); err != nil || !reflect.DeepEqual(recomputed, stats) {
+		t.Errorf("the statistics computed again are different: %v (%v)", recomputed, err)
+	}
+}
+
+func TestStatsAccumulatorMedian(t *testing.T) {
+	// The median is exact for short columns
+	acc := newStatsAccumulator("x", "", 5)
+	for _, value := range []float64{3, math.NaN(), 1, 4, 1, 5} {
+		acc.add(value)
+	}
+	if stats := acc.finish(); stats.Median != 3 || stats.NumOfSamples != 6 || stats.NaNFraction != 1.0/6 {
+		t.Errorf("wrong statistics: %v", stats)
+	}
+
+	// For long columns, the number of samples kept in memory is bounded
+	const numOfSamples = 1000001
+	acc = newStatsAccumulator("x", "", numOfSamples)
+	for idx := 0; idx < numOfSamples; idx++ {
+		acc.add(float64(numOfSamples - 1 - idx))
+	}
+	if len(acc.subsample) >= maxMedianSamples || cap(acc.subsample) > maxMedianSamples {
+		t.Errorf("too many samples kept in memory: %d", len(acc.subsample))
+	}
+	stats := acc.finish()
+	if math.Abs(stats.Median-(numOfSamples-1)/2) > float64(acc.stride) {
+		t.Errorf("wrong median %g, it should be close to %d", stats.Median, (numOfSamples-1)/2)
+	}
+	if stats.Min != 0 || stats.Max != numOfSamples-1 || math.Abs(stats.Mean-(numOfSamples-1)/2) > 1e-6 {
+		t.Errorf("wrong statistics: %v", stats)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Comment is a note written by a user about a test. Comments can reply to
+// other comments of the same test, thus forming discussion threads.
+type Comment struct {
+	ID           int       // Unique ID of the comment
+	TestID       int       // ID of the test being commented
+	Username     string    // Author of the comment
+	CreationDate time.Time // When the comment was written
+	Body         string    // Text of the comment (Markdown)
+	ReplyTo      int       // ID of the comment this is a reply to (0 if none)
+	Depth        int       // Nesting level within the thread (0 for top-level comments)
+}
+
+// AddComment saves a new comment in the database and returns its ID. The
+// fields TestID, Username, Body, and (optionally) ReplyTo of "comment" must
+// be set; the author must be a registered user. The CreationDate field is
+// set to the current time.
+func (conn *Connection) AddComment(comment *Comment) (int, error) {
+	return conn.AddCommentContext(context.Background(), comment)
+}
+
+// AddCommentContext is like AddComment, but it accepts a context to cancel the operation
+func (conn *Connection) AddCommentContext(ctx context.Context, comment *Comment) (int, error) {
+	if err := conn.checkWritable(); err != nil {
+		return -1, err
+	}
+
+	comment.Body = strings.TrimSpace(comment.Body)
+	if comment.Body == "" {
+		return -1, fmt.Errorf("the text of a comment cannot be empty")
+	}
+
+	tx, unlock, err := conn.beginWrite(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer unlock()
+
+	if err := checkTestExists(tx, comment.TestID); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	var enabled bool
+	err = tx.QueryRow(`select is_enabled from users where user_id = ?`,
+		comment.Username).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return -1, errNotFound("user \"%s\" is not registered in the database", comment.Username)
+	} else if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	if !enabled {
+		tx.Rollback()
+		return -1, fmt.Errorf("user \"%s\" is disabled and cannot add comments", comment.Username)
+	}
+
+	var replyTo sql.NullInt64
+	if comment.ReplyTo != 0 {
+		var parentTestID int
+		err := tx.QueryRow(`select test_id from test_comments where comment_id = ?`,
+			comment.ReplyTo).Scan(&parentTestID)
+		if err == sql.ErrNoRows || (err == nil && parentTestID != comment.TestID) {
+			tx.Rollback()
+			return -1, fmt.Errorf("test %d has no comment with ID=%d", comment.TestID, comment.ReplyTo)
+		} else if err != nil {
+			tx.Rollback()
+			return -1, err
+		}
+		replyTo = sql.NullInt64{Int64: int64(comment.ReplyTo), Valid: true}
+	}
+
+	comment.CreationDate = time.Now().UTC().Truncate(time.Second)
+	result, err := tx.Exec(`
+insert into test_comments (test_id, user_id, creation_date, body, reply_to)
+values (?, ?, ?, ?, ?)`,
+		comment.TestID,
+		comment.Username,
+		comment.CreationDate.Format(time.RFC3339),
+		comment.Body,
+		replyTo)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return -1, err
+	}
+	unlock()
+
+	comment.ID = int(id)
+	conn.logAction(ctx, comment.Username, ActionCreate, ObjectComment, comment.ID,
+		fmt.Sprintf("comment %d has been added to test %d", comment.ID, comment.TestID))
+	return comment.ID, nil
+}
+
+// GetComments returns the comments of a test sorted in thread order: each
+// comment is followed by its replies, and the Depth field tells how deep
+// a comment is nested. Comments at the same level are sorted by date.
+func (conn *Connection) GetComments(testID int) ([]Comment, error) {
+	return conn.GetCommentsContext(context.Background(), testID)
+}
+
+// GetCommentsContext is like GetComments, but it accepts a context to cancel the operation
+func (conn *Connection) GetCommentsContext(ctx context.Context, testID int) ([]Comment, error) {
+	if !conn.Active {
+		return []Comment{}, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select comment_id, test_id, user_id, creation_date, body, reply_to
+from test_comments where test_id = ? order by creation_date, comment_id`,
+		testID)
+	if err != nil {
+		return []Comment{}, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var (
+			curComment   Comment
+			creationDate string
+			replyTo      sql.NullInt64
+		)
+		if err := rows.Scan(&curComment.ID, &curComment.TestID, &curComment.Username,
+			&creationDate, &curComment.Body, &replyTo); err != nil {
+			return []Comment{}, err
+		}
+
+		if curComment.CreationDate, err = time.Parse(time.RFC3339, creationDate); err != nil {
+			return []Comment{}, err
+		}
+		curComment.ReplyTo = int(replyTo.Int64)
+		comments = append(comments, curComment)
+	}
+	if err := rows.Err(); err != nil {
+		return []Comment{}, err
+	}
+
+	return sortCommentThreads(comments), nil
+}
+
+// sortCommentThreads reorders a list of comments, already sorted by date,
+// so that each comment is followed by its replies
+func sortCommentThreads(comments []Comment) []Comment {
+	replies := make(map[int][]int)
+	for idx, curComment := range comments {
+		replies[curComment.ReplyTo] = append(replies[curComment.ReplyTo], idx)
+	}
+
+	result := make([]Comment, 0, len(comments))
+	var visit func(parentID int, depth int)
+	visit = func(parentID int, depth int) {
+		for _, idx := range replies[parentID] {
+			curComment := comments[idx]
+			curComment.Depth = depth
+			result = append(result, curComment)
+			visit(curComment.ID, depth+1)
+		}
+	}
+	visit(0, 0)
+
+	return result
+}
@@ -0,0 +1,88 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"path"
+	"testing"
+)
+
+func TestComments(t *testing.T) {
+	conn := createTestDatabase(t, "comments")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 3}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	testID, err := conn.AddTest(&Test{TestType: "sweep", Polarimeter: 3}, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	first, err := conn.AddComment(&Comment{TestID: testID, Username: "testuser", Body: "The *offset* looks wrong"})
+	if err != nil {
+		t.Fatalf("unable to add a comment: %v", err)
+	}
+	second, err := conn.AddComment(&Comment{TestID: testID, Username: "testuser", Body: "Second comment"})
+	if err != nil {
+		t.Fatalf("unable to add a comment: %v", err)
+	}
+	reply, err := conn.AddComment(&Comment{TestID: testID, Username: "testuser", Body: "Fixed", ReplyTo: first})
+	if err != nil {
+		t.Fatalf("unable to add a reply: %v", err)
+	}
+
+	if _, err := conn.AddComment(&Comment{TestID: testID, Username: "nobody", Body: "Hi"}); err == nil {
+		t.Error("a comment by an unknown user was accepted")
+	}
+	if _, err := conn.AddComment(&Comment{TestID: testID, Username: "testuser", Body: " "}); err == nil {
+		t.Error("an empty comment was accepted")
+	}
+	if _, err := conn.AddComment(&Comment{TestID: testID, Username: "testuser", Body: "Hi", ReplyTo: 1000}); err == nil {
+		t.Error("a reply to a nonexistent comment was accepted")
+	}
+
+	if err := conn.DisableUser("testuser"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.AddComment(&Comment{TestID: testID, Username: "testuser", Body: "Hi"}); err == nil {
+		t.Error("a comment by a disabled user was accepted")
+	}
+	if err := conn.EnableUser("testuser"); err != nil {
+		t.Fatal(err)
+	}
+
+	comments, err := conn.GetComments(testID)
+	if err != nil || len(comments) != 3 {
+		t.Fatalf("unexpected result from GetComments: %v (%v)", comments, err)
+	}
+	if comments[0].ID != first || comments[1].ID != reply || comments[1].Depth != 1 ||
+		comments[2].ID != second || comments[2].Depth != 0 {
+		t.Errorf("wrong order of comments: %v", comments)
+	}
+
+	result, err := conn.SearchTests(SearchQuery{Text: "offset"}, "testuser", -1)
+	if err != nil || len(result) != 1 || result[0] != testID {
+		t.Errorf("comments are not used by SearchTests: %v (%v)", result, err)
+	}
+}
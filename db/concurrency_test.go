@@ -0,0 +1,161 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentAccess simulates several processes (each with its own
+// Connection) adding and reading tests at the same time
+func TestConcurrentAccess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the stress test in short mode")
+	}
+
+	const (
+		numOfWriters   = 4
+		testsPerWriter = 3
+		numOfReaders   = 4
+	)
+
+	conn := createTestDatabase(t, "concurrency")
+	defer conn.Disconnect()
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 10}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	errors := make(chan error, numOfWriters*testsPerWriter+numOfReaders)
+	done := make(chan struct{})
+	var writers, readers sync.WaitGroup
+
+	for i := 0; i < numOfWriters; i++ {
+		writers.Add(1)
+		go func(writer int) {
+			defer writers.Done()
+
+			writerConn := Connection{DuplicatePolicy: DuplicateWarn}
+			if err := writerConn.Connect(conn.BasePath); err != nil {
+				errors <- err
+				return
+			}
+			defer writerConn.Disconnect()
+
+			for j := 0; j < testsPerWriter; j++ {
+				test := Test{
+					ShortName:   fmt.Sprintf("writer %d, test %d", writer, j),
+					TestType:    "sweep",
+					Polarimeter: 10,
+				}
+				if _, err := writerConn.AddTest(&test, "testuser", inputFilePath); err != nil {
+					errors <- fmt.Errorf("writer %d: %v", writer, err)
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < numOfReaders; i++ {
+		readers.Add(1)
+		go func(reader int) {
+			defer readers.Done()
+
+			readerConn := Connection{}
+			if err := readerConn.Connect(conn.BasePath); err != nil {
+				errors <- err
+				return
+			}
+			defer readerConn.Disconnect()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				ids, err := readerConn.GetListOfTestIDs("reader", 5)
+				if err != nil {
+					errors <- fmt.Errorf("reader %d: %v", reader, err)
+					return
+				}
+				for _, curID := range ids {
+					var test Test
+					if err := readerConn.GetTest(curID, "reader", &test); err != nil {
+						errors <- fmt.Errorf("reader %d: %v", reader, err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	close(errors)
+
+	for err := range errors {
+		t.Error(err)
+	}
+
+	if ids, err := conn.GetListOfTestIDs("", -1); err != nil || len(ids) != numOfWriters*testsPerWriter {
+		t.Errorf("wrong number of tests after concurrent writes: %d (%v)", len(ids), err)
+	}
+}
+
+// TestWritesTakeTheLock checks that statements run outside of transactions
+// (e.g., SetProperty and the entries of the log) wait for the writer lock
+func TestWritesTakeTheLock(t *testing.T) {
+	conn := createTestDatabase(t, "writerlock")
+	defer conn.Disconnect()
+
+	var other Connection
+	if err := other.Connect(conn.BasePath); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect()
+
+	unlock, err := other.lockWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- conn.SetProperty("test_property", "value", "testuser")
+	}()
+
+	select {
+	case <-done:
+		t.Error("SetProperty did not wait for the writer lock")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	unlock()
+	if err := <-done; err != nil {
+		t.Errorf("unable to set a property: %v", err)
+	}
+}
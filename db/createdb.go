@@ -33,7 +33,7 @@ import (
 
 const (
 	IndexFileName = "index.db"
-	DatabaseSchemaVersion = "0.1.0"
+	DatabaseSchemaVersion = "0.15.0"
 )
 
 func savePropertiesToDb(db *sql.DB, props map[string]string) error {
@@ -61,7 +61,6 @@ const (
 // and populates it with the minimum number of components needed
 // for the folder to be a valid STDB database.
 func CreateEmptyDatabase(dbpath string, mode CreationMode) error {
-	indexFileName := path.Join(dbpath, IndexFileName)
 	if mode == Overwrite {
 		// Ignore the return value
 		os.RemoveAll(dbpath)
@@ -74,13 +73,31 @@ func CreateEmptyDatabase(dbpath string, mode CreationMode) error {
 		return err
 	}
 
+	return createIndexFile(dbpath)
+}
+
+// createIndexFile creates the file "index.db" in the existing folder
+// "dbpath", using the latest version of the schema
+func createIndexFile(dbpath string) error {
+	indexFileName := path.Join(dbpath, IndexFileName)
 	log.Printf("creating a new database file \"%s\"", indexFileName)
-	db, err := sql.Open("sqlite3", indexFileName)
+	db, err := sql.Open("sqlite3", indexDSN(indexFileName))
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
+	if err := createBaseSchema(db); err != nil {
+		return err
+	}
+
+	// Bring the schema up to date
+	return upgradeSchema(db, dbpath)
+}
+
+// createBaseSchema creates the tables of the first version of the database
+// schema (baseSchemaVersion) in an empty database
+func createBaseSchema(db *sql.DB) error {
 	tableCreationStmt := `
 create table tests (
 -- List of all the tests saved in the database
@@ -158,6 +175,6 @@ create table properties (
 	// Save a few generic information about this database
 	props := make(map[string]string)
 	props["creation_date"] = time.Now().UTC().Format(time.RFC3339)
-	props["stdb_version"] = DatabaseSchemaVersion
+	props["stdb_version"] = baseSchemaVersion
 	return savePropertiesToDb(db, props)
 }
@@ -52,6 +52,10 @@ func TestIntegratedDatabase(t *testing.T) {
 		t.Errorf("unable to create a new user: %v", err)
 	}
 
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 49, Band: "Q"}, "testuser"); err != nil {
+		t.Errorf("unable to register a new polarimeter: %v", err)
+	}
+
 	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
 	refTest := Test{
 		ShortName: "short",
@@ -85,6 +89,29 @@ func TestIntegratedDatabase(t *testing.T) {
 	}
 }
 
+// createTestDatabase creates a new empty database named "name" within the
+// temporary directory and connects to it. The database contains the user
+// "testuser".
+func createTestDatabase(t *testing.T, name string) *Connection {
+	dbPath := path.Join(targetPath, name)
+	if err := CreateEmptyDatabase(dbPath, DoNotOverwrite); err != nil {
+		t.Fatalf("unable to create an empty database in \"%s\": %v", dbPath, err)
+	}
+
+	// Most tests import the same file more than once
+	conn := &Connection{DuplicatePolicy: DuplicateWarn}
+	if err := conn.Connect(dbPath); err != nil {
+		t.Fatalf("unable to connect to \"%s\": %v", dbPath, err)
+	}
+
+	if err := conn.CreateUser("testuser", []byte("testpass"),
+		"Mr. Test User", "user@test.inc", true); err != nil {
+		t.Fatalf("unable to create a new user: %v", err)
+	}
+
+	return conn
+}
+
 func TestMain(m *testing.M) {
 	var err error
 	targetPath, err = ioutil.TempDir("", "stdb_test")
@@ -0,0 +1,238 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DuplicatePolicy tells AddTest and ReplaceTestData what to do when the
+// data being imported match those of a test already in the database
+type DuplicatePolicy string
+
+// Possible values for DuplicatePolicy
+const (
+	DuplicateReject DuplicatePolicy = "reject" // Refuse to import the data
+	DuplicateWarn   DuplicatePolicy = "warn"   // Import the data, but log a warning
+	DuplicateLink   DuplicatePolicy = "link"   // Import the data and link the new test to the old one
+)
+
+// DuplicatePolicies lists all the valid values for DuplicatePolicy
+var DuplicatePolicies = []DuplicatePolicy{DuplicateReject, DuplicateWarn, DuplicateLink}
+
+func validateDuplicatePolicy(value string) error {
+	names := make([]string, len(DuplicatePolicies))
+	for idx, curPolicy := range DuplicatePolicies {
+		if value == string(curPolicy) {
+			return nil
+		}
+		names[idx] = string(curPolicy)
+	}
+
+	return fmt.Errorf("unknown duplicate policy \"%s\" (valid values are %s)",
+		value, strings.Join(names, ", "))
+}
+
+// DuplicateGroup is a set of tests whose data are the same
+type DuplicateGroup struct {
+	Kind     string // "source" (same input file) or "data" (same samples)
+	Checksum string // Checksum shared by the tests
+	TestIDs  []int  // IDs of the tests, in ascending order
+}
+
+// fileChecksum computes the SHA-256 checksum of a file
+func fileChecksum(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// duplicateSettings returns the policy and whether the checksum of the
+// samples should be compared too. Fields of the connection take precedence
+// over the "duplicate_policy" and "duplicate_check_data" properties.
+func (conn *Connection) duplicateSettings(q queryRower) (DuplicatePolicy, bool, error) {
+	policy := conn.DuplicatePolicy
+	if policy == "" {
+		value, err := getProperty(q, "duplicate_policy", string(DuplicateReject))
+		if err != nil {
+			return "", false, err
+		}
+		policy = DuplicatePolicy(value)
+	}
+	if err := validateDuplicatePolicy(string(policy)); err != nil {
+		return "", false, err
+	}
+
+	if conn.CheckDataDuplicates != nil {
+		return policy, *conn.CheckDataDuplicates, nil
+	}
+	value, err := getProperty(q, "duplicate_check_data", "false")
+	if err != nil {
+		return "", false, err
+	}
+	checkData := value == "true"
+
+	return policy, checkData, nil
+}
+
+// findDuplicates returns the IDs of the tests other than "testID" for which
+// a version of the data has the same source checksum or (if "checkData" is
+// true) the same data checksum
+func findDuplicates(q queryer, testID int64, sourceChecksum string,
+	dataChecksum string, checkData bool) ([]int, error) {
+
+	rows, err := q.Query(`
+select distinct test_id from test_data_versions
+where test_id != ? and (source_checksum = ? or (? and data_checksum = ?))
+order by test_id`,
+		testID, sourceChecksum, checkData, dataChecksum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int
+	for rows.Next() {
+		var curID int
+		if err := rows.Scan(&curID); err != nil {
+			return nil, err
+		}
+		result = append(result, curID)
+	}
+
+	return result, rows.Err()
+}
+
+// handleDuplicates applies the duplicate policy to the data just imported
+// for the test with ID "testID". The IDs of the duplicates are saved in
+// test.DuplicateOf, so that they can be logged using logDuplicates once
+// the transaction has been committed.
+func (conn *Connection) handleDuplicates(tx *sql.Tx, testID int64, test *Test,
+	sourceChecksum string, dataChecksum string, username string) error {
+
+	policy, checkData, err := conn.duplicateSettings(tx)
+	if err != nil {
+		return err
+	}
+
+	duplicates, err := findDuplicates(tx, testID, sourceChecksum, dataChecksum, checkData)
+	if err != nil {
+		return err
+	}
+	test.DuplicateOf = duplicates
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	switch policy {
+	case DuplicateReject:
+		return fmt.Errorf("the data have already been imported in test %d", duplicates[0])
+	case DuplicateLink:
+		if _, err := tx.Exec(`
+insert or ignore into test_relations (source_id, target_id, relation, user_id, creation_date)
+values (?, ?, ?, ?, ?)`,
+			testID, duplicates[0], RelationDuplicateOf, username,
+			time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// logDuplicates writes a warning in the log if the data imported for a test
+// were already in the database. It must not be called within a transaction.
+func (conn *Connection) logDuplicates(ctx context.Context, testID int, test *Test, username string) {
+	if len(test.DuplicateOf) > 0 {
+		conn.logAction(ctx, username, ActionMessage, ObjectTest, testID,
+			fmt.Sprintf("warning, the data of test %d are the same as in test(s) %v", testID, test.DuplicateOf))
+	}
+}
+
+// FindDuplicateTests looks for tests whose data have been imported more
+// than once. Versions of the data imported before duplicate detection was
+// introduced have no checksum and are not considered.
+func (conn *Connection) FindDuplicateTests() ([]DuplicateGroup, error) {
+	return conn.FindDuplicateTestsContext(context.Background())
+}
+
+// FindDuplicateTestsContext is like FindDuplicateTests, but it accepts a context to cancel the operation
+func (conn *Connection) FindDuplicateTestsContext(ctx context.Context) ([]DuplicateGroup, error) {
+	if !conn.Active {
+		return []DuplicateGroup{}, ErrInactive
+	}
+
+	result := make([]DuplicateGroup, 0)
+	for _, kind := range []string{"source", "data"} {
+		rows, err := conn.withContext(ctx).Query(fmt.Sprintf(`
+select %[1]s_checksum, group_concat(distinct test_id) from test_data_versions
+where %[1]s_checksum is not null
+group by %[1]s_checksum having count(distinct test_id) > 1
+order by min(test_id)`, kind))
+		if err != nil {
+			return []DuplicateGroup{}, err
+		}
+
+		for rows.Next() {
+			var (
+				group DuplicateGroup
+				ids   string
+			)
+			if err := rows.Scan(&group.Checksum, &ids); err != nil {
+				rows.Close()
+				return []DuplicateGroup{}, err
+			}
+
+			group.Kind = kind
+			for _, curID := range strings.Split(ids, ",") {
+				var id int
+				fmt.Sscanf(curID, "%d", &id)
+				group.TestIDs = append(group.TestIDs, id)
+			}
+			sort.Ints(group.TestIDs)
+			result = append(result, group)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return []DuplicateGroup{}, err
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,93 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"path"
+	"testing"
+)
+
+func TestDuplicates(t *testing.T) {
+	conn := createTestDatabase(t, "duplicates")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 6}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	firstID, err := conn.AddTest(&Test{TestType: "sweep", Polarimeter: 6}, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	conn.DuplicatePolicy = ""
+	if _, err := conn.AddTest(&Test{TestType: "sweep", Polarimeter: 6}, "testuser", inputFilePath); err == nil {
+		t.Error("a duplicated test was accepted by the default policy")
+	}
+
+	if err := conn.SetProperty("duplicate_policy", "ignore", "testuser"); err == nil {
+		t.Error("an invalid duplicate policy was accepted")
+	}
+	if err := conn.SetProperty("duplicate_policy", string(DuplicateLink), "testuser"); err != nil {
+		t.Fatalf("unable to set the duplicate policy: %v", err)
+	}
+
+	test := Test{TestType: "sweep", Polarimeter: 6}
+	secondID, err := conn.AddTest(&test, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a duplicated test: %v", err)
+	}
+	if len(test.DuplicateOf) != 1 || test.DuplicateOf[0] != firstID {
+		t.Errorf("wrong list of duplicates: %v", test.DuplicateOf)
+	}
+
+	relations, err := conn.GetTestRelations(secondID)
+	if err != nil || len(relations) != 1 || relations[0].Relation != RelationDuplicateOf ||
+		relations[0].TargetID != firstID {
+		t.Errorf("the duplicated test was not linked: %v (%v)", relations, err)
+	}
+
+	// Explicit settings of the connection take precedence over the properties
+	if err := conn.SetProperty("duplicate_check_data", "true", "testuser"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cur := range []struct {
+		value    *bool
+		expected bool
+	}{{nil, true}, {new(bool), false}} {
+		conn.CheckDataDuplicates = cur.value
+		if _, checkData, err := conn.duplicateSettings(conn.Connection); err != nil || checkData != cur.expected {
+			t.Errorf("wrong data check for CheckDataDuplicates=%v: %v (%v)", cur.value, checkData, err)
+		}
+	}
+	conn.CheckDataDuplicates = nil
+
+	groups, err := conn.FindDuplicateTests()
+	if err != nil || len(groups) != 2 {
+		t.Fatalf("unexpected result from FindDuplicateTests: %v (%v)", groups, err)
+	}
+	for _, curGroup := range groups {
+		if len(curGroup.TestIDs) != 2 || curGroup.TestIDs[0] != firstID || curGroup.TestIDs[1] != secondID {
+			t.Errorf("wrong duplicate group: %v", curGroup)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the methods of Connection. They can be wrapped in more
+// detailed errors, so use errors.Is to check for them.
+var (
+	ErrInactive          = errors.New(MsgInactiveConnection)
+	ErrNotFound          = errors.New("not found")
+	ErrDuplicateUser     = errors.New("user already exists")
+	ErrUnsupportedFormat = errors.New("unsupported file format")
+	ErrReadOnly          = errors.New("the connection to the database is read-only")
+	ErrInvalidRange      = errors.New("invalid range of rows")
+)
+
+// notFoundError is returned when a test, campaign, etc. is not in the
+// database. It matches both ErrNotFound and sql.ErrNoRows, as the latter
+// was returned by older versions of stdb.
+type notFoundError struct {
+	message string
+}
+
+func errNotFound(format string, args ...interface{}) error {
+	return &notFoundError{message: fmt.Sprintf(format, args...)}
+}
+
+func (err *notFoundError) Error() string {
+	return err.message
+}
+
+func (err *notFoundError) Is(target error) bool {
+	return target == ErrNotFound || target == sql.ErrNoRows
+}
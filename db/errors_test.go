@@ -0,0 +1,78 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	var inactive Connection
+	if _, err := inactive.GetListOfTestIDs("", -1); !errors.Is(err, ErrInactive) {
+		t.Errorf("wrong error for an inactive connection: %v", err)
+	}
+
+	conn := createTestDatabase(t, "errors")
+	defer conn.Disconnect()
+
+	var test Test
+	err := conn.GetTest(1000, "", &test)
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("wrong error for a nonexistent test: %v", err)
+	}
+	var campaign Campaign
+	if err := conn.GetCampaign(1000, "", &campaign); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for a nonexistent campaign: %v", err)
+	}
+	if err := conn.EnableUser("nobody"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for a nonexistent user: %v", err)
+	}
+
+	if err := conn.CreateUser("testuser", []byte("pass"), "", "", true); !errors.Is(err, ErrDuplicateUser) {
+		t.Errorf("wrong error for a duplicate user: %v", err)
+	}
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 11}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	textFile := path.Join(targetPath, "errors.txt")
+	if err := ioutil.WriteFile(textFile, []byte("1 2 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.AddTest(&Test{TestType: "dc", Polarimeter: 11}, "testuser", textFile)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("wrong error for an unsupported file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := conn.GetListOfTestIDsContext(ctx, "", -1); !errors.Is(err, context.Canceled) {
+		t.Errorf("a query was run with a cancelled context: %v", err)
+	}
+	if err := conn.AddPolarimeterContext(ctx, &Polarimeter{Number: 12}, "testuser"); err == nil {
+		t.Error("a polarimeter was added with a cancelled context")
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Federation presents several databases as if they were one, e.g., when
+// each cryostat has its own database. The databases are opened using
+// ConnectReadOnly, so a Federation cannot be used to modify them.
+type Federation struct {
+	Databases []*Connection // In the order they were passed to OpenFederation
+}
+
+// FederatedEntry is a test returned by the methods of Federation
+type FederatedEntry struct {
+	Database string // Path of the database containing the test (see Connection.BasePath)
+	TestEntry
+}
+
+// FederatedPage is the result of Federation.ListTests
+type FederatedPage struct {
+	Tests      []FederatedEntry
+	Total      int    // Number of tests matching the filters in all the databases
+	NextCursor string // Only used if the federation contains one database (see TestPage)
+}
+
+// OpenFederation opens the databases in the folders "paths" in read-only
+// mode. The caller must call Close once the federation is no longer needed.
+func OpenFederation(paths []string) (*Federation, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no database specified")
+	}
+
+	fed := &Federation{}
+	for _, curPath := range paths {
+		conn := &Connection{}
+		if err := conn.ConnectReadOnly(curPath); err != nil {
+			fed.Close()
+			return nil, fmt.Errorf("unable to open database \"%s\": %v", curPath, err)
+		}
+		fed.Databases = append(fed.Databases, conn)
+	}
+
+	return fed, nil
+}
+
+// Close closes all the databases of the federation
+func (fed *Federation) Close() error {
+	var result error
+	for _, curConn := range fed.Databases {
+		if err := curConn.Disconnect(); err != nil && result == nil {
+			result = err
+		}
+	}
+	fed.Databases = nil
+	return result
+}
+
+// database returns the connection to the database with path "dbPath"
+func (fed *Federation) database(dbPath string) (*Connection, error) {
+	for _, curConn := range fed.Databases {
+		if curConn.BasePath == dbPath {
+			return curConn, nil
+		}
+	}
+	return nil, errNotFound("database \"%s\" is not part of the federation", dbPath)
+}
+
+// compareEntries compares two tests according to the sort key "sortKey"
+// (see ListOptions), returning a negative number if "a" comes before "b".
+// Ties are broken using the test IDs.
+func compareEntries(sortKey string, a, b *TestEntry) int {
+	result := 0
+	switch sortKey {
+	case SortByDate:
+		if a.Test.CreationDate.Before(b.Test.CreationDate) {
+			result = -1
+		} else if a.Test.CreationDate.After(b.Test.CreationDate) {
+			result = 1
+		}
+	case SortByPolarimeter:
+		result = a.Test.Polarimeter - b.Test.Polarimeter
+	case SortByType:
+		result = strings.Compare(a.Test.TestType, b.Test.TestType)
+	case SortByName:
+		result = strings.Compare(a.Test.ShortName, b.Test.ShortName)
+	}
+
+	if result == 0 {
+		result = a.ID - b.ID
+	}
+	return result
+}
+
+// sortFederatedEntries sorts "entries" like ListTests would do if all the
+// tests were in the same database. Tests that compare equal keep the order
+// of the databases.
+func sortFederatedEntries(entries []FederatedEntry, sortKey string, descending bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		result := compareEntries(sortKey, &entries[i].TestEntry, &entries[j].TestEntry)
+		if descending {
+			return result > 0
+		}
+		return result < 0
+	})
+}
+
+// ListTests returns the tests of all the databases matching the filters in
+// "options", sorted as requested (see Connection.ListTests). Cursors can
+// only be used if the federation contains one database; otherwise, use
+// ListOptions.Offset to get the following pages. Filters on campaigns and
+// test IDs are applied to each database, even if IDs are not shared among
+// them; databases that do not know the campaign are skipped.
+func (fed *Federation) ListTests(options ListOptions) (FederatedPage, error) {
+	return fed.ListTestsContext(context.Background(), options)
+}
+
+// ListTestsContext is like ListTests, but it accepts a context to cancel the operation
+func (fed *Federation) ListTestsContext(ctx context.Context, options ListOptions) (FederatedPage, error) {
+	result := FederatedPage{Tests: []FederatedEntry{}}
+
+	if len(fed.Databases) == 1 {
+		conn := fed.Databases[0]
+		page, err := conn.ListTestsContext(ctx, options)
+		if err != nil {
+			return result, err
+		}
+		for _, curEntry := range page.Tests {
+			result.Tests = append(result.Tests, FederatedEntry{Database: conn.BasePath, TestEntry: curEntry})
+		}
+		result.Total = page.Total
+		result.NextCursor = page.NextCursor
+		return result, nil
+	}
+
+	if options.After != "" {
+		return result, fmt.Errorf("cursors cannot be used with more than one database")
+	}
+
+	// Each database must provide all the tests that can end up in the page
+	memberOptions := options
+	memberOptions.Offset = 0
+	if options.Limit > 0 {
+		memberOptions.Limit = options.Offset + options.Limit
+	}
+
+	for _, curConn := range fed.Databases {
+		page, err := curConn.ListTestsContext(ctx, memberOptions)
+		if err != nil {
+			// Campaigns are local to each database
+			if options.CampaignID == 0 && options.CampaignName != "" && errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return result, fmt.Errorf("database \"%s\": %v", curConn.BasePath, err)
+		}
+		for _, curEntry := range page.Tests {
+			result.Tests = append(result.Tests, FederatedEntry{Database: curConn.BasePath, TestEntry: curEntry})
+		}
+		result.Total += page.Total
+	}
+
+	sortFederatedEntries(result.Tests, options.Sort, options.Descending)
+	if options.Offset >= len(result.Tests) {
+		result.Tests = result.Tests[:0]
+	} else {
+		result.Tests = result.Tests[options.Offset:]
+	}
+	if options.Limit > 0 && len(result.Tests) > options.Limit {
+		result.Tests = result.Tests[:options.Limit]
+	}
+
+	return result, nil
+}
+
+// SearchTests returns the tests of all the databases matching "query" (see
+// Connection.SearchTests), from the most recent to the most ancient one.
+// Databases that do not know the test type or the campaign used in the
+// query are skipped. If maxNum is positive, it specifies the maximum
+// number of tests to return.
+func (fed *Federation) SearchTests(query SearchQuery, maxNum int) ([]FederatedEntry, error) {
+	return fed.SearchTestsContext(context.Background(), query, maxNum)
+}
+
+// SearchTestsContext is like SearchTests, but it accepts a context to cancel the operation
+func (fed *Federation) SearchTestsContext(ctx context.Context, query SearchQuery, maxNum int) ([]FederatedEntry, error) {
+	result := []FederatedEntry{}
+	for _, curConn := range fed.Databases {
+		ids, err := curConn.SearchTestsContext(ctx, query, "", maxNum)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("database \"%s\": %v", curConn.BasePath, err)
+		}
+
+		page, err := curConn.ListTestsContext(ctx, ListOptions{TestIDs: ids})
+		if err != nil {
+			return nil, fmt.Errorf("database \"%s\": %v", curConn.BasePath, err)
+		}
+		for _, curEntry := range page.Tests {
+			result = append(result, FederatedEntry{Database: curConn.BasePath, TestEntry: curEntry})
+		}
+	}
+
+	sortFederatedEntries(result, SortByDate, true)
+	if maxNum > 0 && len(result) > maxNum {
+		result = result[:maxNum]
+	}
+	return result, nil
+}
+
+// ResolveTest returns the database containing the test referred by "ref"
+// and the ID of the test in it. Since UUIDs are unique among databases,
+// "ref" must be a UUID unless the federation contains one database.
+func (fed *Federation) ResolveTest(ref string) (string, int, error) {
+	return fed.ResolveTestContext(context.Background(), ref)
+}
+
+// ResolveTestContext is like ResolveTest, but it accepts a context to cancel the operation
+func (fed *Federation) ResolveTestContext(ctx context.Context, ref string) (string, int, error) {
+	if _, err := strconv.Atoi(ref); err == nil && len(fed.Databases) > 1 {
+		return "", -1, fmt.Errorf("test ID %s is ambiguous with more than one database, use the UUID", ref)
+	}
+
+	for _, curConn := range fed.Databases {
+		id, err := curConn.ResolveTestIDContext(ctx, ref)
+		if err == nil {
+			return curConn.BasePath, id, nil
+		} else if !errors.Is(err, ErrNotFound) {
+			return "", -1, err
+		}
+	}
+
+	return "", -1, errNotFound("no test matches \"%s\" in the databases", ref)
+}
+
+// GetTest reads the test with ID "testID" from the database with path
+// "dbPath" (see FederatedEntry.Database)
+func (fed *Federation) GetTest(dbPath string, testID int, test *Test) error {
+	return fed.GetTestContext(context.Background(), dbPath, testID, test)
+}
+
+// GetTestContext is like GetTest, but it accepts a context to cancel the operation
+func (fed *Federation) GetTestContext(ctx context.Context, dbPath string, testID int, test *Test) error {
+	conn, err := fed.database(dbPath)
+	if err != nil {
+		return err
+	}
+	return conn.GetTestContext(ctx, testID, "", test)
+}
+
+// OpenTestData returns a reader for the FITS file of a test in the
+// database with path "dbPath" (see Connection.OpenTestData)
+func (fed *Federation) OpenTestData(dbPath string, testID int, version int) (io.ReadCloser, DataVersion, error) {
+	return fed.OpenTestDataContext(context.Background(), dbPath, testID, version)
+}
+
+// OpenTestDataContext is like OpenTestData, but it accepts a context to cancel the operation
+func (fed *Federation) OpenTestDataContext(ctx context.Context, dbPath string, testID int, version int) (io.ReadCloser, DataVersion, error) {
+	conn, err := fed.database(dbPath)
+	if err != nil {
+		return nil, DataVersion{}, err
+	}
+	return conn.OpenTestDataContext(ctx, testID, version)
+}
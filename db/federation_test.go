@@ -0,0 +1,110 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"path"
+	"testing"
+)
+
+func TestFederation(t *testing.T) {
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+
+	// The first database contains tests on polarimeters 1 and 3, the second
+	// one on polarimeter 2
+	var uuids []string
+	var paths []string
+	for idx, polarimeters := range [][]int{{1, 3}, {2}} {
+		conn := createTestDatabase(t, []string{"federation_a", "federation_b"}[idx])
+		defer conn.Disconnect()
+		paths = append(paths, conn.BasePath)
+
+		for _, pol := range polarimeters {
+			if err := conn.AddPolarimeter(&Polarimeter{Number: pol}, "testuser"); err != nil {
+				t.Fatalf("unable to register a new polarimeter: %v", err)
+			}
+			test := Test{ShortName: "test", TestType: "sweep", Polarimeter: pol}
+			if _, err := conn.AddTest(&test, "testuser", inputFilePath); err != nil {
+				t.Fatalf("unable to add a test: %v", err)
+			}
+			uuids = append(uuids, test.UUID)
+		}
+	}
+
+	fed, err := OpenFederation(paths)
+	if err != nil {
+		t.Fatalf("unable to open the federation: %v", err)
+	}
+	defer fed.Close()
+
+	page, err := fed.ListTests(ListOptions{Sort: SortByPolarimeter, Limit: 2})
+	if err != nil || page.Total != 3 || len(page.Tests) != 2 {
+		t.Fatalf("wrong result from ListTests: %v (%v)", page, err)
+	}
+	if page.Tests[0].Test.Polarimeter != 1 || page.Tests[0].Database != paths[0] ||
+		page.Tests[1].Test.Polarimeter != 2 || page.Tests[1].Database != paths[1] {
+		t.Errorf("wrong order of tests: %v", page.Tests)
+	}
+
+	page, err = fed.ListTests(ListOptions{Sort: SortByPolarimeter, Descending: true, Offset: 2, Limit: 2})
+	if err != nil || len(page.Tests) != 1 || page.Tests[0].Test.Polarimeter != 1 {
+		t.Errorf("wrong second page: %v (%v)", page, err)
+	}
+	page, err = fed.ListTests(ListOptions{CampaignName: "nonexistent"})
+	if err != nil || len(page.Tests) != 0 {
+		t.Errorf("wrong result when listing a nonexistent campaign: %v (%v)", page, err)
+	}
+	if _, err := fed.ListTests(ListOptions{After: "cursor"}); err == nil {
+		t.Error("a cursor was accepted by a federation")
+	}
+
+	entries, err := fed.SearchTests(SearchQuery{Polarimeter: 2}, -1)
+	if err != nil || len(entries) != 1 || entries[0].Database != paths[1] {
+		t.Errorf("wrong result from SearchTests: %v (%v)", entries, err)
+	}
+	// The second database has no campaign with this name
+	entries, err = fed.SearchTests(SearchQuery{CampaignName: "nonexistent"}, -1)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("wrong result when searching a nonexistent campaign: %v (%v)", entries, err)
+	}
+
+	dbPath, testID, err := fed.ResolveTest(uuids[2])
+	if err != nil || dbPath != paths[1] || testID != 1 {
+		t.Fatalf("unable to resolve a UUID: %s/%d (%v)", dbPath, testID, err)
+	}
+	var test Test
+	if err := fed.GetTest(dbPath, testID, &test); err != nil || test.Polarimeter != 2 {
+		t.Errorf("unable to read a test: %v (%v)", test, err)
+	}
+	r, _, err := fed.OpenTestData(dbPath, testID, 0)
+	if err != nil {
+		t.Errorf("unable to read the data of a test: %v", err)
+	} else {
+		r.Close()
+	}
+
+	if _, _, err := fed.ResolveTest("1"); err == nil {
+		t.Error("an ambiguous test ID was accepted")
+	}
+	if err := fed.GetTest("nonexistent", 1, &test); err == nil {
+		t.Error("a test was read from a database outside the federation")
+	}
+}
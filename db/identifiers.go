@@ -0,0 +1,118 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Besides its integer ID, which is only unique within one database, each
+// test has a UUID. The latter is written in the FITS file and survives
+// merges, so it is the identifier to use in papers and logbooks. Files
+// written before UUIDs were introduced are not rewritten, as their keys
+// depend on their checksum: the UUIDs of those tests are saved only in
+// "index.db" (see Reindex).
+
+func newTestUUID() string {
+	return uuid.NewV4().String()
+}
+
+// normalizeTestUUID checks that "value" is a valid UUID and returns it in
+// canonical form. If "value" is empty, a new UUID is returned.
+func normalizeTestUUID(value string) (string, error) {
+	if value == "" {
+		return newTestUUID(), nil
+	}
+
+	testUUID, err := uuid.FromString(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid UUID \"%s\": %v", value, err)
+	}
+	return testUUID.String(), nil
+}
+
+// assignTestUUIDs is used by the migration that introduced UUIDs: it gives
+// one to each test already in the database
+func assignTestUUIDs(tx *sql.Tx) error {
+	rows, err := tx.Query(`select test_id from tests where uuid is null`)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var curID int64
+		if err := rows.Scan(&curID); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, curID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, curID := range ids {
+		if _, err := tx.Exec(`update tests set uuid = ? where test_id = ?`,
+			newTestUUID(), curID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ResolveTestID returns the ID of the test referred by "ref", which can be
+// either an integer ID or a UUID. UUIDs are accepted in any of the formats
+// understood by github.com/satori/go.uuid (e.g., with or without braces).
+func (conn *Connection) ResolveTestID(ref string) (int, error) {
+	return conn.ResolveTestIDContext(context.Background(), ref)
+}
+
+// ResolveTestIDContext is like ResolveTestID, but it accepts a context to cancel the operation
+func (conn *Connection) ResolveTestIDContext(ctx context.Context, ref string) (int, error) {
+	if !conn.Active {
+		return -1, ErrInactive
+	}
+
+	if id, err := strconv.Atoi(ref); err == nil {
+		return id, nil
+	}
+
+	testUUID, err := uuid.FromString(ref)
+	if err != nil {
+		return -1, errNotFound("\"%s\" is neither a test ID nor a UUID", ref)
+	}
+
+	var id int
+	err = conn.withContext(ctx).QueryRow(`select test_id from tests where uuid = ?`,
+		testUUID.String()).Scan(&id)
+	if err == sql.ErrNoRows {
+		return -1, errNotFound("no test with UUID %s", testUUID)
+	}
+	return id, err
+}
@@ -0,0 +1,68 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestResolveTestID(t *testing.T) {
+	conn := createTestDatabase(t, "identifiers")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 9}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	test := Test{TestType: "sweep", Polarimeter: 9}
+	testID, err := conn.AddTest(&test, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	if len(test.UUID) != 36 {
+		t.Fatalf("no UUID assigned to a new test: \"%s\"", test.UUID)
+	}
+
+	for _, ref := range []string{
+		test.UUID,
+		strings.ToUpper(test.UUID),
+		"{" + test.UUID + "}",
+	} {
+		if id, err := conn.ResolveTestID(ref); err != nil || id != testID {
+			t.Errorf("wrong ID for \"%s\": %d (%v)", ref, id, err)
+		}
+	}
+
+	if _, err := conn.ResolveTestID("00000000-0000-4000-8000-000000000000"); err == nil {
+		t.Error("a nonexistent UUID was resolved")
+	}
+	if _, err := conn.ResolveTestID("not-a-test"); err == nil {
+		t.Error("an invalid reference was resolved")
+	}
+
+	duplicate := Test{UUID: test.UUID, TestType: "sweep", Polarimeter: 9}
+	if _, err := conn.AddTest(&duplicate, "testuser", inputFilePath); err == nil {
+		t.Error("two tests with the same UUID were added")
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// TestEntry is a test together with its ID
+type TestEntry struct {
+	ID   int
+	Test Test
+}
+
+// Keys that can be used to sort the result of ListTests
+const (
+	SortByID          = "id"
+	SortByDate        = "date"
+	SortByPolarimeter = "polarimeter"
+	SortByType        = "type"
+	SortByName        = "name"
+)
+
+var sortExpressions = map[string]string{
+	SortByID:          "t.test_id",
+	SortByDate:        "t.creation_date",
+	SortByPolarimeter: "t.polarimeter",
+	SortByType:        "t.type",
+	SortByName:        "coalesce(t.short_name, '')",
+}
+
+// ListOptions specifies which tests are returned by ListTests, and in
+// which order
+type ListOptions struct {
+	Sort       string // One of the SortBy* constants (default: SortByID)
+	Descending bool   // Sort from the largest to the smallest value
+	Offset     int    // Number of tests to skip (ignored if After is set)
+	After      string // Cursor returned by a previous call (see TestPage.NextCursor)
+	Limit      int    // Maximum number of tests to return (zero or negative means no limit)
+
+	CampaignID   int    // If not zero, only list the tests of this campaign
+	CampaignName string // If not empty (and CampaignID is zero), only list the tests of this campaign
+	Polarimeter  int    // If not zero, only list the tests of this polarimeter
+	TestIDs      []int  // If not nil, only list these tests
+}
+
+// TestPage is the result of ListTests
+type TestPage struct {
+	Tests      []TestEntry
+	Total      int    // Number of tests matching the filters, regardless of the page
+	NextCursor string // Value of ListOptions.After for the next page, empty if this is the last one
+}
+
+// encodeCursor returns a cursor pointing after the test with ID "testID",
+// whose sort key is "value"
+func encodeCursor(value interface{}, testID int) (string, error) {
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	data, err := json.Marshal([]interface{}{value, testID})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string) (interface{}, int, error) {
+	var (
+		fields []interface{}
+		testID float64
+	)
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &fields)
+	}
+	if err == nil && len(fields) == 2 {
+		var ok bool
+		if testID, ok = fields[1].(float64); ok {
+			return fields[0], int(testID), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("invalid cursor \"%s\"", cursor)
+}
+
+// maxIDPlaceholders is the largest number of IDs that idListCondition
+// passes as separate parameters. SQLite limits the number of parameters
+// in a query (999 in older versions), so longer lists are packed in one
+// blob of fixed-width numbers, which the query itself unpacks.
+const maxIDPlaceholders = 500
+
+// idWidth is the number of digits used for each ID packed by idListCondition
+const idWidth = 20
+
+// idListCondition returns a condition matching the rows whose "column"
+// is one of "ids", which must not be empty
+func idListCondition(column string, ids []int) (string, []interface{}) {
+	if len(ids) <= maxIDPlaceholders {
+		args := make([]interface{}, len(ids))
+		for idx, curID := range ids {
+			args[idx] = curID
+		}
+		return column + " in (" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")", args
+	}
+
+	// Unlike strings, blobs can be indexed in constant time by "substr"
+	packed := make([]byte, 0, len(ids)*idWidth)
+	for _, curID := range ids {
+		packed = append(packed, fmt.Sprintf("%0*d", idWidth, curID)...)
+	}
+	return fmt.Sprintf(`%[1]s in (
+with recursive ids(pos) as (
+	select 1
+	union all
+	select pos + %[2]d from ids where pos + %[2]d <= length(?)
+)
+select cast(substr(?, pos, %[2]d) as integer) from ids)`, column, idWidth), []interface{}{packed, packed}
+}
+
+// cursorCondition returns the condition selecting the tests that follow
+// the cursor (value, testID) when sorting on "sortExpr". SQLite sorts
+// NULL before any other value, and row-value comparisons involving NULL
+// are never true, so NULL keys need to be handled separately.
+func cursorCondition(sortExpr string, descending bool, value interface{}, testID int) (string, []interface{}) {
+	switch {
+	case value == nil && !descending:
+		return fmt.Sprintf("((%[1]s is null and t.test_id > ?) or %[1]s is not null)", sortExpr),
+			[]interface{}{testID}
+	case value == nil:
+		return fmt.Sprintf("(%s is null and t.test_id < ?)", sortExpr), []interface{}{testID}
+	case !descending:
+		return fmt.Sprintf("(%s, t.test_id) > (?, ?)", sortExpr), []interface{}{value, testID}
+	default:
+		return fmt.Sprintf("((%[1]s, t.test_id) < (?, ?) or %[1]s is null)", sortExpr),
+			[]interface{}{value, testID}
+	}
+}
+
+// whereClause returns the condition used to filter the tests, ignoring
+// the cursor and the name of the campaign
+func (options *ListOptions) whereClause() (string, []interface{}) {
+	conditions := []string{"1"}
+	var args []interface{}
+	if options.CampaignID != 0 {
+		conditions = append(conditions, "t.campaign_id = ?")
+		args = append(args, options.CampaignID)
+	}
+	if options.Polarimeter != 0 {
+		conditions = append(conditions, "t.polarimeter = ?")
+		args = append(args, options.Polarimeter)
+	}
+	if options.TestIDs != nil {
+		if len(options.TestIDs) == 0 {
+			conditions = append(conditions, "0")
+		} else {
+			condition, idArgs := idListCondition("t.test_id", options.TestIDs)
+			conditions = append(conditions, condition)
+			args = append(args, idArgs...)
+		}
+	}
+
+	return strings.Join(conditions, " and "), args
+}
+
+// ListTests returns one page of the tests in the database, together with
+// their parameters. Unlike GetTest, it runs a fixed number of queries
+// regardless of the number of tests, and it does not write in the log.
+// Pages can be selected either using an offset or, more efficiently,
+// using the cursor returned by the previous call. If the campaign named
+// in the options does not exist, ErrNotFound is returned.
+func (conn *Connection) ListTests(options ListOptions) (TestPage, error) {
+	return conn.ListTestsContext(context.Background(), options)
+}
+
+// ListTestsContext is like ListTests, but it accepts a context to cancel the operation
+func (conn *Connection) ListTestsContext(ctx context.Context, options ListOptions) (TestPage, error) {
+	var page TestPage
+	if !conn.Active {
+		return page, ErrInactive
+	}
+
+	if options.Sort == "" {
+		options.Sort = SortByID
+	}
+	sortExpr, ok := sortExpressions[options.Sort]
+	if !ok {
+		return page, fmt.Errorf("unknown sort key \"%s\"", options.Sort)
+	}
+	direction := "asc"
+	if options.Descending {
+		direction = "desc"
+	}
+
+	q := conn.withContext(ctx)
+	if options.CampaignID == 0 && options.CampaignName != "" {
+		err := q.QueryRow(`select campaign_id from campaigns where name = ?`,
+			options.CampaignName).Scan(&options.CampaignID)
+		if err == sql.ErrNoRows {
+			return page, errNotFound("no campaign named \"%s\"", options.CampaignName)
+		} else if err != nil {
+			return page, err
+		}
+	}
+
+	where, args := options.whereClause()
+	if err := q.QueryRow(`select count(*) from tests t where `+where, args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	offset := options.Offset
+	if options.After != "" {
+		value, testID, err := decodeCursor(options.After)
+		if err != nil {
+			return page, err
+		}
+		condition, cursorArgs := cursorCondition(sortExpr, options.Descending, value, testID)
+		where += " and " + condition
+		args = append(args, cursorArgs...)
+		offset = 0
+	}
+
+	// Ask for one more test, to know if there is another page
+	limit := -1
+	if options.Limit > 0 {
+		limit = options.Limit + 1
+	}
+	rows, err := q.Query(fmt.Sprintf(`
+select %[1]s, %[2]s from tests t where %[3]s
+order by %[1]s %[4]s, t.test_id %[4]s limit ? offset ?`, sortExpr, testColumns, where, direction),
+		append(args, limit, offset)...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	var (
+		lastValue interface{}
+		ids       []int
+	)
+	page.Tests = make([]TestEntry, 0)
+	for rows.Next() {
+		if options.Limit > 0 && len(page.Tests) == options.Limit {
+			if page.NextCursor, err = encodeCursor(lastValue, ids[len(ids)-1]); err != nil {
+				return page, err
+			}
+			break
+		}
+
+		var entry TestEntry
+		if err := scanTest(prefixScanner{rows, &lastValue}, &entry.ID, &entry.Test); err != nil {
+			return page, err
+		}
+		page.Tests = append(page.Tests, entry)
+		ids = append(ids, entry.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	rows.Close()
+
+	params, err := loadParametersOfTests(q, ids)
+	if err != nil {
+		return page, err
+	}
+	for idx := range page.Tests {
+		page.Tests[idx].Test.Parameters = params[page.Tests[idx].ID]
+	}
+
+	return page, nil
+}
@@ -0,0 +1,136 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestListTests(t *testing.T) {
+	conn := createTestDatabase(t, "listing")
+	defer conn.Disconnect()
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	for _, pol := range []int{21, 22} {
+		if err := conn.AddPolarimeter(&Polarimeter{Number: pol}, "testuser"); err != nil {
+			t.Fatalf("unable to register a new polarimeter: %v", err)
+		}
+	}
+	var ids []int
+	for i := 0; i < 5; i++ {
+		test := Test{
+			ShortName:   fmt.Sprintf("test %d", i),
+			TestType:    "sweep",
+			Polarimeter: 21 + i%2,
+			Parameters:  []TestParameter{{Name: "index", Kind: ParameterNumber, Number: float64(i)}},
+		}
+		id, err := conn.AddTest(&test, "testuser", inputFilePath)
+		if err != nil {
+			t.Fatalf("unable to add a test: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	var logEntries int
+	conn.Connection.QueryRow(`select count(*) from log`).Scan(&logEntries)
+
+	// Walk through all the tests using cursors, from the newest
+	var listed []int
+	options := ListOptions{Descending: true, Limit: 2}
+	for {
+		page, err := conn.ListTests(options)
+		if err != nil {
+			t.Fatalf("unable to list tests: %v", err)
+		}
+		if page.Total != 5 {
+			t.Errorf("wrong total: %d", page.Total)
+		}
+		for _, curEntry := range page.Tests {
+			listed = append(listed, curEntry.ID)
+			if len(curEntry.Test.Parameters) != 1 ||
+				curEntry.Test.ShortName != fmt.Sprintf("test %d", int(curEntry.Test.Parameters[0].Number)) {
+				t.Errorf("incomplete test returned by ListTests: %v", curEntry)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		options.After = page.NextCursor
+	}
+	if fmt.Sprint(listed) != fmt.Sprint([]int{ids[4], ids[3], ids[2], ids[1], ids[0]}) {
+		t.Errorf("wrong order of tests: %v", listed)
+	}
+
+	var newLogEntries int
+	conn.Connection.QueryRow(`select count(*) from log`).Scan(&newLogEntries)
+	if newLogEntries != logEntries {
+		t.Errorf("ListTests wrote %d entries in the log", newLogEntries-logEntries)
+	}
+
+	page, err := conn.ListTests(ListOptions{Sort: SortByPolarimeter, Offset: 1, Limit: 2})
+	if err != nil || len(page.Tests) != 2 || page.Tests[0].ID != ids[2] || page.Tests[1].ID != ids[4] {
+		t.Errorf("wrong result when sorting by polarimeter: %v (%v)", page.Tests, err)
+	}
+
+	page, err = conn.ListTests(ListOptions{Polarimeter: 22, TestIDs: []int{ids[0], ids[1], ids[3]}})
+	if err != nil || page.Total != 2 || len(page.Tests) != 2 || page.NextCursor != "" {
+		t.Errorf("wrong result when filtering tests: %v (%v)", page, err)
+	}
+
+	// Lists of IDs longer than the number of parameters allowed by SQLite
+	manyIDs := []int{ids[1], ids[3]}
+	for i := 0; i < 40000; i++ {
+		manyIDs = append(manyIDs, 100000+i)
+	}
+	page, err = conn.ListTests(ListOptions{TestIDs: manyIDs})
+	if err != nil || page.Total != 2 || len(page.Tests) != 2 ||
+		page.Tests[0].ID != ids[1] || page.Tests[1].ID != ids[3] ||
+		len(page.Tests[0].Test.Parameters) != 1 {
+		t.Errorf("wrong result when filtering many tests: %v (%v)", page, err)
+	}
+
+	// A NULL sort key must not end the walk through the tests
+	nullCursor, err := encodeCursor(nil, ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = conn.ListTests(ListOptions{Sort: SortByDate, After: nullCursor})
+	if err != nil || len(page.Tests) != 5 {
+		t.Errorf("wrong result after a NULL sort key: %v (%v)", page, err)
+	}
+	page, err = conn.ListTests(ListOptions{Sort: SortByDate, Descending: true, After: nullCursor})
+	if err != nil || len(page.Tests) != 0 {
+		t.Errorf("wrong result after a NULL sort key: %v (%v)", page, err)
+	}
+
+	if _, err := conn.ListTests(ListOptions{CampaignName: "nonexistent"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error when listing a nonexistent campaign: %v", err)
+	}
+	if _, err := conn.ListTests(ListOptions{Sort: "color"}); err == nil {
+		t.Error("an invalid sort key was accepted")
+	}
+	if _, err := conn.ListTests(ListOptions{After: "garbage"}); err == nil {
+		t.Error("an invalid cursor was accepted")
+	}
+}
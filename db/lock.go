@@ -0,0 +1,70 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+// LockFileName is the name of the file used to serialize writers
+const LockFileName = "index.lock"
+
+// writerLock is an advisory lock that serializes write transactions, both
+// among the goroutines of a process and among the processes (e.g., "stdb
+// webui" and the command-line tools) using the same database. SQLite
+// serializes writers by itself, but a transaction that has to wait for
+// too long fails with "database is locked": holding this lock, a writer
+// never has to wait for another transaction.
+type writerLock struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func openWriterLock(basePath string) (*writerLock, error) {
+	file, err := os.OpenFile(path.Join(basePath, LockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writerLock{file: file}, nil
+}
+
+// Lock waits until no other writer holds the lock
+func (lock *writerLock) Lock() error {
+	lock.mutex.Lock()
+	if err := lockFile(lock.file); err != nil {
+		lock.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unlock releases the lock acquired by Lock
+func (lock *writerLock) Unlock() {
+	unlockFile(lock.file)
+	lock.mutex.Unlock()
+}
+
+func (lock *writerLock) Close() error {
+	return lock.file.Close()
+}
@@ -1,19 +1,480 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// Log writes a message in the "log" table of the database
+// Kinds of action recorded in the log
+const (
+	ActionRead    = "read"    // Someone has looked at some data
+	ActionCreate  = "create"  // A new object has been added to the database
+	ActionUpdate  = "update"  // An object has been modified
+	ActionDelete  = "delete"  // An object has been removed
+	ActionLogin   = "login"   // A user has tried to log in
+	ActionLogout  = "logout"  // A user has logged out
+	ActionMessage = "message" // Free-text message (see Connection.Log)
+)
+
+// Kinds of object the entries of the log refer to
+const (
+	ObjectTest        = "test"
+	ObjectPolarimeter = "polarimeter"
+	ObjectCampaign    = "campaign"
+	ObjectTestType    = "test_type"
+	ObjectAttachment  = "attachment"
+	ObjectComment     = "comment"
+	ObjectUser        = "user"
+	ObjectProperty    = "property"
+	ObjectDatabase    = "database"
+	ObjectLog         = "log"
+	ObjectPage        = "page"
+)
+
+// Outcomes of the actions recorded in the log
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// AnonymousUser is recorded in the log when the user performing an action
+// is not known
+const AnonymousUser = "anonymous"
+
+// ReadLogRetentionProperty is the property containing the number of days
+// the "read" entries are kept in the log by PruneLog
+const ReadLogRetentionProperty = "log_read_retention_days"
+
+// DefaultReadLogRetention is the number of days the "read" entries are
+// kept in the log, if ReadLogRetentionProperty is not set
+const DefaultReadLogRetention = 90
+
+// LogEntry is an entry of the "log" table
+type LogEntry struct {
+	ID            int       `json:"id"`
+	Date          time.Time `json:"date"`
+	Username      string    `json:"username"`       // User performing the action
+	Action        string    `json:"action"`         // One of the Action* constants
+	ObjectType    string    `json:"object_type"`    // One of the Object* constants, empty if none
+	ObjectID      string    `json:"object_id"`      // ID of the object, empty if none
+	ClientAddress string    `json:"client_address"` // Network address of the client, empty if local
+	Outcome       string    `json:"outcome"`        // OutcomeSuccess or OutcomeFailure
+	Message       string    `json:"message"`
+}
+
+type logContextKey int
+
+const (
+	usernameKey logContextKey = iota
+	clientAddressKey
+)
+
+// WithUsername returns a context that makes LogEventContext record
+// "username" for entries that do not specify the user
+func WithUsername(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, usernameKey, username)
+}
+
+// WithClientAddress returns a context that makes LogEventContext record
+// "address" as the network address of the client
+func WithClientAddress(ctx context.Context, address string) context.Context {
+	return context.WithValue(ctx, clientAddressKey, address)
+}
+
+// Log writes a free-text message in the "log" table of the database
 func (conn *Connection) Log(message string, username string) error {
+	return conn.LogContext(context.Background(), message, username)
+}
+
+// LogContext is like Log, but it accepts a context (see LogEventContext)
+func (conn *Connection) LogContext(ctx context.Context, message string, username string) error {
+	return conn.LogEventContext(ctx, LogEntry{
+		Username: username,
+		Action:   ActionMessage,
+		Message:  message,
+	})
+}
+
+// LogEvent writes an entry in the "log" table of the database. If the date
+// or the outcome are not set, the current time and OutcomeSuccess are used.
+func (conn *Connection) LogEvent(entry LogEntry) error {
+	return conn.LogEventContext(context.Background(), entry)
+}
+
+// LogEventContext is like LogEvent, but the user and the client address
+// are taken from "ctx" if they are not set in "entry" (see WithUsername
+// and WithClientAddress). The entry is written even if "ctx" has been
+// cancelled, so that the action it records is not lost. Nothing is written
+// if the connection is read-only.
+func (conn *Connection) LogEventContext(ctx context.Context, entry LogEntry) error {
 	if !conn.Active {
-		return fmt.Errorf(MsgInactiveConnection)
+		return ErrInactive
+	}
+	if conn.ReadOnly {
+		return nil
+	}
+
+	if entry.Username == "" {
+		entry.Username, _ = ctx.Value(usernameKey).(string)
+		if entry.Username == "" {
+			entry.Username = AnonymousUser
+		}
+	}
+	if entry.ClientAddress == "" {
+		entry.ClientAddress, _ = ctx.Value(clientAddressKey).(string)
+	}
+	if entry.Date.IsZero() {
+		entry.Date = time.Now()
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = OutcomeSuccess
 	}
 
-	now := time.Now().UTC().Format(time.RFC3339)
-	_, err := conn.Connection.Exec(`
-insert into log (user_id, date, message) values (?, ?, ?)`,
-		username, now, message)
+	_, err := conn.execWrite(context.Background(), `
+insert into log (user_id, date, message, action, object_type, object_id, client_address, outcome)
+values (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Username,
+		entry.Date.UTC().Format(time.RFC3339),
+		entry.Message,
+		entry.Action,
+		nullIfEmpty(entry.ObjectType),
+		nullIfEmpty(entry.ObjectID),
+		nullIfEmpty(entry.ClientAddress),
+		entry.Outcome)
 	return err
-}
\ No newline at end of file
+}
+
+// logAction records the successful completion of an action on an object.
+// Errors are ignored, as a failure to write the log must not make the
+// action fail.
+func (conn *Connection) logAction(ctx context.Context, username string, action string,
+	objectType string, objectID interface{}, message string) {
+	conn.LogEventContext(ctx, LogEntry{
+		Username:   username,
+		Action:     action,
+		ObjectType: objectType,
+		ObjectID:   fmt.Sprint(objectID),
+		Message:    message,
+	})
+}
+
+// LogFilter specifies which entries are returned by QueryLog. Empty fields
+// are ignored.
+type LogFilter struct {
+	Since      time.Time // Only return entries written at this time or later
+	Until      time.Time // Only return entries written before this time
+	Username   string
+	Action     string
+	ObjectType string
+	ObjectID   string
+	Outcome    string
+	Limit      int // Maximum number of entries to return (zero or negative means no limit)
+}
+
+// whereClause returns the SQL condition selecting the entries of the log
+// matching the filter, together with its arguments
+func (filter *LogFilter) whereClause() (string, []interface{}) {
+	conditions := []string{"1"}
+	var args []interface{}
+
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "date >= ?")
+		args = append(args, filter.Since.UTC().Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "date < ?")
+		args = append(args, filter.Until.UTC().Format(time.RFC3339))
+	}
+	for _, cur := range []struct {
+		column string
+		value  string
+	}{
+		{"user_id", filter.Username},
+		{"action", filter.Action},
+		{"object_type", filter.ObjectType},
+		{"object_id", filter.ObjectID},
+		{"outcome", filter.Outcome},
+	} {
+		if cur.value != "" {
+			conditions = append(conditions, cur.column+" = ?")
+			args = append(args, cur.value)
+		}
+	}
+
+	return strings.Join(conditions, " and "), args
+}
+
+// scanLogEntry reads one row of the "log" table
+func scanLogEntry(row rowScanner, entry *LogEntry) error {
+	var (
+		date          sql.NullString
+		message       sql.NullString
+		action        sql.NullString
+		objectType    sql.NullString
+		objectID      sql.NullString
+		clientAddress sql.NullString
+		outcome       sql.NullString
+	)
+	if err := row.Scan(&entry.ID, &entry.Username, &date, &message, &action, &objectType,
+		&objectID, &clientAddress, &outcome); err != nil {
+		return err
+	}
+
+	entry.Date, _ = time.Parse(time.RFC3339, date.String)
+	entry.Message = message.String
+	entry.Action = action.String
+	entry.ObjectType = objectType.String
+	entry.ObjectID = objectID.String
+	entry.ClientAddress = clientAddress.String
+	entry.Outcome = outcome.String
+	return nil
+}
+
+const logColumns = `msg_id, user_id, date, message, action, object_type, object_id, client_address, outcome`
+
+// QueryLog returns the entries of the log matching "filter", from the most
+// recent to the oldest. Querying the log does not add entries to it.
+func (conn *Connection) QueryLog(filter LogFilter) ([]LogEntry, error) {
+	return conn.QueryLogContext(context.Background(), filter)
+}
+
+// QueryLogContext is like QueryLog, but it accepts a context to cancel the operation
+func (conn *Connection) QueryLogContext(ctx context.Context, filter LogFilter) ([]LogEntry, error) {
+	if !conn.Active {
+		return nil, ErrInactive
+	}
+
+	where, args := filter.whereClause()
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select `+logColumns+` from log where `+where+` order by date desc, msg_id desc limit ?`,
+		append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]LogEntry, 0)
+	for rows.Next() {
+		var curEntry LogEntry
+		if err := scanLogEntry(rows, &curEntry); err != nil {
+			return nil, err
+		}
+		result = append(result, curEntry)
+	}
+
+	return result, rows.Err()
+}
+
+// ReadLogRetention returns the number of days the "read" entries are kept
+// in the log (see ReadLogRetentionProperty)
+func (conn *Connection) ReadLogRetention() (int, error) {
+	return conn.ReadLogRetentionContext(context.Background())
+}
+
+// ReadLogRetentionContext is like ReadLogRetention, but it accepts a context to cancel the operation
+func (conn *Connection) ReadLogRetentionContext(ctx context.Context) (int, error) {
+	if !conn.Active {
+		return 0, ErrInactive
+	}
+
+	value, err := getProperty(conn.withContext(ctx), ReadLogRetentionProperty, "")
+	if err != nil || value == "" {
+		return DefaultReadLogRetention, err
+	}
+
+	days, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value \"%s\" for property \"%s\"", value, ReadLogRetentionProperty)
+	}
+	return days, nil
+}
+
+// PruneLog removes the "read" entries of the log older than "before", as
+// they are the vast majority of the entries and they are seldom useful
+// after some time. If "archive" is not nil, the entries are written in it
+// as JSON objects, one per line, before being removed. The return value is
+// the number of entries that have been removed. The parameter "username"
+// is used only for logging purposes.
+func (conn *Connection) PruneLog(before time.Time, archive io.Writer, username string) (int, error) {
+	return conn.PruneLogContext(context.Background(), before, archive, username)
+}
+
+// PruneLogContext is like PruneLog, but it accepts a context to cancel the operation
+func (conn *Connection) PruneLogContext(ctx context.Context, before time.Time, archive io.Writer, username string) (int, error) {
+	if err := conn.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	tx, unlock, err := conn.beginWrite(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	filter := LogFilter{Until: before, Action: ActionRead}
+	where, args := filter.whereClause()
+
+	if archive != nil {
+		rows, err := tx.Query(`select `+logColumns+` from log where `+where+` order by msg_id`, args...)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		encoder := json.NewEncoder(archive)
+		for rows.Next() {
+			var curEntry LogEntry
+			if err = scanLogEntry(rows, &curEntry); err != nil {
+				break
+			}
+			if err = encoder.Encode(curEntry); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	result, err := tx.Exec(`delete from log where `+where, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	unlock()
+
+	conn.logAction(ctx, username, ActionDelete, ObjectLog, "",
+		fmt.Sprintf("%d read entries older than %s have been pruned from the log",
+			count, before.UTC().Format(time.RFC3339)))
+	return int(count), nil
+}
+
+// legacyLogPattern matches one of the free-text messages written in the
+// log before structured entries were introduced. The first submatch of
+// the regular expression, if any, is the ID of the object; if
+// "userIsObject" is set, the user who wrote the entry is the object.
+type legacyLogPattern struct {
+	regexp       *regexp.Regexp
+	action       string
+	objectType   string
+	outcome      string
+	userIsObject bool
+}
+
+var legacyLogPatterns = []legacyLogPattern{
+	{regexp.MustCompile(`^failed authentication$`), ActionLogin, ObjectUser, OutcomeFailure, true},
+	{regexp.MustCompile(`^granting permission to page$`), ActionRead, ObjectPage, OutcomeSuccess, false},
+	{regexp.MustCompile(`^in protect: error`), ActionRead, ObjectPage, OutcomeFailure, false},
+	{regexp.MustCompile(`^user has logged out$`), ActionLogout, ObjectUser, OutcomeSuccess, true},
+	{regexp.MustCompile(`^new user has been created$`), ActionCreate, ObjectUser, OutcomeSuccess, true},
+	{regexp.MustCompile(`^user has been (?:enabled|disabled)$`), ActionUpdate, ObjectUser, OutcomeSuccess, true},
+	{regexp.MustCompile(`^password has been requested$`), ActionRead, ObjectUser, OutcomeSuccess, true},
+	{regexp.MustCompile(`^password has been changed$`), ActionUpdate, ObjectUser, OutcomeSuccess, true},
+	{regexp.MustCompile(`^querying the IDs of the tests in the database`), ActionRead, ObjectTest, OutcomeSuccess, false},
+	{regexp.MustCompile(`^request for test with ID=(\d+) has been satisfied$`), ActionRead, ObjectTest, OutcomeSuccess, false},
+	{regexp.MustCompile(`^searching the database`), ActionRead, ObjectTest, OutcomeSuccess, false},
+	{regexp.MustCompile(`^data of test (\d+) have been replaced`), ActionUpdate, ObjectTest, OutcomeSuccess, false},
+	{regexp.MustCompile(`^relationship "test (\d+) .*" has been removed$`), ActionUpdate, ObjectTest, OutcomeSuccess, false},
+	{regexp.MustCompile(`^test (\d+) \S+ test \d+$`), ActionUpdate, ObjectTest, OutcomeSuccess, false},
+	{regexp.MustCompile(`^warning, the data of test (\d+) are the same`), ActionMessage, ObjectTest, OutcomeSuccess, false},
+	{regexp.MustCompile(`^file ".*" has been attached to test \d+$`), ActionCreate, ObjectAttachment, OutcomeSuccess, false},
+	{regexp.MustCompile(`^comment (\d+) has been added to test \d+$`), ActionCreate, ObjectComment, OutcomeSuccess, false},
+	{regexp.MustCompile(`^campaign ".*" \(ID=(\d+)\) has been opened$`), ActionCreate, ObjectCampaign, OutcomeSuccess, false},
+	{regexp.MustCompile(`^campaign with ID=(\d+) has been closed$`), ActionUpdate, ObjectCampaign, OutcomeSuccess, false},
+	{regexp.MustCompile(`^request for campaign with ID=(\d+) has been satisfied$`), ActionRead, ObjectCampaign, OutcomeSuccess, false},
+	{regexp.MustCompile(`^querying the list of campaigns`), ActionRead, ObjectCampaign, OutcomeSuccess, false},
+	{regexp.MustCompile(`^querying the tests of campaign (\d+)`), ActionRead, ObjectCampaign, OutcomeSuccess, false},
+	{regexp.MustCompile(`^polarimeter (\d+) has been added`), ActionCreate, ObjectPolarimeter, OutcomeSuccess, false},
+	{regexp.MustCompile(`^polarimeter (\d+) has been updated`), ActionUpdate, ObjectPolarimeter, OutcomeSuccess, false},
+	{regexp.MustCompile(`^request for polarimeter (\d+) has been satisfied$`), ActionRead, ObjectPolarimeter, OutcomeSuccess, false},
+	{regexp.MustCompile(`^querying the list of polarimeters`), ActionRead, ObjectPolarimeter, OutcomeSuccess, false},
+	{regexp.MustCompile(`^querying the tests of polarimeter (\d+)`), ActionRead, ObjectPolarimeter, OutcomeSuccess, false},
+	{regexp.MustCompile(`^test type "(.*)" has been added$`), ActionCreate, ObjectTestType, OutcomeSuccess, false},
+	{regexp.MustCompile(`^".*" is now an alias for test type "(.*)"$`), ActionUpdate, ObjectTestType, OutcomeSuccess, false},
+	{regexp.MustCompile(`^property "(.*?)" has been set to`), ActionUpdate, ObjectProperty, OutcomeSuccess, false},
+	{regexp.MustCompile(`^backup (\S+) saved in`), ActionRead, ObjectDatabase, OutcomeSuccess, false},
+	{regexp.MustCompile(`^\d+ tests have been merged from database (\S+)`), ActionCreate, ObjectDatabase, OutcomeSuccess, false},
+}
+
+// classifyLegacyLogEntries fills the action, the object and the outcome
+// of the entries written in the log before they were recorded
+// explicitly, using the text of their messages. Messages that match none
+// of the known patterns are kept as ActionMessage.
+func classifyLegacyLogEntries(tx *sql.Tx) error {
+	type legacyEntry struct {
+		id       int64
+		username string
+		message  string
+	}
+
+	rows, err := tx.Query(`select msg_id, user_id, coalesce(message, '') from log where action is null`)
+	if err != nil {
+		return err
+	}
+
+	var entries []legacyEntry
+	for rows.Next() {
+		var entry legacyEntry
+		if err := rows.Scan(&entry.id, &entry.username, &entry.message); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, curEntry := range entries {
+		action, objectType, objectID, outcome := ActionMessage, "", "", OutcomeSuccess
+		for _, curPattern := range legacyLogPatterns {
+			match := curPattern.regexp.FindStringSubmatch(curEntry.message)
+			if match == nil {
+				continue
+			}
+
+			action, objectType, outcome = curPattern.action, curPattern.objectType, curPattern.outcome
+			if curPattern.userIsObject {
+				objectID = curEntry.username
+			} else if len(match) > 1 {
+				objectID = match[1]
+			}
+			break
+		}
+
+		if _, err := tx.Exec(`
+update log set action = ?, object_type = ?, object_id = ?, outcome = ? where msg_id = ?`,
+			action, nullIfEmpty(objectType), nullIfEmpty(objectID), outcome, curEntry.id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	conn := createTestDatabase(t, "log")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 5}, "alice"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	ctx := WithClientAddress(WithUsername(context.Background(), "bob"), "192.168.0.1")
+	var pol Polarimeter
+	if err := conn.GetPolarimeterContext(ctx, 5, "", &pol); err != nil {
+		t.Fatalf("unable to retrieve a polarimeter: %v", err)
+	}
+	if err := conn.Log("free-text message", ""); err != nil {
+		t.Fatalf("unable to write in the log: %v", err)
+	}
+
+	entries, err := conn.QueryLog(LogFilter{Username: "alice"})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("wrong result from QueryLog: %v (%v)", entries, err)
+	}
+	if entries[0].Action != ActionCreate || entries[0].ObjectType != ObjectPolarimeter ||
+		entries[0].ObjectID != "5" || entries[0].Outcome != OutcomeSuccess || entries[0].ClientAddress != "" {
+		t.Errorf("wrong log entry: %v", entries[0])
+	}
+
+	entries, err = conn.QueryLog(LogFilter{Action: ActionRead, ObjectType: ObjectPolarimeter})
+	if err != nil || len(entries) != 1 || entries[0].Username != "bob" || entries[0].ClientAddress != "192.168.0.1" {
+		t.Errorf("the user and the client were not taken from the context: %v (%v)", entries, err)
+	}
+
+	entries, err = conn.QueryLog(LogFilter{Action: ActionMessage})
+	if err != nil || len(entries) != 1 || entries[0].Username != AnonymousUser {
+		t.Errorf("wrong user for an anonymous message: %v (%v)", entries, err)
+	}
+
+	if entries, err := conn.QueryLog(LogFilter{Since: time.Now().Add(time.Hour)}); err != nil || len(entries) != 0 {
+		t.Errorf("entries in the future were returned: %v (%v)", entries, err)
+	}
+	if entries, err := conn.QueryLog(LogFilter{Limit: 2}); err != nil || len(entries) != 2 ||
+		entries[0].ID < entries[1].ID {
+		t.Errorf("wrong result when limiting the number of entries: %v (%v)", entries, err)
+	}
+}
+
+func TestPruneLog(t *testing.T) {
+	conn := createTestDatabase(t, "prunelog")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 5}, "alice"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		var pol Polarimeter
+		if err := conn.GetPolarimeter(5, "bob", &pol); err != nil {
+			t.Fatalf("unable to retrieve a polarimeter: %v", err)
+		}
+	}
+
+	if days, err := conn.ReadLogRetention(); err != nil || days != DefaultReadLogRetention {
+		t.Errorf("wrong default retention: %d (%v)", days, err)
+	}
+	if err := conn.SetProperty(ReadLogRetentionProperty, "-3", "alice"); err == nil {
+		t.Error("an invalid retention was accepted")
+	}
+
+	// Nothing is old enough to be removed
+	if count, err := conn.PruneLog(time.Now().Add(-time.Hour), nil, "alice"); err != nil || count != 0 {
+		t.Errorf("recent entries were pruned: %d (%v)", count, err)
+	}
+
+	var archive bytes.Buffer
+	count, err := conn.PruneLog(time.Now().Add(time.Hour), &archive, "alice")
+	if err != nil || count != 3 {
+		t.Fatalf("wrong number of entries pruned: %d (%v)", count, err)
+	}
+	if lines := strings.Split(strings.TrimSpace(archive.String()), "\n"); len(lines) != 3 ||
+		!strings.Contains(lines[0], `"username":"bob"`) {
+		t.Errorf("wrong archive of the pruned entries: %s", archive.String())
+	}
+
+	if entries, err := conn.QueryLog(LogFilter{Action: ActionRead}); err != nil || len(entries) != 0 {
+		t.Errorf("read entries were not pruned: %v (%v)", entries, err)
+	}
+	if entries, err := conn.QueryLog(LogFilter{Username: "alice"}); err != nil || len(entries) < 2 {
+		t.Errorf("entries other than reads were pruned: %v (%v)", entries, err)
+	}
+}
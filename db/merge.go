@@ -0,0 +1,666 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// assignDatabaseID is used by the migration that introduced merges: it
+// gives the database a unique ID, which is saved in the "origin_db" column
+// of the tests merged into other databases
+func assignDatabaseID(tx *sql.Tx) error {
+	_, err := tx.Exec(`insert or ignore into properties (key, value) values ('database_id', ?)`,
+		uuid.NewV4().String())
+	return err
+}
+
+func getDatabaseID(q queryRower) (string, error) {
+	id, err := getProperty(q, "database_id", "")
+	if err == nil && id == "" {
+		err = fmt.Errorf("the database has no ID")
+	}
+	return id, err
+}
+
+// MergeOptions tells MergeFrom how to handle the source database
+type MergeOptions struct {
+	// Renames the users of the source database. It must be used to resolve
+	// conflicts, i.e., users with the same name but a different email
+	// address. If the new name matches an existing user, the two are
+	// considered the same person.
+	UserMap map[string]string
+}
+
+// MergeReport summarizes what MergeFrom has done
+type MergeReport struct {
+	SourceID      string        // ID of the source database
+	TestIDs       map[int]int   // Maps the IDs of the merged tests to their new IDs
+	AlreadyMerged []int         // Tests skipped because their UUID is already in the database
+	Rejected      []int         // Tests skipped because their data are already in the database
+	Duplicates    map[int][]int // Merged tests (new IDs) whose data were already in the database
+	NewUsers      []string      // Users added to the database
+	MissingFiles  []string      // Files that are referenced by the source database but missing
+	LogEntries    int           // Number of log messages copied
+}
+
+// UserConflictError is returned by MergeFrom if the source database has
+// users whose name is already used by different people
+type UserConflictError struct {
+	Usernames []string
+}
+
+func (err *UserConflictError) Error() string {
+	return fmt.Sprintf("users %s exist in both databases but do not match, use a user map to rename them",
+		strings.Join(err.Usernames, ", "))
+}
+
+// forEachRow calls "fn" for each row returned by "query", passing the values
+// of the columns
+func forEachRow(q queryer, query string, fn func(values []interface{}) error, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for idx := range values {
+			pointers[idx] = &values[idx]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// insertValues runs an "insert" statement on "table" with the given columns
+// and values, and returns the ID of the new row
+func insertValues(tx *sql.Tx, verb string, table string, columns string, values []interface{}) (int64, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	result, err := tx.Exec(fmt.Sprintf(`%s into %s (%s) values (%s)`,
+		verb, table, columns, placeholders), values...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// merger holds the state of a call to MergeFrom
+type merger struct {
+	ctx      context.Context
+	conn     *Connection
+	src      *Connection
+	tx       *sql.Tx
+	destID   string
+	options  MergeOptions
+	username string
+	report   MergeReport
+
+	users       map[string]string // Source user → destination user
+	campaignIDs map[int64]int64
+	removeFiles []func()
+}
+
+func (m *merger) user(name interface{}) interface{} {
+	if s, ok := name.(string); ok {
+		if newName, ok := m.users[s]; ok {
+			return newName
+		}
+	}
+	return name
+}
+
+func (m *merger) newTestID(oldID interface{}) (int, bool) {
+	id, ok := oldID.(int64)
+	if !ok {
+		return 0, false
+	}
+	newID, ok := m.report.TestIDs[int(id)]
+	return newID, ok
+}
+
+// mergeUsers decides how each user of the source database is named in the
+// destination, creating the users that are missing. Two users with the same
+// name are the same person if their email addresses match (or, if they have
+// none, their full names).
+func (m *merger) mergeUsers() error {
+	m.users = make(map[string]string)
+	var conflicts []string
+	err := forEachRow(m.src.withContext(m.ctx), `
+select user_id, full_name, creation_date, email, password_hash, is_enabled from users order by user_id`,
+		func(values []interface{}) error {
+			name := values[0].(string)
+			newName := name
+			if mapped, ok := m.options.UserMap[name]; ok {
+				newName = mapped
+			}
+			m.users[name] = newName
+
+			var fullName, email sql.NullString
+			err := m.tx.QueryRow(`select full_name, email from users where user_id = ?`,
+				newName).Scan(&fullName, &email)
+			if err == sql.ErrNoRows {
+				values[0] = newName
+				if _, err := insertValues(m.tx, "insert", "users",
+					"user_id, full_name, creation_date, email, password_hash, is_enabled", values); err != nil {
+					return err
+				}
+				m.report.NewUsers = append(m.report.NewUsers, newName)
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if newName != name {
+				// The user map explicitly says that they are the same person
+				return nil
+			}
+
+			srcFullName, _ := values[1].(string)
+			srcEmail, _ := values[3].(string)
+			sameEmail := email.String != "" && strings.EqualFold(email.String, srcEmail)
+			sameName := email.String == "" && srcEmail == "" && fullName.String == srcFullName
+			if !sameEmail && !sameName {
+				conflicts = append(conflicts, name)
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	if len(conflicts) > 0 {
+		return &UserConflictError{Usernames: conflicts}
+	}
+	return nil
+}
+
+// mergeVocabularies copies the polarimeters, test types and campaigns that
+// are not in the destination database. Campaigns are matched by name.
+func (m *merger) mergeVocabularies() error {
+	for _, curTable := range []struct{ name, columns string }{
+		{"polarimeters", "polarimeter_id, serial_number, module, board, band, status, notes"},
+		{"test_types", "code, test_plan_ref, description, file_format, required_metadata"},
+		{"test_type_aliases", "alias, code"},
+	} {
+		if err := forEachRow(m.src.withContext(m.ctx),
+			fmt.Sprintf(`select %s from %s`, curTable.columns, curTable.name),
+			func(values []interface{}) error {
+				_, err := insertValues(m.tx, "insert or ignore", curTable.name, curTable.columns, values)
+				return err
+			}); err != nil {
+			return err
+		}
+	}
+
+	m.campaignIDs = make(map[int64]int64)
+	return forEachRow(m.src.withContext(m.ctx), `
+select campaign_id, name, start_date, end_date, cryostat, operator, notes from campaigns`,
+		func(values []interface{}) error {
+			oldID := values[0].(int64)
+			var newID int64
+			err := m.tx.QueryRow(`select campaign_id from campaigns where name = ?`,
+				values[1]).Scan(&newID)
+			if err == sql.ErrNoRows {
+				newID, err = insertValues(m.tx, "insert", "campaigns",
+					"name, start_date, end_date, cryostat, operator, notes", values[1:])
+			}
+			if err != nil {
+				return err
+			}
+
+			m.campaignIDs[oldID] = newID
+			return nil
+		})
+}
+
+// copyBlob copies an object of the source database into the destination
+func (m *merger) copyBlob(key string) error {
+	if _, err := m.conn.Blobs.Stat(key); err == nil {
+		return nil
+	} else if err != ErrBlobNotFound {
+		return err
+	}
+
+	r, err := m.src.Blobs.Get(key)
+	if err == ErrBlobNotFound {
+		m.report.MissingFiles = append(m.report.MissingFiles, key)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := m.conn.Blobs.Put(key, r); err != nil {
+		return err
+	}
+	m.removeFiles = append(m.removeFiles, func() { m.conn.Blobs.Delete(key) })
+	return nil
+}
+
+// findMergedTest returns the ID of the test in the destination database
+// with the same UUID, if any
+func (m *merger) findMergedTest(testUUID interface{}) (int, error) {
+	var id int
+	err := m.tx.QueryRow(`select test_id from tests where uuid = ?`, testUUID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// findTestDuplicates returns the tests in the destination database whose
+// data match any version of the data of test "oldID" in the source database
+func (m *merger) findTestDuplicates(oldID int64, checkData bool) ([]int, error) {
+	var duplicates []int
+	err := forEachRow(m.src.withContext(m.ctx), `
+select coalesce(source_checksum, ''), coalesce(data_checksum, '') from test_data_versions
+where test_id = ? and source_checksum is not null`,
+		func(values []interface{}) error {
+			ids, err := findDuplicates(m.tx, 0, values[0].(string), values[1].(string), checkData)
+			duplicates = append(duplicates, ids...)
+			return err
+		}, oldID)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(duplicates)
+	result := duplicates[:0]
+	for idx, curID := range duplicates {
+		if idx == 0 || curID != duplicates[idx-1] {
+			result = append(result, curID)
+		}
+	}
+	return result, nil
+}
+
+const mergedTestColumns = `short_name, description, creation_date, user_id, fits_checksum, type,
+time_span_sec, is_cryogenic, polarimeter, num_of_samples, campaign_id, file_path, uuid`
+
+// mergeTests copies the tests, together with their parameters, data and
+// attachments
+func (m *merger) mergeTests() error {
+	policy, checkData, err := m.conn.duplicateSettings(m.tx)
+	if err != nil {
+		return err
+	}
+
+	m.report.TestIDs = make(map[int]int)
+	m.report.Duplicates = make(map[int][]int)
+	return forEachRow(m.src.withContext(m.ctx), `
+select test_id, coalesce(origin_db, ?), coalesce(origin_test_id, test_id), `+mergedTestColumns+`
+from tests order by test_id`,
+		func(values []interface{}) error {
+			oldID := values[0].(int64)
+			originDB := values[1].(string)
+			originTestID := values[2].(int64)
+			testValues := values[3:]
+
+			if id, err := m.findMergedTest(testValues[12]); err != nil {
+				return err
+			} else if id != 0 {
+				m.report.TestIDs[int(oldID)] = id
+				m.report.AlreadyMerged = append(m.report.AlreadyMerged, int(oldID))
+				return nil
+			}
+
+			duplicates, err := m.findTestDuplicates(oldID, checkData)
+			if err != nil {
+				return err
+			}
+			if len(duplicates) > 0 && policy == DuplicateReject {
+				m.report.Rejected = append(m.report.Rejected, int(oldID))
+				return nil
+			}
+
+			testValues[3] = m.user(testValues[3])
+			if campaignID, ok := testValues[10].(int64); ok {
+				testValues[10] = m.campaignIDs[campaignID]
+			}
+			newID, err := insertValues(m.tx, "insert", "tests",
+				mergedTestColumns+", origin_db, origin_test_id",
+				append(testValues, originDB, originTestID))
+			if err != nil {
+				return err
+			}
+			m.report.TestIDs[int(oldID)] = int(newID)
+
+			if len(duplicates) > 0 {
+				m.report.Duplicates[int(newID)] = duplicates
+				if policy == DuplicateLink {
+					if _, err := m.tx.Exec(`
+insert or ignore into test_relations (source_id, target_id, relation, user_id, creation_date)
+values (?, ?, ?, ?, ?)`,
+						newID, duplicates[0], RelationDuplicateOf, m.username,
+						time.Now().UTC().Format(time.RFC3339)); err != nil {
+						return err
+					}
+				}
+			}
+
+			return m.mergeTestContents(oldID, newID)
+		}, m.report.SourceID)
+}
+
+// legacyDataKey returns the key used by databases created before version
+// 0.10.0 of the schema for the data of a test
+func legacyDataKey(testID int64) string {
+	return fmt.Sprintf("test_%06d.fits.gz", testID)
+}
+
+func (m *merger) mergeTestContents(oldID int64, newID int64) error {
+	if err := forEachRow(m.src.withContext(m.ctx), `
+select name, kind, num_value, str_value, unit, base_value, base_unit from test_parameters where test_id = ?`,
+		func(values []interface{}) error {
+			_, err := insertValues(m.tx, "insert", "test_parameters",
+				"test_id, name, kind, num_value, str_value, unit, base_value, base_unit", append([]interface{}{newID}, values...))
+			return err
+		}, oldID); err != nil {
+		return err
+	}
+
+	if err := forEachRow(m.src.withContext(m.ctx), `
+select version, file_name, fits_checksum, creation_date, user_id, reason, source_checksum, data_checksum
+from test_data_versions where test_id = ?`,
+		func(values []interface{}) error {
+			key := values[1].(string)
+			if strings.HasPrefix(key, dataFolderName+"/") {
+				if err := m.copyBlob(key); err != nil {
+					return err
+				}
+			} else {
+				// Files that could not be relocated are named after the
+				// test, so the name must follow the new ID
+				m.report.MissingFiles = append(m.report.MissingFiles, key)
+				values[1] = legacyDataKey(newID)
+				if _, err := m.tx.Exec(`update tests set file_path = ? where test_id = ? and file_path = ?`,
+					values[1], newID, key); err != nil {
+					return err
+				}
+			}
+
+			values[4] = m.user(values[4])
+			_, err := insertValues(m.tx, "insert", "test_data_versions",
+				"test_id, version, file_name, fits_checksum, creation_date, user_id, reason, source_checksum, data_checksum",
+				append([]interface{}{newID}, values...))
+			return err
+		}, oldID); err != nil {
+		return err
+	}
+
+	return forEachRow(m.src.withContext(m.ctx), `
+select version, column_name, unit, num_of_samples, nan_fraction, mean, std_dev,
+       min_value, max_value, median, first_value, last_value
+from column_stats where test_id = ?`,
+		func(values []interface{}) error {
+			_, err := insertValues(m.tx, "insert", "column_stats",
+				"test_id, version, column_name, unit, num_of_samples, nan_fraction, mean, std_dev, "+
+					"min_value, max_value, median, first_value, last_value",
+				append([]interface{}{newID}, values...))
+			return err
+		}, oldID)
+}
+
+// mergeAttachments copies the attachments of the merged tests
+func (m *merger) mergeAttachments() error {
+	attachmentIDs := make(map[int64]int64)
+	if err := forEachRow(m.src.withContext(m.ctx), `
+select attachment_id, test_id, file_name, mime_type, checksum from attachments order by attachment_id`,
+		func(values []interface{}) error {
+			newTestID, ok := m.newTestID(values[1])
+			if !ok || isAlreadyMerged(m.report.AlreadyMerged, values[1]) {
+				return nil
+			}
+
+			if checksum, ok := values[4].(string); ok {
+				if err := m.copyBlob(attachmentStoragePath(checksum)); err != nil {
+					return err
+				}
+			}
+
+			values[1] = newTestID
+			newID, err := insertValues(m.tx, "insert", "attachments",
+				"test_id, file_name, mime_type, checksum", values[1:])
+			if err != nil {
+				return err
+			}
+			attachmentIDs[values[0].(int64)] = newID
+			return nil
+		}); err != nil {
+		return err
+	}
+
+	return forEachRow(m.src.withContext(m.ctx), `select test_id, attachment_id from test_attachment_assoc`,
+		func(values []interface{}) error {
+			newTestID, ok := m.newTestID(values[0])
+			newAttachmentID, found := attachmentIDs[values[1].(int64)]
+			if !ok || !found {
+				return nil
+			}
+
+			_, err := m.tx.Exec(`insert into test_attachment_assoc (test_id, attachment_id) values (?, ?)`,
+				newTestID, newAttachmentID)
+			return err
+		})
+}
+
+func isAlreadyMerged(ids []int, testID interface{}) bool {
+	id, _ := testID.(int64)
+	for _, curID := range ids {
+		if int64(curID) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeComments copies the comments and the relations between tests. Tests
+// that were merged before are skipped, as their comments are already in the
+// database.
+func (m *merger) mergeComments() error {
+	commentIDs := make(map[int64]int64)
+	if err := forEachRow(m.src.withContext(m.ctx), `
+select comment_id, test_id, user_id, creation_date, body, reply_to from test_comments order by comment_id`,
+		func(values []interface{}) error {
+			newTestID, ok := m.newTestID(values[1])
+			if !ok || isAlreadyMerged(m.report.AlreadyMerged, values[1]) {
+				return nil
+			}
+
+			values[1] = newTestID
+			values[2] = m.user(values[2])
+			if replyTo, ok := values[5].(int64); ok {
+				if newReplyTo, found := commentIDs[replyTo]; found {
+					values[5] = newReplyTo
+				} else {
+					values[5] = nil
+				}
+			}
+			newID, err := insertValues(m.tx, "insert", "test_comments",
+				"test_id, user_id, creation_date, body, reply_to", values[1:])
+			if err != nil {
+				return err
+			}
+			commentIDs[values[0].(int64)] = newID
+			return nil
+		}); err != nil {
+		return err
+	}
+
+	return forEachRow(m.src.withContext(m.ctx), `
+select source_id, target_id, relation, user_id, creation_date from test_relations`,
+		func(values []interface{}) error {
+			sourceID, ok1 := m.newTestID(values[0])
+			targetID, ok2 := m.newTestID(values[1])
+			if !ok1 || !ok2 {
+				return nil
+			}
+
+			values[0], values[1] = sourceID, targetID
+			values[3] = m.user(values[3])
+			_, err := insertValues(m.tx, "insert or ignore", "test_relations",
+				"source_id, target_id, relation, user_id, creation_date", values)
+			return err
+		})
+}
+
+// mergeLog copies the log messages that were not copied by a previous
+// merge. The ID of the source database is prepended to each message, since
+// the IDs they mention refer to the source database.
+func (m *merger) mergeLog() error {
+	propertyKey := "merged_log_" + m.report.SourceID
+	lastID, err := getProperty(m.tx, propertyKey, "0")
+	if err != nil {
+		return err
+	}
+
+	var maxID int64
+	if err := forEachRow(m.src.withContext(m.ctx), `
+select `+logColumns+` from log where msg_id > ? order by msg_id`,
+		func(values []interface{}) error {
+			maxID = values[0].(int64)
+			message, _ := values[3].(string)
+			_, err := m.tx.Exec(`
+insert into log (user_id, date, message, action, object_type, object_id, client_address, outcome)
+values (?, ?, ?, ?, ?, ?, ?, ?)`,
+				m.user(values[1]), values[2], fmt.Sprintf("[%s] %s", m.report.SourceID, message),
+				values[4], values[5], values[6], values[7], values[8])
+			m.report.LogEntries++
+			return err
+		}, lastID); err != nil {
+		return err
+	}
+
+	if maxID > 0 {
+		_, err = m.tx.Exec(`insert or replace into properties (key, value) values (?, ?)`,
+			propertyKey, fmt.Sprintf("%d", maxID))
+	}
+	return err
+}
+
+// MergeFrom imports the tests, users, attachments and log messages of the
+// database in the folder "srcPath". Tests get new IDs, and the ID of the
+// source database and the original ID of each test are recorded (see
+// Test.OriginDB), while UUIDs are preserved. Tests whose UUID is already in
+// the database are not imported again. Tests whose data are already in the database are
+// handled according to the duplicate policy. If some users of the source
+// database conflict with existing users, nothing is merged and a
+// *UserConflictError is returned. The source database is never modified:
+// if it uses an older version of the schema, an error is returned and it
+// must be upgraded first. The parameter "username" is used only for
+// logging purposes.
+func (conn *Connection) MergeFrom(srcPath string, options MergeOptions, username string) (MergeReport, error) {
+	return conn.MergeFromContext(context.Background(), srcPath, options, username)
+}
+
+// MergeFromContext is like MergeFrom, but it accepts a context to cancel the operation
+func (conn *Connection) MergeFromContext(ctx context.Context, srcPath string, options MergeOptions, username string) (MergeReport, error) {
+	if err := conn.checkWritable(); err != nil {
+		return MergeReport{}, err
+	}
+
+	// The source database must not be changed, so it is not upgraded to
+	// the current version of the schema
+	var src Connection
+	if err := src.connectUntouched(srcPath); err != nil {
+		return MergeReport{}, fmt.Errorf("unable to open \"%s\": %v", srcPath, err)
+	}
+	defer src.Disconnect()
+
+	if version, err := getSchemaVersion(src.withContext(ctx)); err != nil {
+		return MergeReport{}, fmt.Errorf("unable to determine the version of the schema of \"%s\": %v",
+			srcPath, err)
+	} else if version != DatabaseSchemaVersion {
+		return MergeReport{}, fmt.Errorf("the database in \"%s\" uses version %s of the schema instead of %s, upgrade it first (e.g., with \"stdb checkdb --fix\")",
+			srcPath, version, DatabaseSchemaVersion)
+	}
+
+	m := merger{ctx: ctx, conn: conn, src: &src, options: options, username: username}
+	var err error
+	if m.report.SourceID, err = getDatabaseID(src.withContext(ctx)); err != nil {
+		return m.report, err
+	}
+	if m.destID, err = getDatabaseID(conn.withContext(ctx)); err != nil {
+		return m.report, err
+	}
+	if m.report.SourceID == m.destID {
+		return m.report, fmt.Errorf("a database cannot be merged into itself")
+	}
+
+	var unlock func()
+	if m.tx, unlock, err = conn.beginWrite(ctx); err != nil {
+		return m.report, err
+	}
+	defer unlock()
+
+	for _, step := range []func() error{
+		m.mergeUsers,
+		m.mergeVocabularies,
+		m.mergeTests,
+		m.mergeAttachments,
+		m.mergeComments,
+		m.mergeLog,
+	} {
+		if err := step(); err != nil {
+			m.tx.Rollback()
+			m.removeNewFiles()
+			return m.report, err
+		}
+	}
+
+	if err := m.tx.Commit(); err != nil {
+		m.removeNewFiles()
+		return m.report, err
+	}
+	unlock()
+
+	conn.logAction(ctx, username, ActionCreate, ObjectDatabase, m.report.SourceID,
+		fmt.Sprintf("%d tests have been merged from database %s (\"%s\")",
+			len(m.report.TestIDs)-len(m.report.AlreadyMerged), m.report.SourceID, srcPath))
+	return m.report, nil
+}
+
+func (m *merger) removeNewFiles() {
+	for _, remove := range m.removeFiles {
+		remove()
+	}
+}
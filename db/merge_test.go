@@ -0,0 +1,192 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeFrom(t *testing.T) {
+	dest := createTestDatabase(t, "merge_dest")
+	defer dest.Disconnect()
+	src := createTestDatabase(t, "merge_src")
+	defer src.Disconnect()
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	for _, conn := range []*Connection{dest, src} {
+		if err := conn.AddPolarimeter(&Polarimeter{Number: 6}, "testuser"); err != nil {
+			t.Fatalf("unable to register a new polarimeter: %v", err)
+		}
+	}
+	destTestID, err := dest.AddTest(&Test{ShortName: "local", TestType: "sweep", Polarimeter: 6},
+		"testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	// Same username, different people
+	if err := dest.CreateUser("bob", []byte("pass"), "Bob", "bob@lab2.org", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.CreateUser("bob", []byte("pass"), "Bob", "bob@lab1.org", true); err != nil {
+		t.Fatal(err)
+	}
+
+	param := TestParameter{Name: "vdrain", Kind: ParameterNumber, Number: 0.8, Unit: "V"}
+	srcTest := Test{ShortName: "remote", TestType: "sweep", Polarimeter: 6,
+		Parameters: []TestParameter{param}}
+	srcTestID, err := src.AddTest(&srcTest, "bob", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	if _, err := src.AddComment(&Comment{TestID: srcTestID, Username: "bob", Body: "Looks fine"}); err != nil {
+		t.Fatalf("unable to add a comment: %v", err)
+	}
+	if _, err := src.AddAttachment(srcTestID, inputFilePath, "bob"); err != nil {
+		t.Fatalf("unable to add an attachment: %v", err)
+	}
+
+	if _, err := dest.MergeFrom(src.BasePath, MergeOptions{}, "testuser"); err == nil {
+		t.Fatal("conflicting users were not detected")
+	} else if conflict, ok := err.(*UserConflictError); !ok || len(conflict.Usernames) != 1 {
+		t.Fatalf("wrong error for conflicting users: %v", err)
+	}
+	if _, err := dest.MergeFrom(dest.BasePath, MergeOptions{}, "testuser"); err == nil {
+		t.Error("a database was merged into itself")
+	}
+
+	options := MergeOptions{UserMap: map[string]string{"bob": "bob_lab1"}}
+	report, err := dest.MergeFrom(src.BasePath, options, "testuser")
+	if err != nil {
+		t.Fatalf("unable to merge a database: %v", err)
+	}
+	newID, ok := report.TestIDs[srcTestID]
+	if !ok || newID == destTestID || len(report.NewUsers) != 1 || report.NewUsers[0] != "bob_lab1" {
+		t.Fatalf("wrong report after a merge: %v", report)
+	}
+	if duplicates := report.Duplicates[newID]; len(duplicates) != 1 || duplicates[0] != destTestID {
+		t.Errorf("duplicated data were not detected: %v", report.Duplicates)
+	}
+
+	var test Test
+	if err := dest.GetTest(newID, "", &test); err != nil {
+		t.Fatalf("unable to read a merged test: %v", err)
+	}
+	srcDatabaseID, _ := src.GetProperty("database_id", "")
+	if test.ShortName != "remote" || test.Username != "bob_lab1" || test.UUID != srcTest.UUID ||
+		test.OriginDB != srcDatabaseID || test.OriginTestID != srcTestID ||
+		len(test.Parameters) != 1 || test.Parameters[0] != param {
+		t.Errorf("wrong merged test: %v", test)
+	}
+
+	r, _, err := dest.OpenTestData(newID, 0)
+	if err != nil {
+		t.Errorf("the data of a merged test are not available: %v", err)
+	} else {
+		r.Close()
+	}
+	if comments, err := dest.GetComments(newID); err != nil || len(comments) != 1 ||
+		comments[0].Username != "bob_lab1" {
+		t.Errorf("comments were not merged: %v (%v)", comments, err)
+	}
+	if attachments, err := dest.GetAttachments(newID); err != nil || len(attachments) != 1 {
+		t.Errorf("attachments were not merged: %v (%v)", attachments, err)
+	}
+
+	// A second merge imports nothing new
+	report, err = dest.MergeFrom(src.BasePath, options, "testuser")
+	if err != nil {
+		t.Fatalf("unable to merge a database again: %v", err)
+	}
+	if len(report.AlreadyMerged) != 1 || report.TestIDs[srcTestID] != newID {
+		t.Errorf("wrong report after a second merge: %v", report)
+	}
+	if ids, _ := dest.GetListOfTestIDs("", -1); len(ids) != 2 {
+		t.Errorf("tests were merged twice: %v", ids)
+	}
+}
+
+// folderContents returns the SHA-256 checksum of every file in a folder,
+// indexed by path
+func folderContents(t *testing.T, folder string) map[string]string {
+	result := make(map[string]string)
+	err := filepath.Walk(folder, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(contents)
+		result[fileName] = hex.EncodeToString(hash[:])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMergeLeavesSourceUnchanged(t *testing.T) {
+	dest := createTestDatabase(t, "merge_unchanged_dest")
+	defer dest.Disconnect()
+	src := createTestDatabase(t, "merge_unchanged_src")
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	if err := src.AddPolarimeter(&Polarimeter{Number: 6}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	testID, err := src.AddTest(&Test{ShortName: "remote", TestType: "sweep", Polarimeter: 6},
+		"testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	if _, err := src.AddAttachment(testID, inputFilePath, "testuser"); err != nil {
+		t.Fatalf("unable to add an attachment: %v", err)
+	}
+	src.Disconnect()
+
+	before := folderContents(t, src.BasePath)
+	if _, err := dest.MergeFrom(src.BasePath, MergeOptions{}, "testuser"); err != nil {
+		t.Fatalf("unable to merge a database: %v", err)
+	}
+	if after := folderContents(t, src.BasePath); !reflect.DeepEqual(after, before) {
+		t.Errorf("the source database has been modified by the merge:\n%v\n%v", before, after)
+	}
+
+	// Databases using older versions of the schema are not upgraded
+	legacyPath := createLegacyDatabase(t, "merge_legacy", []Test{{ShortName: "a", TestType: "dc", Polarimeter: 1}})
+	before = folderContents(t, legacyPath)
+	if _, err := dest.MergeFrom(legacyPath, MergeOptions{}, "testuser"); err == nil {
+		t.Error("a database using an old schema has been merged")
+	}
+	if after := folderContents(t, legacyPath); !reflect.DeepEqual(after, before) {
+		t.Errorf("the legacy database has been modified by the merge:\n%v\n%v", before, after)
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+)
+
+// baseSchemaVersion is the version of the schema created by the statements
+// in "CreateEmptyDatabase". Every change after it is a migration.
+const baseSchemaVersion = "0.1.0"
+
+// schemaMigration upgrades the database schema to "version". The SQL code in
+// "statements" is executed first, then "apply" (if not nil) is called within
+// the same transaction to perform the operations that cannot be expressed
+// in SQL. Migrations that need to move files in the database folder use
+// "relocate": the files it returns are deleted only after the transaction
+// has been committed, so that a failed migration loses no data.
+type schemaMigration struct {
+	version     string
+	description string
+	statements  string
+	apply       func(tx *sql.Tx) error
+	relocate    func(tx *sql.Tx, basePath string) ([]string, error)
+}
+
+// schemaMigrations lists all the migrations in the order they must be
+// applied. The version of the last one must match DatabaseSchemaVersion.
+var schemaMigrations = []schemaMigration{
+	{
+		version:     "0.2.0",
+		description: "add the registry of polarimeters",
+		statements: `
+create table polarimeters (
+-- Registry of the polarimeters that can be tested
+
+	polarimeter_id integer not null primary key, -- Number of the polarimeter
+	serial_number text unique,                   -- Serial number of the hardware
+	module text,                                 -- Position of the polarimeter in the focal plane module
+	board text,                                  -- Bias board driving the polarimeter
+	band text,                                   -- Frequency band ("Q", "W")
+	status text not null,                        -- "available", "in-test", "faulty", ...
+	notes text                                   -- Free-form notes
+);
+
+insert into polarimeters (polarimeter_id, status)
+	select distinct polarimeter, 'unknown' from tests;
+
+create table tests_new (
+-- List of all the tests saved in the database
+
+	test_id integer not null primary key,   -- Unique ID for this test
+	short_name text,                        -- Short, easy to remember name
+	description text,                       -- Full description of the test
+	creation_date text not null,            -- Time when the acquisition stopped (YYYY-MM-DDTHH:MM:SS.SSS)
+	user_id text not null,                  -- ID of the user which uploaded the test
+	fits_checksum text,                     -- Checksum of the FITS file
+	type text not null,                     -- "dc", "noise", "bandpass", ...
+	time_span_sec number,                   -- Length of the acquisition, in seconds
+	is_cryogenic integer not null,          -- Was the test done in cryogenic conditions? (0/1)
+	polarimeter integer not null            -- Number of the polarimeter being tested
+		references polarimeters (polarimeter_id),
+	num_of_samples integer not null         -- Number of samples acquired during the test
+);
+
+insert into tests_new select * from tests;
+drop table tests;
+alter table tests_new rename to tests;
+`,
+	},
+	{
+		version:     "0.3.0",
+		description: "add the controlled vocabulary of test types",
+		statements: `
+create table test_types (
+-- Types of test, as defined in the Test Plan
+
+	code text not null primary key,  -- Short code used in the "tests" table ("dc", "phsw", ...)
+	test_plan_ref text,              -- Section of the Test Plan describing the test
+	description text,                -- Description of the test
+	file_format text,                -- Expected format of the input file ("keithley", ...), NULL if any
+	required_metadata text           -- Comma-separated list of fields that must be provided
+);
+
+create table test_type_aliases (
+-- Alternative spellings for the codes in "test_types"
+
+	alias text not null primary key,                     -- Alternative spelling (lowercase)
+	code text not null references test_types (code)      -- Code of the test type
+);
+
+insert into test_types (code, description, file_format) values
+	('dc', 'DC characterization of amplifiers and detectors', NULL),
+	('sweep', 'Bias sweep acquired with the Keithley apparatus', 'keithley'),
+	('phsw', 'Phase switch tuning', NULL),
+	('noise', 'Noise properties and 1/f knee frequency', NULL),
+	('bandpass', 'Bandpass measurement', NULL);
+
+insert into test_type_aliases (alias, code) values
+	('ph/sw', 'phsw'),
+	('ph-sw', 'phsw'),
+	('phase switch', 'phsw'),
+	('phase-switch', 'phsw'),
+	('phaseswitch', 'phsw'),
+	('bias sweep', 'sweep'),
+	('i/v', 'dc'),
+	('iv', 'dc');
+`,
+		apply: normalizeTestTypes,
+	},
+	{
+		version:     "0.4.0",
+		description: "add test campaigns",
+		statements: `
+create table campaigns (
+-- Test campaigns and cryogenic cooldowns, used to group tests
+
+	campaign_id integer not null primary key, -- Unique ID for this campaign
+	name text not null unique,                -- Name of the campaign
+	start_date text not null,                 -- When the campaign started (YYYY-MM-DDTHH:MM:SS)
+	end_date text,                            -- When the campaign ended, NULL if still open
+	cryostat text,                            -- Cryostat used during the campaign
+	operator text,                            -- Person in charge of the campaign
+	notes text                                -- Free-form notes
+);
+
+alter table tests add column campaign_id integer references campaigns (campaign_id);
+`,
+	},
+	{
+		version:     "0.5.0",
+		description: "add typed relationships between tests",
+		statements: `
+create table test_relations (
+-- Typed relationships between tests. Each row is an edge going from
+-- "source_id" to "target_id", e.g., "source_id repeats target_id"
+
+	source_id integer not null references tests (test_id),
+	target_id integer not null references tests (test_id),
+	relation text not null,           -- "repeats", "supersedes", "reference-for", "same-setup-as"
+	user_id text,                     -- User that created the relationship
+	creation_date text,               -- When the relationship was created (YYYY-MM-DDTHH:MM:SS)
+
+	primary key (source_id, target_id, relation)
+);
+`,
+	},
+	{
+		version:     "0.6.0",
+		description: "add structured parameters to tests",
+		statements: `
+create table test_parameters (
+-- Typed parameters (bias voltages, attenuator settings, ...) of each test
+
+	test_id integer not null references tests (test_id),
+	name text not null,          -- Name of the parameter (lowercase)
+	kind text not null,          -- "number", "string", or "bool"
+	num_value real,              -- Value of "number" and "bool" (0/1) parameters
+	str_value text,              -- Value of "string" parameters
+	unit text,                   -- Measurement unit of "number" parameters
+
+	primary key (test_id, name)
+);
+
+create index test_parameters_name on test_parameters (name, num_value);
+`,
+	},
+	{
+		version:     "0.7.0",
+		description: "add comments to tests",
+		statements: `
+create table test_comments (
+-- Comments written by users about a test. Replies to another comment
+-- form a discussion thread.
+
+	comment_id integer not null primary key,
+	test_id integer not null references tests (test_id),
+	user_id text not null references users (user_id), -- Author of the comment
+	creation_date text not null,                      -- When the comment was written (YYYY-MM-DDTHH:MM:SS)
+	body text not null,                               -- Text of the comment (Markdown)
+	reply_to integer references test_comments (comment_id)
+);
+
+create index test_comments_test on test_comments (test_id);
+`,
+	},
+	{
+		version:     "0.8.0",
+		description: "keep older versions of the data of a test",
+		statements: `
+create table test_data_versions (
+-- Each time the data of a test are re-imported, a new FITS file is
+-- created and a row is added here. Older files are never deleted.
+
+	test_id integer not null references tests (test_id),
+	version integer not null,    -- Progressive number, starting from 1
+	file_name text not null,     -- Name of the FITS file, relative to the database folder
+	fits_checksum text,          -- SHA-256 checksum of the FITS file
+	creation_date text,          -- When this version was imported (YYYY-MM-DDTHH:MM:SS)
+	user_id text,                -- User that imported this version
+	reason text,                 -- Why the data have been replaced
+
+	primary key (test_id, version)
+);
+
+insert into test_data_versions (test_id, version, file_name, creation_date, user_id, reason)
+select test_id, 1, printf('test_%06d.fits.gz', test_id), creation_date, user_id, 'First import'
+from tests;
+`,
+	},
+	{
+		version:     "0.9.0",
+		description: "detect duplicated acquisitions",
+		statements: `
+alter table test_data_versions add column source_checksum text; -- SHA-256 checksum of the input file
+alter table test_data_versions add column data_checksum text;   -- SHA-256 checksum of the samples
+
+create index test_data_versions_source on test_data_versions (source_checksum);
+create index test_data_versions_data on test_data_versions (data_checksum);
+`,
+	},
+	{
+		version:     "0.10.0",
+		description: "move FITS files into a sharded, content-addressed layout",
+		statements: `
+alter table tests add column file_path text; -- FITS file of the latest version of the data
+`,
+		relocate: relocateDataFiles,
+	},
+	{
+		version:     "0.11.0",
+		description: "record the origin of tests merged from other databases",
+		statements: `
+alter table tests add column origin_db text;         -- ID of the database the test was merged from, NULL if added here
+alter table tests add column origin_test_id integer; -- ID of the test in that database
+`,
+		apply: assignDatabaseID,
+	},
+	{
+		version:     "0.12.0",
+		description: "give each test a globally unique identifier",
+		statements: `
+alter table tests add column uuid text; -- UUID of the test, preserved by merges
+
+create unique index tests_uuid on tests (uuid);
+`,
+		apply: assignTestUUIDs,
+	},
+	{
+		version:     "0.13.0",
+		description: "record structured entries in the log",
+		statements: `
+alter table log add column action text;         -- "read", "create", "update", "login", ... (see LogEntry)
+alter table log add column object_type text;    -- Kind of object the action refers to ("test", "user", ...)
+alter table log add column object_id text;      -- ID of the object
+alter table log add column client_address text; -- Network address of the client, NULL if local
+alter table log add column outcome text;        -- "success" or "failure"
+
+update log set user_id = 'anonymous' where user_id = '';
+
+create index log_date on log (date);
+create index log_action on log (action, date);
+create index log_user on log (user_id, date);
+`,
+		apply: classifyLegacyLogEntries,
+	},
+	{
+		version:     "0.14.0",
+		description: "store summary statistics of the columns of the data",
+		statements: `
+create table column_stats (
+    test_id integer not null references tests (test_id),
+    version integer not null,     -- Version of the data (see test_data_versions)
+    column_name text not null,
+    unit text,
+    num_of_samples integer not null,
+    nan_fraction number,          -- Fraction of samples that are NaN or infinite
+    mean number,                  -- NaNs and infinities are ignored in the following statistics,
+    std_dev number,               -- which are NULL if no other value is present
+    min_value number,
+    max_value number,
+    median number,
+    first_value number,           -- NULL if the sample is NaN or infinite
+    last_value number,
+    primary key (test_id, version, column_name)
+);
+
+create index column_stats_column on column_stats (column_name collate nocase);
+`,
+	},
+	{
+		version:     "0.15.0",
+		description: "compare the units of parameters regardless of SI prefixes",
+		statements: `
+alter table test_parameters add column base_value real;   -- Value converted to the unit without SI prefix
+alter table test_parameters add column base_unit text;    -- Unit without SI prefix (e.g., "V" for "mV")
+
+create index test_parameters_base on test_parameters (name, base_unit, base_value);
+`,
+		apply: normalizeParameterUnits,
+	},
+}
+
+func getSchemaVersion(q queryRower) (string, error) {
+	var version string
+	err := q.QueryRow(`select value from properties where key = 'stdb_version'`).Scan(&version)
+	return version, err
+}
+
+// pendingMigrations returns the migrations that must be applied to a
+// database whose schema has version "version".
+func pendingMigrations(version string) ([]schemaMigration, error) {
+	if version == baseSchemaVersion {
+		return schemaMigrations, nil
+	}
+
+	for idx, curMigration := range schemaMigrations {
+		if curMigration.version == version {
+			return schemaMigrations[idx+1:], nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown database schema version \"%s\" (this program supports version %s, consider upgrading stdb)",
+		version, DatabaseSchemaVersion)
+}
+
+// upgradeSchema applies all the pending migrations to the database. Each
+// migration runs in its own transaction, so that a failure leaves the
+// database at the last version that was successfully reached. The
+// parameter "basePath" is the folder containing the database.
+func upgradeSchema(db *sql.DB, basePath string) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("unable to determine the version of the database schema: %v", err)
+	}
+
+	migrations, err := pendingMigrations(version)
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		return nil
+	}
+
+	// Some migrations need to rebuild tables, which is not possible while
+	// foreign keys are enforced. The pragma has no effect within a
+	// transaction and applies to one connection only, so we must pin one.
+	ctx := context.Background()
+	dbConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	var foreignKeys int
+	if err := dbConn.QueryRowContext(ctx, `pragma foreign_keys`).Scan(&foreignKeys); err != nil {
+		return err
+	}
+	if _, err := dbConn.ExecContext(ctx, `pragma foreign_keys = off`); err != nil {
+		return err
+	}
+	defer dbConn.ExecContext(ctx, fmt.Sprintf(`pragma foreign_keys = %d`, foreignKeys))
+
+	for _, curMigration := range migrations {
+		log.Printf("upgrading the database schema to version %s (%s)",
+			curMigration.version, curMigration.description)
+
+		tx, err := dbConn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(curMigration.statements); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to upgrade the database to version %s: %v",
+				curMigration.version, err)
+		}
+
+		if curMigration.apply != nil {
+			if err := curMigration.apply(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("unable to upgrade the database to version %s: %v",
+					curMigration.version, err)
+			}
+		}
+
+		var obsoleteFiles []string
+		if curMigration.relocate != nil {
+			if obsoleteFiles, err = curMigration.relocate(tx, basePath); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("unable to upgrade the database to version %s: %v",
+					curMigration.version, err)
+			}
+		}
+
+		if _, err := tx.Exec(`update properties set value = ? where key = 'stdb_version'`,
+			curMigration.version); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		for _, curFile := range obsoleteFiles {
+			if err := os.Remove(curFile); err != nil {
+				log.Printf("unable to remove file \"%s\": %v", curFile, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// upgradeSchema applies the pending migrations holding the writer lock, so
+// that processes connecting at the same time do not run them twice
+func (conn *Connection) upgradeSchema() error {
+	if err := conn.writer.Lock(); err != nil {
+		return err
+	}
+	defer conn.writer.Unlock()
+
+	return upgradeSchema(conn.Connection, conn.BasePath)
+}
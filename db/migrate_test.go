@@ -0,0 +1,190 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// createLegacyDatabase creates a database using the first version of the
+// schema and fills the "tests" table with the rows in "tests"
+func createLegacyDatabase(t *testing.T, name string, tests []Test) string {
+	dbPath := path.Join(targetPath, name)
+	if err := os.Mkdir(dbPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path.Join(dbPath, IndexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := createBaseSchema(db); err != nil {
+		t.Fatalf("unable to create the base schema: %v", err)
+	}
+
+	for _, curTest := range tests {
+		if _, err := db.Exec(`
+insert into tests (short_name, creation_date, user_id, type, is_cryogenic, polarimeter, num_of_samples)
+values (?, '2017-05-18T10:38:25Z', 'olduser', ?, 0, ?, 0)`,
+			curTest.ShortName, curTest.TestType, curTest.Polarimeter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dbPath
+}
+
+func TestSchemaUpgrade(t *testing.T) {
+	dbPath := createLegacyDatabase(t, "legacy", []Test{
+		{ShortName: "a", TestType: "PH/SW", Polarimeter: 3},
+		{ShortName: "b", TestType: "phase switch", Polarimeter: 3},
+		{ShortName: "c", TestType: "Weird Test", Polarimeter: 7},
+	})
+
+	// Only the second test has a data file, the others are missing
+	legacyFileName := path.Join(dbPath, "test_000002.fits.gz")
+	if err := ioutil.WriteFile(legacyFileName, []byte("legacy data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var conn Connection
+	if err := conn.Connect(dbPath); err != nil {
+		t.Fatalf("unable to upgrade the legacy database: %v", err)
+	}
+	defer conn.Disconnect()
+
+	if version, err := getSchemaVersion(conn.Connection); err != nil || version != DatabaseSchemaVersion {
+		t.Errorf("wrong schema version after the upgrade: \"%s\" (%v)", version, err)
+	}
+
+	pols, err := conn.GetListOfPolarimeters("")
+	if err != nil || len(pols) != 2 || pols[0].Status != PolarimeterUnknown {
+		t.Errorf("polarimeters were not registered during the upgrade: %v (%v)", pols, err)
+	}
+
+	for idx, refType := range []string{"phsw", "phsw", "weird test"} {
+		var test Test
+		if err := conn.GetTest(idx+1, "", &test); err != nil {
+			t.Errorf("unable to read test %d: %v", idx+1, err)
+		} else if test.TestType != refType {
+			t.Errorf("test type \"%s\" was not normalized into \"%s\"", test.TestType, refType)
+		} else if test.UUID == "" {
+			t.Errorf("no UUID was assigned to test %d", idx+1)
+		}
+	}
+
+	var dataVersion DataVersion
+	if err := resolveTestData(conn.Connection, 1, 0, &dataVersion); err != nil || dataVersion.Key != "test_000001.fits.gz" {
+		t.Errorf("legacy data files were not registered: \"%s\" (%v)", dataVersion.Key, err)
+	}
+
+	r, dataVersion, err := conn.OpenTestData(2, 0)
+	if err != nil {
+		t.Errorf("unable to open a legacy data file: %v", err)
+	} else {
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(contents) != "legacy data" {
+			t.Errorf("legacy data file was not relocated properly into \"%s\": %v", dataVersion.Key, err)
+		}
+	}
+	if _, err := os.Stat(legacyFileName); !os.IsNotExist(err) {
+		t.Errorf("legacy data file \"%s\" was not removed", legacyFileName)
+	}
+
+	var tt TestType
+	if err := conn.GetTestType("weird test", &tt); err != nil {
+		t.Errorf("legacy test type was not added to the vocabulary: %v", err)
+	}
+}
+
+func TestLegacyLogUpgrade(t *testing.T) {
+	dbPath := createLegacyDatabase(t, "legacy_log", []Test{{ShortName: "a", TestType: "dc", Polarimeter: 1}})
+
+	legacy, err := sql.Open("sqlite3", path.Join(dbPath, IndexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, curEntry := range [][]string{
+		{"tomasi", "failed authentication"},
+		{"tomasi", "granting permission to page"},
+		{"", "in protect: error http: named cookie not present"},
+		{"tomasi", "request for test with ID=1 has been satisfied"},
+		{"tomasi", "querying the IDs of the tests in the database, 1 results returned (maxNum=-1)"},
+		{"tomasi", "password has been changed"},
+		{"tomasi", "something unexpected"},
+	} {
+		if _, err := legacy.Exec(`insert into log (user_id, date, message) values (?, '2017-05-18T10:38:25Z', ?)`,
+			curEntry[0], curEntry[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy.Close()
+
+	var conn Connection
+	if err := conn.Connect(dbPath); err != nil {
+		t.Fatalf("unable to upgrade the legacy database: %v", err)
+	}
+	defer conn.Disconnect()
+
+	entries, err := conn.QueryLog(LogFilter{Until: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatalf("unable to query the log: %v", err)
+	}
+
+	expected := map[string]LogEntry{
+		"failed authentication": {Username: "tomasi", Action: ActionLogin, ObjectType: ObjectUser,
+			ObjectID: "tomasi", Outcome: OutcomeFailure},
+		"granting permission to page": {Username: "tomasi", Action: ActionRead, ObjectType: ObjectPage,
+			Outcome: OutcomeSuccess},
+		"in protect: error http: named cookie not present": {Username: AnonymousUser, Action: ActionRead,
+			ObjectType: ObjectPage, Outcome: OutcomeFailure},
+		"request for test with ID=1 has been satisfied": {Username: "tomasi", Action: ActionRead,
+			ObjectType: ObjectTest, ObjectID: "1", Outcome: OutcomeSuccess},
+		"querying the IDs of the tests in the database, 1 results returned (maxNum=-1)": {Username: "tomasi",
+			Action: ActionRead, ObjectType: ObjectTest, Outcome: OutcomeSuccess},
+		"password has been changed": {Username: "tomasi", Action: ActionUpdate, ObjectType: ObjectUser,
+			ObjectID: "tomasi", Outcome: OutcomeSuccess},
+		"something unexpected": {Username: "tomasi", Action: ActionMessage, Outcome: OutcomeSuccess},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("wrong number of log entries after the upgrade: %v", entries)
+	}
+	for _, curEntry := range entries {
+		ref, ok := expected[curEntry.Message]
+		if !ok {
+			t.Errorf("unexpected log entry %v", curEntry)
+			continue
+		}
+		if curEntry.Username != ref.Username || curEntry.Action != ref.Action ||
+			curEntry.ObjectType != ref.ObjectType || curEntry.ObjectID != ref.ObjectID ||
+			curEntry.Outcome != ref.Outcome {
+			t.Errorf("legacy log entry \"%s\" was not classified properly: %v", curEntry.Message, curEntry)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/astrogo/fitsio"
+)
+
+// Kinds of value that can be stored in a TestParameter
+const (
+	ParameterNumber = "number"
+	ParameterString = "string"
+	ParameterBool   = "bool"
+)
+
+// TestParameter is a named value associated with a test, e.g., a bias
+// voltage or the power of the RF source. Only one among the fields Number,
+// String, and Bool is meaningful, depending on the value of Kind.
+type TestParameter struct {
+	Name   string  // Name of the parameter (lowercase)
+	Kind   string  // ParameterNumber, ParameterString, or ParameterBool
+	Number float64 // Value of the parameter, if Kind == ParameterNumber
+	String string  // Value of the parameter, if Kind == ParameterString
+	Bool   bool    // Value of the parameter, if Kind == ParameterBool
+	Unit   string  // Measurement unit, if Kind == ParameterNumber
+}
+
+var (
+	parameterNameRegexp   = regexp.MustCompile(`^[a-z][a-z0-9_.-]*$`)
+	parameterNumberRegexp = regexp.MustCompile(`^([-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?)\s*(\S*)$`)
+)
+
+// siPrefixes maps the SI prefixes to their powers of ten
+var siPrefixes = map[string]int{
+	"Y": 24, "Z": 21, "E": 18, "P": 15, "T": 12, "G": 9, "M": 6, "k": 3, "h": 2, "da": 1,
+	"d": -1, "c": -2, "m": -3, "u": -6, "\u00b5": -6, "\u03bc": -6, "n": -9, "p": -12,
+	"f": -15, "a": -18, "z": -21, "y": -24,
+}
+
+// siBaseUnits lists the units that can be preceded by a SI prefix. Units
+// like "dB" and "dBm" are not included, as they are not multiples of "B".
+var siBaseUnits = map[string]bool{
+	"V": true, "A": true, "W": true, "Hz": true, "s": true, "K": true,
+	"Ohm": true, "\u03a9": true, "F": true, "H": true, "S": true, "J": true,
+	"C": true, "Pa": true, "T": true, "m": true, "g": true,
+}
+
+// splitUnitPrefix returns the base unit obtained by removing the SI prefix
+// from "unit" (e.g., "V" for "mV"), together with the exponent of the
+// prefix. Units that are not recognized are returned unchanged.
+func splitUnitPrefix(unit string) (string, int) {
+	if unit == "" || siBaseUnits[unit] {
+		return unit, 0
+	}
+
+	for prefix, exponent := range siPrefixes {
+		base := strings.TrimPrefix(unit, prefix)
+		if base != unit && siBaseUnits[base] {
+			return base, exponent
+		}
+	}
+
+	return unit, 0
+}
+
+// scaleByPowerOf10 multiplies "value" by 10^exponent
+func scaleByPowerOf10(value float64, exponent int) float64 {
+	// Dividing gives exact results for values like 800 mV
+	if exponent < 0 {
+		return value / math.Pow10(-exponent)
+	}
+	return value * math.Pow10(exponent)
+}
+
+// normalizeUnit converts "value", measured in "unit", into the base unit
+// obtained by removing the SI prefix (e.g., 800 mV becomes 0.8 V), so that
+// values can be compared regardless of the prefix used to write them.
+// Units that are not recognized are returned unchanged.
+func normalizeUnit(value float64, unit string) (float64, string) {
+	base, exponent := splitUnitPrefix(unit)
+	return scaleByPowerOf10(value, exponent), base
+}
+
+// Value returns a string representation of the value of the parameter,
+// including its measurement unit
+func (param TestParameter) Value() string {
+	switch param.Kind {
+	case ParameterNumber:
+		value := strconv.FormatFloat(param.Number, 'g', -1, 64)
+		if param.Unit != "" {
+			return value + " " + param.Unit
+		}
+		return value
+	case ParameterBool:
+		return strconv.FormatBool(param.Bool)
+	}
+
+	return param.String
+}
+
+// parseParameterValue interprets "s" as the value of a parameter. Numbers
+// can be followed by a measurement unit (e.g., "0.5V" or "-3 dBm"); the
+// words "true" and "false" are booleans; anything else is a string.
+func parseParameterValue(s string, param *TestParameter) {
+	s = strings.TrimSpace(s)
+
+	switch strings.ToLower(s) {
+	case "true", "yes", "on":
+		param.Kind = ParameterBool
+		param.Bool = true
+		return
+	case "false", "no", "off":
+		param.Kind = ParameterBool
+		param.Bool = false
+		return
+	}
+
+	if matches := parameterNumberRegexp.FindStringSubmatch(s); matches != nil {
+		if value, err := strconv.ParseFloat(matches[1], 64); err == nil {
+			param.Kind = ParameterNumber
+			param.Number = value
+			param.Unit = matches[2]
+			return
+		}
+	}
+
+	param.Kind = ParameterString
+	param.String = s
+}
+
+// normalizeParameterName returns the canonical form of a parameter name,
+// or an error if the name is not valid
+func normalizeParameterName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !parameterNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid parameter name \"%s\" (use letters, digits, and the characters \"_.-\")",
+			name)
+	}
+
+	return name, nil
+}
+
+// ParseParameter interprets a string in the form "name=value[unit]" and
+// returns the corresponding parameter.
+func ParseParameter(s string) (TestParameter, error) {
+	var param TestParameter
+
+	elements := strings.SplitN(s, "=", 2)
+	if len(elements) != 2 {
+		return param, fmt.Errorf("invalid parameter \"%s\", the format must be \"name=value\"", s)
+	}
+
+	name, err := normalizeParameterName(elements[0])
+	if err != nil {
+		return param, err
+	}
+
+	param.Name = name
+	parseParameterValue(elements[1], &param)
+	return param, nil
+}
+
+// checkParameters verifies that the names of the parameters are valid
+// and unique. Names are converted to lowercase.
+func checkParameters(params []TestParameter) error {
+	names := make(map[string]bool)
+	for idx := range params {
+		name, err := normalizeParameterName(params[idx].Name)
+		if err != nil {
+			return err
+		}
+		if names[name] {
+			return fmt.Errorf("parameter \"%s\" has been specified more than once", name)
+		}
+		names[name] = true
+		params[idx].Name = name
+
+		switch params[idx].Kind {
+		case ParameterNumber, ParameterString, ParameterBool:
+		default:
+			return fmt.Errorf("parameter \"%s\" has an unknown kind \"%s\"", name, params[idx].Kind)
+		}
+	}
+
+	return nil
+}
+
+// saveParameters writes the parameters of a test in the "test_parameters" table
+func saveParameters(tx *sql.Tx, testID int64, params []TestParameter) error {
+	for _, curParam := range params {
+		var (
+			numValue  sql.NullFloat64
+			baseValue sql.NullFloat64
+			baseUnit  string
+		)
+		switch curParam.Kind {
+		case ParameterNumber:
+			numValue = sql.NullFloat64{Float64: curParam.Number, Valid: true}
+			baseValue.Float64, baseUnit = normalizeUnit(curParam.Number, curParam.Unit)
+			baseValue.Valid = true
+		case ParameterBool:
+			numValue.Valid = true
+			if curParam.Bool {
+				numValue.Float64 = 1.0
+			}
+		}
+
+		if _, err := tx.Exec(`
+insert into test_parameters (test_id, name, kind, num_value, str_value, unit, base_value, base_unit)
+values (?, ?, ?, ?, ?, ?, ?, ?)`,
+			testID,
+			curParam.Name,
+			curParam.Kind,
+			numValue,
+			nullIfEmpty(curParam.String),
+			nullIfEmpty(curParam.Unit),
+			baseValue,
+			nullIfEmpty(baseUnit)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizeParameterUnits fills the columns "base_value" and "base_unit"
+// of the numeric parameters saved before they were introduced
+func normalizeParameterUnits(tx *sql.Tx) error {
+	type numericParam struct {
+		rowID int64
+		value float64
+		unit  string
+	}
+	var params []numericParam
+	if err := forEachRow(tx, `
+select rowid, num_value, coalesce(unit, '') from test_parameters where kind = ?`,
+		func(values []interface{}) error {
+			value, _ := values[1].(float64)
+			if intValue, ok := values[1].(int64); ok {
+				value = float64(intValue)
+			}
+			params = append(params, numericParam{values[0].(int64), value, values[2].(string)})
+			return nil
+		}, ParameterNumber); err != nil {
+		return err
+	}
+
+	for _, curParam := range params {
+		baseValue, baseUnit := normalizeUnit(curParam.value, curParam.unit)
+		if _, err := tx.Exec(`update test_parameters set base_value = ?, base_unit = ? where rowid = ?`,
+			baseValue, nullIfEmpty(baseUnit), curParam.rowID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanParameter reads a row containing the columns "name", "kind",
+// "num_value", "str_value" and "unit" of the "test_parameters" table
+func scanParameter(row rowScanner, param *TestParameter) error {
+	var (
+		numValue sql.NullFloat64
+		strValue sql.NullString
+		unit     sql.NullString
+	)
+	if err := row.Scan(&param.Name, &param.Kind, &numValue, &strValue, &unit); err != nil {
+		return err
+	}
+
+	switch param.Kind {
+	case ParameterNumber:
+		param.Number = numValue.Float64
+		param.Unit = unit.String
+	case ParameterBool:
+		param.Bool = numValue.Float64 != 0.0
+	default:
+		param.String = strValue.String
+	}
+	return nil
+}
+
+// loadParameters reads the parameters of a test from the "test_parameters"
+// table. If the test has no parameters, the result is nil.
+func loadParameters(q queryer, testID int) ([]TestParameter, error) {
+	rows, err := q.Query(`
+select name, kind, num_value, str_value, unit from test_parameters
+where test_id = ? order by name`,
+		testID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []TestParameter
+	for rows.Next() {
+		var curParam TestParameter
+		if err := scanParameter(rows, &curParam); err != nil {
+			return nil, err
+		}
+		result = append(result, curParam)
+	}
+
+	return result, rows.Err()
+}
+
+// loadParametersOfTests reads the parameters of several tests at once. The
+// result maps the ID of each test to its parameters.
+func loadParametersOfTests(q queryer, testIDs []int) (map[int][]TestParameter, error) {
+	result := make(map[int][]TestParameter)
+	if len(testIDs) == 0 {
+		return result, nil
+	}
+
+	condition, args := idListCondition("test_id", testIDs)
+	rows, err := q.Query(`
+select test_id, name, kind, num_value, str_value, unit from test_parameters
+where `+condition+` order by test_id, name`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			testID   int
+			curParam TestParameter
+		)
+		if err := scanParameter(prefixScanner{rows, &testID}, &curParam); err != nil {
+			return nil, err
+		}
+		result[testID] = append(result[testID], curParam)
+	}
+
+	return result, rows.Err()
+}
+
+// prefixScanner scans the first column of a row into "first", and the
+// remaining ones using the arguments passed to Scan
+type prefixScanner struct {
+	row   rowScanner
+	first interface{}
+}
+
+func (s prefixScanner) Scan(dest ...interface{}) error {
+	return s.row.Scan(append([]interface{}{s.first}, dest...)...)
+}
+
+// parameterFitsCards returns the FITS header cards used to save the
+// parameters of a test. Each parameter uses two cards, PNAMnnn and PVALnnn,
+// since FITS keywords cannot be longer than 8 characters.
+func parameterFitsCards(params []TestParameter) []fitsio.Card {
+	result := make([]fitsio.Card, 0, 2*len(params))
+	for idx, curParam := range params {
+		var value interface{}
+		comment := fmt.Sprintf("Value of parameter \"%s\"", curParam.Name)
+		switch curParam.Kind {
+		case ParameterNumber:
+			value = curParam.Number
+			if curParam.Unit != "" {
+				comment += fmt.Sprintf(" [%s]", curParam.Unit)
+			}
+		case ParameterBool:
+			value = curParam.Bool
+		default:
+			value = curParam.String
+		}
+
+		result = append(result,
+			fitsio.Card{Name: fmt.Sprintf("PNAM%03d", idx+1), Value: curParam.Name, Comment: "Name of a test parameter"},
+			fitsio.Card{Name: fmt.Sprintf("PVAL%03d", idx+1), Value: value, Comment: comment})
+	}
+
+	return result
+}
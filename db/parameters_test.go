@@ -0,0 +1,170 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"path"
+	"testing"
+)
+
+func TestParseParameter(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected TestParameter
+	}{
+		{"vdrain=0.8V", TestParameter{Name: "vdrain", Kind: ParameterNumber, Number: 0.8, Unit: "V"}},
+		{"RF_Power = -30 dBm", TestParameter{Name: "rf_power", Kind: ParameterNumber, Number: -30, Unit: "dBm"}},
+		{"attenuation=3", TestParameter{Name: "attenuation", Kind: ParameterNumber, Number: 3}},
+		{"lna=on", TestParameter{Name: "lna", Kind: ParameterBool, Bool: true}},
+		{"source=Agilent E8257D", TestParameter{Name: "source", Kind: ParameterString, String: "Agilent E8257D"}},
+	}
+
+	for _, curCase := range cases {
+		param, err := ParseParameter(curCase.input)
+		if err != nil {
+			t.Errorf("unable to parse \"%s\": %v", curCase.input, err)
+		} else if param != curCase.expected {
+			t.Errorf("wrong result for \"%s\": %v", curCase.input, param)
+		}
+	}
+
+	for _, curInput := range []string{"vdrain", "1st=3", "=0.5V"} {
+		if _, err := ParseParameter(curInput); err == nil {
+			t.Errorf("invalid parameter \"%s\" was accepted", curInput)
+		}
+	}
+
+	if _, err := ParseParameterCondition("lna>on"); err == nil {
+		t.Error("a numeric comparison with a boolean was accepted")
+	}
+
+	for _, cur := range []struct {
+		value    float64
+		unit     string
+		base     float64
+		baseUnit string
+	}{
+		{800, "mV", 0.8, "V"},
+		{2.5, "kHz", 2500, "Hz"},
+		{3, "\u00b5A", 3e-6, "A"},
+		{-30, "dBm", -30, "dBm"},
+		{5, "Pa", 5, "Pa"},
+		{10, "mm", 0.01, "m"},
+	} {
+		if base, baseUnit := normalizeUnit(cur.value, cur.unit); base != cur.base || baseUnit != cur.baseUnit {
+			t.Errorf("%g %s was normalized into %g %s", cur.value, cur.unit, base, baseUnit)
+		}
+	}
+}
+
+func TestParameters(t *testing.T) {
+	conn := createTestDatabase(t, "parameters")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 7}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	ids := make([]int, 0)
+	for _, curParam := range []string{"vdrain=0.4V", "vdrain=0.8V", "vdrain=800mV", "vdrain=0.6"} {
+		param, _ := ParseParameter(curParam)
+		newTest := Test{
+			TestType:    "sweep",
+			Polarimeter: 7,
+			Parameters:  []TestParameter{param, {Name: "lna", Kind: ParameterBool, Bool: true}},
+		}
+		id, err := conn.AddTest(&newTest, "testuser", inputFilePath)
+		if err != nil {
+			t.Fatalf("unable to add a test: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	duplicated := Test{
+		TestType:    "sweep",
+		Polarimeter: 7,
+		Parameters: []TestParameter{
+			{Name: "lna", Kind: ParameterBool},
+			{Name: "LNA", Kind: ParameterBool},
+		},
+	}
+	if _, err := conn.AddTest(&duplicated, "testuser", inputFilePath); err == nil {
+		t.Error("a test with duplicated parameters was accepted")
+	}
+
+	var test Test
+	if err := conn.GetTest(ids[1], "testuser", &test); err != nil {
+		t.Fatalf("unable to retrieve a test: %v", err)
+	}
+	if len(test.Parameters) != 2 || test.Parameters[0].Name != "lna" ||
+		test.Parameters[1].Value() != "0.8 V" {
+		t.Errorf("wrong parameters retrieved from the database: %v", test.Parameters)
+	}
+
+	cond, err := ParseParameterCondition("vdrain>=0.5V")
+	if err != nil {
+		t.Fatalf("unable to parse a condition: %v", err)
+	}
+	result, err := conn.SearchTests(SearchQuery{Parameters: []ParameterCondition{cond}}, "testuser", -1)
+	if err != nil || len(result) != 2 || result[0] != ids[2] || result[1] != ids[1] {
+		t.Errorf("wrong result from SearchTests: %v (%v)", result, err)
+	}
+
+	// Parameters saved before the introduction of "base_value" are
+	// normalized by the migration
+	if _, err := conn.Connection.Exec(`update test_parameters set base_value = null, base_unit = null`); err != nil {
+		t.Fatal(err)
+	}
+	tx, unlock, err := conn.beginWrite(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = normalizeParameterUnits(tx); err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	unlock()
+	if err != nil {
+		t.Fatalf("unable to normalize the units of the parameters: %v", err)
+	}
+
+	cond, _ = ParseParameterCondition("vdrain<500mV")
+	result, err = conn.SearchTests(SearchQuery{Parameters: []ParameterCondition{cond}}, "testuser", -1)
+	if err != nil || len(result) != 1 || result[0] != ids[0] {
+		t.Errorf("wrong result from SearchTests: %v (%v)", result, err)
+	}
+
+	// Conditions without a unit only match parameters without a unit
+	cond, _ = ParseParameterCondition("vdrain<1")
+	result, err = conn.SearchTests(SearchQuery{Parameters: []ParameterCondition{cond}}, "testuser", -1)
+	if err != nil || len(result) != 1 || result[0] != ids[3] {
+		t.Errorf("wrong result from SearchTests: %v (%v)", result, err)
+	}
+
+	cond, _ = ParseParameterCondition("lna=true")
+	result, err = conn.SearchTests(SearchQuery{Parameters: []ParameterCondition{cond}}, "testuser", -1)
+	if err != nil || len(result) != 4 {
+		t.Errorf("wrong result from SearchTests: %v (%v)", result, err)
+	}
+}
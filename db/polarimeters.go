@@ -0,0 +1,310 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Possible values for the Status field of a Polarimeter
+const (
+	PolarimeterUnknown    = "unknown"    // No information is available (legacy databases)
+	PolarimeterAvailable  = "available"  // Ready to be tested
+	PolarimeterInTest     = "in-test"    // Currently mounted in some test setup
+	PolarimeterIntegrated = "integrated" // Integrated in the focal plane
+	PolarimeterFaulty     = "faulty"     // Not working properly
+	PolarimeterRetired    = "retired"    // No longer in use
+)
+
+// PolarimeterStatuses lists all the valid values for Polarimeter.Status
+var PolarimeterStatuses = []string{
+	PolarimeterUnknown,
+	PolarimeterAvailable,
+	PolarimeterInTest,
+	PolarimeterIntegrated,
+	PolarimeterFaulty,
+	PolarimeterRetired,
+}
+
+// Polarimeter holds the hardware identity of one of the polarimeters
+// that can be referenced by a test.
+type Polarimeter struct {
+	Number       int    // Number of the polarimeter (the one used in Test.Polarimeter)
+	SerialNumber string // Serial number of the hardware
+	Module       string // Position of the polarimeter in the focal plane module
+	Board        string // Bias board driving the polarimeter
+	Band         string // Frequency band ("Q" or "W")
+	Status       string // One of the values in PolarimeterStatuses
+	Notes        string // Free-form notes
+}
+
+// validatePolarimeter checks that the fields of "pol" contain sensible values.
+// The Band field is normalized to uppercase. The number is not checked, as
+// it is validated only when a new polarimeter is added (see
+// UpdatePolarimeter).
+func validatePolarimeter(pol *Polarimeter) error {
+	pol.Band = strings.ToUpper(pol.Band)
+	switch pol.Band {
+	case "", "Q", "W":
+	default:
+		return fmt.Errorf("unknown frequency band \"%s\" (valid bands are Q and W)", pol.Band)
+	}
+
+	for _, curStatus := range PolarimeterStatuses {
+		if pol.Status == curStatus {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown polarimeter status \"%s\" (valid values are %s)",
+		pol.Status, strings.Join(PolarimeterStatuses, ", "))
+}
+
+// nullIfEmpty is used to save empty strings as NULL values in the database
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// AddPolarimeter adds a new polarimeter to the registry. If the Status field
+// of "pol" is empty, it is set to PolarimeterAvailable. The parameter
+// "username" is used only for logging purposes.
+func (conn *Connection) AddPolarimeter(pol *Polarimeter, username string) error {
+	return conn.AddPolarimeterContext(context.Background(), pol, username)
+}
+
+// AddPolarimeterContext is like AddPolarimeter, but it accepts a context to cancel the operation
+func (conn *Connection) AddPolarimeterContext(ctx context.Context, pol *Polarimeter, username string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	if pol.Number <= 0 {
+		return fmt.Errorf("invalid polarimeter number %d", pol.Number)
+	}
+	if pol.Status == "" {
+		pol.Status = PolarimeterAvailable
+	}
+	if err := validatePolarimeter(pol); err != nil {
+		return err
+	}
+
+	_, err := conn.execWrite(ctx, `
+insert into polarimeters (polarimeter_id, serial_number, module, board, band, status, notes)
+values (?, ?, ?, ?, ?, ?, ?)`,
+		pol.Number,
+		nullIfEmpty(pol.SerialNumber),
+		pol.Module,
+		pol.Board,
+		pol.Band,
+		pol.Status,
+		pol.Notes)
+	if err != nil {
+		return err
+	}
+
+	conn.logAction(ctx, username, ActionCreate, ObjectPolarimeter, pol.Number,
+		fmt.Sprintf("polarimeter %d has been added to the registry", pol.Number))
+	return nil
+}
+
+// UpdatePolarimeter overwrites the information about an existing polarimeter
+// with the fields in "pol". Polarimeters whose number is not positive can
+// be updated too, as upgrading a legacy database registers the polarimeter
+// of every test, including number 0 (used when it was unknown). The
+// parameter "username" is used only for logging purposes.
+func (conn *Connection) UpdatePolarimeter(pol *Polarimeter, username string) error {
+	return conn.UpdatePolarimeterContext(context.Background(), pol, username)
+}
+
+// UpdatePolarimeterContext is like UpdatePolarimeter, but it accepts a context to cancel the operation
+func (conn *Connection) UpdatePolarimeterContext(ctx context.Context, pol *Polarimeter, username string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := validatePolarimeter(pol); err != nil {
+		return err
+	}
+
+	result, err := conn.execWrite(ctx, `
+update polarimeters set (serial_number, module, board, band, status, notes) = (?, ?, ?, ?, ?, ?)
+where polarimeter_id = ?`,
+		nullIfEmpty(pol.SerialNumber),
+		pol.Module,
+		pol.Board,
+		pol.Band,
+		pol.Status,
+		pol.Notes,
+		pol.Number)
+	if err != nil {
+		return err
+	}
+
+	if numOfRows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if numOfRows == 0 {
+		return fmt.Errorf("polarimeter %d is not registered in the database", pol.Number)
+	}
+
+	conn.logAction(ctx, username, ActionUpdate, ObjectPolarimeter, pol.Number,
+		fmt.Sprintf("polarimeter %d has been updated (status is \"%s\")", pol.Number, pol.Status))
+	return nil
+}
+
+// scanPolarimeter reads one row of the "polarimeters" table. The columns
+// must be in the same order as in the "polarimeters" table.
+func scanPolarimeter(row rowScanner, pol *Polarimeter) error {
+	var (
+		serialNumber sql.NullString
+		module       sql.NullString
+		board        sql.NullString
+		band         sql.NullString
+		notes        sql.NullString
+	)
+	if err := row.Scan(&pol.Number, &serialNumber, &module, &board, &band,
+		&pol.Status, &notes); err != nil {
+		return err
+	}
+
+	pol.SerialNumber = serialNumber.String
+	pol.Module = module.String
+	pol.Board = board.String
+	pol.Band = band.String
+	pol.Notes = notes.String
+	return nil
+}
+
+// GetPolarimeter retrieves the information about the polarimeter with the
+// given number and saves it in "pol". The parameter "username" is used only
+// for logging purposes, and it can be empty.
+func (conn *Connection) GetPolarimeter(number int, username string, pol *Polarimeter) error {
+	return conn.GetPolarimeterContext(context.Background(), number, username, pol)
+}
+
+// GetPolarimeterContext is like GetPolarimeter, but it accepts a context to cancel the operation
+func (conn *Connection) GetPolarimeterContext(ctx context.Context, number int, username string, pol *Polarimeter) error {
+	if !conn.Active {
+		return ErrInactive
+	}
+
+	err := scanPolarimeter(conn.withContext(ctx).QueryRow(`
+select polarimeter_id, serial_number, module, board, band, status, notes
+from polarimeters where polarimeter_id = ?`,
+		number), pol)
+	if err == sql.ErrNoRows {
+		return errNotFound("polarimeter %d is not registered in the database", number)
+	} else if err != nil {
+		return err
+	}
+
+	conn.logAction(ctx, username, ActionRead, ObjectPolarimeter, number,
+		fmt.Sprintf("request for polarimeter %d has been satisfied", number))
+	return nil
+}
+
+// GetListOfPolarimeters returns all the polarimeters in the registry, sorted
+// by their number. The parameter "username" is used only for logging purposes.
+func (conn *Connection) GetListOfPolarimeters(username string) ([]Polarimeter, error) {
+	return conn.GetListOfPolarimetersContext(context.Background(), username)
+}
+
+// GetListOfPolarimetersContext is like GetListOfPolarimeters, but it accepts a context to cancel the operation
+func (conn *Connection) GetListOfPolarimetersContext(ctx context.Context, username string) ([]Polarimeter, error) {
+	if !conn.Active {
+		return []Polarimeter{}, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select polarimeter_id, serial_number, module, board, band, status, notes
+from polarimeters order by polarimeter_id`)
+	if err != nil {
+		return []Polarimeter{}, err
+	}
+	defer rows.Close()
+
+	result := make([]Polarimeter, 0)
+	for rows.Next() {
+		var curPol Polarimeter
+		if err := scanPolarimeter(rows, &curPol); err != nil {
+			return []Polarimeter{}, err
+		}
+		result = append(result, curPol)
+	}
+	if err := rows.Err(); err != nil {
+		return []Polarimeter{}, err
+	}
+
+	conn.logAction(ctx, username, ActionRead, ObjectPolarimeter, "",
+		fmt.Sprintf("querying the list of polarimeters, %d results returned", len(result)))
+	return result, nil
+}
+
+// GetListOfTestIDsForPolarimeter returns the IDs of all the tests done on
+// a polarimeter, from the most recent to the most ancient one. The parameter
+// "username" is used only for logging purposes.
+func (conn *Connection) GetListOfTestIDsForPolarimeter(number int, username string) ([]int, error) {
+	return conn.GetListOfTestIDsForPolarimeterContext(context.Background(), number, username)
+}
+
+// GetListOfTestIDsForPolarimeterContext is like GetListOfTestIDsForPolarimeter, but it accepts a context to cancel the operation
+func (conn *Connection) GetListOfTestIDsForPolarimeterContext(ctx context.Context, number int, username string) ([]int, error) {
+	if !conn.Active {
+		return []int{}, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select test_id from tests where polarimeter = ? order by creation_date desc, test_id desc`,
+		number)
+	if err != nil {
+		return []int{}, err
+	}
+	defer rows.Close()
+
+	result := make([]int, 0)
+	for rows.Next() {
+		var curID int64
+		if err := rows.Scan(&curID); err != nil {
+			return []int{}, err
+		}
+		result = append(result, int(curID))
+	}
+
+	conn.logAction(ctx, username, ActionRead, ObjectPolarimeter, number,
+		fmt.Sprintf("querying the tests of polarimeter %d, %d results returned", number, len(result)))
+	return result, nil
+}
+
+// checkPolarimeterIsRegistered returns an error if the polarimeter with the
+// given number is not in the "polarimeters" table.
+func checkPolarimeterIsRegistered(tx *sql.Tx, number int) error {
+	var status string
+	err := tx.QueryRow(`select status from polarimeters where polarimeter_id = ?`,
+		number).Scan(&status)
+	if err == sql.ErrNoRows {
+		return errNotFound("polarimeter %d is not registered in the database (use \"stdb polarimeter add\")",
+			number)
+	}
+
+	return err
+}
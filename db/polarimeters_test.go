@@ -0,0 +1,103 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestPolarimeterRegistry(t *testing.T) {
+	conn := createTestDatabase(t, "polarimeters")
+	defer conn.Disconnect()
+
+	refPol := Polarimeter{
+		Number:       12,
+		SerialNumber: "STRIP-Q-012",
+		Module:       "I3",
+		Board:        "B1",
+		Band:         "q",
+		Notes:        "first polarimeter of the batch",
+	}
+	if err := conn.AddPolarimeter(&refPol, "testuser"); err != nil {
+		t.Fatalf("unable to add a polarimeter: %v", err)
+	}
+	if refPol.Band != "Q" || refPol.Status != PolarimeterAvailable {
+		t.Errorf("AddPolarimeter did not normalize the fields: %v", refPol)
+	}
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 13, Status: "broken"}, "testuser"); err == nil {
+		t.Error("AddPolarimeter accepted an invalid status")
+	}
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 0}, "testuser"); err == nil {
+		t.Error("AddPolarimeter accepted polarimeter number 0")
+	}
+
+	// Legacy databases can contain polarimeter 0, which must be updatable
+	if _, err := conn.Connection.Exec(`insert into polarimeters (polarimeter_id, status) values (0, ?)`,
+		PolarimeterUnknown); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.UpdatePolarimeter(&Polarimeter{Number: 0, Status: PolarimeterRetired, Notes: "unknown"}, "testuser"); err != nil {
+		t.Errorf("unable to update polarimeter 0: %v", err)
+	}
+	if err := conn.UpdatePolarimeter(&Polarimeter{Number: -1, Status: PolarimeterRetired}, "testuser"); err == nil {
+		t.Error("UpdatePolarimeter accepted an unregistered polarimeter")
+	}
+
+	refPol.Status = PolarimeterFaulty
+	if err := conn.UpdatePolarimeter(&refPol, "testuser"); err != nil {
+		t.Errorf("unable to update a polarimeter: %v", err)
+	}
+
+	var pol Polarimeter
+	if err := conn.GetPolarimeter(12, "testuser", &pol); err != nil {
+		t.Errorf("unable to retrieve a polarimeter: %v", err)
+	}
+	if !reflect.DeepEqual(pol, refPol) {
+		t.Errorf("GetPolarimeter returned the wrong polarimeter: %v instead of %v", pol, refPol)
+	}
+
+	pols, err := conn.GetListOfPolarimeters("testuser")
+	if err != nil || len(pols) != 2 {
+		t.Errorf("unexpected result from GetListOfPolarimeters: %v (%v)", pols, err)
+	}
+
+	// Tests on unregistered polarimeters must be rejected
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	if _, err := conn.AddTest(&Test{TestType: "sweep", Polarimeter: 99}, "testuser",
+		inputFilePath); err == nil {
+		t.Error("AddTest accepted a test on an unregistered polarimeter")
+	}
+
+	testID, err := conn.AddTest(&Test{TestType: "sweep", Polarimeter: 12}, "testuser",
+		inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	ids, err := conn.GetListOfTestIDsForPolarimeter(12, "testuser")
+	if err != nil || len(ids) != 1 || ids[0] != testID {
+		t.Errorf("unexpected result from GetListOfTestIDsForPolarimeter: %v (%v)", ids, err)
+	}
+}
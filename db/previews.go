@@ -0,0 +1,451 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+
+	"github.com/astrogo/fitsio"
+)
+
+// Previews are saved in the folder "previews", using the checksum of the
+// FITS file they summarize as name
+const previewsFolderName = "previews"
+
+// previewBinCounts lists the number of bins of the resolutions computed
+// for each column (see DataPreview)
+var previewBinCounts = []int{100, 1000, 10000}
+
+// PreviewLevel is a decimated version of a column of data: each bin
+// summarizes Step consecutive samples. NaNs and infinities are ignored;
+// bins containing none of the other values repeat the previous bin.
+type PreviewLevel struct {
+	Step int       `json:"step"`
+	Min  []float64 `json:"min"`
+	Max  []float64 `json:"max"`
+	Mean []float64 `json:"mean"`
+}
+
+// ColumnPreview contains the decimated versions of a column of data
+type ColumnPreview struct {
+	Name   string         `json:"name"`
+	Unit   string         `json:"unit"`
+	Levels []PreviewLevel `json:"levels"` // From the coarsest to the finest
+}
+
+// Level returns the finest resolution with no more than "maxBins" bins, or
+// the coarsest one if all of them have more bins
+func (col *ColumnPreview) Level(maxBins int) PreviewLevel {
+	if len(col.Levels) == 0 {
+		return PreviewLevel{}
+	}
+
+	result := col.Levels[0]
+	for _, curLevel := range col.Levels[1:] {
+		if len(curLevel.Min) > maxBins {
+			break
+		}
+		result = curLevel
+	}
+	return result
+}
+
+// DataPreview contains min/max/mean decimated versions of the numeric
+// columns of the data of a test, at several resolutions. They are computed
+// when the data are imported, and they can be used to plot the data
+// without reading the whole FITS file.
+type DataPreview struct {
+	NumOfSamples int             `json:"num_of_samples"`
+	Columns      []ColumnPreview `json:"columns"`
+}
+
+// Column returns the preview of the column with the given name, or nil if
+// there is no such column
+func (preview *DataPreview) Column(name string) *ColumnPreview {
+	for idx := range preview.Columns {
+		if preview.Columns[idx].Name == name {
+			return &preview.Columns[idx]
+		}
+	}
+	return nil
+}
+
+// previewStoragePath returns the key of the preview of the FITS file with
+// the given checksum
+func previewStoragePath(fitsChecksum string) string {
+	return blobStoragePath(previewsFolderName, fitsChecksum, ".json.gz")
+}
+
+// levelAccumulator computes one PreviewLevel while the samples are read
+type levelAccumulator struct {
+	level PreviewLevel
+	count []int
+}
+
+func newLevelAccumulator(step int, numOfSamples int) *levelAccumulator {
+	numOfBins := (numOfSamples + step - 1) / step
+	return &levelAccumulator{
+		level: PreviewLevel{
+			Step: step,
+			Min:  make([]float64, numOfBins),
+			Max:  make([]float64, numOfBins),
+			Mean: make([]float64, numOfBins),
+		},
+		count: make([]int, numOfBins),
+	}
+}
+
+func (acc *levelAccumulator) add(row int, value float64) {
+	bin := row / acc.level.Step
+	if acc.count[bin] == 0 {
+		acc.level.Min[bin] = value
+		acc.level.Max[bin] = value
+	} else {
+		acc.level.Min[bin] = math.Min(acc.level.Min[bin], value)
+		acc.level.Max[bin] = math.Max(acc.level.Max[bin], value)
+	}
+	acc.level.Mean[bin] += value
+	acc.count[bin]++
+}
+
+func (acc *levelAccumulator) finish() PreviewLevel {
+	for bin, count := range acc.count {
+		if count > 0 {
+			acc.level.Mean[bin] /= float64(count)
+		} else if bin > 0 {
+			acc.level.Min[bin] = acc.level.Min[bin-1]
+			acc.level.Max[bin] = acc.level.Max[bin-1]
+			acc.level.Mean[bin] = acc.level.Mean[bin-1]
+		}
+	}
+	return acc.level
+}
+
+// previewSteps returns the number of samples per bin of each resolution
+func previewSteps(numOfSamples int) []int {
+	var result []int
+	for _, numOfBins := range previewBinCounts {
+		step := (numOfSamples + numOfBins - 1) / numOfBins
+		if step < 1 {
+			step = 1
+		}
+		if len(result) > 0 && result[len(result)-1] == step {
+			continue
+		}
+		result = append(result, step)
+	}
+	return result
+}
+
+// summarizeData reads all the rows of the data table in "f" and computes
+// the preview and the summary statistics of its numeric columns
+func summarizeData(f *fitsio.File) (DataPreview, []ColumnStats, error) {
+	var (
+		preview DataPreview
+		stats   []ColumnStats
+	)
+
+	rows, err := newDataRows(f, nil, 0, -1)
+	if err != nil {
+		return preview, stats, err
+	}
+	defer rows.rows.Close()
+
+	table, _ := dataTable(f)
+	preview.NumOfSamples = int(table.NumRows())
+	steps := previewSteps(preview.NumOfSamples)
+
+	// Only numeric columns are summarized
+	var (
+		indices      []int
+		accumulators [][]*levelAccumulator
+		statsAccs    []*statsAccumulator
+	)
+	for colIdx, col := range rows.columns {
+		if _, err := toFloat64(reflect.Zero(col.Type())); err != nil {
+			continue
+		}
+		indices = append(indices, colIdx)
+		preview.Columns = append(preview.Columns, ColumnPreview{Name: col.Name, Unit: col.Unit})
+
+		levels := make([]*levelAccumulator, len(steps))
+		for idx, step := range steps {
+			levels[idx] = newLevelAccumulator(step, preview.NumOfSamples)
+		}
+		accumulators = append(accumulators, levels)
+		statsAccs = append(statsAccs, newStatsAccumulator(col.Name, col.Unit, preview.NumOfSamples))
+	}
+
+	for rows.Next() {
+		for idx, colIdx := range indices {
+			value, _ := toFloat64(reflect.ValueOf(rows.targets[colIdx]).Elem())
+			statsAccs[idx].add(value)
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			for _, acc := range accumulators[idx] {
+				acc.add(rows.Row(), value)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return preview, stats, err
+	}
+
+	for idx := range preview.Columns {
+		for _, acc := range accumulators[idx] {
+			preview.Columns[idx].Levels = append(preview.Columns[idx].Levels, acc.finish())
+		}
+		stats = append(stats, statsAccs[idx].finish())
+	}
+	return preview, stats, nil
+}
+
+// summarizeBlob computes the preview and the summary statistics of the
+// FITS file with key "key"
+func summarizeBlob(store BlobStore, key string) (DataPreview, []ColumnStats, error) {
+	r, err := store.Get(key)
+	if err != nil {
+		return DataPreview{}, nil, err
+	}
+	defer r.Close()
+
+	f, closeFile, err := openFitsStream(r)
+	if err != nil {
+		return DataPreview{}, nil, err
+	}
+	defer closeFile()
+
+	return summarizeData(f)
+}
+
+// summarizeFile computes the preview and the summary statistics of the
+// uncompressed FITS file "fileName"
+func summarizeFile(fileName string) (DataPreview, []ColumnStats, error) {
+	f, closeFile, err := openFitsFile(fileName)
+	if err != nil {
+		return DataPreview{}, nil, err
+	}
+	defer closeFile()
+
+	return summarizeData(f)
+}
+
+// writeAndUncompress calls "write" with a writer that sends the gzipped
+// FITS file to "w" and, at the same time, uncompresses it into a temporary
+// file, so that the data can be summarized without reading them back from
+// the BlobStore. The caller must remove the temporary file.
+func writeAndUncompress(w io.Writer, write func(w io.Writer) error) (string, error) {
+	type result struct {
+		fileName string
+		err      error
+	}
+	pr, pw := io.Pipe()
+	done := make(chan result)
+	go func() {
+		fileName, err := uncompressFits(pr)
+		if err != nil {
+			// Make "write" fail instead of blocking forever
+			pr.CloseWithError(err)
+		} else {
+			io.Copy(ioutil.Discard, pr)
+		}
+		done <- result{fileName, err}
+	}()
+
+	err := write(io.MultiWriter(w, pw))
+	pw.CloseWithError(err)
+	uncompressed := <-done
+	if err != nil {
+		if uncompressed.err == nil {
+			os.Remove(uncompressed.fileName)
+		}
+		return "", err
+	}
+	return uncompressed.fileName, uncompressed.err
+}
+
+// writePreview saves a preview in the BlobStore, and returns a function
+// that removes it
+func writePreview(store BlobStore, fitsChecksum string, preview *DataPreview) (func(), error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(preview); err != nil {
+		return func() {}, err
+	}
+	if err := zw.Close(); err != nil {
+		return func() {}, err
+	}
+
+	key := previewStoragePath(fitsChecksum)
+	if err := store.Put(key, &buf); err != nil {
+		return func() {}, err
+	}
+	return func() { store.Delete(key) }, nil
+}
+
+// readPreview loads a preview saved by writePreview
+func readPreview(store BlobStore, fitsChecksum string, preview *DataPreview) error {
+	r, err := store.Get(previewStoragePath(fitsChecksum))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	return json.NewDecoder(zr).Decode(preview)
+}
+
+// savePreview saves the preview of the FITS file with checksum "checksum",
+// unless it has already been saved. The function returned removes the
+// preview, if it has been created.
+func savePreview(store BlobStore, checksum string, preview *DataPreview) (func(), error) {
+	noop := func() {}
+	if _, err := store.Stat(previewStoragePath(checksum)); err == nil {
+		return noop, nil
+	} else if err != ErrBlobNotFound {
+		return noop, err
+	}
+
+	return writePreview(store, checksum, preview)
+}
+
+// GetTestPreview returns the preview of version "version" of the data of a
+// test (zero means the latest one). Previews are computed when the data are
+// imported; if a preview is missing (e.g., because the data were imported
+// by an older version of stdb), it is computed from the FITS file and,
+// unless the connection is read-only, saved for later use together with
+// the statistics of the columns, if they are missing too.
+func (conn *Connection) GetTestPreview(testID int, version int) (DataPreview, error) {
+	return conn.GetTestPreviewContext(context.Background(), testID, version)
+}
+
+// GetTestPreviewContext is like GetTestPreview, but it accepts a context to cancel the operation
+func (conn *Connection) GetTestPreviewContext(ctx context.Context, testID int, version int) (DataPreview, error) {
+	var preview DataPreview
+	if !conn.Active {
+		return preview, ErrInactive
+	}
+
+	var dataVersion DataVersion
+	if err := resolveTestData(conn.withContext(ctx), testID, version, &dataVersion); err != nil {
+		return preview, err
+	}
+
+	if dataVersion.Checksum != "" {
+		err := readPreview(conn.Blobs, dataVersion.Checksum, &preview)
+		if err == nil {
+			return preview, nil
+		} else if err != ErrBlobNotFound {
+			return preview, err
+		}
+	}
+
+	preview, stats, err := summarizeBlob(conn.Blobs, dataVersion.Key)
+	if err == ErrBlobNotFound {
+		return preview, errNotFound("the file of test %d (version %d) is missing from the storage",
+			testID, dataVersion.Version)
+	} else if err != nil {
+		return preview, fmt.Errorf("unable to compute the preview of test %d: %v", testID, err)
+	}
+
+	if !conn.ReadOnly {
+		conn.saveSummary(ctx, testID, &dataVersion, &preview, stats)
+	}
+	return preview, nil
+}
+
+// saveSummary saves a preview computed by GetTestPreview, together with
+// the statistics of the columns if they are missing too (e.g., because the
+// data were imported by an older version of stdb). Errors are ignored, as
+// the preview can always be computed again.
+func (conn *Connection) saveSummary(ctx context.Context, testID int, dataVersion *DataVersion,
+	preview *DataPreview, stats []ColumnStats) {
+
+	tx, unlock, err := conn.beginWrite(ctx)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	if dataVersion.Checksum != "" {
+		writePreview(conn.Blobs, dataVersion.Checksum, preview)
+	}
+
+	var numOfStats int
+	err = tx.QueryRow(`select count(*) from column_stats where test_id = ? and version = ?`,
+		testID, dataVersion.Version).Scan(&numOfStats)
+	if err == nil && numOfStats == 0 {
+		err = saveColumnStats(tx, int64(testID), dataVersion.Version, stats)
+	}
+	if err == nil {
+		tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+}
+
+// GetSavedTestPreview returns the preview of version "version" of the data
+// of a test, but only if it has already been saved: unlike GetTestPreview,
+// it never reads the FITS file. If the preview is missing, "ok" is false.
+// The previews of data without a checksum are never saved, and for them
+// the function returns ErrNotFound.
+func (conn *Connection) GetSavedTestPreview(testID int, version int) (preview DataPreview, ok bool, err error) {
+	return conn.GetSavedTestPreviewContext(context.Background(), testID, version)
+}
+
+// GetSavedTestPreviewContext is like GetSavedTestPreview, but it accepts a context to cancel the operation
+func (conn *Connection) GetSavedTestPreviewContext(ctx context.Context, testID int, version int) (preview DataPreview, ok bool, err error) {
+	if !conn.Active {
+		return preview, false, ErrInactive
+	}
+
+	var dataVersion DataVersion
+	if err := resolveTestData(conn.withContext(ctx), testID, version, &dataVersion); err != nil {
+		return preview, false, err
+	}
+	if dataVersion.Checksum == "" {
+		return preview, false, errNotFound("the preview of test %d (version %d) cannot be saved, as the checksum of its FITS file is not recorded (use \"stdb checkdb --fix\")",
+			testID, dataVersion.Version)
+	}
+
+	err = readPreview(conn.Blobs, dataVersion.Checksum, &preview)
+	if err == ErrBlobNotFound {
+		return preview, false, nil
+	} else if err != nil {
+		return preview, false, err
+	}
+	return preview, true, nil
+}
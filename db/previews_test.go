@@ -0,0 +1,178 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"io"
+	"math"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestPreviewSteps(t *testing.T) {
+	for _, cur := range []struct {
+		numOfSamples int
+		steps        []int
+	}{
+		{10, []int{1}},
+		{500, []int{5, 1}},
+		{1000000, []int{10000, 1000, 100}},
+	} {
+		if steps := previewSteps(cur.numOfSamples); !reflect.DeepEqual(steps, cur.steps) {
+			t.Errorf("wrong steps for %d samples: %v instead of %v", cur.numOfSamples, steps, cur.steps)
+		}
+	}
+
+	col := ColumnPreview{Levels: []PreviewLevel{
+		{Step: 100, Min: make([]float64, 10)},
+		{Step: 10, Min: make([]float64, 100)},
+		{Step: 1, Min: make([]float64, 1000)},
+	}}
+	for _, cur := range []struct {
+		maxBins int
+		step    int
+	}{{5, 100}, {10, 100}, {500, 10}, {5000, 1}} {
+		if level := col.Level(cur.maxBins); level.Step != cur.step {
+			t.Errorf("wrong level for %d bins: step %d instead of %d", cur.maxBins, level.Step, cur.step)
+		}
+	}
+}
+
+func TestGetTestPreview(t *testing.T) {
+	conn := createTestDatabase(t, "previews")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 10}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	test := Test{TestType: "sweep", Polarimeter: 10}
+	testID, err := conn.AddTest(&test, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	key := previewStoragePath(test.FitsChecksum)
+	if _, err := conn.Blobs.Stat(key); err != nil {
+		t.Fatalf("the preview has not been saved by AddTest: %v", err)
+	}
+
+	preview, err := conn.GetTestPreview(testID, 0)
+	if err != nil {
+		t.Fatalf("unable to read the preview of test %d: %v", testID, err)
+	}
+	if preview.NumOfSamples != test.NumOfSamples || len(preview.Columns) != 4 {
+		t.Fatalf("wrong preview: %d samples, %d columns", preview.NumOfSamples, len(preview.Columns))
+	}
+
+	col := preview.Column("BaseV")
+	if col == nil || col.Unit != "V" {
+		t.Fatalf("wrong preview for column \"BaseV\": %v", col)
+	}
+	data, err := conn.ReadTestColumns(testID, []string{"BaseV"}, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := data[0].Float64s()
+
+	// Compare the first bin of the coarsest level with the data
+	level := col.Levels[0]
+	if len(level.Min) != (len(values)+level.Step-1)/level.Step {
+		t.Errorf("wrong number of bins: %d", len(level.Min))
+	}
+	lo, hi, sum := values[0], values[0], 0.0
+	for _, value := range values[:level.Step] {
+		lo = math.Min(lo, value)
+		hi = math.Max(hi, value)
+		sum += value
+	}
+	if level.Min[0] != lo || level.Max[0] != hi || math.Abs(level.Mean[0]-sum/float64(level.Step)) > 1e-9 {
+		t.Errorf("wrong first bin: [%g, %g, %g] instead of [%g, %g, %g]",
+			level.Min[0], level.Max[0], level.Mean[0], lo, hi, sum/float64(level.Step))
+	}
+
+	// Missing previews are computed again
+	if err := conn.Blobs.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := conn.GetSavedTestPreview(testID, 0); err != nil || ok {
+		t.Fatalf("GetSavedTestPreview returned a missing preview (ok=%v, err=%v)", ok, err)
+	}
+	recomputed, err := conn.GetTestPreview(testID, 0)
+	if err != nil {
+		t.Fatalf("unable to compute the preview of test %d: %v", testID, err)
+	}
+	if !reflect.DeepEqual(recomputed, preview) {
+		t.Error("the preview computed again is different")
+	}
+	if _, err := conn.Blobs.Stat(key); err != nil {
+		t.Errorf("the preview computed again has not been saved: %v", err)
+	}
+	if saved, ok, err := conn.GetSavedTestPreview(testID, 0); err != nil || !ok {
+		t.Errorf("GetSavedTestPreview did not find the preview (ok=%v, err=%v)", ok, err)
+	} else if !reflect.DeepEqual(saved, preview) {
+		t.Error("the preview returned by GetSavedTestPreview is different")
+	}
+}
+
+// countingBlobStore counts the objects read from a BlobStore
+type countingBlobStore struct {
+	BlobStore
+	numOfGets int
+}
+
+func (store *countingBlobStore) Get(key string) (io.ReadCloser, error) {
+	store.numOfGets++
+	return store.BlobStore.Get(key)
+}
+
+func TestImportDoesNotReadBlobs(t *testing.T) {
+	conn := createTestDatabase(t, "import_blobs")
+	defer conn.Disconnect()
+	store := &countingBlobStore{BlobStore: NewMemoryBlobStore()}
+	conn.Blobs = store
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 10}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	test := Test{TestType: "sweep", Polarimeter: 10}
+	testID, err := conn.AddTest(&test, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	if _, err := conn.ReplaceTestData(testID, inputFilePath, "new calibration", "testuser"); err != nil {
+		t.Fatalf("unable to replace the data of a test: %v", err)
+	}
+	if store.numOfGets != 0 {
+		t.Errorf("%d objects have been read back from the BlobStore while importing data", store.numOfGets)
+	}
+
+	for version := 1; version <= 2; version++ {
+		if stats, err := conn.GetColumnStats(testID, version); err != nil || len(stats) != 4 {
+			t.Errorf("wrong statistics for version %d: %v (%v)", version, stats, err)
+		}
+	}
+	if _, err := conn.Blobs.Stat(previewStoragePath(test.FitsChecksum)); err != nil {
+		t.Errorf("the preview has not been saved: %v", err)
+	}
+}
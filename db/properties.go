@@ -0,0 +1,148 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+// GetProperty returns the value of the key "key" in the "properties" table.
+// If the key is not present, "defaultValue" is returned.
+func (conn *Connection) GetProperty(key string, defaultValue string) (string, error) {
+	return conn.GetPropertyContext(context.Background(), key, defaultValue)
+}
+
+// GetPropertyContext is like GetProperty, but it accepts a context to cancel the operation
+func (conn *Connection) GetPropertyContext(ctx context.Context, key string, defaultValue string) (string, error) {
+	if !conn.Active {
+		return "", ErrInactive
+	}
+
+	return getProperty(conn.withContext(ctx), key, defaultValue)
+}
+
+func getProperty(q queryRower, key string, defaultValue string) (string, error) {
+	var value sql.NullString
+	err := q.QueryRow(`select value from properties where key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows || (err == nil && !value.Valid) {
+		return defaultValue, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return value.String, nil
+}
+
+// SetProperty sets the value of the key "key" in the "properties" table.
+// The parameter "username" is used only for logging purposes.
+func (conn *Connection) SetProperty(key string, value string, username string) error {
+	return conn.SetPropertyContext(context.Background(), key, value, username)
+}
+
+// SetPropertyContext is like SetProperty, but it accepts a context to cancel the operation
+func (conn *Connection) SetPropertyContext(ctx context.Context, key string, value string, username string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	if readOnlyProperties[key] {
+		return fmt.Errorf("property \"%s\" cannot be modified", key)
+	}
+	if validate, ok := propertyValidators[key]; ok {
+		if err := validate(value); err != nil {
+			return err
+		}
+	}
+
+	if _, err := conn.execWrite(ctx, `insert or replace into properties (key, value) values (?, ?)`,
+		key, value); err != nil {
+		return err
+	}
+
+	conn.logAction(ctx, username, ActionUpdate, ObjectProperty, key,
+		fmt.Sprintf("property \"%s\" has been set to \"%s\"", key, value))
+	return nil
+}
+
+// GetProperties returns all the keys in the "properties" table
+func (conn *Connection) GetProperties() (map[string]string, error) {
+	return conn.GetPropertiesContext(context.Background())
+}
+
+// GetPropertiesContext is like GetProperties, but it accepts a context to cancel the operation
+func (conn *Connection) GetPropertiesContext(ctx context.Context) (map[string]string, error) {
+	if !conn.Active {
+		return nil, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`select key, value from properties order by key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]string)
+	for rows.Next() {
+		var (
+			key   string
+			value sql.NullString
+		)
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		result[key] = value.String
+	}
+
+	return result, rows.Err()
+}
+
+// readOnlyProperties lists the properties that are managed by stdb itself
+var readOnlyProperties = map[string]bool{
+	"stdb_version": true,
+	"database_id":  true,
+}
+
+// propertyValidators checks the values of the properties that are
+// interpreted by stdb itself
+var propertyValidators = map[string]func(string) error{
+	"duplicate_policy":       validateDuplicatePolicy,
+	"duplicate_check_data":   validateBoolProperty,
+	"blob_store":             validateBlobStoreKind,
+	ReadLogRetentionProperty: validatePositiveInt,
+}
+
+func validateBoolProperty(value string) error {
+	switch value {
+	case "true", "false":
+		return nil
+	}
+	return fmt.Errorf("invalid value \"%s\", it must be either \"true\" or \"false\"", value)
+}
+
+func validatePositiveInt(value string) error {
+	if number, err := strconv.Atoi(value); err != nil || number <= 0 {
+		return fmt.Errorf("invalid value \"%s\", it must be a positive integer", value)
+	}
+	return nil
+}
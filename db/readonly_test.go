@@ -0,0 +1,96 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestConnectReadOnly(t *testing.T) {
+	conn := createTestDatabase(t, "readonly")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 6}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	testID, err := conn.AddTest(&Test{ShortName: "test", TestType: "sweep", Polarimeter: 6}, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	var roConn Connection
+	if err := roConn.ConnectReadOnly(conn.BasePath); err != nil {
+		t.Fatalf("unable to connect in read-only mode: %v", err)
+	}
+	defer roConn.Disconnect()
+
+	logEntries, _ := conn.QueryLog(LogFilter{})
+
+	var test Test
+	if err := roConn.GetTest(testID, "reader", &test); err != nil || test.ShortName != "test" {
+		t.Errorf("unable to read a test in read-only mode: %v (%v)", test, err)
+	}
+	r, _, err := roConn.OpenTestData(testID, 0)
+	if err != nil {
+		t.Errorf("unable to read the data of a test in read-only mode: %v", err)
+	} else {
+		r.Close()
+	}
+
+	if err := roConn.AddPolarimeter(&Polarimeter{Number: 7}, "reader"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("wrong error when adding a polarimeter in read-only mode: %v", err)
+	}
+	if _, err := roConn.AddTest(&Test{TestType: "sweep", Polarimeter: 6}, "reader", inputFilePath); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("wrong error when adding a test in read-only mode: %v", err)
+	}
+	if err := roConn.SetProperty("duplicate_policy", "allow", "reader"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("wrong error when setting a property in read-only mode: %v", err)
+	}
+	if _, err := roConn.Connection.Exec(`delete from tests`); err == nil {
+		t.Error("the database was modified through a read-only connection")
+	}
+
+	if newEntries, _ := conn.QueryLog(LogFilter{}); len(newEntries) != len(logEntries) {
+		t.Errorf("%d entries were written in the log by a read-only connection", len(newEntries)-len(logEntries))
+	}
+
+	// Changes done by other connections are visible
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 7}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	var pol Polarimeter
+	if err := roConn.GetPolarimeter(7, "reader", &pol); err != nil {
+		t.Errorf("a change was not visible to a read-only connection: %v", err)
+	}
+}
+
+func TestConnectReadOnlyLegacy(t *testing.T) {
+	dbPath := createLegacyDatabase(t, "readonly_legacy", []Test{{ShortName: "a", TestType: "dc", Polarimeter: 1}})
+
+	var conn Connection
+	if err := conn.ConnectReadOnly(dbPath); err == nil {
+		conn.Disconnect()
+		t.Error("a database with an old schema was opened in read-only mode")
+	}
+}
@@ -0,0 +1,847 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/astrogo/fitsio"
+)
+
+// ReindexOptions specifies what Reindex should do
+type ReindexOptions struct {
+	Check  bool   // Compare the FITS files with the existing index instead of rebuilding it
+	Backup string // Archive made by Backup, used to recover users and attachments (ignored if Check is set)
+}
+
+// ReindexReport is the result of Reindex
+type ReindexReport struct {
+	CheckReport
+
+	NumOfFiles       int      // Number of FITS files that have been read
+	NumOfTests       int      // Number of tests found in the FITS files
+	NewUsers         []string // Users that have been recreated (without a password)
+	RecoveredUsers   []string // Users that have been recovered from the backup
+	NumOfAttachments int      // Number of attachments recovered from the backup
+}
+
+// dataFileInfo holds the information about a test read from one of its
+// FITS files
+type dataFileInfo struct {
+	Key      string
+	Checksum string
+	ModTime  time.Time
+	Version  int    // Value of the "datavers" card, zero if missing
+	AddDate  string // Value of the "creadate" card, used to group files without a UUID
+	Test     Test   // Fields that can be recovered from the header
+}
+
+// fitsCards returns the cards in the header of a table, indexed by their
+// lowercase names
+func fitsCards(table *fitsio.Table) map[string]fitsio.Card {
+	hdr := table.Header()
+	cards := make(map[string]fitsio.Card)
+	for _, key := range hdr.Keys() {
+		cards[strings.ToLower(key)] = *hdr.Get(key)
+	}
+	return cards
+}
+
+// unitCommentRegexp matches the measurement unit in the comment of the
+// cards written by parameterFitsCards
+var unitCommentRegexp = regexp.MustCompile(`\[(\S+)\]$`)
+
+// cardString, cardInt, cardFloat and cardBool convert the value of a card
+// read by fitsCards. The second return value is false if the card is
+// missing or has the wrong type.
+func cardString(cards map[string]fitsio.Card, name string) (string, bool) {
+	value, ok := cards[name].Value.(string)
+	return strings.TrimSpace(value), ok
+}
+
+func cardFloat(cards map[string]fitsio.Card, name string) (float64, bool) {
+	switch value := cards[name].Value.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	}
+	return 0, false
+}
+
+func cardInt(cards map[string]fitsio.Card, name string) (int, bool) {
+	value, ok := cardFloat(cards, name)
+	return int(value), ok && value == float64(int(value))
+}
+
+func cardBool(cards map[string]fitsio.Card, name string) (bool, bool) {
+	value, ok := cards[name].Value.(bool)
+	return value, ok
+}
+
+// testFromFitsCards fills the fields of "info" using the cards written by
+// convertFileToFits (see also parameterFitsCards)
+func testFromFitsCards(cards map[string]fitsio.Card, numOfRows int, info *dataFileInfo) error {
+	test := &info.Test
+	var ok bool
+
+	if test.Polarimeter, ok = cardInt(cards, "polarim"); !ok {
+		return fmt.Errorf("card \"polarim\" is missing")
+	}
+	if test.TestType, ok = cardString(cards, "testtype"); !ok || test.TestType == "" {
+		return fmt.Errorf("card \"testtype\" is missing")
+	}
+	if test.Username, _ = cardString(cards, "username"); test.Username == "" {
+		test.Username = AnonymousUser
+	}
+	test.ShortName, _ = cardString(cards, "shortnam")
+	test.CryogenicFlag, _ = cardBool(cards, "cryo")
+	test.UUID, _ = cardString(cards, "testuuid")
+	test.TimeSpanSec, _ = cardFloat(cards, "extime")
+	test.NumOfSamples = numOfRows
+	info.Version, _ = cardInt(cards, "datavers")
+
+	// The time of the acquisition is the one used by importTestData;
+	// "creadate" is the date provided when the test was added, if any
+	if date, ok := cardString(cards, "acqtime"); ok {
+		test.CreationDate, _ = time.Parse(time.RFC3339, date)
+	}
+	info.AddDate = fmt.Sprint(cards["creadate"].Value)
+	if test.CreationDate.IsZero() {
+		switch date := cards["creadate"].Value.(type) {
+		case time.Time:
+			test.CreationDate = date
+		case string:
+			test.CreationDate, _ = time.Parse(time.RFC3339Nano, strings.TrimSpace(date))
+		}
+	}
+
+	for idx := 1; ; idx++ {
+		name, ok := cardString(cards, fmt.Sprintf("pnam%03d", idx))
+		if !ok {
+			break
+		}
+
+		param := TestParameter{Name: name}
+		valueCard := fmt.Sprintf("pval%03d", idx)
+		if value, ok := cardFloat(cards, valueCard); ok {
+			param.Kind = ParameterNumber
+			param.Number = value
+			if match := unitCommentRegexp.FindStringSubmatch(cards[valueCard].Comment); match != nil {
+				param.Unit = match[1]
+			}
+		} else if value, ok := cardBool(cards, valueCard); ok {
+			param.Kind = ParameterBool
+			param.Bool = value
+		} else {
+			param.Kind = ParameterString
+			param.String, _ = cardString(cards, valueCard)
+		}
+		test.Parameters = append(test.Parameters, param)
+	}
+
+	return nil
+}
+
+// readDataFile reads the header of the FITS file with key "key"
+func readDataFile(store BlobStore, blob BlobInfo) (dataFileInfo, error) {
+	info := dataFileInfo{Key: blob.Key, ModTime: blob.ModTime}
+
+	r, err := store.Get(blob.Key)
+	if err != nil {
+		return info, err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	tee := io.TeeReader(r, hash)
+	f, closeFile, err := openFitsStream(tee)
+	if err != nil {
+		return info, err
+	}
+	defer closeFile()
+
+	// Make sure that the checksum covers the whole file
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return info, err
+	}
+	info.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	table, err := dataTable(f)
+	if err != nil {
+		return info, err
+	}
+	return info, testFromFitsCards(fitsCards(table), int(table.NumRows()), &info)
+}
+
+// scanDataFiles reads all the FITS files in the BlobStore and groups them
+// by test, using their UUID. Files written before UUIDs were introduced
+// are returned separately. Files that cannot be used are added to the
+// report.
+func scanDataFiles(ctx context.Context, store BlobStore, report *ReindexReport) (map[string][]dataFileInfo, []dataFileInfo, error) {
+	blobs, err := store.List(dataFolderName + "/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := make(map[string][]dataFileInfo)
+	var legacyFiles []dataFileInfo
+	for _, curBlob := range blobs {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if !strings.HasSuffix(curBlob.Key, ".fits.gz") {
+			continue
+		}
+
+		report.NumOfFiles++
+		info, err := readDataFile(store, curBlob)
+		if err != nil {
+			report.Problems = append(report.Problems, Problem{
+				Severity: SeverityError,
+				Object:   curBlob.Key,
+				Message:  fmt.Sprintf("the file cannot be used: %v", err),
+			})
+			continue
+		}
+		if expected := path.Base(curBlob.Key); expected != info.Checksum+".fits.gz" {
+			report.Problems = append(report.Problems, Problem{
+				Severity: SeverityError,
+				Object:   curBlob.Key,
+				Message:  fmt.Sprintf("the file is corrupted (checksum %s)", info.Checksum),
+			})
+			continue
+		}
+
+		if info.Test.UUID == "" {
+			legacyFiles = append(legacyFiles, info)
+			continue
+		}
+		if info.Test.UUID, err = normalizeTestUUID(info.Test.UUID); err != nil {
+			report.Problems = append(report.Problems, Problem{
+				Severity: SeverityError,
+				Object:   curBlob.Key,
+				Message:  err.Error(),
+			})
+			continue
+		}
+
+		result[info.Test.UUID] = append(result[info.Test.UUID], info)
+	}
+
+	for _, files := range result {
+		sortVersions(files)
+	}
+	return result, legacyFiles, nil
+}
+
+// sortVersions sorts the versions of one test; the last one carries the
+// most recent metadata
+func sortVersions(files []dataFileInfo) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Version != files[j].Version {
+			return files[i].Version < files[j].Version
+		}
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+}
+
+// dataFileUUIDs returns the keys of all the data files listed in an index,
+// and the UUIDs of their tests indexed by the checksum of the files
+func dataFileUUIDs(q queryer) (map[string]bool, map[string]string, error) {
+	keys := make(map[string]bool)
+	checksumUUIDs := make(map[string]string)
+	err := forEachRow(q, `
+select v.file_name, v.fits_checksum, t.uuid
+from test_data_versions as v join tests as t on t.test_id = v.test_id`,
+		func(values []interface{}) error {
+			key, _ := values[0].(string)
+			checksum, _ := values[1].(string)
+			testUUID, _ := values[2].(string)
+			keys[key] = true
+			if checksum != "" && testUUID != "" {
+				checksumUUIDs[checksum] = testUUID
+			}
+			return nil
+		})
+	return keys, checksumUUIDs, err
+}
+
+// matchLegacyFiles adds the files without a UUID whose checksum is in
+// "checksumUUIDs" to the versions of their test, and returns the other
+// ones. The headers of these files have not been updated when UUIDs were
+// introduced, so an index is the only place where their UUID is saved.
+func matchLegacyFiles(files map[string][]dataFileInfo, legacyFiles []dataFileInfo,
+	checksumUUIDs map[string]string) []dataFileInfo {
+	var unmatched []dataFileInfo
+	for _, curFile := range legacyFiles {
+		testUUID, ok := checksumUUIDs[curFile.Checksum]
+		if !ok {
+			unmatched = append(unmatched, curFile)
+			continue
+		}
+		curFile.Test.UUID = testUUID
+		files[testUUID] = append(files[testUUID], curFile)
+		sortVersions(files[testUUID])
+	}
+	return unmatched
+}
+
+// groupLegacyFiles assigns a new UUID to the files without one. Files with
+// the same polarimeter, test type, short name and date are considered
+// versions of the same test.
+func groupLegacyFiles(files map[string][]dataFileInfo, legacyFiles []dataFileInfo, report *ReindexReport) {
+	groupUUIDs := make(map[string]string)
+	for _, curFile := range legacyFiles {
+		group := fmt.Sprintf("%d\x00%s\x00%s\x00%s", curFile.Test.Polarimeter, curFile.Test.TestType,
+			curFile.Test.ShortName, curFile.AddDate)
+		testUUID, ok := groupUUIDs[group]
+		if !ok {
+			testUUID = newTestUUID()
+			groupUUIDs[group] = testUUID
+		}
+
+		curFile.Test.UUID = testUUID
+		files[testUUID] = append(files[testUUID], curFile)
+		report.Problems = append(report.Problems, Problem{
+			Severity: SeverityWarning,
+			Object:   curFile.Key,
+			Message: fmt.Sprintf("the file has no UUID, so it has been assigned to test %s "+
+				"using its polarimeter, test type, short name and date", testUUID),
+		})
+	}
+
+	for _, testUUID := range groupUUIDs {
+		sortVersions(files[testUUID])
+	}
+}
+
+// openBackupIndex extracts "index.db" from a backup archive into a
+// temporary file and opens it. The function returned must be called once
+// the index is no longer needed.
+func openBackupIndex(archiveName string) (*sql.DB, func(), error) {
+	tmpFile, err := ioutil.TempFile("", "stdb-reindex-")
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpFileName := tmpFile.Name()
+	tmpFile.Close()
+
+	foundIndex := false
+	if _, err := walkBackupArchive(archiveName, func(name string, r io.Reader) error {
+		if name != backupIndexName {
+			return nil
+		}
+		foundIndex = true
+		return writeFile(tmpFileName, r)
+	}); err != nil {
+		os.Remove(tmpFileName)
+		return nil, nil, err
+	}
+	if !foundIndex {
+		os.Remove(tmpFileName)
+		return nil, nil, fmt.Errorf("no index found in \"%s\"", archiveName)
+	}
+
+	backup, err := sql.Open("sqlite3", readOnlyDSN(tmpFileName))
+	if err != nil {
+		os.Remove(tmpFileName)
+		return nil, nil, err
+	}
+	return backup, func() {
+		backup.Close()
+		os.Remove(tmpFileName)
+	}, nil
+}
+
+// recoverUsers copies the users saved in the backup, together with their
+// passwords
+func recoverUsers(tx *sql.Tx, backup *sql.DB, knownUsers map[string]bool, report *ReindexReport) error {
+	return forEachRow(backup, `
+select user_id, full_name, creation_date, email, password_hash, is_enabled from users order by user_id`,
+		func(values []interface{}) error {
+			if _, err := insertValues(tx, "insert", "users",
+				"user_id, full_name, creation_date, email, password_hash, is_enabled", values); err != nil {
+				return err
+			}
+			name, _ := values[0].(string)
+			knownUsers[name] = true
+			report.RecoveredUsers = append(report.RecoveredUsers, name)
+			return nil
+		})
+}
+
+// recoverAttachments copies the attachments saved in the backup whose test
+// and file are in the database being rebuilt. It returns the keys of the
+// files that have been associated with their tests.
+func recoverAttachments(tx *sql.Tx, backup *sql.DB, storedKeys map[string]bool,
+	report *ReindexReport) (map[string]bool, error) {
+	testIDs := make(map[string]int64)
+	if err := forEachRow(tx, `select uuid, test_id from tests`, func(values []interface{}) error {
+		testUUID, _ := values[0].(string)
+		testIDs[testUUID], _ = values[1].(int64)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	recovered := make(map[string]bool)
+	attachmentIDs := make(map[int64]int64)
+	if err := forEachRow(backup, `
+select a.attachment_id, t.uuid, a.file_name, a.mime_type, a.checksum
+from attachments as a join tests as t on t.test_id = a.test_id order by a.attachment_id`,
+		func(values []interface{}) error {
+			testUUID, _ := values[1].(string)
+			checksum, _ := values[4].(string)
+			testID, ok := testIDs[testUUID]
+			key := attachmentStoragePath(checksum)
+			if !ok || !storedKeys[key] {
+				report.Problems = append(report.Problems, Problem{
+					Severity: SeverityWarning,
+					Object:   fmt.Sprintf("attachment \"%v\" of test %s", values[2], testUUID),
+					Message:  "the attachment cannot be recovered, as its test or its file is missing",
+				})
+				return nil
+			}
+
+			newID, err := insertValues(tx, "insert", "attachments", "test_id, file_name, mime_type, checksum",
+				[]interface{}{testID, values[2], values[3], values[4]})
+			if err != nil {
+				return err
+			}
+			oldID, _ := values[0].(int64)
+			attachmentIDs[oldID] = newID
+			recovered[key] = true
+			report.NumOfAttachments++
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+
+	err := forEachRow(backup, `
+select t.uuid, ta.attachment_id
+from test_attachment_assoc as ta join tests as t on t.test_id = ta.test_id`,
+		func(values []interface{}) error {
+			testUUID, _ := values[0].(string)
+			oldID, _ := values[1].(int64)
+			testID, ok := testIDs[testUUID]
+			newID, found := attachmentIDs[oldID]
+			if !ok || !found {
+				return nil
+			}
+
+			_, err := tx.Exec(`insert into test_attachment_assoc (test_id, attachment_id) values (?, ?)`,
+				testID, newID)
+			return err
+		})
+	return recovered, err
+}
+
+// sortedUUIDs returns the keys of the result of scanDataFiles, sorted by
+// the date of the tests
+func sortedUUIDs(files map[string][]dataFileInfo) []string {
+	result := make([]string, 0, len(files))
+	for curUUID := range files {
+		result = append(result, curUUID)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		first := files[result[i]][0].Test.CreationDate
+		second := files[result[j]][0].Test.CreationDate
+		if !first.Equal(second) {
+			return first.Before(second)
+		}
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// rebuildTest adds one test and all its versions to the database being
+// rebuilt
+func rebuildTest(tx *sql.Tx, versions []dataFileInfo, knownUsers map[string]bool, report *ReindexReport) error {
+	latest := versions[len(versions)-1]
+	test := latest.Test
+
+	if test.CreationDate.IsZero() {
+		test.CreationDate = versions[0].ModTime.UTC()
+		report.Problems = append(report.Problems, Problem{
+			Severity: SeverityWarning,
+			Object:   fmt.Sprintf("test %s", test.UUID),
+			Message:  "the date of the test is unknown, the date of its first file has been used",
+		})
+	}
+
+	if _, err := tx.Exec(`
+insert or ignore into polarimeters (polarimeter_id, status) values (?, ?)`,
+		test.Polarimeter, PolarimeterUnknown); err != nil {
+		return err
+	}
+
+	var testType TestType
+	if err := resolveTestType(tx, test.TestType, &testType); err == nil {
+		test.TestType = testType.Code
+	} else if errors.Is(err, ErrNotFound) {
+		if _, err := tx.Exec(`insert into test_types (code, description) values (?, ?)`,
+			test.TestType, "Recovered from the FITS files"); err != nil {
+			return err
+		}
+		report.Problems = append(report.Problems, Problem{
+			Severity: SeverityWarning,
+			Object:   fmt.Sprintf("test type %s", test.TestType),
+			Message:  "the test type is not known and has been added without a description",
+		})
+	} else {
+		return err
+	}
+
+	for _, curVersion := range versions {
+		curUser := curVersion.Test.Username
+		if knownUsers[curUser] {
+			continue
+		}
+		if _, err := tx.Exec(`
+insert or ignore into users (user_id, full_name, creation_date, is_enabled) values (?, ?, ?, 0)`,
+			curUser, curUser, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+		knownUsers[curUser] = true
+		report.NewUsers = append(report.NewUsers, curUser)
+	}
+
+	result, err := tx.Exec(`
+insert into tests (short_name, creation_date, user_id, fits_checksum, type, time_span_sec,
+                   is_cryogenic, polarimeter, num_of_samples, file_path, uuid)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		nullIfEmpty(test.ShortName),
+		test.CreationDate.Format(time.RFC3339),
+		test.Username,
+		latest.Checksum,
+		test.TestType,
+		test.TimeSpanSec,
+		test.CryogenicFlag,
+		test.Polarimeter,
+		test.NumOfSamples,
+		latest.Key,
+		test.UUID)
+	if err != nil {
+		return err
+	}
+	testID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if err := checkParameters(test.Parameters); err != nil {
+		report.Problems = append(report.Problems, Problem{
+			Severity: SeverityWarning,
+			Object:   fmt.Sprintf("test %d", testID),
+			Message:  fmt.Sprintf("the parameters of the test have been dropped: %v", err),
+		})
+	} else if err := saveParameters(tx, testID, test.Parameters); err != nil {
+		return err
+	}
+
+	// Versions are numbered again, as some of them might be missing
+	for idx, curVersion := range versions {
+		if _, err := tx.Exec(`
+insert into test_data_versions (test_id, version, file_name, fits_checksum, creation_date, user_id, reason)
+values (?, ?, ?, ?, ?, ?, ?)`,
+			testID,
+			idx+1,
+			curVersion.Key,
+			curVersion.Checksum,
+			curVersion.ModTime.UTC().Format(time.RFC3339),
+			curVersion.Test.Username,
+			"Recovered from the FITS file"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildIndex creates a new "index.db" file in "dbpath" using the FITS
+// files in the folder and, if provided, the backup archive
+func rebuildIndex(ctx context.Context, dbpath string, options ReindexOptions, username string) (ReindexReport, error) {
+	report := ReindexReport{CheckReport: CheckReport{Problems: []Problem{}}}
+
+	indexFileName := path.Join(dbpath, IndexFileName)
+	if _, err := os.Stat(indexFileName); err == nil {
+		return report, fmt.Errorf("file \"%s\" already exists, move it away before rebuilding it", indexFileName)
+	} else if !os.IsNotExist(err) {
+		return report, err
+	}
+
+	files, legacyFiles, err := scanDataFiles(ctx, NewFileBlobStore(dbpath), &report)
+	if err != nil {
+		return report, err
+	}
+
+	var backup *sql.DB
+	if options.Backup != "" {
+		var closeBackup func()
+		if backup, closeBackup, err = openBackupIndex(options.Backup); err != nil {
+			return report, fmt.Errorf("unable to read the backup \"%s\": %v", options.Backup, err)
+		}
+		defer closeBackup()
+
+		_, checksumUUIDs, err := dataFileUUIDs(backup)
+		if err != nil {
+			return report, fmt.Errorf("unable to read the backup \"%s\": %v", options.Backup, err)
+		}
+		legacyFiles = matchLegacyFiles(files, legacyFiles, checksumUUIDs)
+	}
+
+	// The tests of the files written before UUIDs were introduced must be
+	// identified using the other fields of their headers
+	groupLegacyFiles(files, legacyFiles, &report)
+	report.NumOfTests = len(files)
+
+	if err := createIndexFile(dbpath); err != nil {
+		return report, err
+	}
+	success := false
+	defer func() {
+		if !success {
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				os.Remove(indexFileName + suffix)
+			}
+		}
+	}()
+
+	var conn Connection
+	if err := conn.Connect(dbpath); err != nil {
+		return report, err
+	}
+	defer conn.Disconnect()
+
+	tx, unlock, err := conn.beginWrite(ctx)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	knownUsers := make(map[string]bool)
+	if backup != nil {
+		if err := recoverUsers(tx, backup, knownUsers, &report); err != nil {
+			tx.Rollback()
+			return report, fmt.Errorf("unable to recover the users: %v", err)
+		}
+	}
+	for _, curUUID := range sortedUUIDs(files) {
+		if err := rebuildTest(tx, files[curUUID], knownUsers, &report); err != nil {
+			tx.Rollback()
+			return report, fmt.Errorf("unable to add test %s: %v", curUUID, err)
+		}
+	}
+	if err := fillColumnStats(tx, conn.Blobs); err != nil {
+		tx.Rollback()
+		return report, err
+	}
+
+	for _, curUser := range report.NewUsers {
+		report.Problems = append(report.Problems, Problem{
+			Severity: SeverityInfo,
+			Object:   fmt.Sprintf("user %s", curUser),
+			Message:  "the user has been recreated without a password and is disabled",
+		})
+	}
+
+	attachments, err := conn.Blobs.List(attachmentsFolderName + "/")
+	if err != nil {
+		tx.Rollback()
+		return report, err
+	}
+	recovered := make(map[string]bool)
+	if backup != nil {
+		storedKeys := make(map[string]bool)
+		for _, curAttachment := range attachments {
+			storedKeys[curAttachment.Key] = true
+		}
+		if recovered, err = recoverAttachments(tx, backup, storedKeys, &report); err != nil {
+			tx.Rollback()
+			return report, fmt.Errorf("unable to recover the attachments: %v", err)
+		}
+	}
+	for _, curAttachment := range attachments {
+		if recovered[curAttachment.Key] {
+			continue
+		}
+		report.Problems = append(report.Problems, Problem{
+			Severity: SeverityWarning,
+			Object:   curAttachment.Key,
+			Message:  "the attachment cannot be associated with its test, as its metadata were saved only in the index",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	success = true
+	unlock()
+
+	conn.logAction(ctx, username, ActionCreate, ObjectDatabase, "",
+		fmt.Sprintf("the index has been rebuilt from %d FITS files (%d tests)",
+			report.NumOfFiles, report.NumOfTests))
+	return report, nil
+}
+
+// compareIndex compares the tests in "index.db" with the FITS files
+func compareIndex(ctx context.Context, dbpath string) (ReindexReport, error) {
+	report := ReindexReport{CheckReport: CheckReport{Problems: []Problem{}}}
+
+	var conn Connection
+	if err := conn.ConnectReadOnly(dbpath); err != nil {
+		return report, err
+	}
+	defer conn.Disconnect()
+
+	files, legacyFiles, err := scanDataFiles(ctx, conn.Blobs, &report)
+	if err != nil {
+		return report, err
+	}
+
+	page, err := conn.ListTestsContext(ctx, ListOptions{})
+	if err != nil {
+		return report, err
+	}
+
+	indexKeys, checksumUUIDs, err := dataFileUUIDs(conn.withContext(ctx))
+	if err != nil {
+		return report, err
+	}
+	for _, curFile := range matchLegacyFiles(files, legacyFiles, checksumUUIDs) {
+		report.Problems = append(report.Problems, Problem{
+			Severity: SeverityError,
+			Object:   curFile.Key,
+			Message:  "the file has no UUID and its checksum is not in the index",
+		})
+	}
+	report.NumOfTests = len(files)
+
+	for _, curEntry := range page.Tests {
+		object := fmt.Sprintf("test %d", curEntry.ID)
+		versions, ok := files[curEntry.Test.UUID]
+		if !ok {
+			report.Problems = append(report.Problems, Problem{
+				Severity: SeverityError,
+				Object:   object,
+				Message:  "no FITS file refers to the test",
+			})
+			continue
+		}
+		delete(files, curEntry.Test.UUID)
+
+		fromFile := versions[len(versions)-1].Test
+		for _, cur := range []struct {
+			field   string
+			inIndex interface{}
+			inFile  interface{}
+		}{
+			{"short name", curEntry.Test.ShortName, fromFile.ShortName},
+			{"user", curEntry.Test.Username, fromFile.Username},
+			{"test type", curEntry.Test.TestType, fromFile.TestType},
+			{"polarimeter", curEntry.Test.Polarimeter, fromFile.Polarimeter},
+			{"cryogenic flag", curEntry.Test.CryogenicFlag, fromFile.CryogenicFlag},
+			{"number of samples", curEntry.Test.NumOfSamples, fromFile.NumOfSamples},
+		} {
+			if cur.inIndex != cur.inFile {
+				report.Problems = append(report.Problems, Problem{
+					Severity: SeverityWarning,
+					Object:   object,
+					Message: fmt.Sprintf("the %s is \"%v\" in the index and \"%v\" in the FITS file",
+						cur.field, cur.inIndex, cur.inFile),
+				})
+			}
+		}
+
+		for _, curVersion := range versions {
+			if !indexKeys[curVersion.Key] {
+				report.Problems = append(report.Problems, Problem{
+					Severity: SeverityWarning,
+					Object:   object,
+					Message:  fmt.Sprintf("file \"%s\" is not listed among the versions of the test", curVersion.Key),
+				})
+			}
+		}
+	}
+
+	for _, curUUID := range sortedUUIDs(files) {
+		for _, curVersion := range files[curUUID] {
+			report.Problems = append(report.Problems, Problem{
+				Severity: SeverityError,
+				Object:   curVersion.Key,
+				Message:  fmt.Sprintf("test %s is not in the index", curUUID),
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// Reindex rebuilds the file "index.db" in the folder "dbpath" using the
+// headers of the FITS files in the database, which must use a
+// FileBlobStore. This can be used if "index.db" has been lost or
+// corrupted: tests, their parameters and the versions of their data are
+// recovered, while descriptions, campaigns, comments, relations and the
+// associations of attachments cannot be, as they are saved only in
+// "index.db". Users are recreated without a password, and they are
+// disabled. If options.Backup names a backup archive (usually the most
+// recent one), the users, the attachments of the tests, and the UUIDs of
+// the tests whose files have none are recovered from the index it
+// contains. The FITS files written before UUIDs were introduced do not
+// contain the UUID of their test: without a backup, the files with the
+// same polarimeter, test type, short name and date are assigned to a new
+// test. When comparing, these files are matched with the index using
+// their checksum. "index.db" must not exist. If options.Check is true, the
+// existing "index.db" is compared with the FITS files instead, and nothing
+// is modified. Files that cannot be reconciled are listed in the report.
+// The parameter "username" is used only for logging purposes.
+func Reindex(dbpath string, options ReindexOptions, username string) (ReindexReport, error) {
+	return ReindexContext(context.Background(), dbpath, options, username)
+}
+
+// ReindexContext is like Reindex, but it accepts a context to cancel the operation
+func ReindexContext(ctx context.Context, dbpath string, options ReindexOptions, username string) (ReindexReport, error) {
+	if options.Check {
+		return compareIndex(ctx, dbpath)
+	}
+	return rebuildIndex(ctx, dbpath, options, username)
+}
@@ -0,0 +1,309 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReindex(t *testing.T) {
+	conn := createTestDatabase(t, "reindex")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 8}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	firstID, err := conn.AddTest(&Test{
+		ShortName:     "first",
+		TestType:      "sweep",
+		Polarimeter:   8,
+		CryogenicFlag: true,
+		Parameters: []TestParameter{
+			{Name: "vdrain", Kind: ParameterNumber, Number: 0.5, Unit: "V"},
+			{Name: "lna", Kind: ParameterBool, Bool: true},
+		},
+	}, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	if _, err := conn.ReplaceTestData(firstID, inputFilePath, "new calibration", "testuser"); err != nil {
+		t.Fatalf("unable to replace the data of a test: %v", err)
+	}
+	if _, err := conn.AddTest(&Test{ShortName: "second", TestType: "sweep", Polarimeter: 8}, "testuser", inputFilePath); err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	var original Test
+	if err := conn.GetTest(firstID, "testuser", &original); err != nil {
+		t.Fatal(err)
+	}
+	attachmentID, err := conn.AddAttachment(firstID, inputFilePath, "testuser")
+	if err != nil {
+		t.Fatalf("unable to attach a file: %v", err)
+	}
+	r, attachment, err := conn.OpenAttachment(attachmentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	report, err := Reindex(conn.BasePath, ReindexOptions{Check: true}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to compare the index with the FITS files: %v", err)
+	}
+	if report.NumOfFiles != 3 || report.NumOfTests != 2 || len(report.Problems) != 0 {
+		t.Fatalf("wrong comparison between the index and the FITS files: %v", report)
+	}
+
+	if _, err := conn.Connection.Exec(`update tests set short_name = 'renamed' where test_id = ?`, firstID); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Reindex(conn.BasePath, ReindexOptions{Check: true}, "testuser"); err != nil {
+		t.Fatalf("unable to compare the index with the FITS files: %v", err)
+	}
+	if len(report.Problems) != 1 || findProblem(report.CheckReport, "test", "short name") == nil {
+		t.Errorf("a different short name has not been detected: %v", report.Problems)
+	}
+
+	if _, err := Reindex(conn.BasePath, ReindexOptions{}, "testuser"); err == nil {
+		t.Error("an existing index has been overwritten")
+	}
+
+	// Lose the index
+	conn.Disconnect()
+	removeIndex(conn.BasePath)
+
+	report, err = Reindex(conn.BasePath, ReindexOptions{}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to rebuild the index: %v", err)
+	}
+	if report.NumOfFiles != 3 || report.NumOfTests != 2 {
+		t.Errorf("wrong number of files/tests: %d/%d", report.NumOfFiles, report.NumOfTests)
+	}
+	if len(report.NewUsers) != 1 || report.NewUsers[0] != "testuser" {
+		t.Errorf("wrong list of recreated users: %v", report.NewUsers)
+	}
+
+	var rebuilt Connection
+	if err := rebuilt.Connect(conn.BasePath); err != nil {
+		t.Fatalf("unable to connect to the rebuilt database: %v", err)
+	}
+	defer rebuilt.Disconnect()
+
+	page, err := rebuilt.ListTests(ListOptions{Sort: SortByName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 {
+		t.Fatalf("wrong number of tests in the rebuilt database: %d", page.Total)
+	}
+	test := page.Tests[0].Test
+	if test.UUID != original.UUID || test.ShortName != "first" || !test.CryogenicFlag ||
+		test.Polarimeter != 8 || test.NumOfSamples != original.NumOfSamples ||
+		test.DataVersion != 2 || test.FitsChecksum != original.FitsChecksum ||
+		!test.CreationDate.Equal(original.CreationDate) {
+		t.Errorf("wrong test rebuilt: %v (original: %v)", test, original)
+	}
+	if len(test.Parameters) != 2 || test.Parameters[0].Value() != original.Parameters[0].Value() ||
+		test.Parameters[1].Value() != original.Parameters[1].Value() {
+		t.Errorf("wrong parameters rebuilt: %v (original: %v)", test.Parameters, original.Parameters)
+	}
+
+	if report, err := rebuilt.Check(CheckOptions{}, "testuser"); err != nil {
+		t.Errorf("unable to check the rebuilt database: %v", err)
+	} else if report.Count(SeverityError) != 0 {
+		t.Errorf("the rebuilt database is not consistent: %v", report.Problems)
+	}
+
+	// The attachments are not in the rebuilt index, but fixing the
+	// database must not remove their files
+	oldTime := time.Now().Add(-2 * orphanGracePeriod)
+	attachmentFile := filepath.Join(conn.BasePath, filepath.FromSlash(attachmentStoragePath(attachment.Checksum)))
+	if err := os.Chtimes(attachmentFile, oldTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rebuilt.Check(CheckOptions{Fix: true}, "testuser"); err != nil {
+		t.Errorf("unable to fix the rebuilt database: %v", err)
+	}
+	if _, err := os.Stat(attachmentFile); err != nil {
+		t.Errorf("the file of an attachment has been removed: %v", err)
+	}
+}
+
+// writeLegacyFiles replaces the FITS files of a test with ones that do not
+// contain its UUID, like the ones written by old versions of stdb
+func writeLegacyFiles(t *testing.T, conn *Connection, testID int, inputFilePath string) {
+	var test Test
+	if err := conn.GetTest(testID, "testuser", &test); err != nil {
+		t.Fatal(err)
+	}
+	latest := test.DataVersion
+	test.UUID = ""
+
+	for version := 1; version <= latest; version++ {
+		var oldKey string
+		if err := conn.Connection.QueryRow(`select file_name from test_data_versions where test_id = ? and version = ?`,
+			testID, version).Scan(&oldKey); err != nil {
+			t.Fatal(err)
+		}
+
+		test.DataVersion = version
+		key, checksum, _, err := writeBlob(conn.Blobs, dataStoragePath, func(w io.Writer) error {
+			_, err := convertFileToFits(inputFilePath, w, &test)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unable to write a legacy FITS file: %v", err)
+		}
+		if _, err := conn.Connection.Exec(`
+update test_data_versions set file_name = ?, fits_checksum = ? where test_id = ? and version = ?`,
+			key, checksum, testID, version); err != nil {
+			t.Fatal(err)
+		}
+		if version == latest {
+			if _, err := conn.Connection.Exec(`update tests set file_path = ?, fits_checksum = ? where test_id = ?`,
+				key, checksum, testID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := conn.Blobs.Delete(oldKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// removeIndex deletes "index.db" from the database folder
+func removeIndex(dbPath string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(path.Join(dbPath, IndexFileName+suffix))
+	}
+}
+
+func TestReindexLegacyFiles(t *testing.T) {
+	conn := createTestDatabase(t, "reindex_legacy")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 9}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	var (
+		ids   []int
+		uuids []string
+	)
+	for _, name := range []string{"legacy", "other"} {
+		testID, err := conn.AddTest(&Test{ShortName: name, TestType: "sweep", Polarimeter: 9}, "testuser", inputFilePath)
+		if err != nil {
+			t.Fatalf("unable to add a test: %v", err)
+		}
+		if name == "legacy" {
+			if _, err := conn.ReplaceTestData(testID, inputFilePath, "new calibration", "testuser"); err != nil {
+				t.Fatalf("unable to replace the data of a test: %v", err)
+			}
+		}
+		writeLegacyFiles(t, conn, testID, inputFilePath)
+
+		var test Test
+		if err := conn.GetTest(testID, "testuser", &test); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, testID)
+		uuids = append(uuids, test.UUID)
+	}
+	if _, err := conn.AddAttachment(ids[0], inputFilePath, "testuser"); err != nil {
+		t.Fatalf("unable to attach a file: %v", err)
+	}
+
+	// Files without a UUID are matched with the index using their checksum
+	report, err := Reindex(conn.BasePath, ReindexOptions{Check: true}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to compare the index with the FITS files: %v", err)
+	}
+	if report.NumOfFiles != 3 || report.NumOfTests != 2 || len(report.Problems) != 0 {
+		t.Errorf("wrong comparison of legacy files with the index: %v", report)
+	}
+
+	archiveName := path.Join(targetPath, "reindex_legacy.tar.gz")
+	if _, err := conn.Backup(archiveName, "", "testuser"); err != nil {
+		t.Fatalf("unable to save a backup: %v", err)
+	}
+	conn.Disconnect()
+	removeIndex(conn.BasePath)
+
+	// Without a backup, the versions of a test are grouped using the
+	// fields of their headers
+	report, err = Reindex(conn.BasePath, ReindexOptions{}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to rebuild the index: %v", err)
+	}
+	if report.NumOfTests != 2 || len(report.NewUsers) != 1 || report.NumOfAttachments != 0 {
+		t.Errorf("wrong index rebuilt from legacy files: %v", report)
+	}
+	var rebuilt Connection
+	if err := rebuilt.Connect(conn.BasePath); err != nil {
+		t.Fatalf("unable to connect to the rebuilt database: %v", err)
+	}
+	page, err := rebuilt.ListTests(ListOptions{Sort: SortByName})
+	rebuilt.Disconnect()
+	if err != nil || page.Total != 2 || page.Tests[0].Test.ShortName != "legacy" ||
+		page.Tests[0].Test.DataVersion != 2 || page.Tests[0].Test.UUID == uuids[0] {
+		t.Fatalf("wrong tests rebuilt from legacy files: %v (%v)", page.Tests, err)
+	}
+	removeIndex(conn.BasePath)
+
+	// The backup provides users, attachments and UUIDs
+	report, err = Reindex(conn.BasePath, ReindexOptions{Backup: archiveName}, "testuser")
+	if err != nil {
+		t.Fatalf("unable to rebuild the index using a backup: %v", err)
+	}
+	if report.NumOfTests != 2 || len(report.NewUsers) != 0 || report.NumOfAttachments != 1 ||
+		len(report.RecoveredUsers) != 1 || report.RecoveredUsers[0] != "testuser" {
+		t.Errorf("wrong index rebuilt using a backup: %v", report)
+	}
+	if err := rebuilt.Connect(conn.BasePath); err != nil {
+		t.Fatalf("unable to connect to the rebuilt database: %v", err)
+	}
+	defer rebuilt.Disconnect()
+
+	page, err = rebuilt.ListTests(ListOptions{Sort: SortByName})
+	if err != nil || page.Total != 2 || page.Tests[0].Test.DataVersion != 2 ||
+		page.Tests[0].Test.UUID != uuids[0] || page.Tests[1].Test.UUID != uuids[1] {
+		t.Fatalf("wrong tests rebuilt using a backup: %v (%v)", page.Tests, err)
+	}
+	attachments, err := rebuilt.GetAttachments(page.Tests[0].ID)
+	if err != nil || len(attachments) != 1 {
+		t.Errorf("the attachment has not been recovered: %v (%v)", attachments, err)
+	}
+	if password, err := rebuilt.GetUserPassword("testuser"); err != nil || len(password) == 0 {
+		t.Errorf("the password of the user has not been recovered (%v)", err)
+	}
+	if report, err := rebuilt.Check(CheckOptions{}, "testuser"); err != nil {
+		t.Errorf("unable to check the rebuilt database: %v", err)
+	} else if len(report.Problems) != 0 {
+		t.Errorf("the rebuilt database is not consistent: %v", report.Problems)
+	}
+}
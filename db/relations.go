@@ -0,0 +1,261 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kinds of relationship between two tests. Each relationship is read as
+// "source <relation> target", e.g., "15 repeats 12".
+const (
+	RelationRepeats      = "repeats"       // The source is a repetition of the target
+	RelationSupersedes   = "supersedes"    // The source replaces the target, which should not be used
+	RelationReferenceFor = "reference-for" // The source is the baseline used to analyze the target
+	RelationSameSetupAs  = "same-setup-as" // The two tests share the same setup
+	RelationDuplicateOf  = "duplicate-of"  // The source contains the same data as the target
+)
+
+// TestRelationTypes lists all the valid kinds of relationship between tests
+var TestRelationTypes = []string{
+	RelationRepeats,
+	RelationSupersedes,
+	RelationReferenceFor,
+	RelationSameSetupAs,
+	RelationDuplicateOf,
+}
+
+// inverseRelationNames is used to describe a relationship from the point
+// of view of its target
+var inverseRelationNames = map[string]string{
+	RelationRepeats:      "repeated by",
+	RelationSupersedes:   "superseded by",
+	RelationReferenceFor: "uses as reference",
+	RelationSameSetupAs:  "same setup as",
+	RelationDuplicateOf:  "duplicated by",
+}
+
+// TestRelation is a typed, directed edge between two tests
+type TestRelation struct {
+	SourceID     int       // ID of the source test
+	TargetID     int       // ID of the target test
+	Relation     string    // One of the values in TestRelationTypes
+	Username     string    // User that created the relationship
+	CreationDate time.Time // When the relationship was created
+}
+
+// OtherTest returns the ID of the test at the other end of the relationship,
+// as seen from the test with ID "testID"
+func (rel *TestRelation) OtherTest(testID int) int {
+	if rel.SourceID == testID {
+		return rel.TargetID
+	}
+	return rel.SourceID
+}
+
+// Describe returns a description of the relationship from the point of
+// view of the test with ID "testID", e.g., "repeats" or "repeated by".
+func (rel *TestRelation) Describe(testID int) string {
+	if rel.SourceID == testID {
+		return strings.Replace(rel.Relation, "-", " ", -1)
+	}
+	return inverseRelationNames[rel.Relation]
+}
+
+// validateRelation returns an error if "relation" is not one of the
+// TestRelationTypes
+func validateRelation(relation string) error {
+	for _, curRelation := range TestRelationTypes {
+		if relation == curRelation {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown relationship \"%s\" (valid values are %s)",
+		relation, strings.Join(TestRelationTypes, ", "))
+}
+
+// checkTestExists returns an error if there is no test with the given ID
+func checkTestExists(q queryRower, testID int) error {
+	var id int
+	err := q.QueryRow(`select test_id from tests where test_id = ?`, testID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errNotFound("no test with ID=%d", testID)
+	}
+
+	return err
+}
+
+// LinkTests creates a relationship "sourceID <relation> targetID" between
+// two tests. Relationships of type "supersedes" cannot form cycles. The
+// parameter "username" is the name of the user creating the relationship.
+func (conn *Connection) LinkTests(sourceID int, relation string, targetID int, username string) error {
+	return conn.LinkTestsContext(context.Background(), sourceID, relation, targetID, username)
+}
+
+// LinkTestsContext is like LinkTests, but it accepts a context to cancel the operation
+func (conn *Connection) LinkTestsContext(ctx context.Context, sourceID int, relation string, targetID int, username string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := validateRelation(relation); err != nil {
+		return err
+	}
+	if sourceID == targetID {
+		return fmt.Errorf("a test cannot be related with itself")
+	}
+
+	tx, unlock, err := conn.beginWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, curID := range []int{sourceID, targetID} {
+		if err := checkTestExists(tx, curID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if relation == RelationSupersedes {
+		// The new edge would close a cycle if the source can already be
+		// reached by following the "supersedes" chain from the target
+		var found int
+		err := tx.QueryRow(`
+with recursive chain(id) as (
+	select ?
+	union
+	select target_id from test_relations join chain on source_id = chain.id
+	where relation = 'supersedes'
+)
+select count(*) from chain where id = ?`,
+			targetID, sourceID).Scan(&found)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if found > 0 {
+			tx.Rollback()
+			return fmt.Errorf("test %d cannot supersede test %d, as this would create a cycle",
+				sourceID, targetID)
+		}
+	}
+
+	if _, err := tx.Exec(`
+insert into test_relations (source_id, target_id, relation, user_id, creation_date)
+values (?, ?, ?, ?, ?)`,
+		sourceID, targetID, relation, username,
+		time.Now().UTC().Format(time.RFC3339)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	unlock()
+
+	conn.logAction(ctx, username, ActionUpdate, ObjectTest, sourceID,
+		fmt.Sprintf("test %d %s test %d", sourceID, relation, targetID))
+	return nil
+}
+
+// UnlinkTests removes the relationship "sourceID <relation> targetID". The
+// parameter "username" is used only for logging purposes.
+func (conn *Connection) UnlinkTests(sourceID int, relation string, targetID int, username string) error {
+	return conn.UnlinkTestsContext(context.Background(), sourceID, relation, targetID, username)
+}
+
+// UnlinkTestsContext is like UnlinkTests, but it accepts a context to cancel the operation
+func (conn *Connection) UnlinkTestsContext(ctx context.Context, sourceID int, relation string, targetID int, username string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	result, err := conn.execWrite(ctx, `
+delete from test_relations where source_id = ? and target_id = ? and relation = ?`,
+		sourceID, targetID, relation)
+	if err != nil {
+		return err
+	}
+
+	if numOfRows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if numOfRows == 0 {
+		return fmt.Errorf("test %d is not related to test %d by \"%s\"", sourceID, targetID, relation)
+	}
+
+	conn.logAction(ctx, username, ActionUpdate, ObjectTest, sourceID,
+		fmt.Sprintf("relationship \"test %d %s test %d\" has been removed", sourceID, relation, targetID))
+	return nil
+}
+
+// GetTestRelations returns all the relationships involving the test with
+// the given ID, both as a source and as a target.
+func (conn *Connection) GetTestRelations(testID int) ([]TestRelation, error) {
+	return conn.GetTestRelationsContext(context.Background(), testID)
+}
+
+// GetTestRelationsContext is like GetTestRelations, but it accepts a context to cancel the operation
+func (conn *Connection) GetTestRelationsContext(ctx context.Context, testID int) ([]TestRelation, error) {
+	if !conn.Active {
+		return []TestRelation{}, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select source_id, target_id, relation, user_id, creation_date
+from test_relations where source_id = ? or target_id = ?
+order by relation, source_id, target_id`,
+		testID, testID)
+	if err != nil {
+		return []TestRelation{}, err
+	}
+	defer rows.Close()
+
+	result := make([]TestRelation, 0)
+	for rows.Next() {
+		var (
+			curRelation  TestRelation
+			username     sql.NullString
+			creationDate sql.NullString
+		)
+		if err := rows.Scan(&curRelation.SourceID, &curRelation.TargetID, &curRelation.Relation,
+			&username, &creationDate); err != nil {
+			return []TestRelation{}, err
+		}
+
+		curRelation.Username = username.String
+		if creationDate.Valid {
+			if curRelation.CreationDate, err = time.Parse(time.RFC3339, creationDate.String); err != nil {
+				return []TestRelation{}, err
+			}
+		}
+		result = append(result, curRelation)
+	}
+
+	return result, rows.Err()
+}
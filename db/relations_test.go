@@ -0,0 +1,86 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"path"
+	"testing"
+)
+
+func TestRelations(t *testing.T) {
+	conn := createTestDatabase(t, "relations")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 5}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	ids := make([]int, 3)
+	for idx := range ids {
+		var err error
+		ids[idx], err = conn.AddTest(&Test{TestType: "sweep", Polarimeter: 5}, "testuser", inputFilePath)
+		if err != nil {
+			t.Fatalf("unable to add a test: %v", err)
+		}
+	}
+
+	if err := conn.LinkTests(ids[1], RelationRepeats, ids[0], "testuser"); err != nil {
+		t.Errorf("unable to link two tests: %v", err)
+	}
+	if err := conn.LinkTests(ids[2], RelationSupersedes, ids[1], "testuser"); err != nil {
+		t.Errorf("unable to link two tests: %v", err)
+	}
+	if err := conn.LinkTests(ids[1], RelationSupersedes, ids[0], "testuser"); err != nil {
+		t.Errorf("unable to link two tests: %v", err)
+	}
+
+	if err := conn.LinkTests(ids[0], RelationSupersedes, ids[2], "testuser"); err == nil {
+		t.Error("a cycle of \"supersedes\" relationships was not detected")
+	}
+	if err := conn.LinkTests(ids[0], "follows", ids[2], "testuser"); err == nil {
+		t.Error("an invalid relationship was accepted")
+	}
+	if err := conn.LinkTests(ids[0], RelationRepeats, 1000, "testuser"); err == nil {
+		t.Error("a relationship with a nonexistent test was accepted")
+	}
+
+	relations, err := conn.GetTestRelations(ids[1])
+	if err != nil || len(relations) != 3 {
+		t.Fatalf("unexpected result from GetTestRelations: %v (%v)", relations, err)
+	}
+
+	descriptions := make(map[string]int)
+	for _, curRelation := range relations {
+		descriptions[curRelation.Describe(ids[1])] = curRelation.OtherTest(ids[1])
+	}
+	if descriptions["repeats"] != ids[0] || descriptions["superseded by"] != ids[2] ||
+		descriptions["supersedes"] != ids[0] {
+		t.Errorf("wrong descriptions of the relationships: %v", descriptions)
+	}
+
+	if err := conn.UnlinkTests(ids[1], RelationRepeats, ids[0], "testuser"); err != nil {
+		t.Errorf("unable to unlink two tests: %v", err)
+	}
+	if relations, _ := conn.GetTestRelations(ids[0]); len(relations) != 1 {
+		t.Errorf("wrong number of relationships after UnlinkTests: %v", relations)
+	}
+}
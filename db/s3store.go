@@ -0,0 +1,455 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3BlobStore keeps objects in a bucket of a S3-compatible service (Amazon
+// S3, MinIO, Ceph, …). Requests use path-style URLs and are signed using
+// AWS Signature Version 4.
+type S3BlobStore struct {
+	Endpoint  string       // Base URL of the service, e.g., "http://localhost:9000"
+	Bucket    string       // Name of the bucket
+	Prefix    string       // Prepended to every key, e.g., "stdb/"
+	Region    string       // Region used in signatures (e.g., "us-east-1")
+	AccessKey string       // Access key ID
+	SecretKey string       // Secret access key
+	Client    *http.Client // HTTP client used for the requests
+	PartSize  int          // Size of the parts of multipart uploads (see Put)
+}
+
+// s3DefaultPartSize is the default value of S3BlobStore.PartSize. S3
+// requires parts of at least 5 MiB, apart from the last one.
+const s3DefaultPartSize = 8 << 20
+
+// NewS3BlobStore creates a BlobStore that saves objects in "bucket"
+func NewS3BlobStore(endpoint, bucket, region, accessKey, secretKey string) *S3BlobStore {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3BlobStore{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    http.DefaultClient,
+		PartSize:  s3DefaultPartSize,
+	}
+}
+
+// s3EscapePath encodes a path as required by AWS, keeping the slashes
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for idx, curSegment := range segments {
+		segments[idx] = s3Escape(curSegment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3Escape encodes every character but the unreserved ones (RFC 3986)
+func s3Escape(s string) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signRequestV4 adds the headers required by AWS Signature Version 4 to
+// "req". All the headers already set in the request are signed, together
+// with "host". The parameter "payloadHash" is the hex-encoded SHA-256
+// checksum of the body.
+func signRequestV4(req *http.Request, payloadHash string, accessKey string,
+	secretKey string, region string, now time.Time) {
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	shortDate := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for key := range headers {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, curName := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", curName, headers[curName])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	queryParts := make([]string, 0, len(queryKeys))
+	for _, key := range queryKeys {
+		for _, value := range query[key] {
+			queryParts = append(queryParts, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		strings.Join(queryParts, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", shortDate, region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), shortDate)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// do sends a signed request for the object "key" (which can be empty to
+// address the bucket itself)
+func (store *S3BlobStore) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(store.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + store.Bucket
+	if key != "" {
+		u.Path += "/" + store.Prefix + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	if query != nil {
+		u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	payloadHash := sha256.Sum256(body)
+	signRequestV4(req, hex.EncodeToString(payloadHash[:]), store.AccessKey, store.SecretKey,
+		store.Region, time.Now())
+
+	return store.Client.Do(req)
+}
+
+// s3Error converts an unsuccessful response into an error
+func s3Error(resp *http.Response, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrBlobNotFound
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 request for \"%s\" failed with status %s: %s",
+		key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// readPart reads the next part of an upload into "buf". The boolean is true
+// if the end of "r" has been reached.
+func readPart(r io.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	return n, false, err
+}
+
+// Put implements BlobStore. Since the signature requires the checksum of
+// the payload, objects are read in memory one part at a time: objects
+// larger than PartSize are sent using a multipart upload, so that the
+// memory used does not depend on the size of the object.
+func (store *S3BlobStore) Put(key string, r io.Reader) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+
+	partSize := store.PartSize
+	if partSize <= 0 {
+		partSize = s3DefaultPartSize
+	}
+	buf := make([]byte, partSize)
+	n, last, err := readPart(r, buf)
+	if err != nil {
+		return err
+	}
+	if last {
+		return store.putObject(key, nil, buf[:n], nil)
+	}
+
+	return store.putMultipart(key, r, buf, n)
+}
+
+// putObject sends a PUT request and returns the ETag of the object
+func (store *S3BlobStore) putObject(key string, query url.Values, body []byte, etag *string) error {
+	resp, err := store.do(http.MethodPut, key, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	if etag != nil {
+		*etag = resp.Header.Get("ETag")
+	}
+	return nil
+}
+
+// s3CompletedPart is an element of a CompleteMultipartUpload request
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads "r" in parts. The first part, of length "n", has
+// already been read in "buf". The upload is aborted if an error occurs, so
+// that the service does not keep the parts.
+func (store *S3BlobStore) putMultipart(key string, r io.Reader, buf []byte, n int) error {
+	resp, err := store.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = s3Error(resp, key)
+	} else {
+		err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	uploadQuery := url.Values{"uploadId": {initiate.UploadID}}
+	abort := func(err error) error {
+		if resp, abortErr := store.do(http.MethodDelete, key, uploadQuery, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	var parts []s3CompletedPart
+	for last := false; ; {
+		curPart := s3CompletedPart{PartNumber: len(parts) + 1}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(curPart.PartNumber)},
+			"uploadId":   {initiate.UploadID},
+		}
+		if err := store.putObject(key, query, buf[:n], &curPart.ETag); err != nil {
+			return abort(err)
+		}
+		parts = append(parts, curPart)
+
+		if last {
+			break
+		}
+		if n, last, err = readPart(r, buf); err != nil {
+			return abort(err)
+		}
+		if last && n == 0 {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = store.do(http.MethodPost, key, uploadQuery, body)
+	if err != nil {
+		return abort(err)
+	}
+	defer resp.Body.Close()
+
+	// Errors can be reported after a "200 OK" status, as the service sends
+	// the status before having assembled the object
+	result, err := ioutil.ReadAll(resp.Body)
+	if err == nil && (resp.StatusCode != http.StatusOK || bytes.Contains(result, []byte("<Error>"))) {
+		err = fmt.Errorf("unable to complete the upload of \"%s\" (status %s): %s",
+			key, resp.Status, strings.TrimSpace(string(result)))
+	}
+	if err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+// Get implements BlobStore
+func (store *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := store.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp, key)
+	}
+	return resp.Body, nil
+}
+
+// Stat implements BlobStore
+func (store *S3BlobStore) Stat(key string) (BlobInfo, error) {
+	resp, err := store.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return BlobInfo{}, s3Error(resp, key)
+	}
+
+	info := BlobInfo{Key: key}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+// Delete implements BlobStore. S3 does not report whether the object
+// existed, so the object is looked for before being deleted.
+func (store *S3BlobStore) Delete(key string) error {
+	if _, err := store.Stat(key); err != nil {
+		return err
+	}
+
+	resp, err := store.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	return nil
+}
+
+// s3ListResult is the response to a ListObjectsV2 request
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List implements BlobStore
+func (store *S3BlobStore) List(prefix string) ([]BlobInfo, error) {
+	result := make([]BlobInfo, 0)
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", store.Prefix+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := store.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var list s3ListResult
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp, prefix)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&list)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, curObject := range list.Contents {
+			result = append(result, BlobInfo{
+				Key:     strings.TrimPrefix(curObject.Key, store.Prefix),
+				Size:    curObject.Size,
+				ModTime: curObject.LastModified,
+			})
+		}
+
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
@@ -0,0 +1,530 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/astrogo/fitsio"
+)
+
+// DataColumn contains the values of one column of the data of a test,
+// read by ReadTestColumns
+type DataColumn struct {
+	Name   string      `json:"name"`
+	Unit   string      `json:"unit"`
+	Values interface{} `json:"values"` // Slice with the type of the column, e.g., []float32
+}
+
+// Len returns the number of values in the column
+func (col *DataColumn) Len() int {
+	if col.Values == nil {
+		return 0
+	}
+	return reflect.ValueOf(col.Values).Len()
+}
+
+// jsonColumn has the same fields as DataColumn, but not its methods
+type jsonColumn DataColumn
+
+// MarshalJSON encodes the column as the default encoder would do, but NaNs
+// and infinities, which JSON cannot represent, become null
+func (col DataColumn) MarshalJSON() ([]byte, error) {
+	encoded := jsonColumn(col)
+
+	slice := reflect.ValueOf(col.Values)
+	if col.Values != nil && slice.Kind() == reflect.Slice {
+		switch slice.Type().Elem().Kind() {
+		case reflect.Float32, reflect.Float64:
+			for idx := 0; idx < slice.Len(); idx++ {
+				if value := slice.Index(idx).Float(); math.IsNaN(value) || math.IsInf(value, 0) {
+					encoded.Values = finiteOrNull(slice)
+					break
+				}
+			}
+		}
+	}
+
+	return json.Marshal(encoded)
+}
+
+// finiteOrNull copies a slice of floating-point numbers, replacing NaNs
+// and infinities with nil
+func finiteOrNull(slice reflect.Value) []interface{} {
+	result := make([]interface{}, slice.Len())
+	for idx := range result {
+		value := slice.Index(idx)
+		if x := value.Float(); !math.IsNaN(x) && !math.IsInf(x, 0) {
+			result[idx] = value.Interface()
+		}
+	}
+	return result
+}
+
+// Float64s returns the values of a numeric column converted to float64
+func (col *DataColumn) Float64s() ([]float64, error) {
+	if values, ok := col.Values.([]float64); ok {
+		return values, nil
+	}
+
+	slice := reflect.ValueOf(col.Values)
+	result := make([]float64, col.Len())
+	for idx := range result {
+		value, err := toFloat64(slice.Index(idx))
+		if err != nil {
+			return nil, fmt.Errorf("column \"%s\": %v", col.Name, err)
+		}
+		result[idx] = value
+	}
+	return result, nil
+}
+
+// toFloat64 converts a numeric value to float64
+func toFloat64(value reflect.Value) (float64, error) {
+	switch value.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), nil
+	}
+	return 0, fmt.Errorf("values of type %s are not numbers", value.Type())
+}
+
+// uncompressFits uncompresses the FITS file read from "r" into a
+// temporary file, whose name is returned, as astrogo/fitsio cannot read
+// gzipped streams. The caller must remove the file.
+func uncompressFits(r io.Reader) (string, error) {
+	tmpFile, err := ioutil.TempFile("", "stdb-fits-")
+	if err != nil {
+		return "", err
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err == nil {
+		_, err = io.Copy(tmpFile, zr)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// openFitsFile opens an uncompressed FITS file. The function returned
+// together with the file closes it.
+func openFitsFile(fileName string) (*fitsio.File, func(), error) {
+	r, err := os.Open(fileName)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	f, err := fitsio.Open(r)
+	if err != nil {
+		r.Close()
+		return nil, func() {}, err
+	}
+
+	return f, func() {
+		f.Close()
+		r.Close()
+	}, nil
+}
+
+// openFitsStream uncompresses the FITS file read from "r" into a temporary
+// file and opens it. The function returned together with the file closes
+// it and removes the temporary copy.
+func openFitsStream(r io.Reader) (*fitsio.File, func(), error) {
+	noop := func() {}
+
+	fileName, err := uncompressFits(r)
+	if err != nil {
+		return nil, noop, err
+	}
+
+	f, closeFile, err := openFitsFile(fileName)
+	if err != nil {
+		os.Remove(fileName)
+		return nil, noop, err
+	}
+
+	return f, func() {
+		closeFile()
+		os.Remove(fileName)
+	}, nil
+}
+
+// maxUncompressedFiles is the number of uncompressed FITS files kept by
+// each Connection, so that reading the data of a test in chunks (as the
+// web interface does) does not uncompress the file every time
+const maxUncompressedFiles = 4
+
+// uncompressedFile is a temporary copy of one of the FITS files in the
+// BlobStore
+type uncompressedFile struct {
+	key      string
+	fileName string
+	users    int  // Number of DataRows reading the file
+	evicted  bool // Remove the file as soon as it is no longer used
+}
+
+// uncompressedCache keeps the most recently used uncompressed files
+type uncompressedCache struct {
+	mutex sync.Mutex
+	files []*uncompressedFile // From the least to the most recently used
+}
+
+// evict removes the file at position "idx" from the cache. The caller must
+// hold the mutex.
+func (cache *uncompressedCache) evict(idx int) {
+	entry := cache.files[idx]
+	cache.files = append(cache.files[:idx], cache.files[idx+1:]...)
+	entry.evicted = true
+	if entry.users == 0 {
+		os.Remove(entry.fileName)
+	}
+}
+
+// get returns the file with key "key", or nil if it is not in the cache.
+// The file must be released once it is no longer used.
+func (cache *uncompressedCache) get(key string) *uncompressedFile {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for idx, curFile := range cache.files {
+		if curFile.key == key {
+			cache.files = append(append(cache.files[:idx], cache.files[idx+1:]...), curFile)
+			curFile.users++
+			return curFile
+		}
+	}
+	return nil
+}
+
+// add puts a new file in the cache, evicting the least recently used ones,
+// and returns it. If a file with the same key has been added in the
+// meantime, the new one is removed and the other is returned. In both
+// cases, the file must be released once it is no longer used.
+func (cache *uncompressedCache) add(key string, fileName string) *uncompressedFile {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for _, curFile := range cache.files {
+		if curFile.key == key {
+			os.Remove(fileName)
+			curFile.users++
+			return curFile
+		}
+	}
+
+	entry := &uncompressedFile{key: key, fileName: fileName, users: 1}
+	cache.files = append(cache.files, entry)
+	for len(cache.files) > maxUncompressedFiles {
+		cache.evict(0)
+	}
+	return entry
+}
+
+// release tells the cache that the caller no longer uses "entry"
+func (cache *uncompressedCache) release(entry *uncompressedFile) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry.users--
+	if entry.evicted && entry.users == 0 {
+		os.Remove(entry.fileName)
+	}
+}
+
+// clear evicts all the files from the cache
+func (cache *uncompressedCache) clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for len(cache.files) > 0 {
+		cache.evict(0)
+	}
+}
+
+// dataTable returns the first table HDU of a FITS file
+func dataTable(f *fitsio.File) (*fitsio.Table, error) {
+	for _, curHDU := range f.HDUs() {
+		if table, ok := curHDU.(*fitsio.Table); ok {
+			return table, nil
+		}
+	}
+	return nil, fmt.Errorf("no table HDU found in the FITS file")
+}
+
+// DataRows iterates over the rows of the data of a test, like sql.Rows.
+// Use Connection.OpenTestRows to create it, and call Close when done.
+type DataRows struct {
+	columns []fitsio.Column
+	indices []int         // Indices of the selected columns in the table
+	targets []interface{} // Pointers to the values of all the columns of the current row
+	rows    *fitsio.Rows
+	closeFn func()
+	row     int
+	err     error
+}
+
+// Columns returns the name of the selected columns
+func (r *DataRows) Columns() []string {
+	result := make([]string, len(r.indices))
+	for idx, colIdx := range r.indices {
+		result[idx] = r.columns[colIdx].Name
+	}
+	return result
+}
+
+// Next reads the next row, and returns false when there are no more rows
+// or an error occurred (see Err)
+func (r *DataRows) Next() bool {
+	if r.err != nil || !r.rows.Next() {
+		return false
+	}
+
+	if r.err = r.rows.Scan(r.targets...); r.err != nil {
+		return false
+	}
+	r.row++
+	return true
+}
+
+// Row returns the index of the current row, starting from zero
+func (r *DataRows) Row() int {
+	return r.row
+}
+
+// Values returns the values of the selected columns in the current row
+func (r *DataRows) Values() []interface{} {
+	result := make([]interface{}, len(r.indices))
+	for idx, colIdx := range r.indices {
+		result[idx] = reflect.ValueOf(r.targets[colIdx]).Elem().Interface()
+	}
+	return result
+}
+
+// Scan copies the values of the selected columns in the current row into
+// "dest", which must contain one pointer per column. Pointers must be
+// either of the same type as the column, *float64 for numeric columns, or
+// *interface{}.
+func (r *DataRows) Scan(dest ...interface{}) error {
+	if len(dest) != len(r.indices) {
+		return fmt.Errorf("%d values expected by Scan, got %d", len(r.indices), len(dest))
+	}
+
+	for idx, colIdx := range r.indices {
+		value := reflect.ValueOf(r.targets[colIdx]).Elem()
+		switch target := dest[idx].(type) {
+		case *interface{}:
+			*target = value.Interface()
+		case *float64:
+			var err error
+			if *target, err = toFloat64(value); err != nil {
+				return fmt.Errorf("column \"%s\": %v", r.columns[colIdx].Name, err)
+			}
+		default:
+			targetValue := reflect.ValueOf(dest[idx])
+			if targetValue.Kind() != reflect.Ptr || targetValue.Elem().Type() != value.Type() {
+				return fmt.Errorf("column \"%s\" contains values of type %s, cannot scan them into %T",
+					r.columns[colIdx].Name, value.Type(), dest[idx])
+			}
+			targetValue.Elem().Set(value)
+		}
+	}
+	return nil
+}
+
+// Err returns the error that stopped the iteration, if any
+func (r *DataRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.rows.Err()
+}
+
+// Close releases the resources used by the iterator
+func (r *DataRows) Close() error {
+	err := r.rows.Close()
+	r.closeFn()
+	return err
+}
+
+// OpenTestRows returns an iterator over the rows of the latest version of
+// the data of a test, from "rowStart" (included) to "rowEnd" (excluded).
+// A negative "rowEnd" means the end of the table. Only the columns whose
+// names are in "columns" are returned, in the same order; if "columns" is
+// empty, all the columns are returned. Since FITS files are compressed,
+// the whole file is first uncompressed in a temporary file; the most
+// recently used ones are kept until the connection is closed, so that
+// reading a file in chunks is fast. Rows are then read one at a time.
+func (conn *Connection) OpenTestRows(testID int, columns []string, rowStart int, rowEnd int) (*DataRows, error) {
+	return conn.OpenTestRowsContext(context.Background(), testID, columns, rowStart, rowEnd)
+}
+
+// OpenTestRowsContext is like OpenTestRows, but it accepts a context to cancel the operation
+func (conn *Connection) OpenTestRowsContext(ctx context.Context, testID int, columns []string,
+	rowStart int, rowEnd int) (*DataRows, error) {
+	if !conn.Active {
+		return nil, ErrInactive
+	}
+
+	var dataVersion DataVersion
+	if err := resolveTestData(conn.withContext(ctx), testID, 0, &dataVersion); err != nil {
+		return nil, err
+	}
+
+	entry := conn.uncompressed.get(dataVersion.Key)
+	if entry == nil {
+		r, err := conn.openDataVersion(&dataVersion)
+		if err != nil {
+			return nil, err
+		}
+		fileName, err := uncompressFits(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the FITS file of test %d: %v", testID, err)
+		}
+		entry = conn.uncompressed.add(dataVersion.Key, fileName)
+	}
+
+	f, closeFile, err := openFitsFile(entry.fileName)
+	if err != nil {
+		conn.uncompressed.release(entry)
+		return nil, fmt.Errorf("unable to read the FITS file of test %d: %v", testID, err)
+	}
+
+	result, err := newDataRows(f, columns, rowStart, rowEnd)
+	if err != nil {
+		closeFile()
+		conn.uncompressed.release(entry)
+		return nil, err
+	}
+	result.closeFn = func() {
+		closeFile()
+		conn.uncompressed.release(entry)
+	}
+	return result, nil
+}
+
+// newDataRows creates an iterator over the rows of the first table in "f"
+func newDataRows(f *fitsio.File, columns []string, rowStart int, rowEnd int) (*DataRows, error) {
+	table, err := dataTable(f)
+	if err != nil {
+		return nil, err
+	}
+
+	result := DataRows{
+		columns: table.Cols(),
+		row:     rowStart - 1,
+	}
+
+	if len(columns) == 0 {
+		for idx := range result.columns {
+			result.indices = append(result.indices, idx)
+		}
+	} else {
+		for _, name := range columns {
+			colIdx := table.Index(name)
+			if colIdx < 0 {
+				return nil, errNotFound("no column \"%s\" in the data", name)
+			}
+			result.indices = append(result.indices, colIdx)
+		}
+	}
+
+	result.targets = make([]interface{}, len(result.columns))
+	for idx := range result.columns {
+		result.targets[idx] = reflect.New(result.columns[idx].Type()).Interface()
+	}
+
+	numOfRows := int(table.NumRows())
+	if rowEnd < 0 || rowEnd > numOfRows {
+		rowEnd = numOfRows
+	}
+	if rowStart < 0 || rowStart > rowEnd {
+		return nil, fmt.Errorf("%w [%d, %d), the table has %d rows",
+			ErrInvalidRange, rowStart, rowEnd, numOfRows)
+	}
+
+	if result.rows, err = table.Read(int64(rowStart), int64(rowEnd)); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ReadTestColumns returns the values of some columns of the latest version
+// of the data of a test, from row "rowStart" (included) to "rowEnd"
+// (excluded). See OpenTestRows for the meaning of the parameters. Each
+// column is returned as a slice of the type used in the FITS file.
+func (conn *Connection) ReadTestColumns(testID int, columns []string, rowStart int, rowEnd int) ([]DataColumn, error) {
+	return conn.ReadTestColumnsContext(context.Background(), testID, columns, rowStart, rowEnd)
+}
+
+// ReadTestColumnsContext is like ReadTestColumns, but it accepts a context to cancel the operation
+func (conn *Connection) ReadTestColumnsContext(ctx context.Context, testID int, columns []string,
+	rowStart int, rowEnd int) ([]DataColumn, error) {
+	rows, err := conn.OpenTestRowsContext(ctx, testID, columns, rowStart, rowEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]DataColumn, len(rows.indices))
+	slices := make([]reflect.Value, len(rows.indices))
+	for idx, colIdx := range rows.indices {
+		col := rows.columns[colIdx]
+		result[idx].Name = col.Name
+		result[idx].Unit = col.Unit
+		slices[idx] = reflect.MakeSlice(reflect.SliceOf(col.Type()), 0, 0)
+	}
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for idx, colIdx := range rows.indices {
+			slices[idx] = reflect.Append(slices[idx], reflect.ValueOf(rows.targets[colIdx]).Elem())
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for idx := range result {
+		result[idx].Values = slices[idx].Interface()
+	}
+	return result, nil
+}
@@ -0,0 +1,173 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestReadTestColumns(t *testing.T) {
+	conn := createTestDatabase(t, "samples")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 9}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	test := Test{TestType: "sweep", Polarimeter: 9}
+	testID, err := conn.AddTest(&test, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+
+	allColumns, err := conn.ReadTestColumns(testID, nil, 0, -1)
+	if err != nil {
+		t.Fatalf("unable to read the data of test %d: %v", testID, err)
+	}
+	if len(allColumns) != 4 || allColumns[0].Name != "EmitterI" || allColumns[3].Name != "BaseV" {
+		t.Fatalf("wrong columns: %v", allColumns)
+	}
+	if allColumns[3].Len() != test.NumOfSamples || allColumns[3].Unit != "V" {
+		t.Errorf("wrong column \"BaseV\": %d samples, unit \"%s\"", allColumns[3].Len(), allColumns[3].Unit)
+	}
+	if _, ok := allColumns[3].Values.([]float32); !ok {
+		t.Errorf("wrong type for the values of a column: %T", allColumns[3].Values)
+	}
+
+	columns, err := conn.ReadTestColumns(testID, []string{"BaseV", "EmitterV"}, 1, 3)
+	if err != nil {
+		t.Fatalf("unable to read a range of the data of test %d: %v", testID, err)
+	}
+	if len(columns) != 2 || columns[0].Name != "BaseV" || columns[0].Len() != 2 {
+		t.Fatalf("wrong columns: %v", columns)
+	}
+	baseV, err := columns[0].Float64s()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullBaseV, _ := allColumns[3].Float64s()
+	if baseV[0] != fullBaseV[1] || baseV[1] != fullBaseV[2] {
+		t.Errorf("wrong values in the range: %v", baseV)
+	}
+
+	// Iterate over the last rows
+	rows, err := conn.OpenTestRows(testID, []string{"BaseV"}, test.NumOfSamples-2, -1)
+	if err != nil {
+		t.Fatalf("unable to iterate over the rows of test %d: %v", testID, err)
+	}
+	var values []float64
+	for rows.Next() {
+		var value float64
+		if err := rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		if rows.Row() != test.NumOfSamples-2+len(values) {
+			t.Errorf("wrong row number %d", rows.Row())
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		t.Error(err)
+	}
+	rows.Close()
+	if len(values) != 2 || math.Abs(values[1]-0.7755449) > 1e-6 {
+		t.Errorf("wrong values for the last rows: %v", values)
+	}
+
+	if _, err := conn.ReadTestColumns(testID, []string{"Foo"}, 0, -1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for a missing column: %v", err)
+	}
+	if _, err := conn.ReadTestColumns(testID, nil, 10, 5); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("wrong error for an invalid range of rows: %v", err)
+	}
+
+	// The file has been uncompressed only once
+	if len(conn.uncompressed.files) != 1 || conn.uncompressed.files[0].users != 0 {
+		t.Fatalf("wrong cache of uncompressed files: %v", conn.uncompressed.files)
+	}
+	cachedFile := conn.uncompressed.files[0].fileName
+	conn.Disconnect()
+	if _, err := os.Stat(cachedFile); !os.IsNotExist(err) {
+		t.Errorf("uncompressed file \"%s\" has not been removed: %v", cachedFile, err)
+	}
+}
+
+func TestUncompressedCache(t *testing.T) {
+	var cache uncompressedCache
+	var entries []*uncompressedFile
+	for idx := 0; idx <= maxUncompressedFiles; idx++ {
+		f, err := ioutil.TempFile("", "stdb-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		entries = append(entries, cache.add(strconv.Itoa(idx), f.Name()))
+	}
+
+	// The first file is still in use, so it must not be removed yet
+	if cache.get("0") != nil || len(cache.files) != maxUncompressedFiles {
+		t.Fatalf("the least recently used file has not been evicted: %v", cache.files)
+	}
+	if _, err := os.Stat(entries[0].fileName); err != nil {
+		t.Errorf("a file in use has been removed: %v", err)
+	}
+	cache.release(entries[0])
+	if _, err := os.Stat(entries[0].fileName); !os.IsNotExist(err) {
+		t.Errorf("an evicted file has not been removed: %v", err)
+	}
+
+	if entry := cache.get("1"); entry != entries[1] || entry.users != 2 {
+		t.Errorf("wrong entry returned by the cache: %v", entry)
+	}
+	for _, curEntry := range entries[1:] {
+		cache.release(curEntry)
+	}
+	cache.release(entries[1])
+	cache.clear()
+	for _, curEntry := range entries {
+		if _, err := os.Stat(curEntry.fileName); !os.IsNotExist(err) {
+			t.Errorf("file \"%s\" has not been removed: %v", curEntry.fileName, err)
+		}
+	}
+}
+
+func TestDataColumnJSON(t *testing.T) {
+	col := DataColumn{Name: "BaseV", Unit: "V", Values: []float32{1.5, float32(math.NaN()), float32(math.Inf(1))}}
+	data, err := json.Marshal(col)
+	if err != nil {
+		t.Fatalf("unable to encode a column with NaNs: %v", err)
+	}
+	if string(data) != `{"name":"BaseV","unit":"V","values":[1.5,null,null]}` {
+		t.Errorf("wrong encoding of a column with NaNs: %s", data)
+	}
+
+	data, err = json.Marshal([]DataColumn{{Name: "n", Values: []int16{1, 2}}})
+	if err != nil || string(data) != `[{"name":"n","unit":"","values":[1,2]}]` {
+		t.Errorf("wrong encoding of an integer column: %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// comparisonOperators lists the operators accepted in conditions. Longer
+// operators must come first, so that ">=" is not parsed as ">".
+var comparisonOperators = []string{">=", "<=", "!=", "==", "=", ">", "<"}
+
+// isComparisonOperator returns true if "op" can be used in a SQL condition
+func isComparisonOperator(op string) bool {
+	for _, curOp := range comparisonOperators {
+		if op == curOp {
+			return true
+		}
+	}
+	return false
+}
+
+// ParameterCondition is a condition on the value of a test parameter, e.g.,
+// "vdrain > 0.5 V"
+type ParameterCondition struct {
+	Operator  string        // One among "=", "!=", "<", "<=", ">", ">="
+	Reference TestParameter // Name of the parameter and value to compare with
+}
+
+// ParseParameterCondition interprets a string like "vdrain>0.5V" or
+// "lna=on" as a condition on a parameter. Operators "<", "<=", ">" and ">="
+// can only be used with numbers. If a unit is specified, it must match the
+// unit of the parameter, apart from SI prefixes ("vdrain>500mV" matches a
+// parameter equal to 0.8 V); otherwise, only parameters without a unit
+// match.
+func ParseParameterCondition(s string) (ParameterCondition, error) {
+	var cond ParameterCondition
+
+	for _, curOp := range comparisonOperators {
+		idx := strings.Index(s, curOp)
+		if idx < 0 {
+			continue
+		}
+
+		name, err := normalizeParameterName(s[:idx])
+		if err != nil {
+			return cond, err
+		}
+
+		cond.Operator = curOp
+		if cond.Operator == "==" {
+			cond.Operator = "="
+		}
+		cond.Reference.Name = name
+		parseParameterValue(s[idx+len(curOp):], &cond.Reference)
+
+		if cond.Reference.Kind != ParameterNumber && cond.Operator != "=" && cond.Operator != "!=" {
+			return cond, fmt.Errorf("operator \"%s\" can only be used with numbers in \"%s\"",
+				cond.Operator, s)
+		}
+
+		return cond, nil
+	}
+
+	return cond, fmt.Errorf("no comparison operator found in \"%s\"", s)
+}
+
+// sqlCondition returns a SQL expression that can be used in the "where"
+// clause of a query on the "tests" table, together with its arguments
+func (cond *ParameterCondition) sqlCondition() (string, []interface{}) {
+	args := []interface{}{cond.Reference.Name}
+	expr := `exists (select 1 from test_parameters p
+where p.test_id = tests.test_id and p.name = ? and p.kind = ?`
+
+	switch cond.Reference.Kind {
+	case ParameterNumber:
+		if cond.Reference.Unit != "" {
+			// Units are compared without SI prefixes, so that "800 mV"
+			// matches "vdrain>=0.5V"
+			value, unit := normalizeUnit(cond.Reference.Number, cond.Reference.Unit)
+			args = append(args, ParameterNumber, value, unit)
+			expr += fmt.Sprintf(" and p.base_value %s ? and p.base_unit = ?", cond.Operator)
+		} else {
+			// Values measured in some unit cannot be compared with a pure number
+			args = append(args, ParameterNumber, cond.Reference.Number)
+			expr += fmt.Sprintf(" and p.num_value %s ? and p.unit is null", cond.Operator)
+		}
+	case ParameterBool:
+		var value float64
+		if cond.Reference.Bool {
+			value = 1.0
+		}
+		args = append(args, ParameterBool, value)
+		expr += fmt.Sprintf(" and p.num_value %s ?", cond.Operator)
+	default:
+		args = append(args, ParameterString, cond.Reference.String)
+		expr += fmt.Sprintf(" and p.str_value %s ?", cond.Operator)
+	}
+
+	return expr + ")", args
+}
+
+// SearchQuery specifies the conditions used by SearchTests. All the
+// conditions must be satisfied at the same time; zero values mean that
+// the corresponding condition is not used.
+type SearchQuery struct {
+	Text         string               // Text to look for in the short name, description and comments
+	TestType     string               // Code (or alias) of the test type
+	Polarimeter  int                  // Number of the polarimeter
+	CampaignID   int                  // ID of the campaign
+	CampaignName string               // Name of the campaign (used only if CampaignID is zero)
+	Parameters   []ParameterCondition // Conditions on the parameters of the test
+	Columns      []ColumnCondition    // Conditions on the statistics of the columns of the data
+}
+
+// whereClause builds the "where" clause of a query on the "tests" table
+// that implements the search, and returns it together with its arguments
+func (query *SearchQuery) whereClause(q queryRower) (string, []interface{}, error) {
+	conditions := []string{"1"}
+	args := []interface{}{}
+
+	if query.Text != "" {
+		pattern := "%" + query.Text + "%"
+		conditions = append(conditions, `(short_name like ? or description like ? or exists (
+select 1 from test_comments c where c.test_id = tests.test_id and c.body like ?))`)
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	if query.TestType != "" {
+		var tt TestType
+		if err := resolveTestType(q, query.TestType, &tt); err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, "type = ?")
+		args = append(args, tt.Code)
+	}
+
+	if query.Polarimeter != 0 {
+		conditions = append(conditions, "polarimeter = ?")
+		args = append(args, query.Polarimeter)
+	}
+
+	if query.CampaignID != 0 {
+		conditions = append(conditions, "campaign_id = ?")
+		args = append(args, query.CampaignID)
+	} else if query.CampaignName != "" {
+		var campaignID int
+		err := q.QueryRow(`select campaign_id from campaigns where name = ?`, query.CampaignName).Scan(&campaignID)
+		if err == sql.ErrNoRows {
+			return "", nil, errNotFound("no campaign named \"%s\"", query.CampaignName)
+		} else if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, "campaign_id = ?")
+		args = append(args, campaignID)
+	}
+
+	for _, curCond := range query.Parameters {
+		expr, exprArgs := curCond.sqlCondition()
+		conditions = append(conditions, expr)
+		args = append(args, exprArgs...)
+	}
+
+	for _, curCond := range query.Columns {
+		expr, exprArgs, err := curCond.sqlCondition()
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, expr)
+		args = append(args, exprArgs...)
+	}
+
+	return strings.Join(conditions, " and "), args, nil
+}
+
+// SearchTests returns the IDs of the tests matching "query", from the most
+// recent to the most ancient one. If maxNum is positive, it specifies the
+// maximum number of IDs to retrieve. The parameter "username" is used only
+// for logging purposes.
+func (conn *Connection) SearchTests(query SearchQuery, username string, maxNum int) ([]int, error) {
+	return conn.SearchTestsContext(context.Background(), query, username, maxNum)
+}
+
+// SearchTestsContext is like SearchTests, but it accepts a context to cancel the operation
+func (conn *Connection) SearchTestsContext(ctx context.Context, query SearchQuery, username string, maxNum int) ([]int, error) {
+	if !conn.Active {
+		return []int{}, ErrInactive
+	}
+
+	where, args, err := query.whereClause(conn.withContext(ctx))
+	if err != nil {
+		return []int{}, err
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select test_id from tests where `+where+` order by test_id desc limit ?`,
+		append(args, maxNum)...)
+	if err != nil {
+		return []int{}, err
+	}
+	defer rows.Close()
+
+	result := make([]int, 0)
+	for rows.Next() {
+		var curID int64
+		if err := rows.Scan(&curID); err != nil {
+			return []int{}, err
+		}
+		result = append(result, int(curID))
+	}
+	if err := rows.Err(); err != nil {
+		return []int{}, err
+	}
+
+	conn.logAction(ctx, username, ActionRead, ObjectTest, "",
+		fmt.Sprintf("searching the database, %d results returned (maxNum=%d)", len(result), maxNum))
+	return result, nil
+}
@@ -0,0 +1,164 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+)
+
+// DiskUsage is the space used by a set of files
+type DiskUsage struct {
+	NumOfFiles int   // Number of files
+	Bytes      int64 // Sum of the sizes of the files
+}
+
+// DatabaseStats contains aggregated information about all the tests in
+// the database
+type DatabaseStats struct {
+	NumOfTests     int            // Number of tests in the database
+	ByPolarimeter  map[int]int    // Number of tests for each polarimeter
+	ByTestType     map[string]int // Number of tests for each test type
+	ByUploader     map[string]int // Number of tests uploaded by each user
+	ByMonth        map[string]int // Number of tests acquired in each month ("2017-05")
+	CryogenicTests int            // Number of tests done at cryogenic temperatures
+	WarmTests      int            // Number of tests done at room temperature
+	TotalSamples   int64          // Number of samples acquired in all the tests
+	TotalHours     float64        // Sum of the length of all the tests, in hours
+
+	FitsFiles   DiskUsage // FITS files, including old versions of the data
+	Attachments DiskUsage // Attachments of the tests
+}
+
+// countTestsBy counts the tests for each value of the SQL expression
+// "expr" and calls "add" for each of them
+func countTestsBy(q queryer, expr string, add func(key string, count int) error) error {
+	rows, err := q.Query(`select ` + expr + `, count(*) from tests group by 1`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			key   sql.NullString
+			count int
+		)
+		if err := rows.Scan(&key, &count); err != nil {
+			return err
+		}
+		if err := add(key.String, count); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// blobDiskUsage returns the space used by the objects of "store" whose key
+// begins with "prefix"
+func blobDiskUsage(store BlobStore, prefix string) (DiskUsage, error) {
+	var usage DiskUsage
+	blobs, err := store.List(prefix)
+	if err != nil {
+		return usage, err
+	}
+
+	for _, curBlob := range blobs {
+		usage.NumOfFiles++
+		usage.Bytes += curBlob.Size
+	}
+	return usage, nil
+}
+
+// Stats computes aggregated information about the tests in the database
+// and the space used by their files. Listing the files can be slow if the
+// BlobStore is remote.
+func (conn *Connection) Stats() (DatabaseStats, error) {
+	return conn.StatsContext(context.Background())
+}
+
+// StatsContext is like Stats, but it accepts a context to cancel the operation
+func (conn *Connection) StatsContext(ctx context.Context) (DatabaseStats, error) {
+	stats := DatabaseStats{
+		ByPolarimeter: make(map[int]int),
+		ByTestType:    make(map[string]int),
+		ByUploader:    make(map[string]int),
+		ByMonth:       make(map[string]int),
+	}
+
+	if !conn.Active {
+		return stats, ErrInactive
+	}
+
+	q := conn.withContext(ctx)
+
+	var (
+		cryoTests    sql.NullInt64
+		totalSamples sql.NullInt64
+		totalSeconds sql.NullFloat64
+	)
+	if err := q.QueryRow(`
+select count(*), sum(is_cryogenic), sum(num_of_samples), sum(time_span_sec) from tests`).Scan(
+		&stats.NumOfTests, &cryoTests, &totalSamples, &totalSeconds); err != nil {
+		return stats, err
+	}
+	stats.CryogenicTests = int(cryoTests.Int64)
+	stats.WarmTests = stats.NumOfTests - stats.CryogenicTests
+	stats.TotalSamples = totalSamples.Int64
+	stats.TotalHours = totalSeconds.Float64 / 3600.0
+
+	if err := countTestsBy(q, "polarimeter", func(key string, count int) error {
+		number, err := strconv.Atoi(key)
+		stats.ByPolarimeter[number] = count
+		return err
+	}); err != nil {
+		return stats, err
+	}
+
+	for _, cur := range []struct {
+		expr   string
+		result map[string]int
+	}{
+		{"type", stats.ByTestType},
+		{"user_id", stats.ByUploader},
+		{"substr(creation_date, 1, 7)", stats.ByMonth},
+	} {
+		result := cur.result
+		if err := countTestsBy(q, cur.expr, func(key string, count int) error {
+			result[key] = count
+			return nil
+		}); err != nil {
+			return stats, err
+		}
+	}
+
+	var err error
+	if stats.FitsFiles, err = blobDiskUsage(conn.Blobs, dataFolderName+"/"); err != nil {
+		return stats, err
+	}
+	if stats.Attachments, err = blobDiskUsage(conn.Blobs, attachmentsFolderName+"/"); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
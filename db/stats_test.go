@@ -0,0 +1,83 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	conn := createTestDatabase(t, "stats")
+	defer conn.Disconnect()
+
+	if stats, err := conn.Stats(); err != nil || stats.NumOfTests != 0 || stats.FitsFiles.NumOfFiles != 0 {
+		t.Errorf("wrong statistics for an empty database: %v (%v)", stats, err)
+	}
+
+	for _, pol := range []int{7, 8} {
+		if err := conn.AddPolarimeter(&Polarimeter{Number: pol}, "testuser"); err != nil {
+			t.Fatalf("unable to register a new polarimeter: %v", err)
+		}
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	var totalSamples int64
+	var month string
+	for idx, pol := range []int{7, 7, 8} {
+		test := Test{ShortName: "test", TestType: "sweep", Polarimeter: pol, CryogenicFlag: idx == 0}
+		if _, err := conn.AddTest(&test, "testuser", inputFilePath); err != nil {
+			t.Fatalf("unable to add a test: %v", err)
+		}
+		totalSamples += int64(test.NumOfSamples)
+		month = test.CreationDate.Format("2006-01")
+	}
+
+	if _, err := conn.AddAttachment(1, inputFilePath, "testuser"); err != nil {
+		t.Fatalf("unable to add an attachment: %v", err)
+	}
+	info, err := os.Stat(inputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := conn.Stats()
+	if err != nil {
+		t.Fatalf("unable to compute the statistics: %v", err)
+	}
+	if stats.NumOfTests != 3 || stats.CryogenicTests != 1 || stats.WarmTests != 2 {
+		t.Errorf("wrong number of tests: %v", stats)
+	}
+	if stats.ByPolarimeter[7] != 2 || stats.ByPolarimeter[8] != 1 || stats.ByTestType["sweep"] != 3 ||
+		stats.ByUploader["testuser"] != 3 || stats.ByMonth[month] != 3 {
+		t.Errorf("wrong counts: %v", stats)
+	}
+	if stats.TotalSamples != totalSamples {
+		t.Errorf("wrong number of samples: %d instead of %d", stats.TotalSamples, totalSamples)
+	}
+	if stats.FitsFiles.NumOfFiles != 3 || stats.FitsFiles.Bytes <= 0 {
+		t.Errorf("wrong disk usage of FITS files: %v", stats.FitsFiles)
+	}
+	if stats.Attachments.NumOfFiles != 1 || stats.Attachments.Bytes != info.Size() {
+		t.Errorf("wrong disk usage of attachments: %v", stats.Attachments)
+	}
+}
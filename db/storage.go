@@ -0,0 +1,193 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// Data files are saved in the folder "data" of the database, using their
+// SHA-256 checksum as name. In order to keep the number of entries in each
+// folder small, the first four characters of the checksum are used to build
+// two levels of subdirectories, e.g., "data/3f/a1/3fa1…e2.fits.gz".
+const dataFolderName = "data"
+
+// Attachments are saved in the folder "attachments", using the same layout
+const attachmentsFolderName = "attachments"
+
+// blobFolders lists the prefixes of all the keys used in a BlobStore
+var blobFolders = []string{dataFolderName + "/", attachmentsFolderName + "/", previewsFolderName + "/"}
+
+// dataStoragePath returns the key of the FITS file with the given checksum.
+// When the database uses a FileBlobStore, this is the path of the file
+// relative to the database folder.
+func dataStoragePath(checksum string) string {
+	return blobStoragePath(dataFolderName, checksum, ".fits.gz")
+}
+
+// blobStoragePath returns the key used to save an object with the given
+// checksum, using two levels of subdirectories below "folder"
+func blobStoragePath(folder string, checksum string, suffix string) string {
+	return path.Join(folder, checksum[0:2], checksum[2:4], checksum+suffix)
+}
+
+// writeBlob saves the data produced by "write" in the blob store, using a
+// key derived from their SHA-256 checksum by "keyFn". It returns the key,
+// the checksum, and a function that removes the object. The latter must be
+// called if the object is not going to be referenced by the database.
+// Objects are written first in a temporary file, as their key is known only
+// once all the data have been produced.
+func writeBlob(store BlobStore, keyFn func(checksum string) string,
+	write func(w io.Writer) error) (string, string, func(), error) {
+	noop := func() {}
+
+	tmpFile, err := ioutil.TempFile("", "stdb-import-")
+	if err != nil {
+		return "", "", noop, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hash := sha256.New()
+	if err := write(io.MultiWriter(tmpFile, hash)); err != nil {
+		return "", "", noop, err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	key := keyFn(checksum)
+
+	// Since keys are content-addressed, an existing object with the same
+	// key has the same contents
+	if _, err := store.Stat(key); err == nil {
+		return key, checksum, noop, nil
+	} else if err != ErrBlobNotFound {
+		return "", "", noop, err
+	}
+
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return "", "", noop, err
+	}
+	if err := store.Put(key, tmpFile); err != nil {
+		return "", "", noop, err
+	}
+
+	return key, checksum, func() { store.Delete(key) }, nil
+}
+
+// writeDataFile saves a FITS file produced by "write" in the blob store.
+// See writeBlob for the meaning of the return values.
+func writeDataFile(store BlobStore, write func(w io.Writer) error) (string, string, func(), error) {
+	return writeBlob(store, dataStoragePath, write)
+}
+
+// putFile saves the contents of the local file "fileName" in the BlobStore
+func putFile(store BlobStore, key string, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return store.Put(key, f)
+}
+
+// relocateDataFiles is used by the migration that introduced the sharded
+// layout. It copies the files of every version of the data into their new
+// location and returns the list of the old files. Files that are missing
+// are left where the database expects them.
+func relocateDataFiles(tx *sql.Tx, basePath string) ([]string, error) {
+	// Old files are always in the database folder, but the new ones must go
+	// wherever the "blob_store" property says
+	store, err := openBlobStore(tx, basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`select test_id, version, file_name from test_data_versions`)
+	if err != nil {
+		return nil, err
+	}
+
+	type dataFile struct {
+		testID   int
+		version  int
+		fileName string
+	}
+	var files []dataFile
+	for rows.Next() {
+		var curFile dataFile
+		if err := rows.Scan(&curFile.testID, &curFile.version, &curFile.fileName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		files = append(files, curFile)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var obsoleteFiles []string
+	for _, curFile := range files {
+		oldPath := path.Join(basePath, curFile.fileName)
+		checksum, err := fileChecksum(oldPath)
+		if os.IsNotExist(err) {
+			log.Printf("warning, file \"%s\" for test %d (version %d) is missing",
+				oldPath, curFile.testID, curFile.version)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		relPath := dataStoragePath(checksum)
+		if _, err := store.Stat(relPath); err == ErrBlobNotFound {
+			if err := putFile(store, relPath, oldPath); err != nil {
+				return nil, fmt.Errorf("unable to copy \"%s\": %v", oldPath, err)
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec(`
+update test_data_versions set file_name = ?, fits_checksum = ?
+where test_id = ? and version = ?`,
+			relPath, checksum, curFile.testID, curFile.version); err != nil {
+			return nil, err
+		}
+		obsoleteFiles = append(obsoleteFiles, oldPath)
+	}
+
+	_, err = tx.Exec(`
+update tests set
+	file_path = (select file_name from test_data_versions v
+	             where v.test_id = tests.test_id order by version desc limit 1),
+	fits_checksum = (select fits_checksum from test_data_versions v
+	                 where v.test_id = tests.test_id order by version desc limit 1)`)
+	return obsoleteFiles, err
+}
@@ -21,10 +21,10 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"time"
 
 	"github.com/astrogo/fitsio"
@@ -35,6 +35,7 @@ import (
 
 // Test is a structure holding all the information related to a test
 type Test struct {
+	UUID          string    // Globally unique identifier, assigned by AddTest if empty
 	ShortName     string    // Short name of the test
 	Description   string    // Full description of the test
 	CreationDate  time.Time // Time when the acquisition of data stopped
@@ -45,6 +46,13 @@ type Test struct {
 	CryogenicFlag bool      // Was the test performed at cryogenic temperatures?
 	Polarimeter   int       // Number of the polarimeter being tested
 	NumOfSamples  int       // Number of samples acquired during the test
+	CampaignID    int       // ID of the campaign the test belongs to (0 if none)
+	DataVersion   int       // Latest version of the data (see ReplaceTestData)
+	DuplicateOf   []int     // Tests containing the same data, set by AddTest (see DuplicatePolicy)
+	OriginDB      string    // ID of the database the test was merged from (empty if added here)
+	OriginTestID  int       // ID of the test in the database it was merged from
+
+	Parameters []TestParameter // Structured parameters (bias voltages, ...), nil if none
 }
 
 // FileCopy copies the file with path "sourcePath" into the file with
@@ -89,8 +97,8 @@ func convertFileToFits(inputFileName string, w io.Writer, test *Test) (convert.T
 	}
 	conversionFn, ok := convFunctions[fileType]
 	if !ok {
-		return result, fmt.Errorf("unsupported file type \"%s\", update stdb to the latest version",
-			fileType)
+		return result, fmt.Errorf("%w \"%s\", update stdb to the latest version",
+			ErrUnsupportedFormat, fileType)
 	}
 
 	fitshdr := []fitsio.Card{
@@ -100,8 +108,11 @@ func convertFileToFits(inputFileName string, w io.Writer, test *Test) (convert.T
 		{Name: "testtype", Value: test.TestType, Comment: "Type of the test"},
 		{Name: "cryo", Value: test.CryogenicFlag, Comment: "Was the test done at cryogenic temperatures?"},
 		{Name: "polarim", Value: test.Polarimeter, Comment: "Number of the polarimeter being tested"},
+		{Name: "testuuid", Value: test.UUID, Comment: "Globally unique identifier of the test"},
+		{Name: "datavers", Value: test.DataVersion, Comment: "Version of the data of the test"},
 		{Name: "stdbver", Value: DatabaseSchemaVersion, Comment: "Version of the database schema"},
 	}
+	fitshdr = append(fitshdr, parameterFitsCards(test.Parameters)...)
 
 	// Create the FITS file
 	return conversionFn(inputFileName, w, fitshdr)
@@ -110,21 +121,72 @@ func convertFileToFits(inputFileName string, w io.Writer, test *Test) (convert.T
 // AddTest creates a new entry in the "tests" table of the database and
 // fills it with the details of "newTest". The file "fitsFileName" is copied
 // in the database folder, and it can therefore be removed after successful
-// completion of this function. The return value contains the
-// unique id of the test and an Error object.
+// completion of this function. The polarimeter must have been registered
+// using AddPolarimeter, and the test type must match one of the codes (or
+// aliases) in the "test_types" table: it is replaced by its code. If the
+// CampaignID field is zero, the test is associated with the campaign that
+// is currently open (if any). If the UUID field is empty, a new UUID is
+// assigned to the test. The fields of "newTest" that are computed from the
+// file (creation date, time span, number of samples, checksum) are updated,
+// and the data are saved as version 1 (see ReplaceTestData). The
+// return value contains the unique id of the test and an Error object.
 func (conn *Connection) AddTest(newTest *Test,
 	username string,
 	inputFileName string) (int, error) {
-	if !conn.Active {
-		return -1, fmt.Errorf(MsgInactiveConnection)
+	return conn.AddTestContext(context.Background(), newTest, username, inputFileName)
+}
+
+// AddTestContext is like AddTest, but it accepts a context to cancel the operation
+func (conn *Connection) AddTestContext(ctx context.Context, newTest *Test,
+	username string,
+	inputFileName string) (int, error) {
+	if err := conn.checkWritable(); err != nil {
+		return -1, err
 	}
 
 	newTest.Username = username
+	var err error
+	if newTest.UUID, err = normalizeTestUUID(newTest.UUID); err != nil {
+		return -1, err
+	}
+	if err := checkParameters(newTest.Parameters); err != nil {
+		return -1, err
+	}
 
-	tx, err := conn.Connection.Begin()
+	tx, unlock, err := conn.beginWrite(ctx)
 	if err != nil {
 		return -1, err
 	}
+	defer unlock()
+
+	if err := checkPolarimeterIsRegistered(tx, newTest.Polarimeter); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	var testType TestType
+	if err := resolveTestType(tx, newTest.TestType, &testType); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	newTest.TestType = testType.Code
+
+	fileType, err := convert.FileType(inputFileName)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	if err := validateTestType(&testType, newTest, fileType); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	campaignID, err := checkCampaign(tx, newTest.CampaignID)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	newTest.CampaignID = int(campaignID.Int64)
 
 	result, err := tx.Exec(`
 insert into tests (short_name, 
@@ -134,8 +196,10 @@ insert into tests (short_name,
 				   type, 
 				   is_cryogenic,
 				   polarimeter,
-				   num_of_samples)
-values (?, ?, ?, ?, ?, ?, ?, ?)`,
+				   num_of_samples,
+				   campaign_id,
+				   uuid)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		newTest.ShortName,
 		newTest.Description,
 		newTest.CreationDate.Format(time.RFC3339Nano),
@@ -143,7 +207,9 @@ values (?, ?, ?, ?, ?, ?, ?, ?)`,
 		newTest.TestType,
 		newTest.CryogenicFlag,
 		newTest.Polarimeter,
-		newTest.NumOfSamples)
+		newTest.NumOfSamples,
+		campaignID,
+		newTest.UUID)
 	if err != nil {
 		tx.Rollback()
 		return -1, err
@@ -155,49 +221,27 @@ values (?, ?, ?, ?, ?, ?, ?, ?)`,
 		return -1, err
 	}
 
-	outFitsFilePath := path.Join(conn.BasePath, fmt.Sprintf("test_%06d.fits.gz", id))
-	outFits, err := os.Create(outFitsFilePath)
-	if err != nil {
-		tx.Rollback()
-		return -1, err
-	}
-
-	testFile, err := convertFileToFits(inputFileName, outFits, newTest)
-	if err != nil {
-		outFits.Close()
-		os.Remove(outFitsFilePath)
-		tx.Rollback()
-		return -1, err
-	}
-
-	if err := outFits.Close(); err != nil {
-		os.Remove(outFitsFilePath)
+	if err := saveParameters(tx, id, newTest.Parameters); err != nil {
 		tx.Rollback()
 		return -1, err
 	}
 
-	// Update the entry in the database with the information extracted from
-	// the FITS file that has just been created
-	result, err = tx.Exec(`
-update or fail tests set (creation_date,
-                          time_span_sec,
-				          num_of_samples) = (?, ?, ?)
-where test_id = ?`,
-		testFile.CreationDate.Format(time.RFC3339),
-		testFile.TimeSpanSec,
-		testFile.NumOfSamples,
-		id)
+	_, removeFile, err := conn.importTestData(tx, id, 1, inputFileName, newTest,
+		"First import", username)
 	if err != nil {
 		tx.Rollback()
-		os.Remove(outFitsFilePath)
 		return -1, err
 	}
 
 	if err := tx.Commit(); err != nil {
-		os.Remove(outFitsFilePath)
+		removeFile()
 		return -1, err
 	}
+	unlock()
 
+	conn.logAction(ctx, username, ActionCreate, ObjectTest, id,
+		fmt.Sprintf("test %d (UUID %s) has been added", id, newTest.UUID))
+	conn.logDuplicates(ctx, int(id), newTest, username)
 	return int(id), nil
 }
 
@@ -208,11 +252,16 @@ where test_id = ?`,
 // order, that is, from the most recent test to the most ancient one. The "username"
 // is used only for logging purposes.
 func (conn *Connection) GetListOfTestIDs(username string, maxNum int) ([]int, error) {
+	return conn.GetListOfTestIDsContext(context.Background(), username, maxNum)
+}
+
+// GetListOfTestIDsContext is like GetListOfTestIDs, but it accepts a context to cancel the operation
+func (conn *Connection) GetListOfTestIDsContext(ctx context.Context, username string, maxNum int) ([]int, error) {
 	if !conn.Active {
-		return []int{}, fmt.Errorf(MsgInactiveConnection)
+		return []int{}, ErrInactive
 	}
 
-	rows, err := conn.Connection.Query(`select test_id from tests order by test_id desc limit ?`,
+	rows, err := conn.withContext(ctx).Query(`select test_id from tests order by test_id desc limit ?`,
 		maxNum)
 	if err != nil {
 		return []int{}, err
@@ -228,40 +277,48 @@ func (conn *Connection) GetListOfTestIDs(username string, maxNum int) ([]int, er
 		result = append(result, int(curID))
 	}
 
-	conn.Log(fmt.Sprintf("querying the IDs of the tests in the database, %d results returned (maxNum=%d)",
-		len(result), maxNum), username)
+	conn.logAction(ctx, username, ActionRead, ObjectTest, "",
+		fmt.Sprintf("querying the IDs of the tests in the database, %d results returned (maxNum=%d)",
+			len(result), maxNum))
 	return result, nil
 }
 
-// GetTest searches for a test with the given ID in the database.
-// If a matching test is found in the database, the function fills
-// the structure pointed by "test." The parameter "username" is
-// used only for logging purposes, and it can be empty
-func (conn *Connection) GetTest(testID int,
-	username string,
-	test *Test) error {
-	if !conn.Active {
-		return fmt.Errorf(MsgInactiveConnection)
-	}
-
+// testColumns lists the columns read by scanTest. The table "tests" must
+// be aliased as "t".
+const testColumns = `t.test_id,
+       t.short_name,
+       t.description,
+       t.creation_date,
+       t.user_id,
+       t.type,
+       t.time_span_sec,
+       t.is_cryogenic,
+       t.polarimeter,
+       t.num_of_samples,
+       t.campaign_id,
+       t.fits_checksum,
+       (select max(version) from test_data_versions v where v.test_id = t.test_id),
+       t.origin_db,
+       t.origin_test_id,
+       t.uuid`
+
+// scanTest reads a row containing the columns in testColumns. Parameters
+// are not read.
+func scanTest(row rowScanner, testID *int, test *Test) error {
 	var (
 		shortName    sql.NullString
 		description  sql.NullString
 		creationDate sql.NullString
 		timeSpanSec  sql.NullFloat64
+		campaignID   sql.NullInt64
+		checksum     sql.NullString
+		dataVersion  sql.NullInt64
+		originDB     sql.NullString
+		originTestID sql.NullInt64
+		testUUID     sql.NullString
 	)
-	err := conn.Connection.QueryRow(`
-select short_name,
-       description,
-	   creation_date,
-	   user_id,
-	   type,
-	   time_span_sec,
-	   is_cryogenic,
-	   polarimeter,
-	   num_of_samples
-from tests where test_id = ?`,
-		testID).Scan(
+	err := row.Scan(
+		testID,
 		&shortName,
 		&description,
 		&creationDate,
@@ -270,7 +327,13 @@ from tests where test_id = ?`,
 		&timeSpanSec,
 		&test.CryogenicFlag,
 		&test.Polarimeter,
-		&test.NumOfSamples)
+		&test.NumOfSamples,
+		&campaignID,
+		&checksum,
+		&dataVersion,
+		&originDB,
+		&originTestID,
+		&testUUID)
 	if err != nil {
 		return err
 	}
@@ -290,8 +353,50 @@ from tests where test_id = ?`,
 	if timeSpanSec.Valid {
 		test.TimeSpanSec = timeSpanSec.Float64
 	}
+	test.CampaignID = int(campaignID.Int64)
+	test.FitsChecksum = checksum.String
+	test.DataVersion = int(dataVersion.Int64)
+	test.OriginDB = originDB.String
+	test.OriginTestID = int(originTestID.Int64)
+	test.UUID = testUUID.String
+
+	return nil
+}
+
+// GetTest searches for a test with the given ID in the database.
+// If a matching test is found in the database, the function fills
+// the structure pointed by "test." The parameter "username" is
+// used only for logging purposes, and it can be empty
+func (conn *Connection) GetTest(testID int,
+	username string,
+	test *Test) error {
+	return conn.GetTestContext(context.Background(), testID, username, test)
+}
+
+// GetTestContext is like GetTest, but it accepts a context to cancel the operation
+func (conn *Connection) GetTestContext(ctx context.Context, testID int,
+	username string,
+	test *Test) error {
+	if !conn.Active {
+		return ErrInactive
+	}
+
+	var id int
+	err := scanTest(conn.withContext(ctx).QueryRow(`
+select `+testColumns+` from tests t where t.test_id = ?`,
+		testID), &id, test)
+	if err == sql.ErrNoRows {
+		return errNotFound("no test with ID=%d", testID)
+	} else if err != nil {
+		return err
+	}
+
+	if test.Parameters, err = loadParameters(conn.withContext(ctx), testID); err != nil {
+		return err
+	}
 
-	conn.Log(fmt.Sprintf("request for test with ID=%d has been satisfied", testID), username)
+	conn.logAction(ctx, username, ActionRead, ObjectTest, testID,
+		fmt.Sprintf("request for test with ID=%d has been satisfied", testID))
 
 	return nil
 }
@@ -0,0 +1,360 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lspestrip/stdb/convert"
+)
+
+// TestType describes one of the kinds of test listed in the Test Plan
+type TestType struct {
+	Code             string   // Short code used in Test.TestType
+	TestPlanRef      string   // Section of the Test Plan describing the test
+	Description      string   // Description of the test
+	FileFormat       string   // Expected format of the input file (see convert.FileType), empty if any
+	RequiredMetadata []string // Fields of the test that must not be empty
+}
+
+// normalizeTestTypeName converts a test type into the canonical form used
+// to look for codes and aliases: lowercase, with no repeated spaces.
+func normalizeTestTypeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// scanTestType reads one row of the "test_types" table. The columns must be
+// in the same order as in the "test_types" table.
+func scanTestType(row rowScanner, tt *TestType) error {
+	var (
+		testPlanRef      sql.NullString
+		description      sql.NullString
+		fileFormat       sql.NullString
+		requiredMetadata sql.NullString
+	)
+	if err := row.Scan(&tt.Code, &testPlanRef, &description, &fileFormat,
+		&requiredMetadata); err != nil {
+		return err
+	}
+
+	tt.TestPlanRef = testPlanRef.String
+	tt.Description = description.String
+	tt.FileFormat = fileFormat.String
+	tt.RequiredMetadata = splitMetadataFields(requiredMetadata.String)
+	return nil
+}
+
+// resolveTestType looks for a test type whose code or alias matches "name"
+func resolveTestType(q queryRower, name string, tt *TestType) error {
+	normName := normalizeTestTypeName(name)
+	err := scanTestType(q.QueryRow(`
+select code, test_plan_ref, description, file_format, required_metadata
+from test_types
+where code = ? or code = (select code from test_type_aliases where alias = ?)`,
+		normName, normName), tt)
+	if err == sql.ErrNoRows {
+		return errNotFound("unknown test type \"%s\" (use \"stdb testtype list\" to get a list of valid types)",
+			name)
+	}
+
+	return err
+}
+
+// splitMetadataFields converts the comma-separated list of fields saved in
+// the "required_metadata" column into a slice
+func splitMetadataFields(s string) []string {
+	result := []string{}
+	for _, curField := range strings.Split(s, ",") {
+		if curField = strings.TrimSpace(curField); curField != "" {
+			result = append(result, strings.ToLower(curField))
+		}
+	}
+	return result
+}
+
+// normalizeMetadataFields checks the names of the fields in
+// TestType.RequiredMetadata and converts them into the canonical form. Each
+// name must be either "shortname", "description", or a valid parameter
+// name, and it cannot appear twice.
+func normalizeMetadataFields(fields []string) ([]string, error) {
+	result := make([]string, 0, len(fields))
+	seen := make(map[string]bool)
+	for _, curField := range fields {
+		if strings.TrimSpace(curField) == "" {
+			return nil, fmt.Errorf("the names of the required metadata cannot be empty")
+		}
+		name, err := normalizeParameterName(curField)
+		if err != nil {
+			return nil, fmt.Errorf("invalid required metadata: %v", err)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("required metadata \"%s\" is listed more than once", name)
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// validateFileFormat checks that "format" is either empty or one of the
+// file types known to the convert package
+func validateFileFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	for _, curType := range convert.FileTypes {
+		if format == curType {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown file format \"%s\" (valid choices are %s)",
+		format, strings.Join(convert.FileTypes, ", "))
+}
+
+// testMetadataValue returns the value of the metadata field "field" for
+// "test". Fields can be either "shortname", "description", or the name of
+// one of the parameters of the test. The boolean is false if "field" is
+// not a known field.
+func testMetadataValue(test *Test, field string) (string, bool) {
+	switch field {
+	case "shortname":
+		return test.ShortName, true
+	case "description":
+		return test.Description, true
+	}
+
+	for _, curParam := range test.Parameters {
+		if curParam.Name == field {
+			return curParam.Value(), true
+		}
+	}
+
+	return "", false
+}
+
+// validateTestType checks that "test" and the input file, whose type is
+// "fileType", satisfy the requirements of the test type "tt"
+func validateTestType(tt *TestType, test *Test, fileType string) error {
+	if tt.FileFormat != "" && tt.FileFormat != fileType {
+		return fmt.Errorf("tests of type \"%s\" require a file in format \"%s\", but a file of type \"%s\" was provided",
+			tt.Code, tt.FileFormat, fileType)
+	}
+
+	for _, curField := range tt.RequiredMetadata {
+		value, ok := testMetadataValue(test, curField)
+		if !ok || value == "" {
+			return fmt.Errorf("field \"%s\" is required for tests of type \"%s\"",
+				curField, tt.Code)
+		}
+	}
+
+	return nil
+}
+
+// AddTestType adds a new entry to the vocabulary of test types. The parameter
+// "username" is used only for logging purposes.
+func (conn *Connection) AddTestType(tt *TestType, username string) error {
+	return conn.AddTestTypeContext(context.Background(), tt, username)
+}
+
+// AddTestTypeContext is like AddTestType, but it accepts a context to cancel the operation
+func (conn *Connection) AddTestTypeContext(ctx context.Context, tt *TestType, username string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	tt.Code = normalizeTestTypeName(tt.Code)
+	if tt.Code == "" {
+		return fmt.Errorf("the code of a test type cannot be empty")
+	}
+	if err := validateFileFormat(tt.FileFormat); err != nil {
+		return err
+	}
+	fields, err := normalizeMetadataFields(tt.RequiredMetadata)
+	if err != nil {
+		return err
+	}
+	tt.RequiredMetadata = fields
+
+	_, err = conn.execWrite(ctx, `
+insert into test_types (code, test_plan_ref, description, file_format, required_metadata)
+values (?, ?, ?, ?, ?)`,
+		tt.Code,
+		nullIfEmpty(tt.TestPlanRef),
+		tt.Description,
+		nullIfEmpty(tt.FileFormat),
+		strings.Join(tt.RequiredMetadata, ","))
+	if err != nil {
+		return err
+	}
+
+	conn.logAction(ctx, username, ActionCreate, ObjectTestType, tt.Code,
+		fmt.Sprintf("test type \"%s\" has been added", tt.Code))
+	return nil
+}
+
+// AddTestTypeAlias makes "alias" an alternative spelling for the test type
+// "code". The parameter "username" is used only for logging purposes.
+func (conn *Connection) AddTestTypeAlias(alias string, code string, username string) error {
+	return conn.AddTestTypeAliasContext(context.Background(), alias, code, username)
+}
+
+// AddTestTypeAliasContext is like AddTestTypeAlias, but it accepts a context to cancel the operation
+func (conn *Connection) AddTestTypeAliasContext(ctx context.Context, alias string, code string, username string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	var tt TestType
+	if err := resolveTestType(conn.withContext(ctx), code, &tt); err != nil {
+		return err
+	}
+
+	normAlias := normalizeTestTypeName(alias)
+	if normAlias == tt.Code {
+		return fmt.Errorf("\"%s\" is already the code of a test type", alias)
+	}
+
+	if _, err := conn.execWrite(ctx, `
+insert into test_type_aliases (alias, code) values (?, ?)`,
+		normAlias, tt.Code); err != nil {
+		return err
+	}
+
+	conn.logAction(ctx, username, ActionUpdate, ObjectTestType, tt.Code,
+		fmt.Sprintf("\"%s\" is now an alias for test type \"%s\"", normAlias, tt.Code))
+	return nil
+}
+
+// GetTestType looks for a test type whose code or alias matches "name"
+// and saves it in "tt".
+func (conn *Connection) GetTestType(name string, tt *TestType) error {
+	return conn.GetTestTypeContext(context.Background(), name, tt)
+}
+
+// GetTestTypeContext is like GetTestType, but it accepts a context to cancel the operation
+func (conn *Connection) GetTestTypeContext(ctx context.Context, name string, tt *TestType) error {
+	if !conn.Active {
+		return ErrInactive
+	}
+
+	return resolveTestType(conn.withContext(ctx), name, tt)
+}
+
+// GetListOfTestTypes returns all the test types in the database, together
+// with a map associating each code with the list of its aliases.
+func (conn *Connection) GetListOfTestTypes() ([]TestType, map[string][]string, error) {
+	return conn.GetListOfTestTypesContext(context.Background())
+}
+
+// GetListOfTestTypesContext is like GetListOfTestTypes, but it accepts a context to cancel the operation
+func (conn *Connection) GetListOfTestTypesContext(ctx context.Context) ([]TestType, map[string][]string, error) {
+	if !conn.Active {
+		return []TestType{}, nil, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select code, test_plan_ref, description, file_format, required_metadata
+from test_types order by code`)
+	if err != nil {
+		return []TestType{}, nil, err
+	}
+	defer rows.Close()
+
+	result := make([]TestType, 0)
+	for rows.Next() {
+		var curType TestType
+		if err := scanTestType(rows, &curType); err != nil {
+			return []TestType{}, nil, err
+		}
+		result = append(result, curType)
+	}
+	if err := rows.Err(); err != nil {
+		return []TestType{}, nil, err
+	}
+
+	aliasRows, err := conn.withContext(ctx).Query(`select alias, code from test_type_aliases order by alias`)
+	if err != nil {
+		return []TestType{}, nil, err
+	}
+	defer aliasRows.Close()
+
+	aliases := make(map[string][]string)
+	for aliasRows.Next() {
+		var alias, code string
+		if err := aliasRows.Scan(&alias, &code); err != nil {
+			return []TestType{}, nil, err
+		}
+		aliases[code] = append(aliases[code], alias)
+	}
+
+	return result, aliases, aliasRows.Err()
+}
+
+// normalizeTestTypes is used by the migration that introduced the
+// "test_types" table. It replaces legacy spellings in the "tests" table
+// with the corresponding code. Types that cannot be matched are added to
+// the vocabulary, so that no information is lost.
+func normalizeTestTypes(tx *sql.Tx) error {
+	rows, err := tx.Query(`select distinct type from tests`)
+	if err != nil {
+		return err
+	}
+
+	var legacyTypes []string
+	for rows.Next() {
+		var curType string
+		if err := rows.Scan(&curType); err != nil {
+			rows.Close()
+			return err
+		}
+		legacyTypes = append(legacyTypes, curType)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, curType := range legacyTypes {
+		var tt TestType
+		if err := resolveTestType(tx, curType, &tt); err != nil {
+			tt.Code = normalizeTestTypeName(curType)
+			if tt.Code == "" {
+				tt.Code = "unknown"
+			}
+			if _, err := tx.Exec(`
+insert or ignore into test_types (code, description) values (?, ?)`,
+				tt.Code, "Legacy test type found in the database"); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(`update tests set type = ? where type = ?`,
+			tt.Code, curType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
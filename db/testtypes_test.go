@@ -0,0 +1,89 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"path"
+	"testing"
+)
+
+func TestTestTypes(t *testing.T) {
+	conn := createTestDatabase(t, "testtypes")
+	defer conn.Disconnect()
+
+	var tt TestType
+	for _, name := range []string{"PH/SW", "ph-sw", "Phase  Switch", "phsw"} {
+		if err := conn.GetTestType(name, &tt); err != nil || tt.Code != "phsw" {
+			t.Errorf("\"%s\" was not resolved into \"phsw\" (%v)", name, err)
+		}
+	}
+
+	if err := conn.GetTestType("nonexistent", &tt); err == nil {
+		t.Error("GetTestType accepted an unknown test type")
+	}
+
+	for _, invalid := range []TestType{
+		{Code: "bad1", RequiredMetadata: []string{"description", ""}},
+		{Code: "bad2", RequiredMetadata: []string{"description", "Description"}},
+		{Code: "bad3", RequiredMetadata: []string{"vdrain,vgate"}},
+		{Code: "bad4", FileFormat: "spreadsheet"},
+	} {
+		if err := conn.AddTestType(&invalid, "testuser"); err == nil {
+			t.Errorf("AddTestType accepted an invalid test type: %v", invalid)
+		}
+	}
+
+	if err := conn.AddTestType(&TestType{
+		Code:             "Stability",
+		Description:      "Long-term stability",
+		FileFormat:       "keithley",
+		RequiredMetadata: []string{"description"},
+	}, "testuser"); err != nil {
+		t.Fatalf("unable to add a test type: %v", err)
+	}
+	if err := conn.AddTestTypeAlias("long run", "stability", "testuser"); err != nil {
+		t.Errorf("unable to add an alias: %v", err)
+	}
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 1}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	test := Test{TestType: "Long Run", Polarimeter: 1}
+	if _, err := conn.AddTest(&test, "testuser", inputFilePath); err == nil {
+		t.Error("AddTest accepted a test without a required field")
+	}
+
+	test.Description = "this is a description"
+	if _, err := conn.AddTest(&test, "testuser", inputFilePath); err != nil {
+		t.Errorf("unable to add a test: %v", err)
+	}
+	if test.TestType != "stability" {
+		t.Errorf("the type of the test was not normalized: \"%s\"", test.TestType)
+	}
+
+	testTypes, aliases, err := conn.GetListOfTestTypes()
+	if err != nil || len(testTypes) != 6 || len(aliases["stability"]) != 1 {
+		t.Errorf("unexpected result from GetListOfTestTypes: %v, %v (%v)",
+			testTypes, aliases, err)
+	}
+}
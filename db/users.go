@@ -21,9 +21,13 @@
 package db
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"time"
 	"golang.org/x/crypto/bcrypt"	
+
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 // CreateUser add a new user in the "users" table of the database
@@ -33,9 +37,19 @@ func (conn *Connection) CreateUser(
   	fullname string, 
   	email string,
 	isEnabled bool) error {
+	return conn.CreateUserContext(context.Background(), user, password, fullname, email, isEnabled)
+}
 
-	if !conn.Active {
-		return fmt.Errorf(MsgInactiveConnection)
+// CreateUserContext is like CreateUser, but it accepts a context to cancel the operation
+func (conn *Connection) CreateUserContext(ctx context.Context,
+	user string, 
+ 	password []byte,
+  	fullname string, 
+  	email string,
+	isEnabled bool) error {
+
+	if err := conn.checkWritable(); err != nil {
+		return err
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
@@ -44,61 +58,104 @@ func (conn *Connection) CreateUser(
 	}
 
 	curDate := time.Now().UTC().Format(time.RFC3339)
-	_, err = conn.Connection.Exec(`
+	_, err = conn.execWrite(ctx, `
 insert into users (user_id, password_hash, full_name, creation_date, email, is_enabled)
 values (?, ?, ?, ?, ?, ?)`,
 		user, hashedPassword, fullname, curDate, email, isEnabled)
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return fmt.Errorf("%w: \"%s\"", ErrDuplicateUser, user)
+	} else if err != nil {
+		return err
+	}
+
+	conn.logAction(ctx, user, ActionCreate, ObjectUser, user, "new user has been created")
 
-	conn.Log("new user has been created", user)
+	return nil
+}
+
+// checkUserUpdated returns an error if the statement that produced "result"
+// did not modify any user
+func checkUserUpdated(result sql.Result, err error, user string) error {
+	if err != nil {
+		return err
+	}
 
-	return err
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return errNotFound("user \"%s\" is not registered in the database", user)
+	}
+	return nil
 }
 
 // EnableUser changes the status of an user to "active"
 func (conn *Connection) EnableUser(user string) error {
-	if !conn.Active {
-		return fmt.Errorf(MsgInactiveConnection)
+	return conn.EnableUserContext(context.Background(), user)
+}
+
+// EnableUserContext is like EnableUser, but it accepts a context to cancel the operation
+func (conn *Connection) EnableUserContext(ctx context.Context, user string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
 	}
 
-	_, err := conn.Connection.Exec(`
+	result, err := conn.execWrite(ctx, `
 update users set is_enabled = 1 where user_id = ?`,
 		user)
+	if err := checkUserUpdated(result, err, user); err != nil {
+		return err
+	}
 
-	conn.Log("user has been enabled", user)
+	conn.logAction(ctx, user, ActionUpdate, ObjectUser, user, "user has been enabled")
 
-	return err
+	return nil
 }
 
 // DisableUser changes the status of an user to "active"
 func (conn *Connection) DisableUser(user string) error {
-	if !conn.Active {
-		return fmt.Errorf(MsgInactiveConnection)
+	return conn.DisableUserContext(context.Background(), user)
+}
+
+// DisableUserContext is like DisableUser, but it accepts a context to cancel the operation
+func (conn *Connection) DisableUserContext(ctx context.Context, user string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
 	}
 
-	_, err := conn.Connection.Exec(`
+	result, err := conn.execWrite(ctx, `
 update users set is_enabled = 0 where user_id = ?`,
 		user)
+	if err := checkUserUpdated(result, err, user); err != nil {
+		return err
+	}
 
-	conn.Log("user has been disabled", user)
+	conn.logAction(ctx, user, ActionUpdate, ObjectUser, user, "user has been disabled")
 
-	return err
+	return nil
 }
 
 // GetUserPassword returns the *hashed* password for a specified user
 func (conn *Connection) GetUserPassword(user string) ([]byte, error) {
+	return conn.GetUserPasswordContext(context.Background(), user)
+}
+
+// GetUserPasswordContext is like GetUserPassword, but it accepts a context to cancel the operation
+func (conn *Connection) GetUserPasswordContext(ctx context.Context, user string) ([]byte, error) {
 	if !conn.Active {
-		return []byte{}, fmt.Errorf(MsgInactiveConnection)
+		return []byte{}, ErrInactive
 	}
 
 	var password string
-	err := conn.Connection.QueryRow(`
+	err := conn.withContext(ctx).QueryRow(`
 select password_hash from users where user_id = ?`,
 		user).Scan(&password)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		return []byte{}, errNotFound("user \"%s\" is not registered in the database", user)
+	} else if err != nil {
 		return []byte{}, err
 	}
 
-	conn.Log("password has been requested", user)
+	conn.logAction(ctx, user, ActionRead, ObjectUser, user, "password has been requested")
 
 	return []byte(password), nil
 }
@@ -106,21 +163,27 @@ select password_hash from users where user_id = ?`,
 // ChangeUserPassword updates the password of a user in the database
 // "newPassword" must *not* be hashed.
 func (conn *Connection) ChangeUserPassword(user string,	newPassword []byte) error {
-	if !conn.Active {
-		return fmt.Errorf(MsgInactiveConnection)
+	return conn.ChangeUserPasswordContext(context.Background(), user, newPassword)
+}
+
+// ChangeUserPasswordContext is like ChangeUserPassword, but it accepts a context to cancel the operation
+func (conn *Connection) ChangeUserPasswordContext(ctx context.Context, user string,	newPassword []byte) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword(newPassword, bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	_, err = conn.Connection.Exec(`
+	result, err := conn.execWrite(ctx, `
 update users set password_hash = ? where user_id = ?`,
 		hashedPassword, user)
-
-	if err == nil {
-		conn.Log("password has been changed", user)
+	if err := checkUserUpdated(result, err, user); err != nil {
+		return err
 	}
 
-	return err
+	conn.logAction(ctx, user, ActionUpdate, ObjectUser, user, "password has been changed")
+
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,370 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lspestrip/stdb/convert"
+)
+
+// DataVersion describes one of the FITS files imported for a test. Each
+// time the data of a test are replaced, a new version is created; older
+// versions remain readable.
+type DataVersion struct {
+	TestID       int       // ID of the test
+	Version      int       // Progressive number of the version, starting from 1
+	Key          string    // Key of the FITS file in the BlobStore of the database
+	Checksum     string    // SHA-256 checksum of the FITS file (empty for legacy files)
+	Username     string    // User that imported the data
+	CreationDate time.Time // When the data were imported
+	Reason       string    // Why the data have been replaced
+}
+
+// importTestData converts "inputFileName" into a new FITS file, which
+// becomes version "version" of the data of the test with ID "testID". The
+// "tests" table is updated with the information read from the file.
+// Duplicated data are handled according to the policy of the connection
+// (see DuplicatePolicy). A preview of the data and the statistics of its
+// columns are saved as well (see DataPreview and ColumnStats). The
+// function returned together with the file information removes the new
+// FITS file and its preview: it must be called if the transaction is
+// rolled back or fails to commit. (If an error is returned, the file has
+// already been removed.)
+func (conn *Connection) importTestData(tx *sql.Tx, testID int64, version int,
+	inputFileName string, test *Test, reason string, username string) (convert.TestFile, func(), error) {
+
+	noop := func() {}
+	sourceChecksum, err := fileChecksum(inputFileName)
+	if err != nil {
+		return convert.TestFile{}, noop, err
+	}
+
+	// The preview and the statistics are computed from an uncompressed copy
+	// of the FITS file made while converting it, so that the file does not
+	// need to be read back from the BlobStore
+	test.DataVersion = version
+	var (
+		testFile         convert.TestFile
+		uncompressedName string
+	)
+	key, checksum, removeFile, err := writeDataFile(conn.Blobs, func(w io.Writer) error {
+		var err error
+		uncompressedName, err = writeAndUncompress(w, func(w io.Writer) error {
+			var err error
+			testFile, err = convertFileToFits(inputFileName, w, test)
+			return err
+		})
+		return err
+	})
+	if uncompressedName != "" {
+		defer os.Remove(uncompressedName)
+	}
+	if err != nil {
+		return testFile, noop, err
+	}
+
+	// A missing preview is computed again when needed, so failing to save
+	// it must not prevent the import
+	removePreview := noop
+	preview, stats, err := summarizeFile(uncompressedName)
+	if err == nil {
+		removePreview, err = savePreview(conn.Blobs, checksum, &preview)
+	}
+	if err != nil {
+		log.Printf("warning, unable to compute the preview of test %d: %v", testID, err)
+	}
+	removeData := removeFile
+	removeFile = func() {
+		removeData()
+		removePreview()
+	}
+
+	if err := conn.handleDuplicates(tx, testID, test, sourceChecksum,
+		testFile.DataChecksum, username); err != nil {
+		removeFile()
+		return testFile, noop, err
+	}
+
+	if _, err := tx.Exec(`
+insert into test_data_versions (test_id, version, file_name, fits_checksum, creation_date,
+                                user_id, reason, source_checksum, data_checksum)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		testID,
+		version,
+		key,
+		checksum,
+		time.Now().UTC().Format(time.RFC3339),
+		username,
+		reason,
+		sourceChecksum,
+		nullIfEmpty(testFile.DataChecksum)); err != nil {
+		removeFile()
+		return testFile, noop, err
+	}
+
+	if err := saveColumnStats(tx, testID, version, stats); err != nil {
+		removeFile()
+		return testFile, noop, err
+	}
+
+	// Update the entry in the database with the information extracted from
+	// the FITS file that has just been created
+	if _, err = tx.Exec(`
+update or fail tests set (creation_date,
+                          time_span_sec,
+                          num_of_samples,
+                          fits_checksum,
+                          file_path) = (?, ?, ?, ?, ?)
+where test_id = ?`,
+		testFile.CreationDate.Format(time.RFC3339),
+		testFile.TimeSpanSec,
+		testFile.NumOfSamples,
+		checksum,
+		key,
+		testID); err != nil {
+		removeFile()
+		return testFile, noop, err
+	}
+
+	test.CreationDate = testFile.CreationDate
+	test.TimeSpanSec = float64(testFile.TimeSpanSec)
+	test.NumOfSamples = testFile.NumOfSamples
+	test.FitsChecksum = checksum
+	return testFile, removeFile, nil
+}
+
+// ReplaceTestData imports "inputFileName" as a new version of the data of
+// the test with ID "testID", keeping the same ID and metadata. Older versions
+// of the data remain in the database. The parameter "reason" explains why
+// the data have been replaced, and "username" is the name of the user doing
+// the replacement. The return value is the number of the new version.
+func (conn *Connection) ReplaceTestData(testID int, inputFileName string,
+	reason string, username string) (int, error) {
+	return conn.ReplaceTestDataContext(context.Background(), testID, inputFileName, reason, username)
+}
+
+// ReplaceTestDataContext is like ReplaceTestData, but it accepts a context to cancel the operation
+func (conn *Connection) ReplaceTestDataContext(ctx context.Context, testID int, inputFileName string,
+	reason string, username string) (int, error) {
+	if err := conn.checkWritable(); err != nil {
+		return -1, err
+	}
+
+	tx, unlock, err := conn.beginWrite(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer unlock()
+
+	// The test is read within the transaction, so that other writers
+	// cannot change it before the new version is saved
+	var (
+		test Test
+		id   int
+	)
+	err = scanTest(tx.QueryRow(`select `+testColumns+` from tests t where t.test_id = ?`, testID),
+		&id, &test)
+	if err == sql.ErrNoRows {
+		err = errNotFound("no test with ID=%d", testID)
+	}
+	if err == nil {
+		test.Parameters, err = loadParameters(tx, testID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	var testType TestType
+	if err := resolveTestType(tx, test.TestType, &testType); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	fileType, err := convert.FileType(inputFileName)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	if err := validateTestType(&testType, &test, fileType); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	var lastVersion int
+	if err := tx.QueryRow(`
+select coalesce(max(version), 0) from test_data_versions where test_id = ?`,
+		testID).Scan(&lastVersion); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	newVersion := lastVersion + 1
+	_, removeFile, err := conn.importTestData(tx, int64(testID), newVersion, inputFileName,
+		&test, reason, username)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		removeFile()
+		return -1, err
+	}
+	unlock()
+
+	conn.logAction(ctx, username, ActionUpdate, ObjectTest, testID,
+		fmt.Sprintf("data of test %d have been replaced by version %d (%s)", testID, newVersion, reason))
+	conn.logDuplicates(ctx, testID, &test, username)
+	return newVersion, nil
+}
+
+// scanDataVersion reads one row of the "test_data_versions" table. The
+// columns must be in the order used by dataVersionColumns.
+func scanDataVersion(row rowScanner, version *DataVersion) error {
+	var (
+		checksum     sql.NullString
+		username     sql.NullString
+		creationDate sql.NullString
+		reason       sql.NullString
+	)
+	if err := row.Scan(&version.TestID, &version.Version, &version.Key,
+		&checksum, &username, &creationDate, &reason); err != nil {
+		return err
+	}
+
+	version.Checksum = checksum.String
+	version.Username = username.String
+	version.Reason = reason.String
+	if creationDate.Valid {
+		// Legacy entries copy the date of the test, which can have a
+		// fractional part
+		var err error
+		if version.CreationDate, err = time.Parse(time.RFC3339Nano, creationDate.String); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const dataVersionColumns = `v.test_id, v.version, v.file_name, v.fits_checksum, v.user_id,
+v.creation_date, v.reason`
+
+// GetTestDataVersions returns all the versions of the data of a test,
+// from the oldest to the newest.
+func (conn *Connection) GetTestDataVersions(testID int) ([]DataVersion, error) {
+	return conn.GetTestDataVersionsContext(context.Background(), testID)
+}
+
+// GetTestDataVersionsContext is like GetTestDataVersions, but it accepts a context to cancel the operation
+func (conn *Connection) GetTestDataVersionsContext(ctx context.Context, testID int) ([]DataVersion, error) {
+	if !conn.Active {
+		return []DataVersion{}, ErrInactive
+	}
+
+	rows, err := conn.withContext(ctx).Query(`
+select `+dataVersionColumns+`
+from test_data_versions v where test_id = ? order by version`,
+		testID)
+	if err != nil {
+		return []DataVersion{}, err
+	}
+	defer rows.Close()
+
+	result := make([]DataVersion, 0)
+	for rows.Next() {
+		var curVersion DataVersion
+		if err := scanDataVersion(rows, &curVersion); err != nil {
+			return []DataVersion{}, err
+		}
+		result = append(result, curVersion)
+	}
+
+	return result, rows.Err()
+}
+
+// resolveTestData looks for version "version" of the data of a test. If
+// "version" is zero, the latest version is returned. Since the layout of
+// the storage can change, this is the only way to locate the data of a test.
+func resolveTestData(q queryRower, testID int, version int, result *DataVersion) error {
+	var err error
+	if version == 0 {
+		err = scanDataVersion(q.QueryRow(`
+select `+dataVersionColumns+`
+from test_data_versions v join tests t on v.test_id = t.test_id
+where v.test_id = ? and v.file_name = t.file_path
+order by v.version desc limit 1`,
+			testID), result)
+	} else {
+		err = scanDataVersion(q.QueryRow(`
+select `+dataVersionColumns+`
+from test_data_versions v where v.test_id = ? and v.version = ?`,
+			testID, version), result)
+	}
+
+	if err == sql.ErrNoRows {
+		if version == 0 {
+			return errNotFound("no data available for test %d", testID)
+		}
+		return errNotFound("test %d has no data version %d", testID, version)
+	}
+	return err
+}
+
+// OpenTestData returns a reader for version "version" of the FITS file of a
+// test, together with the information about the version. If "version" is
+// zero, the latest version is returned. The caller must close the reader.
+func (conn *Connection) OpenTestData(testID int, version int) (io.ReadCloser, DataVersion, error) {
+	return conn.OpenTestDataContext(context.Background(), testID, version)
+}
+
+// OpenTestDataContext is like OpenTestData, but it accepts a context to cancel the operation
+func (conn *Connection) OpenTestDataContext(ctx context.Context, testID int, version int) (io.ReadCloser, DataVersion, error) {
+	var dataVersion DataVersion
+	if !conn.Active {
+		return nil, dataVersion, ErrInactive
+	}
+
+	if err := resolveTestData(conn.withContext(ctx), testID, version, &dataVersion); err != nil {
+		return nil, dataVersion, err
+	}
+
+	r, err := conn.openDataVersion(&dataVersion)
+	return r, dataVersion, err
+}
+
+// openDataVersion opens the FITS file of a version of the data
+func (conn *Connection) openDataVersion(dataVersion *DataVersion) (io.ReadCloser, error) {
+	r, err := conn.Blobs.Get(dataVersion.Key)
+	if err == ErrBlobNotFound {
+		return nil, errNotFound("the file of test %d (version %d) is missing from the storage",
+			dataVersion.TestID, dataVersion.Version)
+	}
+	return r, err
+}
@@ -0,0 +1,86 @@
+// Copyright © 2017 Maurizio Tomasi <maurizio.tomasi@unimi.it>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package db
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestReplaceTestData(t *testing.T) {
+	conn := createTestDatabase(t, "versions")
+	defer conn.Disconnect()
+
+	if err := conn.AddPolarimeter(&Polarimeter{Number: 4}, "testuser"); err != nil {
+		t.Fatalf("unable to register a new polarimeter: %v", err)
+	}
+
+	inputFilePath := path.Join("..", "testdata", "keithley_file.xls")
+	test := Test{ShortName: "sweep", TestType: "sweep", Polarimeter: 4}
+	testID, err := conn.AddTest(&test, "testuser", inputFilePath)
+	if err != nil {
+		t.Fatalf("unable to add a test: %v", err)
+	}
+	if len(test.FitsChecksum) != 64 || test.DataVersion != 1 {
+		t.Errorf("wrong checksum/version for a new test: \"%s\"/%d", test.FitsChecksum, test.DataVersion)
+	}
+
+	version, err := conn.ReplaceTestData(testID, inputFilePath, "converter bug fixed", "testuser")
+	if err != nil || version != 2 {
+		t.Fatalf("unable to replace the data of a test: %d (%v)", version, err)
+	}
+	if _, err := conn.ReplaceTestData(1000, inputFilePath, "no test", "testuser"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error when replacing the data of a nonexistent test: %v", err)
+	}
+	if entries, err := conn.QueryLog(LogFilter{Username: "testuser", Action: ActionRead}); err != nil || len(entries) != 0 {
+		t.Errorf("replacing the data of a test has been logged as a read: %v (%v)", entries, err)
+	}
+
+	var newTest Test
+	if err := conn.GetTest(testID, "testuser", &newTest); err != nil {
+		t.Fatalf("unable to retrieve a test: %v", err)
+	}
+	if newTest.DataVersion != 2 || newTest.ShortName != "sweep" {
+		t.Errorf("wrong test after the data have been replaced: %v", newTest)
+	}
+
+	versions, err := conn.GetTestDataVersions(testID)
+	if err != nil || len(versions) != 2 || versions[1].Reason != "converter bug fixed" ||
+		versions[1].Checksum != newTest.FitsChecksum {
+		t.Fatalf("unexpected result from GetTestDataVersions: %v (%v)", versions, err)
+	}
+
+	for _, curVersion := range []int{0, 1, 2} {
+		r, dataVersion, err := conn.OpenTestData(testID, curVersion)
+		if err != nil {
+			t.Errorf("unable to open version %d: %v", curVersion, err)
+			continue
+		}
+		r.Close()
+		if curVersion == 0 && dataVersion.Key != versions[1].Key {
+			t.Errorf("the latest version is not the default one: \"%s\"", dataVersion.Key)
+		}
+	}
+	if _, _, err := conn.OpenTestData(testID, 3); err == nil {
+		t.Error("a nonexistent version was found")
+	}
+}